@@ -1,15 +1,19 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	log "github.com/Sirupsen/logrus"
-	"net"
+	"github.com/jonathanlloyd/skewserver/server"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
 )
 
 const (
-	DEFAULT_PORT = 61613
-	BANNER       = `
+	BANNER = `
 ███████╗██╗  ██╗███████╗██╗    ██╗███████╗███████╗██████╗ ██╗   ██╗███████╗██████╗ 
 ██╔════╝██║ ██╔╝██╔════╝██║    ██║██╔════╝██╔════╝██╔══██╗██║   ██║██╔════╝██╔══██╗
 ███████╗█████╔╝ █████╗  ██║ █╗ ██║███████╗█████╗  ██████╔╝██║   ██║█████╗  ██████╔╝
@@ -18,40 +22,195 @@ const (
 ╚══════╝╚═╝  ╚═╝╚══════╝ ╚══╝╚══╝ ╚══════╝╚══════╝╚═╝  ╚═╝  ╚═══╝  ╚══════╝╚═╝  ╚═╝
 `
 	STRAPLINE = "STOMP 1.2 Compatible message queueing server"
+
+	DEFAULT_TCP_KEEPALIVE  = 15 * time.Second
+	DEFAULT_SHUTDOWN_GRACE = 10 * time.Second
 )
 
 func main() {
-	initLogging()
+	var opts server.Options
+	flag.StringVar(&opts.Addr, "addr", fmt.Sprintf(":%d", server.DEFAULT_PORT), "Address to listen on")
+	flag.StringVar(&opts.HealthAddr, "health-addr", "", "Address to serve HTTP /healthz and /readyz checks on")
+	shutdownGrace := flag.Duration("shutdown-grace", DEFAULT_SHUTDOWN_GRACE, "How long to drain connections for after SIGTERM before closing them")
+	flag.StringVar(&opts.TLSCertFile, "tls-cert", "", "TLS certificate file (requires -tls-key)")
+	flag.StringVar(&opts.TLSKeyFile, "tls-key", "", "TLS private key file (requires -tls-cert)")
+	flag.StringVar(&opts.TLSClientCAFile, "tls-client-ca", "", "CA certificates to authenticate clients by their TLS certificate against, using its common name as the login (requires -tls-cert)")
+	flag.BoolVar(&opts.TLSRequireClientCert, "tls-require-client-cert", false, "Refuse TLS clients without a certificate signed by -tls-client-ca")
+	flag.BoolVar(&opts.Compression, "compression", false, "Let clients opt into gzip compression by compressing what they send")
+	flag.BoolVar(&opts.TCPNoDelay, "tcp-nodelay", true, "Disable Nagle's algorithm on client connections")
+	flag.DurationVar(&opts.TCPKeepAlive, "tcp-keepalive", DEFAULT_TCP_KEEPALIVE, "TCP keep-alive period for client connections (0 to disable)")
+	flag.IntVar(&opts.MaxHeaderKeyLength, "max-header-key-length", 0, "Maximum length of a header key in bytes (0 for unlimited)")
+	flag.IntVar(&opts.MaxHeaderValueLength, "max-header-value-length", 0, "Maximum length of a header value in bytes (0 for unlimited)")
+	flag.IntVar(&opts.MaxBodySize, "max-body-size", 0, "Maximum size of a frame body in bytes (0 for unlimited)")
+	flag.IntVar(&opts.MaxHeaderLines, "max-header-lines", 0, "Maximum number of lines before the body of a frame, counting the command (0 for unlimited)")
+	flag.IntVar(&opts.MaxFrameSize, "max-frame-size", 0, "Maximum size of a whole frame in bytes (0 for unlimited)")
+	flag.Float64Var(&opts.ConnectRate, "connect-rate", 0, "Connections per second each remote IP can open, refusing the rest (0 for unlimited)")
+	flag.IntVar(&opts.ConnectBurst, "connect-burst", 10, "Connections each remote IP can open at once before -connect-rate applies")
+	flag.Float64Var(&opts.IngestAlarmRate, "ingest-alarm-rate", 0, "Warn when a connection sends more frames per second than this (0 to disable)")
+	flag.IntVar(&opts.MetricsSampleRate, "metrics-sample-rate", 0, "Count only one in this many received frames in the metrics, scaling the figures up (0 to count every frame)")
+	flag.BoolVar(&opts.Strict, "strict", false, "Reject frames that don't follow the STOMP 1.2 spec exactly")
+	flag.BoolVar(&opts.ResyncAfterBadFrames, "resync", false, "Send an ERROR for a bad frame but keep the connection open, skipping to the next frame")
+	flag.BoolVar(&opts.BlankLineTerminators, "blank-line-terminators", false, "Accept a blank line instead of a null byte at the end of frames without a body, for typing frames by hand")
+	adminLogins := flag.String("admin-logins", "", "Comma separated logins allowed to use the management destinations (requires -credentials or -tls-require-client-cert)")
+	credentialsFile := flag.String("credentials", "", "File of login:passcode lines to authenticate clients against (reloaded on SIGHUP)")
+	auditLog := flag.String("audit-log", "", "File to append an audit event to for every CONNECT, as JSON lines")
+	flag.BoolVar(&opts.AllowAnonymous, "allow-anonymous", false, "Let clients without a login or passcode connect when -credentials is set")
+	flag.DurationVar(&opts.HeartBeatSend, "heart-beat-send", 0, "Smallest interval the server sends heart-beats at, if clients want them (0 to disable)")
+	flag.DurationVar(&opts.HeartBeatReceive, "heart-beat-receive", 0, "Interval the server wants clients to send heart-beats at (0 to disable)")
+	flag.DurationVar(&opts.MinHeartBeat, "min-heart-beat", 0, "Shortest heart-beat interval a client can negotiate (0 for any)")
+	flag.Var(&opts.HeartBeatPolicy, "heart-beat-policy", "What to do when a client wants heart-beats more often than the minimum (clamp or reject)")
+	flag.Var(&opts.DuplicateSessionPolicy, "duplicate-session", "How to handle a client-id that is already connected (reject or takeover)")
+	flag.DurationVar(&opts.SessionRetention, "session-retention", 0, "How long a dropped session can be resumed for (0 to disable)")
+	flag.IntVar(&opts.MaxTransactions, "max-transactions", 0, "Maximum transactions each connection can have open (0 for unlimited)")
+	flag.IntVar(&opts.MaxTransactionBytes, "max-transaction-bytes", 0, "Maximum bytes of frames each connection's open transactions can hold (0 for unlimited)")
+	flag.IntVar(&opts.MaxTransactedMessages, "max-transacted-messages", 0, "Maximum messages open transactions can hold across all connections (0 for unlimited)")
+	flag.IntVar(&opts.MaxSubscriptions, "max-subscriptions", 0, "Most subscriptions each connection can have at once (0 for unlimited)")
+	flag.IntVar(&opts.MaxSelectorLength, "max-selector-length", 0, "Most bytes a subscription's selector can be (0 for unlimited)")
+	flag.IntVar(&opts.MaxSelectorDepth, "max-selector-depth", 0, "How deeply a subscription's selector can nest parentheses and NOTs (0 for unlimited)")
+	flag.BoolVar(&opts.IdempotentSubscribe, "idempotent-subscribe", false, "Receipt a repeated SUBSCRIBE for an existing subscription instead of rejecting it")
+	flag.IntVar(&opts.MaxQueueBytes, "max-queue-bytes", 0, "Most bytes of messages each queue can hold before SENDs to it are refused (0 for unlimited)")
+	flag.IntVar(&opts.SendQuota, "send-quota", 0, "Most messages each connection can publish within the quota window (0 for unlimited)")
+	flag.DurationVar(&opts.SendQuotaWindow, "send-quota-window", time.Minute, "Sliding window the send quota applies to")
+	flag.IntVar(&opts.DispatchCredit, "dispatch-credit", 0, "Most unacked messages from a queue each client-acked subscriber can hold, favouring faster consumers (0 for unlimited)")
+	defaultDestinations := flag.String("default-destinations", "", "Comma separated destinations every client is subscribed to when it connects")
+	persistentPrefixes := flag.String("persistent-prefixes", "", "Comma separated destination prefixes whose messages are always persistent")
+	transientPrefixes := flag.String("transient-prefixes", "", "Comma separated destination prefixes whose messages are never persistent")
+	storeFile := flag.String("store", "", "File to keep persistent queue messages in until they're acked, replayed on startup")
+	flag.BoolVar(&opts.ValidateReplay, "validate-replay", false, "Skip stored messages that aren't valid SEND frames when replaying them, rather than failing to start (requires -store)")
+	flag.DurationVar(&opts.MaxMessageAge, "max-message-age", 0, "Evict queued messages older than this (0 to disable)")
+	flag.DurationVar(&opts.AckTimeout, "ack-timeout", 0, "Redeliver messages not acked within this long (0 to wait forever)")
+	flag.DurationVar(&opts.SubscriptionIdleTimeout, "subscription-idle-timeout", 0, "Close subscriptions whose unacked messages go this long without an ACK or NACK, sending the client an ERROR naming the subscription and disconnecting it (0 to disable)")
+	flag.BoolVar(&opts.SequenceHeader, "sequence-header", false, "Stamp delivered messages with the order the broker routed them in (x-broker-seq)")
+	flag.StringVar(&opts.DefaultContentType, "default-content-type", "", "Content type for messages sent with a body but no content-type (e.g. text/plain;charset=utf-8)")
+	flag.IntVar(&opts.OutboundQueueSize, "outbound-queue-size", 0, "Maximum messages waiting to be written to each subscription (0 for unlimited)")
+	flag.IntVar(&opts.MaxOutboundBytes, "max-outbound-bytes", 0, "Most bytes of messages waiting to be written to each connection before the overflow policy applies (0 for unlimited)")
+	flag.DurationVar(&opts.FlushInterval, "flush-interval", 0, "How long written messages can wait to be flushed along with others (0 to flush immediately)")
+	flag.Var(&opts.ReceiptPolicy, "receipt-policy", "When to receipt a frame: once it has been routed, or as soon as it is accepted (routed or accepted)")
+	flag.BoolVar(&opts.ReportTopicDeliveries, "report-topic-deliveries", false, "Tell producers how many subscribers a topic message reached in the x-delivered-to header of its RECEIPT")
+	flag.Var(&opts.OverflowPolicy, "overflow-policy", "What to do when a subscription's outbound queue is full (block, drop-oldest, drop-newest or disconnect)")
+	flag.StringVar(&opts.DeadLetterQueue, "dead-letter-queue", "", "Destination that evicted messages are moved to")
+	flag.IntVar(&opts.QuarantineSize, "quarantine-size", 0, "Dead letters to hold for inspection through /admin/quarantine instead of the dead letter queue (0 to disable)")
+	flag.IntVar(&opts.MaxMetricDestinations, "max-metric-destinations", server.DEFAULT_MAX_METRIC_DESTINATIONS, "Destinations labelled individually in metrics, the rest are reported as \"other\"")
+	flag.DurationVar(&opts.ConnectionLogInterval, "connection-log-interval", 0, "How often to log the number of active connections (0 to disable)")
+	logLevel := flag.String("log-level", "info", "Most detailed level to log at (error, warn, info, debug or trace)")
+	flag.BoolVar(&opts.LogBodies, "log-bodies", false, "Log every frame received with its body at trace level, which may expose sensitive data")
+	flag.IntVar(&opts.LogBodyLimit, "log-body-limit", server.DEFAULT_LOG_BODY_LIMIT, "Most bytes of each body to log with -log-bodies")
+	validate := flag.String("validate", "", "Parse and print the STOMP frames in a file then exit, failing on the first invalid frame")
+	flag.Parse()
 
-	fmt.Println(BANNER)
-	fmt.Println(STRAPLINE)
-	fmt.Println("\n")
+	if *validate != "" {
+		os.Exit(validateFile(*validate, opts.Strict))
+	}
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", DEFAULT_PORT))
-	if err != nil {
-		log.Error(fmt.Sprintf("Error listening on port %d: %s", DEFAULT_PORT, err.Error()))
+	if err := initLogging(*logLevel); err != nil {
+		log.Error(fmt.Sprintf("Invalid log level: %s", err.Error()))
 		os.Exit(1)
 	}
-	log.Info(fmt.Sprintf("Listening on port %d...", DEFAULT_PORT))
-	defer listener.Close()
+	opts.Logger = log.StandardLogger()
 
-	for {
-		conn, err := listener.Accept()
+	if *credentialsFile != "" {
+		creds, err := server.LoadStaticCredentials(*credentialsFile)
+		if err != nil {
+			log.Error(fmt.Sprintf("Error loading credentials: %s", err.Error()))
+			os.Exit(1)
+		}
+		opts.Authenticator = creds
+		go reloadOnHangup(creds)
+	}
+	if *auditLog != "" {
+		auditor, err := server.OpenAuditLog(*auditLog)
 		if err != nil {
-			log.Error(fmt.Sprintf("Error processing incoming connection: %s", err.Error()))
+			log.Error(fmt.Sprintf("Error opening audit log: %s", err.Error()))
 			os.Exit(1)
 		}
-		go handleIncomingConnection(conn)
+		opts.Auditor = auditor
+	}
+	if *adminLogins != "" {
+		opts.AdminLogins = strings.Split(*adminLogins, ",")
+	}
+	if *defaultDestinations != "" {
+		opts.DefaultSubscriber = server.StaticDefaultDestinations(strings.Split(*defaultDestinations, ","))
+	}
+	if *persistentPrefixes != "" {
+		opts.PersistentPrefixes = strings.Split(*persistentPrefixes, ",")
+	}
+	if *transientPrefixes != "" {
+		opts.TransientPrefixes = strings.Split(*transientPrefixes, ",")
+	}
+	if *storeFile != "" {
+		store, err := server.OpenFileStore(*storeFile)
+		if err != nil {
+			log.Error(fmt.Sprintf("Error opening message store: %s", err.Error()))
+			os.Exit(1)
+		}
+		defer store.Close()
+		opts.Store = store
+	}
+
+	fmt.Print(BANNER)
+	fmt.Println(STRAPLINE)
+	fmt.Print("\n\n")
+
+	srv, err := server.New(opts)
+	if err != nil {
+		log.Error(fmt.Sprintf("Invalid configuration: %s", err.Error()))
+		os.Exit(1)
+	}
+
+	stopped := make(chan struct{})
+	go shutdownOnTerminate(srv, *shutdownGrace, stopped)
+
+	err = srv.ListenAndServe()
+	if err != nil && err != server.ErrServerClosed {
+		log.Error(fmt.Sprintf("Error serving on %s: %s", opts.Addr, err.Error()))
+		os.Exit(1)
+	}
+	<-stopped
+}
+
+// On SIGTERM or SIGINT stop accepting connections, which fails readiness
+// checks, then give existing clients the grace period to finish up before
+// closing their connections
+func shutdownOnTerminate(srv *server.Server, grace time.Duration, stopped chan<- struct{}) {
+	terminate := make(chan os.Signal, 1)
+	signal.Notify(terminate, syscall.SIGTERM, os.Interrupt)
+	<-terminate
+
+	log.Info(fmt.Sprintf("Shutting down, draining connections for %s", grace))
+	srv.Drain()
+	select {
+	case <-terminate:
+	case <-time.After(grace):
+	}
+	srv.Close()
+	close(stopped)
+}
+
+// Re-read the credentials file whenever the process receives SIGHUP, so that
+// passwords can be rotated without a restart
+func reloadOnHangup(creds *server.StaticCredentials) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+
+	for range hangups {
+		if err := creds.Reload(); err != nil {
+			log.Error(fmt.Sprintf("Error reloading credentials, keeping the old ones: %s", err.Error()))
+			continue
+		}
+		log.Info("Reloaded credentials")
 	}
 }
 
-func initLogging() {
+func initLogging(level string) error {
 	customFormatter := new(log.TextFormatter)
 	customFormatter.TimestampFormat = "2006-01-02 15:04:05"
 	log.SetFormatter(customFormatter)
 	customFormatter.FullTimestamp = true
-}
 
-func handleIncomingConnection(conn net.Conn) {
-	log.Info(fmt.Sprintf("Handling incoming connection from %s", conn.RemoteAddr()))
+	parsed, err := log.ParseLevel(level)
+	if err != nil {
+		return err
+	}
+	log.SetLevel(parsed)
+	return nil
 }
@@ -0,0 +1,68 @@
+package parsing
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// Parsing from a connection
+// A parser made from a net.Conn keeps hold of it, so that a read can be
+// interrupted by setting the connection's read deadline rather than by
+// leaving a goroutine blocked on it.
+
+// A deadline in the past, which makes a blocked read return straight away
+var aLongTimeAgo = time.Unix(1, 0)
+
+func NewStompParserFromConn(conn net.Conn, options ...ParserOption) StompParser {
+	parser := NewStompParserFromReader(conn, options...)
+	parser.conn = conn
+	return parser
+}
+
+// NextFrameContext is NextFrame but gives up once ctx is done, returning its
+// error. Only a parser made with NewStompParserFromConn can be interrupted
+// while it waits for data, otherwise ctx is only checked beforehand. An
+// interrupted read may have consumed part of a frame, so the parser
+// shouldn't be used again afterwards. Any read deadline on the connection
+// is cleared when it returns.
+func (parser *StompParser) NextFrameContext(ctx context.Context) (Frame, error) {
+	if err := ctx.Err(); err != nil {
+		return Frame{}, err
+	}
+	conn := parser.conn
+	if conn == nil || ctx.Done() == nil {
+		return parser.NextFrame()
+	}
+
+	deadline, hasDeadline := ctx.Deadline()
+	if hasDeadline {
+		conn.SetReadDeadline(deadline)
+	}
+	stop := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		select {
+		case <-ctx.Done():
+			conn.SetReadDeadline(aLongTimeAgo)
+		case <-stop:
+		}
+	}()
+
+	frame, err := parser.NextFrame()
+	close(stop)
+	<-stopped
+	conn.SetReadDeadline(time.Time{})
+
+	if err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return Frame{}, ctxErr
+		}
+		// The connection's deadline can pass just before the context's
+		if hasDeadline && !time.Now().Before(deadline) {
+			return Frame{}, context.DeadlineExceeded
+		}
+	}
+	return frame, err
+}
@@ -0,0 +1,66 @@
+package parsing_test
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+func TestNextFrameContextTimesOut(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+	parser := parsing.NewStompParserFromConn(serverSide)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := parser.NextFrameContext(ctx)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Should give up once the context times out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Should return promptly after the deadline, took %s", elapsed)
+	}
+}
+
+func TestNextFrameContextCancelled(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+	parser := parsing.NewStompParserFromConn(serverSide)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+	if _, err := parser.NextFrameContext(ctx); err != context.Canceled {
+		t.Errorf("Should give up once the context is cancelled, got %v", err)
+	}
+}
+
+func TestNextFrameContextClearsDeadline(t *testing.T) {
+	serverSide, clientSide := net.Pipe()
+	defer serverSide.Close()
+	defer clientSide.Close()
+	parser := parsing.NewStompParserFromConn(serverSide)
+
+	go func() {
+		clientSide.Write([]byte("SEND\ndestination:/queue/a\n\nfirst\x00"))
+		time.Sleep(100 * time.Millisecond)
+		clientSide.Write([]byte("SEND\ndestination:/queue/a\n\nsecond\x00"))
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	frame, err := parser.NextFrameContext(ctx)
+	if err != nil || string(frame.Body) != "first" {
+		t.Fatalf("Should parse a frame that arrives in time, got %v %v", frame, err)
+	}
+	// The deadline has passed by the time the second frame arrives
+	frame, err = parser.NextFrame()
+	if err != nil || string(frame.Body) != "second" {
+		t.Errorf("Should clear the read deadline afterwards, got %v %v", frame, err)
+	}
+}
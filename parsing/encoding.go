@@ -0,0 +1,242 @@
+package parsing
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// STOMP Frame Encoder
+// Serializes STOMP frames onto an io.Writer
+
+type StompEncoder struct {
+	writer *bufio.Writer
+}
+
+func NewStompEncoder(writer io.Writer) *StompEncoder {
+	return &StompEncoder{writer: bufio.NewWriter(fullWriter{writer})}
+}
+
+// A writer should only write less than it was given along with an error, but
+// a short write would leave a frame cut off on the wire, so the rest is
+// retried rather than trusting it. It fails if the writer makes no progress.
+type fullWriter struct {
+	writer io.Writer
+}
+
+func (w fullWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		n, err := w.writer.Write(p[written:])
+		if n > 0 {
+			written += n
+		}
+		if err != nil {
+			return written, err
+		}
+		if n <= 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// Encode writes a single frame to the underlying writer and flushes it
+func (encoder *StompEncoder) Encode(frame Frame) error {
+	if err := encoder.Write(frame); err != nil {
+		return err
+	}
+	return encoder.Flush()
+}
+
+// Write buffers a frame without flushing it, so that several frames can be
+// sent with as few writes as possible. The buffer is flushed early if it
+// fills up.
+func (encoder *StompEncoder) Write(frame Frame) error {
+	writeFrame(encoder.writer, frame)
+	// Writes to a bufio.Writer are sticky, so any error shows up here
+	_, err := encoder.writer.Write(nil)
+	return err
+}
+
+// WriteHeartBeat buffers a heart-beat, which is a lone end of line
+func (encoder *StompEncoder) WriteHeartBeat() error {
+	return encoder.writer.WriteByte('\n')
+}
+
+// Flush writes any buffered frames to the underlying writer
+func (encoder *StompEncoder) Flush() error {
+	return encoder.writer.Flush()
+}
+
+// Marshal returns the wire representation of the frame
+func (frame Frame) Marshal() []byte {
+	var buf bytes.Buffer
+	writeFrame(&buf, frame)
+	return buf.Bytes()
+}
+
+type byteWriter interface {
+	io.Writer
+	WriteByte(byte) error
+	WriteString(string) (int, error)
+}
+
+// Headers are written in their original order if the frame has raw headers,
+// otherwise in sorted order so that output is deterministic. Unless the
+// frame already has one, a content-length header is added if the body holds
+// null bytes, so that it isn't cut short at the first, or if it's empty
+// rather than nil, so that it parses back the same.
+func writeFrame(writer byteWriter, frame Frame) {
+	escape := shouldEscapeHeaders(frame.Command)
+
+	writer.WriteString(frame.Command.String())
+	writer.WriteByte('\n')
+
+	headers := frame.RawHeaders
+	if headers == nil {
+		keys := make([]string, 0, len(frame.Headers))
+		for key := range frame.Headers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		headers = make([][2]string, len(keys))
+		for i, key := range keys {
+			headers[i] = [2]string{key, frame.Headers[key]}
+		}
+	}
+
+	for _, header := range headers {
+		key, value := header[0], header[1]
+		if escape {
+			key, value = escapeHeader(key), escapeHeader(value)
+		}
+		writer.WriteString(key)
+		writer.WriteByte(':')
+		writer.WriteString(value)
+		writer.WriteByte('\n')
+	}
+	if needsContentLength(frame.Body) && !hasHeader(headers, HEADER_CONTENT_LENGTH) {
+		writer.WriteString(HEADER_CONTENT_LENGTH)
+		writer.WriteByte(':')
+		writer.WriteString(strconv.Itoa(len(frame.Body)))
+		writer.WriteByte('\n')
+	}
+
+	writer.WriteByte('\n')
+	writer.Write(frame.Body)
+	writer.WriteByte('\x00')
+}
+
+func needsContentLength(body []byte) bool {
+	return body != nil && (len(body) == 0 || bytes.IndexByte(body, '\x00') >= 0)
+}
+
+func hasHeader(headers [][2]string, key string) bool {
+	for _, header := range headers {
+		if header[0] == key {
+			return true
+		}
+	}
+	return false
+}
+
+// Commands
+// The names of the built-in commands never change, while custom ones can be
+// registered at any time so are kept separately behind a lock.
+
+var commandNames = map[CommandType]string{}
+
+var customCommandNames = struct {
+	sync.RWMutex
+	names map[CommandType]string
+}{names: map[CommandType]string{}}
+
+func init() {
+	for name, command := range commands {
+		commandNames[command] = name
+	}
+}
+
+// RegisterCommandName sets the name a custom command is written with. The
+// names of built-in commands can't be changed.
+func RegisterCommandName(command CommandType, name string) {
+	if _, builtIn := commandNames[command]; builtIn {
+		return
+	}
+	customCommandNames.Lock()
+	defer customCommandNames.Unlock()
+	customCommandNames.names[command] = name
+}
+
+func (command CommandType) String() string {
+	if name, ok := commandNames[command]; ok {
+		return name
+	}
+	customCommandNames.RLock()
+	defer customCommandNames.RUnlock()
+	return customCommandNames.names[command]
+}
+
+// Header escaping
+// The CONNECT and CONNECTED frames do not escape headers for backwards
+// compatibility with STOMP 1.0, every other frame does.
+
+var headerEscapes = map[byte]byte{
+	'\r': 'r',
+	'\n': 'n',
+	':':  'c',
+	'\\': '\\',
+}
+
+var headerUnescapes = map[byte]byte{
+	'r':  '\r',
+	'n':  '\n',
+	'c':  ':',
+	'\\': '\\',
+}
+
+func shouldEscapeHeaders(command CommandType) bool {
+	return command != CONNECT && command != CONNECTED
+}
+
+func escapeHeader(literal string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(literal); i++ {
+		if escaped, ok := headerEscapes[literal[i]]; ok {
+			buf.WriteByte('\\')
+			buf.WriteByte(escaped)
+		} else {
+			buf.WriteByte(literal[i])
+		}
+	}
+	return buf.String()
+}
+
+func unescapeHeader(literal []byte) (string, error) {
+	if bytes.IndexByte(literal, '\\') == -1 {
+		return string(literal), nil
+	}
+
+	var buf bytes.Buffer
+	for i := 0; i < len(literal); i++ {
+		if literal[i] != '\\' {
+			buf.WriteByte(literal[i])
+			continue
+		}
+		if i+1 == len(literal) {
+			return "", ParseError{message: "Header ends with an incomplete escape sequence"}
+		}
+		unescaped, ok := headerUnescapes[literal[i+1]]
+		if !ok {
+			return "", ParseError{message: "Header contains an undefined escape sequence"}
+		}
+		buf.WriteByte(unescaped)
+		i++
+	}
+	return buf.String(), nil
+}
@@ -0,0 +1,295 @@
+package parsing_test
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Should serialize frames onto the wire format
+
+func TestMarshalFrame(t *testing.T) {
+	frame := parsing.Frame{
+		Command: parsing.MESSAGE,
+		Headers: map[string]string{
+			"subscription": "0",
+			"destination":  "/queue/a",
+		},
+		Body: []byte("message body"),
+	}
+
+	expected := "MESSAGE\ndestination:/queue/a\nsubscription:0\n\nmessage body\x00"
+	if string(frame.Marshal()) != expected {
+		t.Errorf("Frame should serialize to %q, got %q", expected, frame.Marshal())
+	}
+}
+
+func TestMarshalEscapesHeaders(t *testing.T) {
+	frame := parsing.Frame{
+		Command: parsing.MESSAGE,
+		Headers: map[string]string{"x-key": "a:b\nc\\d"},
+	}
+
+	expected := "MESSAGE\nx-key:a\\cb\\nc\\\\d\n\n\x00"
+	if string(frame.Marshal()) != expected {
+		t.Errorf("Headers should be escaped, got %q", frame.Marshal())
+	}
+}
+
+func TestMarshalDoesNotEscapeConnected(t *testing.T) {
+	frame := parsing.Frame{
+		Command: parsing.CONNECTED,
+		Headers: map[string]string{"server": "a\\b"},
+	}
+
+	expected := "CONNECTED\nserver:a\\b\n\n\x00"
+	if string(frame.Marshal()) != expected {
+		t.Errorf("CONNECTED headers should not be escaped, got %q", frame.Marshal())
+	}
+}
+
+// Should parse back to the same frame
+
+func TestMarshalRoundTrip(t *testing.T) {
+	original := parsing.Frame{
+		Command: parsing.SEND,
+		Headers: map[string]string{
+			"destination": "/queue/a",
+			"x-escaped":   "a:b\r\nc\\d",
+		},
+		Body: []byte("message body"),
+	}
+
+	var buf bytes.Buffer
+	encoder := parsing.NewStompEncoder(&buf)
+	if err := encoder.Encode(original); err != nil {
+		t.Fatalf("No error should be raised encoding the frame")
+	}
+
+	parser := parsing.NewStompParserFromReader(&buf)
+	frame, err := parser.NextFrame()
+	if err != nil {
+		t.Fatalf("No error should be raised parsing the frame: %s", err)
+	}
+
+	if !reflect.DeepEqual(original, frame) {
+		t.Errorf("Frame should survive a round trip, got %+v", frame)
+	}
+}
+
+// Should tell an empty body apart from no body at all after a round trip
+
+func TestEmptyBodyDistinctFromNoBody(t *testing.T) {
+	empty := parsing.Frame{Command: parsing.MESSAGE, Headers: map[string]string{"destination": "/queue/a"}, Body: []byte{}}
+	none := parsing.Frame{Command: parsing.MESSAGE, Headers: map[string]string{"destination": "/queue/a"}}
+
+	if expected := "MESSAGE\ndestination:/queue/a\ncontent-length:0\n\n\x00"; string(empty.Marshal()) != expected {
+		t.Errorf("Empty body should be written with a zero content-length, got %q", empty.Marshal())
+	}
+	if expected := "MESSAGE\ndestination:/queue/a\n\n\x00"; string(none.Marshal()) != expected {
+		t.Errorf("Missing body should be written without a content-length, got %q", none.Marshal())
+	}
+
+	stream := mockTCPStream{streamData: string(empty.Marshal()) + string(none.Marshal())}
+	parser := parsing.NewStompParserFromReader(&stream)
+
+	frame, err := parser.NextFrame()
+	if err != nil {
+		t.Fatalf("No error should be raised parsing the frame: %s", err)
+	}
+	if frame.Body == nil || len(frame.Body) != 0 {
+		t.Errorf("Empty body should parse back as empty rather than nil, got %#v", frame.Body)
+	}
+
+	frame, err = parser.NextFrame()
+	if err != nil {
+		t.Fatalf("No error should be raised parsing the frame: %s", err)
+	}
+	if frame.Body != nil {
+		t.Errorf("Missing body should parse back as nil, got %#v", frame.Body)
+	}
+}
+
+// Should keep writing until the whole frame is out when writes come up short
+
+func TestEncodeShortWrites(t *testing.T) {
+	frame := parsing.Frame{Command: parsing.SEND, Headers: map[string]string{"destination": "/queue/a"}, Body: []byte("message body")}
+
+	writer := &shortWriter{max: 3}
+	if err := parsing.NewStompEncoder(writer).Encode(frame); err != nil {
+		t.Fatalf("No error should be raised encoding the frame: %s", err)
+	}
+	if !bytes.Equal(frame.Marshal(), writer.written.Bytes()) {
+		t.Errorf("Whole frame should be written, got %q", writer.written.Bytes())
+	}
+
+	if err := parsing.NewStompEncoder(&shortWriter{}).Encode(frame); err != io.ErrShortWrite {
+		t.Errorf("Writer making no progress should raise a short write error, got %v", err)
+	}
+}
+
+// Writes at most max bytes at a time without complaint
+type shortWriter struct {
+	max     int
+	written bytes.Buffer
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.written.Write(p)
+}
+
+// Should give a body with null bytes a content-length so that it isn't
+// truncated, unless the frame already has one
+
+func TestBodyWithNullBytesRoundTrip(t *testing.T) {
+	original := parsing.Frame{Command: parsing.SEND, Headers: map[string]string{"destination": "/queue/a"}, Body: []byte("a\x00b\x00")}
+
+	expected := "SEND\ndestination:/queue/a\ncontent-length:4\n\na\x00b\x00\x00"
+	if string(original.Marshal()) != expected {
+		t.Errorf("Body with null bytes should be written with its content-length, got %q", original.Marshal())
+	}
+
+	stream := mockTCPStream{streamData: string(original.Marshal()) + "SEND\ndestination:/queue/b\n\nnext\x00"}
+	parser := parsing.NewStompParserFromReader(&stream)
+	frame, err := parser.NextFrame()
+	if err != nil {
+		t.Fatalf("No error should be raised parsing the frame: %s", err)
+	}
+	if !bytes.Equal(original.Body, frame.Body) {
+		t.Errorf("Body should be read whole, got %q", frame.Body)
+	}
+	if frame, err = parser.NextFrame(); err != nil || string(frame.Body) != "next" {
+		t.Errorf("Frame after the body should be parsed as normal, got %q (%v)", frame.Body, err)
+	}
+
+	given := parsing.Frame{Command: parsing.SEND, Headers: map[string]string{"content-length": "2"}, Body: []byte("a\x00")}
+	if expected := "SEND\ncontent-length:2\n\na\x00\x00"; string(given.Marshal()) != expected {
+		t.Errorf("Content-length set by the caller should be kept as is, got %q", given.Marshal())
+	}
+}
+
+// Should reproduce the original header order, including repeated headers
+
+func TestRawHeadersRoundTrip(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a\nzeta:1\nalpha:2\nzeta:3\n\nmessage body\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithRawHeaders())
+	frame, err := parser.NextFrame()
+	if err != nil {
+		t.Fatalf("No error should be raised parsing the frame: %s", err)
+	}
+
+	expectedRaw := [][2]string{{"destination", "/queue/a"}, {"zeta", "1"}, {"alpha", "2"}, {"zeta", "3"}}
+	if !reflect.DeepEqual(expectedRaw, frame.RawHeaders) {
+		t.Errorf("Frame should record headers in order, got %v", frame.RawHeaders)
+	}
+	if frame.Headers["alpha"] != "2" {
+		t.Errorf("Frame should still have a header map")
+	}
+	if marshalled := string(frame.Marshal()); marshalled != testData {
+		t.Errorf("Frame should marshal byte for byte, got %q", marshalled)
+	}
+}
+
+func TestRawHeadersOptIn(t *testing.T) {
+	conn := mockTCPStream{streamData: "SEND\ndestination:/queue/a\n\n\x00"}
+	parser := parsing.NewStompParserFromReader(&conn)
+	frame, _ := parser.NextFrame()
+
+	if frame.RawHeaders != nil {
+		t.Errorf("Raw headers should only be recorded when asked for")
+	}
+}
+
+// Should keep whitespace around header keys and values byte for byte
+
+func TestHeaderWhitespacePreserved(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a\nfoo: bar \n x :\t\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithRawHeaders())
+	frame, err := parser.NextFrame()
+	if err != nil {
+		t.Fatalf("No error should be raised parsing the frame: %s", err)
+	}
+
+	if frame.Headers["foo"] != " bar " || frame.Headers[" x "] != "\t" {
+		t.Errorf("Header whitespace should not be trimmed, got %q", frame.Headers)
+	}
+	if marshalled := string(frame.Marshal()); marshalled != testData {
+		t.Errorf("Frame should marshal byte for byte, got %q", marshalled)
+	}
+
+	frame.RawHeaders = nil
+	expected := "SEND\n x :\t\ndestination:/queue/a\nfoo: bar \n\n\x00"
+	if marshalled := string(frame.Marshal()); marshalled != expected {
+		t.Errorf("Header map should marshal with whitespace intact, got %q", marshalled)
+	}
+}
+
+func TestParseUndefinedEscape(t *testing.T) {
+	testData := "SEND\nx-key:a\\tb\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn)
+	_, err := parser.NextFrame()
+
+	if _, ok := err.(parsing.ParseError); !ok {
+		t.Errorf("Undefined escape sequences should raise a ParseError")
+	}
+}
+
+// Server frame constructors
+
+func TestConnectedFrame(t *testing.T) {
+	frame := parsing.ConnectedFrame("1.2", "session-1", "skewserver")
+
+	expected := "CONNECTED\nserver:skewserver\nsession:session-1\nversion:1.2\n\n\x00"
+	if string(frame.Marshal()) != expected {
+		t.Errorf("CONNECTED frame should serialize to %q, got %q", expected, frame.Marshal())
+	}
+}
+
+func TestReceiptFrame(t *testing.T) {
+	frame := parsing.ReceiptFrame("receipt-1")
+
+	expected := "RECEIPT\nreceipt-id:receipt-1\n\n\x00"
+	if string(frame.Marshal()) != expected {
+		t.Errorf("RECEIPT frame should serialize to %q, got %q", expected, frame.Marshal())
+	}
+}
+
+func TestErrorFrame(t *testing.T) {
+	frame := parsing.ErrorFrame("Bad frame", nil)
+	expected := "ERROR\nmessage:Bad frame\n\n\x00"
+	if string(frame.Marshal()) != expected {
+		t.Errorf("ERROR frame should serialize to %q, got %q", expected, frame.Marshal())
+	}
+
+	frame = parsing.ErrorFrame("Bad frame", []byte("details"))
+	expected = "ERROR\ncontent-type:text/plain\nmessage:Bad frame\n\ndetails\x00"
+	if string(frame.Marshal()) != expected {
+		t.Errorf("ERROR frame with a body should serialize to %q, got %q", expected, frame.Marshal())
+	}
+}
+
+func TestMessageFrame(t *testing.T) {
+	frame := parsing.MessageFrame("/queue/a", "message-1", "0", []byte("hello"), "text/plain")
+	expected := "MESSAGE\ncontent-type:text/plain\ndestination:/queue/a\nmessage-id:message-1\nsubscription:0\n\nhello\x00"
+	if string(frame.Marshal()) != expected {
+		t.Errorf("MESSAGE frame should serialize to %q, got %q", expected, frame.Marshal())
+	}
+
+	frame = parsing.MessageFrame("/queue/a", "message-1", "0", nil, "")
+	expected = "MESSAGE\ndestination:/queue/a\nmessage-id:message-1\nsubscription:0\n\n\x00"
+	if string(frame.Marshal()) != expected {
+		t.Errorf("Untyped MESSAGE frame should serialize to %q, got %q", expected, frame.Marshal())
+	}
+}
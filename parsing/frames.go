@@ -0,0 +1,60 @@
+package parsing
+
+// Server frames
+// Constructors for the frames a server sends, so that the headers the spec
+// requires of each are set in one place. Callers are free to add headers of
+// their own to the result.
+
+// ConnectedFrame acknowledges a CONNECT, naming the negotiated protocol
+// version, the session and the server
+func ConnectedFrame(version string, session string, server string) Frame {
+	return Frame{
+		Command: CONNECTED,
+		Headers: map[string]string{
+			HEADER_VERSION: version,
+			HEADER_SESSION: session,
+			HEADER_SERVER:  server,
+		},
+	}
+}
+
+// ReceiptFrame answers a frame which asked for the receipt with the given id
+func ReceiptFrame(id string) Frame {
+	return Frame{
+		Command: RECEIPT,
+		Headers: map[string]string{HEADER_RECEIPT_ID: id},
+	}
+}
+
+// ErrorFrame reports an error with a short message, and optionally more
+// detail in a plain text body
+func ErrorFrame(message string, body []byte) Frame {
+	frame := Frame{
+		Command: ERROR,
+		Headers: map[string]string{HEADER_MESSAGE: message},
+	}
+	if len(body) > 0 {
+		frame.Headers[HEADER_CONTENT_TYPE] = "text/plain"
+		frame.Body = body
+	}
+	return frame
+}
+
+// MessageFrame delivers a message to a subscription. An empty content type
+// leaves the message untyped, and a nil body is sent as no body at all
+// rather than an empty one.
+func MessageFrame(destination string, messageID string, subscription string, body []byte, contentType string) Frame {
+	frame := Frame{
+		Command: MESSAGE,
+		Headers: map[string]string{
+			HEADER_DESTINATION:  destination,
+			HEADER_MESSAGE_ID:   messageID,
+			HEADER_SUBSCRIPTION: subscription,
+		},
+		Body: body,
+	}
+	if contentType != "" {
+		frame.Headers[HEADER_CONTENT_TYPE] = contentType
+	}
+	return frame
+}
@@ -0,0 +1,58 @@
+package parsing
+
+// Header names defined by the STOMP 1.2 specification. Both the parser and
+// anything constructing frames should use these rather than string literals.
+const (
+	HEADER_ACCEPT_VERSION = "accept-version"
+	HEADER_ACK            = "ack"
+	HEADER_CONTENT_LENGTH = "content-length"
+	HEADER_CONTENT_TYPE   = "content-type"
+	HEADER_DESTINATION    = "destination"
+	HEADER_HEART_BEAT     = "heart-beat"
+	HEADER_HOST           = "host"
+	HEADER_ID             = "id"
+	HEADER_LOGIN          = "login"
+	HEADER_MESSAGE        = "message"
+	HEADER_MESSAGE_ID     = "message-id"
+	HEADER_PASSCODE       = "passcode"
+	HEADER_RECEIPT        = "receipt"
+	HEADER_RECEIPT_ID     = "receipt-id"
+	HEADER_SERVER         = "server"
+	HEADER_SESSION        = "session"
+	HEADER_SUBSCRIPTION   = "subscription"
+	HEADER_TRANSACTION    = "transaction"
+	HEADER_VERSION        = "version"
+)
+
+// The spec's header names, so that parsing one doesn't allocate a new string
+var specHeaders = map[string]string{}
+
+func init() {
+	for _, name := range []string{
+		HEADER_ACCEPT_VERSION, HEADER_ACK, HEADER_CONTENT_LENGTH, HEADER_CONTENT_TYPE,
+		HEADER_DESTINATION, HEADER_HEART_BEAT, HEADER_HOST, HEADER_ID, HEADER_LOGIN,
+		HEADER_MESSAGE, HEADER_MESSAGE_ID, HEADER_PASSCODE, HEADER_RECEIPT,
+		HEADER_RECEIPT_ID, HEADER_SERVER, HEADER_SESSION, HEADER_SUBSCRIPTION,
+		HEADER_TRANSACTION, HEADER_VERSION,
+	} {
+		specHeaders[name] = name
+	}
+}
+
+// Convert a header key as read, unescaping it if the frame's command calls
+// for it. Spec header names are shared rather than copied.
+func headerKey(literal []byte, escaped bool) (string, error) {
+	if name, ok := specHeaders[string(literal)]; ok {
+		return name, nil
+	}
+	return headerValue(literal, escaped)
+}
+
+// Convert a header value as read, unescaping it if the frame's command calls
+// for it, copying it only once either way
+func headerValue(literal []byte, escaped bool) (string, error) {
+	if !escaped {
+		return string(literal), nil
+	}
+	return unescapeHeader(literal)
+}
@@ -0,0 +1,49 @@
+package parsing
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Heart-beating
+// The heart-beat header of CONNECT and CONNECTED frames holds two intervals
+// in milliseconds. The first is the smallest interval at which the sender
+// can send heart-beats, the second the interval at which it would like to
+// receive them. Zero means it can't, or doesn't want to.
+
+type HeartBeat struct {
+	Outgoing time.Duration
+	Incoming time.Duration
+}
+
+// HeartBeat parses the frame's heart-beat header, ok is false if it doesn't
+// have one
+func (frame Frame) HeartBeat() (heartBeat HeartBeat, ok bool, err error) {
+	value, ok := frame.Headers[HEADER_HEART_BEAT]
+	if !ok {
+		return HeartBeat{}, false, nil
+	}
+
+	intervals := strings.Split(value, ",")
+	if len(intervals) != 2 {
+		return HeartBeat{}, true, fmt.Errorf("Invalid heart-beat header %q", value)
+	}
+	var millis [2]int64
+	for i, interval := range intervals {
+		millis[i], err = strconv.ParseInt(strings.TrimSpace(interval), 10, 32)
+		if err != nil || millis[i] < 0 {
+			return HeartBeat{}, true, fmt.Errorf("Invalid heart-beat header %q", value)
+		}
+	}
+	return HeartBeat{
+		Outgoing: time.Duration(millis[0]) * time.Millisecond,
+		Incoming: time.Duration(millis[1]) * time.Millisecond,
+	}, true, nil
+}
+
+// String formats the intervals as a heart-beat header value
+func (heartBeat HeartBeat) String() string {
+	return fmt.Sprintf("%d,%d", heartBeat.Outgoing/time.Millisecond, heartBeat.Incoming/time.Millisecond)
+}
@@ -5,28 +5,158 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 )
 
 // Custom error types for package
 
-type ParseError struct{ message string }
+type ParseError struct {
+	message string
+	limit   bool
+}
 
 func (e ParseError) Error() string {
 	return fmt.Sprintf("Failed trying to parse STOMP frame: %s", e.message)
 }
 
+// ExceedsLimit reports whether the frame was refused for going over one of
+// the parser's size limits, rather than for being malformed
+func (e ParseError) ExceedsLimit() bool {
+	return e.limit
+}
+
 // STOMP Frame Parser
 // Parses STOMP message frames from a bufio.Reader
 
 type StompParser struct {
 	stream         ReadPeeker
+	conn           net.Conn // Set if parsing from a connection, see NextFrameContext
 	reachedEOF     bool
 	frameJustEnded bool
+
+	// Limits, zero means unlimited
+	maxHeaderKeyLength   int
+	maxHeaderValueLength int
+	maxHeaderLines       int
+	maxBodySize          int
+	maxFrameSize         int
+
+	frameBytes int // Bytes read so far of the frame being parsed
+	frameLines int // Command and header lines read so far of the frame being parsed
+	offset     int // Bytes read so far from the stream
+
+	recordRawHeaders bool
+	policy           Policy
+	emptyBody        bool // A blank line may end the frame being parsed, see Policy.BlankLineTerminators
+	bodyLength       int  // Length the content-length header gives the body being parsed, -1 if none
+
+	// Reused for each command and header line, which are copied out of it
+	// before the next line is scanned
+	lineBuffer []byte
+
+	// The caller's buffers to parse into, only set during NextFrameInto
+	bodyBuffer []byte
+	rawBuffer  [][2]string
+
+	lexError error // Why the lexer produced an invalid token, if it knows
+
+	commands     map[string]CommandType // The built-in commands plus any added WithCommands
+	keyScanLimit int                    // Longest a key or command is scanned before it's refused
 }
 
-func NewStompParserFromReader(reader io.Reader) (parser StompParser) {
+func NewStompParserFromReader(reader io.Reader, options ...ParserOption) (parser StompParser) {
 	bufferedReader := bufio.NewReader(reader)
-	return StompParser{stream: bufferedReader}
+	parser = StompParser{stream: bufferedReader, commands: commands, policy: LENIENT}
+	for _, option := range options {
+		option(&parser)
+	}
+
+	// Commands are scanned the same way as header keys, so a key limit
+	// shorter than a command is only applied once the key has been scanned
+	if parser.maxHeaderKeyLength > 0 {
+		parser.keyScanLimit = parser.maxHeaderKeyLength
+		for name := range parser.commands {
+			if len(name) > parser.keyScanLimit {
+				parser.keyScanLimit = len(name)
+			}
+		}
+	}
+	return parser
+}
+
+// Parser options
+
+type ParserOption func(*StompParser)
+
+// Reject frames with a header key longer than the given number of bytes
+func WithMaxHeaderKeyLength(length int) ParserOption {
+	return func(parser *StompParser) {
+		parser.maxHeaderKeyLength = length
+	}
+}
+
+// Reject frames with a header value longer than the given number of bytes
+func WithMaxHeaderValueLength(length int) ParserOption {
+	return func(parser *StompParser) {
+		parser.maxHeaderValueLength = length
+	}
+}
+
+// Reject frames with more than the given number of lines before the body,
+// counting the command. Repeating a header key doesn't grow the parsed frame,
+// so without this a client could keep the parser scanning forever.
+func WithMaxHeaderLines(lines int) ParserOption {
+	return func(parser *StompParser) {
+		parser.maxHeaderLines = lines
+	}
+}
+
+// Reject frames with a body longer than the given number of bytes
+func WithMaxBodySize(size int) ParserOption {
+	return func(parser *StompParser) {
+		parser.maxBodySize = size
+	}
+}
+
+// Reject frames longer than the given number of bytes in total, counting
+// from the command to the null byte which ends the frame
+func WithMaxFrameSize(size int) ParserOption {
+	return func(parser *StompParser) {
+		parser.maxFrameSize = size
+	}
+}
+
+// Record every header in the order it was received in Frame.RawHeaders, as
+// well as in the Headers map
+func WithRawHeaders() ParserOption {
+	return func(parser *StompParser) {
+		parser.recordRawHeaders = true
+	}
+}
+
+// Recognise the given commands as well as the built-in ones, e.g. for
+// experimental extensions to the protocol. They are also registered so that
+// frames with them can be encoded, see RegisterCommandName, and should be
+// numbered from CUSTOM_COMMANDS up so as not to clash with the built-in
+// ones. A name already used by a built-in command is ignored.
+func WithCommands(custom map[string]CommandType) ParserOption {
+	return func(parser *StompParser) {
+		merged := make(map[string]CommandType, len(parser.commands)+len(custom))
+		for name, command := range parser.commands {
+			merged[name] = command
+		}
+		for name, command := range custom {
+			if _, builtIn := commands[name]; builtIn {
+				continue
+			}
+			merged[name] = command
+			RegisterCommandName(command, name)
+		}
+		parser.commands = merged
+	}
 }
 
 // Parsing
@@ -35,6 +165,11 @@ type Frame struct {
 	Command CommandType
 	Headers map[string]string
 	Body    []byte
+
+	// Headers in their original order, including any repeated keys. Only
+	// recorded by parsers created WithRawHeaders. When set the encoder writes
+	// these instead of Headers, so clear it after changing Headers.
+	RawHeaders [][2]string
 }
 
 type CommandType int
@@ -57,6 +192,9 @@ const (
 	ERROR       CommandType = iota + 1
 )
 
+// Custom commands, see WithCommands, are numbered from here
+const CUSTOM_COMMANDS CommandType = 100
+
 var commands = map[string]CommandType{
 	"SEND":        SEND,
 	"SUBSCRIBE":   SUBSCRIBE,
@@ -75,38 +213,245 @@ var commands = map[string]CommandType{
 	"ERROR":       ERROR,
 }
 
-func (parser *StompParser) NextFrame() (parsedFrame Frame, err error) {
+// Only these commands may carry a body, every other frame must have an empty
+// one
+var bodyCommands = map[CommandType]bool{
+	SEND:    true,
+	MESSAGE: true,
+	ERROR:   true,
+}
+
+// Validate checks a parsed frame against the parts of the spec that the
+// grammar alone doesn't enforce
+func (frame Frame) Validate() error {
+	if len(frame.Body) > 0 && !bodyCommands[frame.Command] {
+		return fmt.Errorf("%s frame must not have a body", frame.Command)
+	}
+	return nil
+}
+
+// String summarises the frame on one line, with its headers in the order
+// they were received if known and sorted otherwise, and the body's length
+// rather than its contents
+func (frame Frame) String() string {
+	headers := frame.RawHeaders
+	if headers == nil {
+		keys := make([]string, 0, len(frame.Headers))
+		for key := range frame.Headers {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			headers = append(headers, [2]string{key, frame.Headers[key]})
+		}
+	}
+
+	var summary strings.Builder
+	summary.WriteString(frame.Command.String())
+	for _, header := range headers {
+		fmt.Fprintf(&summary, " %s:%s", header[0], header[1])
+	}
+	fmt.Fprintf(&summary, " (%d byte body)", len(frame.Body))
+	return summary.String()
+}
+
+// Clone returns a deep copy of the frame, which can be changed without
+// affecting the original
+func (frame Frame) Clone() Frame {
+	clone := Frame{Command: frame.Command}
+	if frame.Headers != nil {
+		clone.Headers = make(map[string]string, len(frame.Headers))
+		for key, value := range frame.Headers {
+			clone.Headers[key] = value
+		}
+	}
+	if frame.RawHeaders != nil {
+		clone.RawHeaders = append([][2]string{}, frame.RawHeaders...)
+	}
+	if frame.Body != nil {
+		clone.Body = append([]byte{}, frame.Body...)
+	}
+	return clone
+}
+
+// Offset is the number of bytes read from the stream so far, e.g. to say
+// where a parse error was found
+func (parser *StompParser) Offset() int {
+	return parser.offset
+}
+
+// Longest command a frame can begin with, not counting its line ending
+const MAX_COMMAND_LENGTH = len("UNSUBSCRIBE")
+
+// PeekCommand identifies the command of the next frame without consuming
+// any of it, so that the whole frame is still returned by the next call to
+// NextFrame. Only the command's line is looked at, so a frame with invalid
+// headers or body is only rejected by NextFrame.
+func (parser *StompParser) PeekCommand() (CommandType, error) {
+	if parser.frameJustEnded {
+		parser.skipEOLs()
+		parser.frameJustEnded = false
+	}
+	if parser.lexError != nil {
+		return 0, parser.lexError
+	}
+
+	// The command line fits in the reader's buffer, so it can be peeked at
+	// a byte at a time until its line ending
+	for n := 1; n <= MAX_COMMAND_LENGTH+len("\r\n"); n++ {
+		peeked, err := parser.stream.Peek(n)
+		if err != nil {
+			return 0, err
+		}
+		switch peeked[n-1] {
+		case '\n':
+			return parser.peekedCommand(bytes.TrimSuffix(peeked[:n-1], []byte{'\r'}))
+		case '\r':
+			next, err := parser.stream.Peek(n + 1)
+			if err == nil && next[n] != '\n' && parser.policy.LoneCarriageReturns {
+				return parser.peekedCommand(next[:n-1])
+			}
+		}
+	}
+	return 0, ParseError{message: "Frame must begin with a command"}
+}
+
+// Look up a peeked command. NextFrame finds the same problem again if it
+// isn't one.
+func (parser *StompParser) peekedCommand(literal []byte) (CommandType, error) {
+	if command, ok := parser.lookupCommand(literal); ok {
+		return command, nil
+	}
+	return 0, parser.errorOr("Frame must begin with a command")
+}
+
+// Resync recovers from a parse error by skipping the rest of the bad frame,
+// up to and including its null byte, so that NextFrame can carry on with
+// the frame after it. Returns io.EOF if the stream ends first.
+func (parser *StompParser) Resync() error {
+	parser.lexError = nil
+	parser.emptyBody = false
+	parser.bodyLength = -1
+	for {
+		currentByte, err := parser.readByte()
+		if err != nil {
+			parser.reachedEOF = true
+			return io.EOF
+		}
+		if currentByte == '\x00' {
+			parser.frameJustEnded = true
+			parser.frameBytes = 0
+			parser.frameLines = 0
+			return nil
+		}
+	}
+}
+
+func (parser *StompParser) NextFrame() (Frame, error) {
+	return parser.nextFrame(map[string]string{})
+}
+
+// NextFrameInto is NextFrame but parses into the frame given, reusing its
+// header map and body buffer rather than allocating new ones. Everything in
+// the frame is overwritten, including the bytes of its body, so Clone it if
+// it has to outlive the next call. On error the frame is left empty.
+func (parser *StompParser) NextFrameInto(frame *Frame) error {
+	headers := frame.Headers
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	for key := range headers {
+		delete(headers, key)
+	}
+	parser.bodyBuffer = frame.Body[:0]
+	if parser.recordRawHeaders {
+		parser.rawBuffer = frame.RawHeaders[:0]
+	}
+
+	parsed, err := parser.nextFrame(headers)
+	parser.bodyBuffer, parser.rawBuffer = nil, nil
+	if err != nil {
+		*frame = Frame{Headers: headers}
+		return err
+	}
+	*frame = parsed
+	return nil
+}
+
+// Parse the next frame, with its headers put in the map given
+func (parser *StompParser) nextFrame(headers map[string]string) (parsedFrame Frame, err error) {
+	parser.frameBytes = 0
+	parser.frameLines = 0
+	parser.bodyLength = -1
+
 	//Command
 	tokType, tokLiteral := parser.nextToken()
 	if tokType != COMMAND && !parser.reachedEOF {
-		return Frame{}, ParseError{message: "Frame must begin with a command"}
+		return Frame{}, parser.errorOr("Frame must begin with a command")
 	}
-	command := commands[string(tokLiteral)]
+	command, _ := parser.lookupCommand(tokLiteral)
 
 	//Headers
+	parser.emptyBody = parser.blankLineMayEnd(command, headers)
 	tokType, tokLiteral = parser.nextToken() // Could be header or body
 
-	headers := map[string]string{}
+	rawHeaders := parser.rawBuffer
 	for ; tokType == HEADER_KEY; tokType, tokLiteral = parser.nextToken() {
-		if tokType == HEADER_KEY {
-			header_key := string(tokLiteral)
-			tokType, tokLiteral = parser.nextToken()
-			if tokType != HEADER_VALUE && !parser.reachedEOF {
-				return Frame{}, ParseError{message: "Headers must have values"}
-			}
-			header_value := string(tokLiteral)
-			headers[header_key] = header_value
-		} else {
-			break
+		if exceedsLimit(tokLiteral, parser.maxHeaderKeyLength) {
+			return Frame{}, ParseError{message: fmt.Sprintf("Header key exceeds the maximum length of %d bytes", parser.maxHeaderKeyLength), limit: true}
+		}
+		escaped := shouldEscapeHeaders(command)
+		var header_key, header_value string
+		if header_key, err = headerKey(tokLiteral, escaped); err != nil {
+			return Frame{}, err
+		}
+		tokType, tokLiteral = parser.nextToken()
+		if tokType != HEADER_VALUE && !parser.reachedEOF {
+			return Frame{}, parser.errorOr("Headers must have values")
+		}
+		// Whitespace around keys and values is part of them, as STOMP
+		// doesn't trim, so it is never stripped here
+		if header_value, err = headerValue(tokLiteral, escaped); err != nil {
+			return Frame{}, err
 		}
+		headers[header_key] = header_value
+		if parser.recordRawHeaders {
+			rawHeaders = append(rawHeaders, [2]string{header_key, header_value})
+		}
+		parser.emptyBody = parser.blankLineMayEnd(command, headers)
+		parser.bodyLength = contentLength(headers)
 	}
 
 	//Body
+	if tokType == INVALID_TOKEN {
+		// Something other than a header where the headers should end, most
+		// likely the body without the blank line that has to precede it
+		return Frame{}, parser.errorOr("Missing blank line before body")
+	}
 	if tokType != BODY && !parser.reachedEOF {
-		return Frame{}, ParseError{message: "Frames must contain bodies"}
+		return Frame{}, parser.errorOr("Frames must contain bodies")
+	}
+	if parser.lexError != nil {
+		return Frame{}, parser.errorOr("")
 	}
 	body := tokLiteral
 
+	// The lexer leaves the body of a frame which may end with a blank line
+	// to be scanned here, once it's clear there is no such line
+	if parser.emptyBody {
+		parser.emptyBody = false
+		if parser.scanEOL() {
+			parser.frameJustEnded = true
+			return Frame{Command: command, Headers: headers, Body: bodyOf(body, headers), RawHeaders: rawHeaders}, nil
+		}
+		if !parser.reachedEOF && parser.lexError == nil {
+			body = parser.scanBody()
+		}
+		if parser.lexError != nil {
+			return Frame{}, parser.errorOr("")
+		}
+	}
+
 	// If we have reached the end of the stream before we have parsed a valid
 	// frame then no more tokens can be returned.
 	if parser.reachedEOF {
@@ -116,10 +461,58 @@ func (parser *StompParser) NextFrame() (parsedFrame Frame, err error) {
 	//Delimiter
 	tokType, tokLiteral = parser.nextToken()
 	if tokType != DELIMITER && !parser.reachedEOF {
-		return Frame{}, ParseError{message: "Frames must end with a null byte"}
+		return Frame{}, parser.errorOr("Frames must end with a null byte")
+	}
+
+	return Frame{Command: command, Headers: headers, Body: bodyOf(body, headers), RawHeaders: rawHeaders}, nil
+}
+
+// A frame with nothing between the blank line and the null byte has no body,
+// which is nil, unless a zero content-length says the body is there but empty
+func bodyOf(body []byte, headers map[string]string) []byte {
+	switch {
+	case len(body) > 0:
+		return body
+	case headers[HEADER_CONTENT_LENGTH] == "0":
+		return []byte{}
+	default:
+		return nil
+	}
+}
+
+// The body length given by the content-length header, or -1 if there isn't
+// a usable one, in which case the body runs up to the first null byte
+func contentLength(headers map[string]string) int {
+	value, ok := headers[HEADER_CONTENT_LENGTH]
+	if !ok {
+		return -1
+	}
+	length, err := strconv.Atoi(value)
+	if err != nil || length < 0 {
+		return -1
+	}
+	return length
+}
+
+// Whether a blank line straight after the headers ends the frame so far
+func (parser *StompParser) blankLineMayEnd(command CommandType, headers map[string]string) bool {
+	if !parser.policy.BlankLineTerminators {
+		return false
 	}
+	return !bodyCommands[command] || headers[HEADER_CONTENT_LENGTH] == "0"
+}
+
+func exceedsLimit(literal []byte, limit int) bool {
+	return limit > 0 && len(literal) > limit
+}
 
-	return Frame{Command: command, Headers: headers, Body: body}, nil
+// Prefer the lexer's explanation of an invalid token over a generic message
+func (parser *StompParser) errorOr(message string) error {
+	if err := parser.lexError; err != nil {
+		parser.lexError = nil
+		return err
+	}
+	return ParseError{message: message}
 }
 
 // Scanning / lexing
@@ -141,6 +534,8 @@ type TerminatorType int
 const (
 	EOL TerminatorType = iota + 1
 	HEADER_SEPARATOR
+	NULL_BYTE // Left unread, so that the frame it ends can be skipped with Resync
+	TOO_LONG  // Scanning stopped at the length limit
 )
 
 type ReadPeeker interface {
@@ -162,6 +557,8 @@ func (parser *StompParser) nextToken() (tokType TokenType, tokLiteral []byte) {
 	if parser.frameJustEnded {
 		parser.skipEOLs()
 		parser.frameJustEnded = false
+		parser.frameBytes = 0
+		parser.frameLines = 0
 	}
 
 	peekBytes, err := parser.stream.Peek(1)
@@ -175,28 +572,37 @@ func (parser *StompParser) nextToken() (tokType TokenType, tokLiteral []byte) {
 	case currentByte == '\x00':
 		tokType = DELIMITER
 		tokLiteral = []byte{currentByte}
-		parser.stream.ReadByte()
+		parser.readByte()
 		parser.frameJustEnded = true
 	case currentByte == '\r' || currentByte == '\n':
 		foundEOL := parser.scanEOL()
 		if foundEOL {
 			tokType = BODY
-			tokLiteral = parser.scanTillDelimiter()
+			tokLiteral = []byte{}
+			if !parser.emptyBody {
+				tokLiteral = parser.scanBody()
+			}
 		} else {
 			tokType = INVALID_TOKEN
 		}
 	case currentByte == ':':
-		parser.stream.ReadByte()
-		tokLiteral, terminator = parser.scanTillTerminator()
+		parser.readByte()
+		tokLiteral, terminator = parser.scanTillTerminator(parser.maxHeaderValueLength)
+		if terminator == TOO_LONG {
+			parser.lexError = ParseError{message: fmt.Sprintf("Header value exceeds the maximum length of %d bytes", parser.maxHeaderValueLength), limit: true}
+		}
 		if terminator == EOL {
 			tokType = HEADER_VALUE
 		} else {
 			tokType = INVALID_TOKEN
 		}
 	default:
-		tokLiteral, terminator = parser.scanTillTerminator()
+		tokLiteral, terminator = parser.scanTillTerminator(parser.keyScanLimit)
+		if terminator == TOO_LONG {
+			parser.lexError = ParseError{message: fmt.Sprintf("Header key exceeds the maximum length of %d bytes", parser.maxHeaderKeyLength), limit: true}
+		}
 		switch {
-		case isCommand(tokLiteral) && terminator == EOL:
+		case terminator == EOL && parser.isCommand(tokLiteral):
 			tokType = COMMAND
 		case terminator == HEADER_SEPARATOR:
 			tokType = HEADER_KEY
@@ -217,6 +623,13 @@ func (parser *StompParser) skipEOLs() {
 }
 
 func (parser *StompParser) scanEOL() (found bool) {
+	// A lone line feed is settled without waiting for a second byte, which
+	// may not come until the client sends its next frame
+	if peekBytes, err := parser.stream.Peek(1); err == nil && peekBytes[0] == '\n' {
+		parser.readByte()
+		return true
+	}
+
 	peekBytes, err := parser.stream.Peek(2)
 	if err != nil {
 		parser.reachedEOF = true
@@ -225,11 +638,17 @@ func (parser *StompParser) scanEOL() (found bool) {
 
 	if peekBytes[0] == '\n' {
 		found = true
-		parser.stream.ReadByte()
+		parser.readByte()
 	} else if bytes.Equal(peekBytes, []byte{'\r', '\n'}) {
 		found = true
-		parser.stream.ReadByte()
-		parser.stream.ReadByte()
+		parser.readByte()
+		parser.readByte()
+	} else if peekBytes[0] == '\r' && parser.policy.LoneCarriageReturns {
+		found = true
+		parser.readByte()
+	} else if peekBytes[0] == '\r' {
+		parser.lexError = ParseError{message: "Carriage return must be followed by a line feed"}
+		found = false
 	} else {
 		found = false
 	}
@@ -252,8 +671,31 @@ func (parser *StompParser) scanHeaderSeparator() (found bool) {
 	return
 }
 
+// Scan the body, which is as long as the content-length header says if the
+// frame has one, so that it may contain null bytes
+func (parser *StompParser) scanBody() []byte {
+	if parser.bodyLength < 0 {
+		return parser.scanTillDelimiter()
+	}
+	if parser.exceedsSizeLimits(parser.bodyLength) {
+		return nil
+	}
+
+	literal := parser.bodyBuffer
+	for len(literal) < parser.bodyLength && !parser.exceedsSizeLimits(len(literal)) {
+		currentByte, err := parser.readByte()
+		if err != nil {
+			parser.reachedEOF = true
+			break
+		}
+		literal = append(literal, currentByte)
+	}
+	return literal
+}
+
 func (parser *StompParser) scanTillDelimiter() (literal []byte) {
-	for {
+	literal = parser.bodyBuffer
+	for !parser.exceedsSizeLimits(len(literal)) {
 		peekBytes, err := parser.stream.Peek(1)
 		if err != nil {
 			parser.reachedEOF = true
@@ -261,7 +703,7 @@ func (parser *StompParser) scanTillDelimiter() (literal []byte) {
 		} else if peekBytes[0] == '\x00' {
 			break
 		} else {
-			currentByte, err := parser.stream.ReadByte()
+			currentByte, err := parser.readByte()
 			if err != nil {
 				parser.reachedEOF = true
 				break
@@ -272,17 +714,25 @@ func (parser *StompParser) scanTillDelimiter() (literal []byte) {
 	return
 }
 
-func (parser *StompParser) scanTillTerminator() (literal []byte, term TerminatorType) {
-	literal = []byte{}
+// Scan a command or header line up to its terminator, giving up once it's
+// longer than limit bytes unless limit is zero, so that an oversized key or
+// value isn't read into memory in full
+func (parser *StompParser) scanTillTerminator(limit int) (literal []byte, term TerminatorType) {
+	literal = parser.lineBuffer[:0]
 
-	for term == 0 && !parser.reachedEOF {
+	for term == 0 && !parser.reachedEOF && !parser.exceedsSizeLimits(0) {
 		switch {
+		case limit > 0 && len(literal) > limit:
+			term = TOO_LONG
 		case parser.scanEOL():
 			term = EOL
+			parser.countLine()
 		case parser.scanHeaderSeparator():
 			term = HEADER_SEPARATOR
+		case parser.atNull():
+			term = NULL_BYTE
 		default:
-			currentByte, err := parser.stream.ReadByte()
+			currentByte, err := parser.readByte()
 			if err != nil {
 				parser.reachedEOF = true
 				break
@@ -291,10 +741,69 @@ func (parser *StompParser) scanTillTerminator() (literal []byte, term Terminator
 		}
 	}
 
+	parser.lineBuffer = literal
 	return
 }
 
-func isCommand(literal []byte) (result bool) {
-	_, result = commands[string(literal)]
+// Count a command or header line, refusing the frame once there are more
+// than WithMaxHeaderLines allows. A blank line ends the headers rather than
+// being one of them, and those between frames are heart-beats, so only the
+// lines the lexer has scanned a token from are counted.
+func (parser *StompParser) countLine() {
+	parser.frameLines++
+	if parser.maxHeaderLines > 0 && parser.frameLines > parser.maxHeaderLines && parser.lexError == nil {
+		parser.lexError = ParseError{message: fmt.Sprintf("Frame exceeds the maximum of %d lines before the body", parser.maxHeaderLines), limit: true}
+	}
+}
+
+// A null byte can't appear in a command or header line, so one found while
+// scanning them ends a malformed frame
+func (parser *StompParser) atNull() bool {
+	peeked, err := parser.stream.Peek(1)
+	return err == nil && peeked[0] == '\x00'
+}
+
+// Read a byte of the current frame, keeping count for the frame size limit
+func (parser *StompParser) readByte() (byte, error) {
+	currentByte, err := parser.stream.ReadByte()
+	if err == nil {
+		parser.frameBytes++
+		parser.offset++
+	}
+	return currentByte, err
+}
+
+// Check the size limits while scanning, so that an oversized frame is
+// rejected before it has all been read into memory. Also stops scanning if
+// the lexer has already found a problem.
+func (parser *StompParser) exceedsSizeLimits(bodyLength int) bool {
+	switch {
+	case parser.lexError != nil:
+	case parser.maxBodySize > 0 && bodyLength > parser.maxBodySize:
+		parser.lexError = ParseError{message: fmt.Sprintf("Body exceeds the maximum size of %d bytes", parser.maxBodySize), limit: true}
+	case parser.maxFrameSize > 0 && parser.frameBytes > parser.maxFrameSize:
+		parser.lexError = ParseError{message: fmt.Sprintf("Frame exceeds the maximum size of %d bytes", parser.maxFrameSize), limit: true}
+	default:
+		return false
+	}
+	return true
+}
+
+func (parser *StompParser) isCommand(literal []byte) (result bool) {
+	_, result = parser.lookupCommand(literal)
 	return
 }
+
+// Look up a command, ignoring its case if the policy allows
+func (parser *StompParser) lookupCommand(literal []byte) (CommandType, bool) {
+	if command, ok := parser.commands[string(literal)]; ok {
+		return command, true
+	}
+
+	command, ok := parser.commands[strings.ToUpper(string(literal))]
+	if ok && !parser.policy.CaseInsensitiveCommands {
+		parser.lexError = ParseError{message: fmt.Sprintf("Commands are case sensitive, expected %s", command)}
+		return 0, false
+	}
+	return command, ok
+}
@@ -2,9 +2,12 @@ package parsing_test
 
 import (
 	"bytes"
+	"fmt"
 	"io"
 	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/jonathanlloyd/skewserver/parsing"
 )
@@ -181,6 +184,573 @@ func TestMultipleFrames(t *testing.T) {
 	}
 }
 
+// Header length limits
+
+func TestHeaderKeyTooLong(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a\nx-very-long-key:value\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithMaxHeaderKeyLength(11))
+	_, err := parser.NextFrame()
+
+	parseErr, ok := err.(parsing.ParseError)
+	if !ok {
+		t.Fatalf("Over-long header key should raise a ParseError")
+	}
+	if !strings.Contains(parseErr.Error(), "key") {
+		t.Errorf("Error should say the header key is too long, got %q", parseErr.Error())
+	}
+}
+
+func TestHeaderValueTooLong(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a-very-long-name\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithMaxHeaderValueLength(8))
+	_, err := parser.NextFrame()
+
+	parseErr, ok := err.(parsing.ParseError)
+	if !ok {
+		t.Fatalf("Over-long header value should raise a ParseError")
+	}
+	if !strings.Contains(parseErr.Error(), "value") {
+		t.Errorf("Error should say the header value is too long, got %q", parseErr.Error())
+	}
+}
+
+// An oversized key or value is refused without reading the rest of it
+func TestOversizedHeadersRefusedWhileScanning(t *testing.T) {
+	huge := strings.Repeat("x", 1<<20)
+	for name, testData := range map[string]string{
+		"key":   "SEND\n" + huge + ":value\n\n\x00",
+		"value": "SEND\ndestination:" + huge + "\n\n\x00",
+	} {
+		conn := mockTCPStream{streamData: testData}
+		parser := parsing.NewStompParserFromReader(&conn,
+			parsing.WithMaxHeaderKeyLength(16),
+			parsing.WithMaxHeaderValueLength(16))
+		_, err := parser.NextFrame()
+
+		if parseErr, ok := err.(parsing.ParseError); !ok || !parseErr.ExceedsLimit() || !strings.Contains(err.Error(), name) {
+			t.Errorf("Over-long header %s should raise a ParseError over the limit, got %v", name, err)
+		}
+		if parser.Offset() > 64 {
+			t.Errorf("Parser should stop reading an over-long header %s at the limit, read %d bytes", name, parser.Offset())
+		}
+	}
+}
+
+func TestKeyLimitShorterThanCommand(t *testing.T) {
+	testData := "SUBSCRIBE\nid:0\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithMaxHeaderKeyLength(2))
+	if frame, err := parser.NextFrame(); err != nil || frame.Command != parsing.SUBSCRIBE {
+		t.Errorf("A command longer than the key limit should still be parsed, got %v %v", frame.Command, err)
+	}
+}
+
+func TestHeadersWithinLimits(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn,
+		parsing.WithMaxHeaderKeyLength(len("destination")),
+		parsing.WithMaxHeaderValueLength(len("/queue/a")))
+	frame, err := parser.NextFrame()
+
+	if err != nil {
+		t.Errorf("No error should be raised for headers at the limit: %s", err)
+	}
+	if frame.Headers["destination"] != "/queue/a" {
+		t.Errorf("Frame should have correct headers")
+	}
+}
+
+func TestTooManyHeaderLines(t *testing.T) {
+	testData := "SEND\n" + strings.Repeat("x:y\n", 5000) + "\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithMaxHeaderLines(100))
+	_, err := parser.NextFrame()
+
+	parseErr, ok := err.(parsing.ParseError)
+	if !ok {
+		t.Fatalf("Too many lines before the body should raise a ParseError, got %v", err)
+	}
+	if !strings.Contains(parseErr.Error(), "lines") {
+		t.Errorf("Error should say there are too many lines, got %q", parseErr.Error())
+	}
+}
+
+func TestHeaderLinesWithinLimit(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a\nx:y\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithMaxHeaderLines(3))
+	if _, err := parser.NextFrame(); err != nil {
+		t.Errorf("No error should be raised for a frame at the line limit: %s", err)
+	}
+}
+
+// Heart-beats between frames aren't lines of either
+func TestHeaderLinesCountedPerFrame(t *testing.T) {
+	frame := "SEND\ndestination:/queue/a\nx:y\n\n\x00"
+	testData := frame + "\n\n\n\n" + frame
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithMaxHeaderLines(3))
+	for i := 0; i < 2; i++ {
+		if _, err := parser.NextFrame(); err != nil {
+			t.Errorf("No error should be raised for frame %d at the line limit: %s", i+1, err)
+		}
+	}
+}
+
+// Size limits
+
+func TestBodyTooLarge(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a\n\nhello world\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithMaxBodySize(5), parsing.WithMaxFrameSize(1024))
+	_, err := parser.NextFrame()
+
+	parseErr, ok := err.(parsing.ParseError)
+	if !ok {
+		t.Fatalf("Over-large body should raise a ParseError, got %v", err)
+	}
+	if !strings.Contains(parseErr.Error(), "Body exceeds") {
+		t.Errorf("Error should say the body is too large, got %q", parseErr.Error())
+	}
+}
+
+func TestFrameTooLarge(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a\n\nhello\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithMaxBodySize(1024), parsing.WithMaxFrameSize(20))
+	_, err := parser.NextFrame()
+
+	if err == nil || !strings.Contains(err.Error(), "Frame exceeds") {
+		t.Errorf("Error should say the frame is too large, got %v", err)
+	}
+}
+
+func TestFramesWithinSizeLimits(t *testing.T) {
+	frame := "SEND\ndestination:/queue/a\n\nhello\x00"
+	testData := frame + "\n\n" + frame
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn,
+		parsing.WithMaxBodySize(len("hello")),
+		parsing.WithMaxFrameSize(len(frame)))
+	for i := 0; i < 2; i++ {
+		parsed, err := parser.NextFrame()
+		if err != nil {
+			t.Fatalf("No error should be raised for frames at the limits: %s", err)
+		}
+		if string(parsed.Body) != "hello" {
+			t.Errorf("Frame should have correct body, got %q", parsed.Body)
+		}
+	}
+}
+
+// Strictness
+
+func TestLowercaseCommand(t *testing.T) {
+	testData := "send\ndestination:/queue/a\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithPolicy(parsing.STRICT))
+	_, err := parser.NextFrame()
+	if err == nil || !strings.Contains(err.Error(), "case sensitive") {
+		t.Errorf("Strict parser should reject a lowercase command, got %v", err)
+	}
+
+	conn = mockTCPStream{streamData: testData}
+	parser = parsing.NewStompParserFromReader(&conn, parsing.WithPolicy(parsing.LENIENT))
+	frame, err := parser.NextFrame()
+	if err != nil || frame.Command != parsing.SEND {
+		t.Errorf("Lenient parser should accept a lowercase command, got %v %v", frame.Command, err)
+	}
+}
+
+// Strictness has to be asked for
+func TestLenientByDefault(t *testing.T) {
+	testData := "send\rdestination:/queue/a\r\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn)
+	frame, err := parser.NextFrame()
+	if err != nil || frame.Command != parsing.SEND || frame.Headers["destination"] != "/queue/a" {
+		t.Errorf("Parser without a policy should be lenient, got %v %v %v", frame.Command, frame.Headers, err)
+	}
+}
+
+func TestLowercaseHeaderKeyNotMistakenForCommand(t *testing.T) {
+	testData := "SEND\nsend:value\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithPolicy(parsing.STRICT))
+	frame, err := parser.NextFrame()
+	if err != nil || frame.Headers["send"] != "value" {
+		t.Errorf("Header key spelling a command should be accepted, got %v", err)
+	}
+}
+
+func TestLoneCarriageReturn(t *testing.T) {
+	testData := "SEND\rdestination:/queue/a\r\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithPolicy(parsing.STRICT))
+	_, err := parser.NextFrame()
+	if err == nil || !strings.Contains(err.Error(), "Carriage return") {
+		t.Errorf("Strict parser should reject a lone carriage return, got %v", err)
+	}
+
+	conn = mockTCPStream{streamData: testData}
+	parser = parsing.NewStompParserFromReader(&conn, parsing.WithPolicy(parsing.LENIENT))
+	frame, err := parser.NextFrame()
+	if err != nil || frame.Headers["destination"] != "/queue/a" {
+		t.Errorf("Lenient parser should treat a lone carriage return as a line ending, got %v", err)
+	}
+}
+
+func TestBlankLineTerminator(t *testing.T) {
+	testData := "SUBSCRIBE\nid:0\ndestination:/queue/a\n\n\n" +
+		"SEND\ndestination:/queue/a\ncontent-length:0\n\n\n" +
+		"SEND\ndestination:/queue/a\n\n\nhello\x00"
+
+	policy := parsing.LENIENT
+	policy.BlankLineTerminators = true
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithPolicy(policy))
+
+	frame, err := parser.NextFrame()
+	if err != nil || frame.Command != parsing.SUBSCRIBE || frame.Headers["id"] != "0" {
+		t.Fatalf("A blank line should end a frame that can't have a body, got %s %v", frame, err)
+	}
+	frame, err = parser.NextFrame()
+	if err != nil || frame.Command != parsing.SEND || len(frame.Body) != 0 {
+		t.Fatalf("A blank line should end a frame with a content-length of 0, got %s %v", frame, err)
+	}
+	frame, err = parser.NextFrame()
+	if err != nil || string(frame.Body) != "\nhello" {
+		t.Fatalf("A blank line should not end a frame that may have a body, got %s %v", frame, err)
+	}
+}
+
+func TestBlankLineTerminatorNotStrict(t *testing.T) {
+	testData := "SUBSCRIBE\nid:0\ndestination:/queue/a\n\n\nSEND\ndestination:/queue/a\n\nhello\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn, parsing.WithPolicy(parsing.STRICT))
+	frame, err := parser.NextFrame()
+	if err == nil && frame.Command == parsing.SUBSCRIBE && frame.Validate() == nil {
+		t.Errorf("Strict parser should not end a frame at a blank line")
+	}
+}
+
+func TestResyncAfterBadFrame(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a\n\nfirst\x00\n" +
+		"SEND\nbad header\n\nskipped\x00\n\n" +
+		"SEND\ndestination:/queue/a\n\nsecond\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn)
+	if frame, err := parser.NextFrame(); err != nil || string(frame.Body) != "first" {
+		t.Fatalf("First frame should parse, got %v", err)
+	}
+	if _, err := parser.NextFrame(); err == nil {
+		t.Fatalf("Bad frame should fail to parse")
+	}
+	if err := parser.Resync(); err != nil {
+		t.Fatalf("Resync should find the end of the bad frame, got %v", err)
+	}
+	if frame, err := parser.NextFrame(); err != nil || string(frame.Body) != "second" {
+		t.Errorf("Frame after the bad one should parse, got %q %v", frame.Body, err)
+	}
+}
+
+func TestMissingBlankLineBeforeBody(t *testing.T) {
+	for _, testData := range []string{
+		"SEND\ndest:/q\nbody-without-blank\x00",
+		"SEND\ndest:/q\nbody\nspanning lines\x00",
+	} {
+		conn := mockTCPStream{streamData: testData + "SEND\ndestination:/queue/a\n\nnext\x00"}
+		parser := parsing.NewStompParserFromReader(&conn)
+		_, err := parser.NextFrame()
+		if err == nil || !strings.Contains(err.Error(), "Missing blank line before body") {
+			t.Errorf("Body without a blank line before it should be reported as such for %q, got %v", testData, err)
+		}
+
+		// The null byte is left for Resync, so the next frame isn't lost
+		if err := parser.Resync(); err != nil {
+			t.Fatalf("Resync should find the end of the bad frame, got %v", err)
+		}
+		if frame, err := parser.NextFrame(); err != nil || string(frame.Body) != "next" {
+			t.Errorf("Frame after the bad one should parse, got %q %v", frame.Body, err)
+		}
+	}
+}
+
+func TestResyncAtEndOfStream(t *testing.T) {
+	conn := mockTCPStream{streamData: "SEND\nbad header\n\nno null byte"}
+	parser := parsing.NewStompParserFromReader(&conn)
+	parser.NextFrame()
+	if err := parser.Resync(); err != io.EOF {
+		t.Errorf("Resync should reach the end of the stream, got %v", err)
+	}
+}
+
+// Validation
+
+func TestSendWithBodyIsValid(t *testing.T) {
+	conn := mockTCPStream{streamData: "SEND\ndestination:/queue/a\n\nhello\x00"}
+	parser := parsing.NewStompParserFromReader(&conn)
+	frame, err := parser.NextFrame()
+	if err != nil {
+		t.Fatalf("Error parsing frame: %s", err)
+	}
+	if err := frame.Validate(); err != nil {
+		t.Errorf("SEND frame should be allowed a body, got %s", err)
+	}
+}
+
+func TestBeginWithBodyIsInvalid(t *testing.T) {
+	conn := mockTCPStream{streamData: "BEGIN\ntransaction:tx1\n\nhello\x00"}
+	parser := parsing.NewStompParserFromReader(&conn)
+	frame, err := parser.NextFrame()
+	if err != nil {
+		t.Fatalf("Error parsing frame: %s", err)
+	}
+	if err := frame.Validate(); err == nil || !strings.Contains(err.Error(), "must not have a body") {
+		t.Errorf("BEGIN frame should not be allowed a body, got %v", err)
+	}
+}
+
+func TestEmptyStream(t *testing.T) {
+	conn := mockTCPStream{streamData: ""}
+	parser := parsing.NewStompParserFromReader(&conn)
+
+	if _, err := parser.NextFrame(); err != io.EOF {
+		t.Errorf("Empty stream should return EOF, got %v", err)
+	}
+}
+
+// Heart-beating
+
+func TestHeartBeatHeader(t *testing.T) {
+	frame := parsing.Frame{Command: parsing.CONNECT, Headers: map[string]string{"heart-beat": "100,2000"}}
+
+	heartBeat, ok, err := frame.HeartBeat()
+	if err != nil || !ok {
+		t.Fatalf("Heart-beat header should parse, got %v %v", ok, err)
+	}
+	if heartBeat.Outgoing != 100*time.Millisecond || heartBeat.Incoming != 2*time.Second {
+		t.Errorf("Heart-beat intervals should be in milliseconds, got %+v", heartBeat)
+	}
+	if heartBeat.String() != "100,2000" {
+		t.Errorf("Heart-beat should format as its header value, got %q", heartBeat.String())
+	}
+}
+
+func TestHeartBeatAbsent(t *testing.T) {
+	frame := parsing.Frame{Command: parsing.CONNECT, Headers: map[string]string{}}
+
+	if heartBeat, ok, err := frame.HeartBeat(); ok || err != nil || heartBeat != (parsing.HeartBeat{}) {
+		t.Errorf("Frame without a heart-beat header should have none, got %+v %v %v", heartBeat, ok, err)
+	}
+}
+
+func TestInvalidHeartBeat(t *testing.T) {
+	for _, value := range []string{"", "100", "100,", "-1,0", "a,b", "1,2,3"} {
+		frame := parsing.Frame{Command: parsing.CONNECT, Headers: map[string]string{"heart-beat": value}}
+		if _, _, err := frame.HeartBeat(); err == nil {
+			t.Errorf("Heart-beat header %q should be invalid", value)
+		}
+	}
+}
+
+// Peeking
+
+func TestPeekCommandThenParse(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a\n\nhello\x00\r\n\nUNSUBSCRIBE\r\nid:0\r\n\r\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn)
+	for _, expected := range []parsing.CommandType{parsing.SEND, parsing.UNSUBSCRIBE} {
+		for i := 0; i < 2; i++ {
+			command, err := parser.PeekCommand()
+			if err != nil || command != expected {
+				t.Fatalf("Peek should find %s, got %s %v", expected, command, err)
+			}
+		}
+
+		frame, err := parser.NextFrame()
+		if err != nil {
+			t.Fatalf("Peeked frame should still parse: %s", err)
+		}
+		if frame.Command != expected || len(frame.Headers) != 1 {
+			t.Errorf("Peeking should not consume the frame, got %s %v", frame.Command, frame.Headers)
+		}
+	}
+
+	if _, err := parser.PeekCommand(); err != io.EOF {
+		t.Errorf("Peek at the end of the stream should return EOF, got %v", err)
+	}
+}
+
+func TestPeekInvalidCommand(t *testing.T) {
+	conn := mockTCPStream{streamData: "SENDING\ndestination:/queue/a\n\n\x00"}
+	parser := parsing.NewStompParserFromReader(&conn)
+
+	if _, err := parser.PeekCommand(); err == nil {
+		t.Errorf("Peek should reject an unknown command")
+	}
+	if _, err := parser.NextFrame(); err == nil {
+		t.Errorf("Parse should still reject the unknown command after a peek")
+	}
+}
+
+// Debugging
+
+func TestFrameString(t *testing.T) {
+	frame := parsing.Frame{
+		Command: parsing.SEND,
+		Headers: map[string]string{"destination": "/queue/a", "content-type": "text/plain"},
+		Body:    []byte("hello"),
+	}
+
+	expected := "SEND content-type:text/plain destination:/queue/a (5 byte body)"
+	if frame.String() != expected {
+		t.Errorf("Frame should be summarised as %q, got %q", expected, frame.String())
+	}
+}
+
+func TestFrameClone(t *testing.T) {
+	frame := parsing.Frame{
+		Command: parsing.SEND,
+		Headers: map[string]string{"destination": "/queue/a"},
+		Body:    []byte("hello"),
+	}
+
+	clone := frame.Clone()
+	clone.Headers["destination"] = "/queue/b"
+	clone.Body[0] = 'j'
+	if frame.Headers["destination"] != "/queue/a" || string(frame.Body) != "hello" {
+		t.Errorf("Changing a clone should not change the original, got %s", frame)
+	}
+}
+
+func TestOffsetOfParseError(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a\n\n\x00\nSEND\nbad header\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn)
+	if _, err := parser.NextFrame(); err != nil {
+		t.Fatalf("Error parsing frame: %s", err)
+	}
+	firstFrame := len("SEND\ndestination:/queue/a\n\n\x00")
+	if parser.Offset() != firstFrame {
+		t.Errorf("Offset should be the end of the first frame, %d, got %d", firstFrame, parser.Offset())
+	}
+
+	if _, err := parser.NextFrame(); err == nil {
+		t.Fatalf("Header without a separator should raise an error")
+	}
+	if parser.Offset() <= firstFrame+len("\nSEND\n") {
+		t.Errorf("Offset should be within the second frame's headers, got %d", parser.Offset())
+	}
+}
+
+// Reusing a frame
+
+func TestNextFrameInto(t *testing.T) {
+	testData := "SEND\ndestination:/queue/a\nx-first:1\n\nfirst body\x00" +
+		"SEND\ndestination:/queue/b\n\nsecond\x00" +
+		"SEND\nbad header\n\n\x00"
+
+	conn := mockTCPStream{streamData: testData}
+	parser := parsing.NewStompParserFromReader(&conn)
+
+	var frame parsing.Frame
+	if err := parser.NextFrameInto(&frame); err != nil {
+		t.Fatalf("No error should be raised parsing the first frame: %s", err)
+	}
+	retained := frame.Clone()
+	headers, body := frame.Headers, frame.Body
+
+	if err := parser.NextFrameInto(&frame); err != nil {
+		t.Fatalf("No error should be raised parsing the second frame: %s", err)
+	}
+	expected := map[string]string{"destination": "/queue/b"}
+	if !reflect.DeepEqual(expected, frame.Headers) || string(frame.Body) != "second" {
+		t.Errorf("Frame should hold only the second frame, got %s %q", frame, frame.Body)
+	}
+	if reflect.ValueOf(headers).Pointer() != reflect.ValueOf(frame.Headers).Pointer() || &body[0] != &frame.Body[0] {
+		t.Errorf("Header map and body buffer should be reused")
+	}
+	if retained.Headers["x-first"] != "1" || string(retained.Body) != "first body" {
+		t.Errorf("Clone should be unaffected by reuse, got %s %q", retained, retained.Body)
+	}
+
+	if err := parser.NextFrameInto(&frame); err == nil {
+		t.Fatalf("Header without a separator should raise an error")
+	}
+	if frame.Command != 0 || len(frame.Headers) != 0 || frame.Body != nil {
+		t.Errorf("Frame should be left empty after an error, got %s", frame)
+	}
+}
+
+func BenchmarkNextFrame(b *testing.B) {
+	parser := parsing.NewStompParserFromReader(repeatedFrames(b.N))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parser.NextFrame(); err != nil {
+			b.Fatalf("Error parsing frame: %s", err)
+		}
+	}
+}
+
+func BenchmarkNextFrameInto(b *testing.B) {
+	parser := parsing.NewStompParserFromReader(repeatedFrames(b.N))
+	var frame parsing.Frame
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := parser.NextFrameInto(&frame); err != nil {
+			b.Fatalf("Error parsing frame: %s", err)
+		}
+	}
+}
+
+// Allocations for typical frames with a few headers, which are mostly down
+// to the header map and the strings in it
+func BenchmarkHeaders(b *testing.B) {
+	headers := []string{"destination:/queue/a\n", "content-type:text/plain\n", "receipt:r1\n", "x-trace:abc123\n"}
+	for n := 1; n <= len(headers); n++ {
+		frame := "SEND\n" + strings.Join(headers[:n], "") + "\nbody\x00"
+		b.Run(fmt.Sprintf("%d headers", n), func(b *testing.B) {
+			parser := parsing.NewStompParserFromReader(strings.NewReader(strings.Repeat(frame, b.N)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := parser.NextFrame(); err != nil {
+					b.Fatalf("Error parsing frame: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func repeatedFrames(n int) io.Reader {
+	frame := "SEND\ndestination:/queue/a\ncontent-type:text/plain\nreceipt:r1\n\n" + strings.Repeat("body ", 40) + "\x00"
+	return strings.NewReader(strings.Repeat(frame, n))
+}
+
 // Mock representation of incoming tcp connection
 type mockTCPStream struct {
 	streamData  string
@@ -218,3 +788,33 @@ func min(x, y int) int {
 		return y
 	}
 }
+
+func TestCustomCommand(t *testing.T) {
+	const PING = parsing.CUSTOM_COMMANDS + 1
+	input := "PING\nid:1\n\n\x00SEND\ndestination:/queue/a\n\n\x00"
+	parser := parsing.NewStompParserFromReader(strings.NewReader(input), parsing.WithCommands(map[string]parsing.CommandType{"PING": PING}))
+
+	frame, err := parser.NextFrame()
+	if err != nil || frame.Command != PING || frame.Headers["id"] != "1" {
+		t.Fatalf("Should parse a registered custom command, got %v %v", frame, err)
+	}
+	if frame, err = parser.NextFrame(); err != nil || frame.Command != parsing.SEND {
+		t.Errorf("Should still parse built-in commands, got %v %v", frame, err)
+	}
+	if encoded := string(parsing.Frame{Command: PING, Headers: map[string]string{}}.Marshal()); encoded != "PING\n\n\x00" {
+		t.Errorf("Custom command should be encoded with its name, got %q", encoded)
+	}
+
+	plain := parsing.NewStompParserFromReader(strings.NewReader(input))
+	if _, err := plain.NextFrame(); err == nil {
+		t.Errorf("Custom command should only be recognised by parsers it was added to")
+	}
+}
+
+func TestCustomCommandCannotReplaceBuiltIn(t *testing.T) {
+	option := parsing.WithCommands(map[string]parsing.CommandType{"SEND": parsing.CUSTOM_COMMANDS + 2})
+	parser := parsing.NewStompParserFromReader(strings.NewReader("SEND\ndestination:/queue/a\n\n\x00"), option)
+	if frame, err := parser.NextFrame(); err != nil || frame.Command != parsing.SEND {
+		t.Errorf("Built-in command should keep its meaning, got %v %v", frame, err)
+	}
+}
@@ -0,0 +1,40 @@
+package parsing
+
+// Strictness
+// A Policy decides which deviations from the STOMP 1.2 spec are tolerated.
+// The zero value, STRICT, tolerates none of them. LENIENT accepts the
+// mistakes real clients are known to make, and is what a parser uses unless
+// it's given another WithPolicy, as the server does when run in strict mode.
+// Some leniencies only concern the parser while others are checked by
+// whatever handles the parsed frames.
+
+type Policy struct {
+	CaseInsensitiveCommands bool // Accept commands in any case, e.g. "send"
+	LoneCarriageReturns     bool // Accept a \r without a following \n as a line ending
+	OptionalConnectHeaders  bool // Accept CONNECT frames without accept-version and host
+	ReservedHeaders         bool // Accept SEND frames setting server-assigned headers, which are ignored
+
+	// Accept a blank line instead of the null byte at the end of a frame
+	// that can't have a body, or declares a content-length of 0, as
+	// telnet-style testers tend to send. A frame which might have a body
+	// still has to end with a null byte, as otherwise a blank line in its
+	// body would end it early. Not part of LENIENT, it has to be asked for.
+	BlankLineTerminators bool
+}
+
+var (
+	STRICT  = Policy{}
+	LENIENT = Policy{
+		CaseInsensitiveCommands: true,
+		LoneCarriageReturns:     true,
+		OptionalConnectHeaders:  true,
+		ReservedHeaders:         true,
+	}
+)
+
+// Parse frames according to the given policy rather than LENIENT
+func WithPolicy(policy Policy) ParserOption {
+	return func(parser *StompParser) {
+		parser.policy = policy
+	}
+}
@@ -0,0 +1,30 @@
+package parsing
+
+import (
+	"fmt"
+	"io"
+)
+
+// Frame validation
+// Checks a stream of STOMP frames offline, e.g. a file captured from a
+// misbehaving client. Each frame is printed as it is parsed, and the first
+// that doesn't parse is reported with its position.
+
+// ValidateFrames prints every frame read from reader to out, stopping at the
+// first invalid one
+func ValidateFrames(reader io.Reader, out io.Writer, policy Policy) error {
+	parser := NewStompParserFromReader(reader, WithPolicy(policy), WithRawHeaders())
+	for n := 1; ; n++ {
+		frame, err := parser.NextFrame()
+		if err == io.EOF {
+			return nil
+		}
+		if err == nil {
+			err = frame.Validate()
+		}
+		if err != nil {
+			return fmt.Errorf("frame %d, byte %d: %s", n, parser.Offset(), err)
+		}
+		fmt.Fprintf(out, "%d: %s\n", n, frame)
+	}
+}
@@ -0,0 +1,49 @@
+package parsing_test
+
+import (
+	"bytes"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+func TestValidateValidFile(t *testing.T) {
+	var out bytes.Buffer
+	if err := validateFixture(t, "testdata/valid.stomp", &out); err != nil {
+		t.Fatalf("Valid file should validate, got %s", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("Every frame should be printed, got %q", out.String())
+	}
+	expected := "3: SEND destination:/queue/a content-type:text/plain (5 byte body)"
+	if lines[2] != expected {
+		t.Errorf("Frame should be printed as %q, got %q", expected, lines[2])
+	}
+}
+
+func TestValidateInvalidFile(t *testing.T) {
+	var out bytes.Buffer
+	err := validateFixture(t, "testdata/invalid.stomp", &out)
+	if err == nil {
+		t.Fatalf("Invalid file should fail to validate")
+	}
+	if !strings.HasPrefix(err.Error(), "frame 2, byte ") {
+		t.Errorf("Error should say where the invalid frame is, got %q", err)
+	}
+	if !strings.HasPrefix(out.String(), "1: CONNECT") {
+		t.Errorf("Frames before the invalid one should be printed, got %q", out.String())
+	}
+}
+
+func validateFixture(t *testing.T, path string, out *bytes.Buffer) error {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("Error opening fixture: %s", err)
+	}
+	defer file.Close()
+	return parsing.ValidateFrames(file, out, parsing.LENIENT)
+}
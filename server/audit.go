@@ -0,0 +1,95 @@
+package server
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Auditing
+// Every CONNECT is reported to Options.Auditor, whether it succeeds or not,
+// apart from the operational log so that audit events can be routed to a
+// dedicated file or SIEM. An Auditor is called from each connection's
+// goroutine, so must be safe for concurrent use.
+
+type Auditor interface {
+	AuditConnect(event ConnectAudit)
+}
+
+// ConnectResult is the outcome of a CONNECT
+type ConnectResult string
+
+const (
+	CONNECT_ACCEPTED    ConnectResult = "accepted"
+	CONNECT_AUTH_FAILED ConnectResult = "auth-failed"
+	CONNECT_REFUSED     ConnectResult = "refused" // For any reason other than authentication, e.g. a malformed frame
+)
+
+// ConnectAudit describes a CONNECT and its outcome
+type ConnectAudit struct {
+	Time       time.Time     `json:"time"`
+	Principal  string        `json:"principal"` // The login given, whether or not it authenticated
+	RemoteAddr string        `json:"remote_addr"`
+	Host       string        `json:"host"`              // Virtual host asked for
+	Version    string        `json:"version,omitempty"` // Negotiated protocol version, only if accepted
+	Session    string        `json:"session,omitempty"` // Only if accepted
+	Result     ConnectResult `json:"result"`
+}
+
+// AuditLog is an Auditor that writes each event as a line of JSON. An event
+// that can't be written is lost, so the writer should be one that doesn't
+// fail in the normal course of things, such as a local file.
+type AuditLog struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
+
+func NewAuditLog(writer io.Writer) *AuditLog {
+	return &AuditLog{writer: writer}
+}
+
+// OpenAuditLog appends audit events to the file at path, creating it if
+// needed
+func OpenAuditLog(path string) (*AuditLog, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return NewAuditLog(file), nil
+}
+
+func (audit *AuditLog) AuditConnect(event ConnectAudit) {
+	line, err := json.Marshal(event)
+	if err != nil {
+		return
+	}
+	line = append(line, '\n')
+
+	audit.mu.Lock()
+	defer audit.mu.Unlock()
+	audit.writer.Write(line)
+}
+
+func (c *conn) auditConnect(frame parsing.Frame, result ConnectResult) {
+	auditor := c.server.opts.Auditor
+	if auditor == nil {
+		return
+	}
+	event := ConnectAudit{
+		Time:       c.server.clock.Now(),
+		Principal:  frame.Headers[parsing.HEADER_LOGIN],
+		RemoteAddr: c.netConn.RemoteAddr().String(),
+		Host:       frame.Headers[parsing.HEADER_HOST],
+		Result:     result,
+	}
+	if result == CONNECT_ACCEPTED {
+		event.Principal = c.principal
+		event.Version = PROTOCOL_VERSION
+		event.Session = c.sessionID
+	}
+	auditor.AuditConnect(event)
+}
@@ -0,0 +1,72 @@
+package server
+
+import (
+	"bufio"
+	"crypto/subtle"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+)
+
+// Authenticator verifies the login and passcode headers of a CONNECT frame
+type Authenticator interface {
+	Authenticate(login string, passcode string) bool
+}
+
+// StaticCredentials authenticates against a file of login:passcode lines.
+// Blank lines and lines starting with # are ignored. The file can be re-read
+// with Reload, which swaps in the new credentials atomically so connections
+// being authenticated concurrently see either the old set or the new one.
+type StaticCredentials struct {
+	path        string
+	credentials atomic.Value // map[string]string
+}
+
+func LoadStaticCredentials(path string) (*StaticCredentials, error) {
+	creds := &StaticCredentials{path: path}
+	if err := creds.Reload(); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// Reload re-reads the credentials file. On error the previously loaded
+// credentials stay in effect.
+func (creds *StaticCredentials) Reload() error {
+	file, err := os.Open(creds.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	credentials := map[string]string{}
+	scanner := bufio.NewScanner(file)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		separator := strings.Index(line, ":")
+		if separator < 1 {
+			return fmt.Errorf("%s:%d: expected login:passcode", creds.path, lineNo)
+		}
+		credentials[line[:separator]] = line[separator+1:]
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	creds.credentials.Store(credentials)
+	return nil
+}
+
+func (creds *StaticCredentials) Authenticate(login string, passcode string) bool {
+	credentials := creds.credentials.Load().(map[string]string)
+	expected, ok := credentials[login]
+	if !ok {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(passcode)) == 1
+}
@@ -0,0 +1,213 @@
+package server_test
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestStaticCredentials(t *testing.T) {
+	path := writeCredentials(t, "# comment\n\nalice:secret\nbob:pass:with:colons\n")
+
+	creds, err := server.LoadStaticCredentials(path)
+	if err != nil {
+		t.Fatalf("No error should be raised loading credentials: %s", err)
+	}
+
+	if !creds.Authenticate("alice", "secret") {
+		t.Errorf("Valid credentials should authenticate")
+	}
+	if !creds.Authenticate("bob", "pass:with:colons") {
+		t.Errorf("Passcodes may contain colons")
+	}
+	if creds.Authenticate("alice", "wrong") {
+		t.Errorf("Wrong passcode should not authenticate")
+	}
+	if creds.Authenticate("carol", "") {
+		t.Errorf("Unknown login should not authenticate")
+	}
+}
+
+func TestStaticCredentialsInvalidFile(t *testing.T) {
+	path := writeCredentials(t, "alice:secret\nno-separator\n")
+
+	if _, err := server.LoadStaticCredentials(path); err == nil {
+		t.Errorf("Malformed lines should be rejected")
+	}
+}
+
+func TestStaticCredentialsReload(t *testing.T) {
+	path := writeCredentials(t, "alice:old\n")
+	creds, err := server.LoadStaticCredentials(path)
+	if err != nil {
+		t.Fatalf("No error should be raised loading credentials: %s", err)
+	}
+	_, addr := startServer(t, server.Options{Authenticator: creds})
+
+	client := dial(t, addr)
+	client.connect(map[string]string{"login": "alice", "passcode": "old"})
+
+	ioutil.WriteFile(path, []byte("alice:new\n"), 0600)
+	if err := creds.Reload(); err != nil {
+		t.Fatalf("No error should be raised reloading credentials: %s", err)
+	}
+
+	client = dial(t, addr)
+	client.send("CONNECT\nlogin:alice\npasscode:old\n\n\x00")
+	client.expectFrame(parsing.ERROR)
+	client.expectClosed()
+
+	client = dial(t, addr)
+	client.connect(map[string]string{"login": "alice", "passcode": "new"})
+}
+
+func TestStaticCredentialsFailedReloadKeepsOld(t *testing.T) {
+	path := writeCredentials(t, "alice:secret\n")
+	creds, err := server.LoadStaticCredentials(path)
+	if err != nil {
+		t.Fatalf("No error should be raised loading credentials: %s", err)
+	}
+
+	ioutil.WriteFile(path, []byte("garbage\n"), 0600)
+	if err := creds.Reload(); err == nil {
+		t.Errorf("Reloading a malformed file should fail")
+	}
+	if !creds.Authenticate("alice", "secret") {
+		t.Errorf("Old credentials should stay in effect after a failed reload")
+	}
+}
+
+func TestAuthenticationRequired(t *testing.T) {
+	creds, _ := server.LoadStaticCredentials(writeCredentials(t, "alice:secret\n"))
+	_, addr := startServer(t, server.Options{Authenticator: creds})
+
+	client := dial(t, addr)
+	client.send("CONNECT\naccept-version:1.2\n\n\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if frame.Headers["message"] != "Authentication failed" {
+		t.Errorf("ERROR should report the authentication failure")
+	}
+	client.expectClosed()
+}
+
+func TestAnonymousAllowed(t *testing.T) {
+	creds, _ := server.LoadStaticCredentials(writeCredentials(t, "alice:secret\n"))
+	_, addr := startServer(t, server.Options{Authenticator: creds, AllowAnonymous: true})
+
+	anonymous := dial(t, addr)
+	anonymous.connect(nil)
+
+	wrongPasscode := dial(t, addr)
+	wrongPasscode.send("CONNECT\naccept-version:1.2\nlogin:alice\npasscode:guess\n\n\x00")
+	wrongPasscode.expectFrame(parsing.ERROR)
+	wrongPasscode.expectClosed()
+}
+
+func TestAnonymousDenied(t *testing.T) {
+	creds, _ := server.LoadStaticCredentials(writeCredentials(t, "alice:secret\n"))
+	_, addr := startServer(t, server.Options{Authenticator: creds})
+
+	anonymous := dial(t, addr)
+	anonymous.send("CONNECT\naccept-version:1.2\nhost:localhost\n\n\x00")
+	anonymous.expectFrame(parsing.ERROR)
+	anonymous.expectClosed()
+
+	alice := dial(t, addr)
+	alice.connect(map[string]string{"login": "alice", "passcode": "secret"})
+}
+
+func TestConnectAuditLog(t *testing.T) {
+	creds, _ := server.LoadStaticCredentials(writeCredentials(t, "alice:secret\n"))
+	path := filepath.Join(tempDir(t), "audit.log")
+	auditor, err := server.OpenAuditLog(path)
+	if err != nil {
+		t.Fatalf("Error opening audit log: %s", err)
+	}
+	_, addr := startServer(t, server.Options{Authenticator: creds, Auditor: auditor})
+
+	alice := dial(t, addr)
+	session := alice.connect(map[string]string{"login": "alice", "passcode": "secret", "host": "vhost-a"}).Headers["session"]
+
+	intruder := dial(t, addr)
+	intruder.send("CONNECT\naccept-version:1.2\nhost:vhost-a\nlogin:alice\npasscode:guess\n\n\x00")
+	intruder.expectFrame(parsing.ERROR)
+	intruder.expectClosed()
+
+	var events []server.ConnectAudit
+	eventually(t, func() bool {
+		contents, _ := ioutil.ReadFile(path)
+		lines := strings.Split(strings.TrimSpace(string(contents)), "\n")
+		if len(lines) < 2 {
+			return false
+		}
+		events = make([]server.ConnectAudit, len(lines))
+		for i, line := range lines {
+			if err := json.Unmarshal([]byte(line), &events[i]); err != nil {
+				t.Fatalf("Audit log should hold a JSON event per line, got %q: %s", line, err)
+			}
+		}
+		return true
+	})
+
+	accepted, failed := events[0], events[1]
+	if accepted.Result != server.CONNECT_ACCEPTED || accepted.Principal != "alice" || accepted.Host != "vhost-a" ||
+		accepted.Version != "1.2" || accepted.Session != session || accepted.RemoteAddr == "" {
+		t.Errorf("Successful CONNECT should be audited in full, got %+v", accepted)
+	}
+	if failed.Result != server.CONNECT_AUTH_FAILED || failed.Principal != "alice" || failed.Session != "" {
+		t.Errorf("Failed CONNECT should be audited as an authentication failure, got %+v", failed)
+	}
+}
+
+func TestClientCertificateAuthentication(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+	caFile, clientCert := writeClientCertificate(t, "admin")
+	creds, err := server.LoadStaticCredentials(writeCredentials(t, "alice:secret\n"))
+	if err != nil {
+		t.Fatalf("Error loading credentials: %s", err)
+	}
+
+	srv, err := server.New(server.Options{
+		Addr:            "127.0.0.1:0",
+		TLSCertFile:     certFile,
+		TLSKeyFile:      keyFile,
+		TLSClientCAFile: caFile,
+		Authenticator:   creds,
+		AdminLogins:     []string{"admin"},
+	})
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+	go srv.ListenAndServe()
+	t.Cleanup(func() { srv.Close() })
+	eventually(t, func() bool { return srv.Addr() != nil })
+
+	admin := dialTLS(t, srv.Addr().String(), &tls.Config{InsecureSkipVerify: true, Certificates: []tls.Certificate{clientCert}})
+	admin.connect(nil)
+	admin.subscribe("/queue/replies", "replies", nil)
+	admin.request(parsing.SEND, map[string]string{"destination": "/admin/quarantine", "reply-to": "/queue/replies"}, "")
+	if frame, ok := admin.nextFrame(FRAME_TIMEOUT); !ok || frame.Command != parsing.MESSAGE {
+		t.Errorf("Certificate's common name should be authorized as an admin")
+	}
+
+	anonymous := dialTLS(t, srv.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	anonymous.send("CONNECT\naccept-version:1.2\nhost:localhost\nlogin:admin\n\n\x00")
+	anonymous.expectFrame(parsing.ERROR)
+
+	alice := dialTLS(t, srv.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	alice.connect(map[string]string{"login": "alice", "passcode": "secret"})
+}
+
+func writeCredentials(t *testing.T, contents string) string {
+	path := filepath.Join(tempDir(t), "credentials")
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatalf("Error writing credentials: %s", err)
+	}
+	return path
+}
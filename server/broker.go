@@ -0,0 +1,1276 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Broker
+// Routes messages from SEND frames to the subscriptions on each destination.
+// Queues hand each message to a single subscriber and retain messages until
+// one is available, topics fan out to every subscriber. Subscriptions to a
+// topic which share a subscription group count as one subscriber, with each
+// message going to one member of the group in round-robin order. A message
+// with a deliver-after header is held back until its delay has passed before
+// being routed. All broker state, including each connection's subscription
+// table, is guarded by broker.mu.
+
+type broker struct {
+	log    Logger
+	clock  Clock
+	router Router
+	opts   Options
+
+	deadLetterQueue string // Normalized name of Options.DeadLetterQueue
+
+	mu           sync.Mutex
+	destinations map[string]*destination
+	durables     map[string]*subscription    // Durable subscriptions keyed by client-id and subscription id
+	queuedBytes  int64                       // Total of every destination's queuedBytes
+	sessions     map[string]*retainedSession // Dropped sessions that can be resumed, keyed by resume token
+	scheduled    map[*message]Timer          // Delayed messages waiting to be routed
+	closed       bool                        // Set on shutdown, after which nothing more is scheduled
+	counters     destinationCounters         // Per destination totals for metrics
+	quarantine   []QuarantinedMessage        // Dead letters held for inspection, see Options.QuarantineSize
+	pushback     *pushback                   // Nil unless a send is routing a message, see pushback
+	transacted   int                         // Messages held by open transactions, see holdTransacted
+
+	idCounter  uint64
+	seqCounter uint64 // Last sequence number given to a routed message
+}
+
+func newBroker(log Logger, clock Clock, opts Options) *broker {
+	b := &broker{
+		log:          log,
+		clock:        clock,
+		router:       opts.router(),
+		opts:         opts,
+		destinations: map[string]*destination{},
+		durables:     map[string]*subscription{},
+		sessions:     map[string]*retainedSession{},
+		scheduled:    map[*message]Timer{},
+		counters:     newDestinationCounters(opts.MaxMetricDestinations),
+	}
+	if opts.DeadLetterQueue != "" {
+		_, b.deadLetterQueue = b.router.Resolve(opts.DeadLetterQueue)
+	}
+	return b
+}
+
+// Destinations are created on first use, whether by a SEND or a SUBSCRIBE.
+// A queue retains messages until a subscriber takes them, so sending to a
+// queue that nobody has subscribed to yet keeps the message for the first
+// consumer. A topic only delivers to whoever is subscribed at the time, so a
+// message sent to a topic without subscribers is dropped. Which kind a
+// destination is depends on its name, see Router.
+type DestinationKind int
+
+const (
+	QUEUE DestinationKind = iota + 1
+	TOPIC
+)
+
+type destination struct {
+	name          string
+	kind          DestinationKind
+	subscriptions []*subscription
+	messages      []*message     // Queues only, messages waiting for a subscriber
+	next          int            // Queues only, round-robin cursor into subscriptions
+	queuedBytes   int64          // Size of the messages retained for the destination, see sizeOf
+	groupNext     map[string]int // Topics only, round-robin cursor into each subscription group
+}
+
+type message struct {
+	id           string
+	destination  string
+	headers      map[string]string
+	body         []byte
+	traceID      string // Follows the message from its SEND to every delivery and log line
+	seq          uint64 // Order in which the broker routed the message, across all destinations
+	redeliveries int    // How many times the message has been handed back to be delivered again
+	storeKey     string // Empty unless the message is in Options.Store, see saveMessage
+	enqueuedAt   time.Time
+	expiresAt    time.Time // Zero if the message never expires
+}
+
+type subscription struct {
+	id          string
+	conn        *conn // Nil while a durable subscription is detached
+	destination *destination
+	ackMode     ackMode
+	overflow    OverflowPolicy
+	batchSize   int
+	group       string            // Empty unless the subscription shares a topic's messages with its group
+	paused      bool              // Paused subscriptions are passed over for queue and group messages
+	selector    *selector         // Nil unless the SUBSCRIBE had a selector header
+	accepts     contentTypeFilter // Content types the subscription takes, see contentTypeFilter
+	durableKey  string            // Empty unless the subscription is durable
+	unacked     unackedDeliveries // Outstanding deliveries, oldest first
+	active      time.Time         // Last ACK or NACK, or first delivery since, for reclaiming idle subscriptions
+	acked       uint64            // Deliveries acked over the subscription's life
+	backlog     []*message        // Messages retained while detached
+	settled     []string          // Most recent ack ids that were acked, nacked or timed out, oldest first
+}
+
+type delivery struct {
+	ackID       string
+	message     *message
+	timer       Timer // Fires if the delivery isn't acked within the ack timeout
+	deliveredAt time.Time
+}
+
+// How many settled ack ids each subscription remembers, so that a repeated
+// ACK, one for a delivery already covered by a cumulative ACK, or one which
+// loses the race with its timer is ignored rather than treated as an error
+const SETTLED_ACK_MEMORY = 64
+
+// Ack modes
+
+type ackMode int
+
+const (
+	ACK_AUTO ackMode = iota + 1
+	ACK_CLIENT
+	ACK_CLIENT_INDIVIDUAL
+)
+
+var ackModes = map[string]ackMode{
+	"auto":              ACK_AUTO,
+	"client":            ACK_CLIENT,
+	"client-individual": ACK_CLIENT_INDIVIDUAL,
+}
+
+var ackModeNames = map[ackMode]string{}
+
+func init() {
+	for name, mode := range ackModes {
+		ackModeNames[mode] = name
+	}
+}
+
+// Settings a SUBSCRIBE frame can choose
+type subscribeOptions struct {
+	ackMode   ackMode
+	durable   bool
+	overflow  OverflowPolicy
+	batchSize int
+	group     string
+	selector  *selector
+	accepts   contentTypeFilter
+}
+
+// Headers from a SEND frame which only make sense to the broker and so are
+// not copied onto the delivered MESSAGE
+var brokerOnlyHeaders = map[string]bool{
+	parsing.HEADER_RECEIPT:     true,
+	parsing.HEADER_TRANSACTION: true,
+	HEADER_DELIVER_AFTER:       true,
+}
+
+// Headers of a MESSAGE which the broker sets itself. A SEND frame trying to
+// set them is rejected in strict mode, otherwise they are ignored.
+var serverAssignedHeaders = []string{
+	parsing.HEADER_ACK,
+	parsing.HEADER_MESSAGE_ID,
+	parsing.HEADER_SUBSCRIPTION,
+	HEADER_REDELIVERED,
+	HEADER_REDELIVERY_COUNT,
+	HEADER_BROKER_SEQ,
+}
+
+func init() {
+	for _, name := range serverAssignedHeaders {
+		brokerOnlyHeaders[name] = true
+	}
+}
+
+// Publishing
+
+// Route a message sent by a client. For a message sent straight to a topic,
+// delivered is how many subscriptions it was handed to. Otherwise it's -1,
+// as a queue hands the message on later, as does a delayed message. The
+// publisher is nil for messages the server sends of its own accord.
+func (b *broker) send(publisher *conn, frame parsing.Frame) (delivered int, err error) {
+	now := b.clock.Now()
+	expiresAt, err := messageExpiry(frame.Headers, now)
+	if err != nil {
+		return -1, err
+	}
+	delay, err := deliveryDelay(frame.Headers)
+	if err != nil {
+		return -1, err
+	}
+
+	headers := map[string]string{}
+	for key, value := range frame.Headers {
+		if !brokerOnlyHeaders[key] {
+			headers[key] = value
+		}
+	}
+	if !expiresAt.IsZero() {
+		headers[HEADER_EXPIRES] = strconv.FormatInt(expiresAt.UnixNano()/int64(time.Millisecond), 10)
+	}
+	traceID := frame.Headers[HEADER_TRACE_ID]
+	if traceID == "" {
+		traceID = b.newTraceID()
+		headers[HEADER_TRACE_ID] = traceID
+	}
+
+	msg := &message{
+		headers:    headers,
+		body:       frame.Body,
+		traceID:    traceID,
+		enqueuedAt: now,
+		expiresAt:  expiresAt,
+	}
+
+	b.mu.Lock()
+	b.pushback = &pushback{}
+	delivered, err = b.publish(frame.Headers[parsing.HEADER_DESTINATION], msg, delay)
+	pushback := b.pushback
+	b.pushback = nil
+	b.mu.Unlock()
+
+	pushback.wait(publisher)
+	return delivered, err
+}
+
+// Route a message to the named destination, or schedule it if it's delayed.
+// Called with the lock held.
+func (b *broker) publish(name string, msg *message, delay time.Duration) (int, error) {
+	dest := b.destination(name)
+	if b.persistent(dest.name, msg.headers) {
+		msg.headers[HEADER_PERSISTENT] = "true"
+	} else {
+		delete(msg.headers, HEADER_PERSISTENT)
+	}
+	msg.id = b.nextID("message")
+	msg.destination = dest.name
+
+	if delay > 0 {
+		b.schedule(msg, delay)
+		return -1, nil
+	}
+	return b.route(dest, msg)
+}
+
+// Back pressure
+// Under the block overflow policy a publisher is made to wait while the
+// message it sent has taken a subscription's outbound queue over its limits.
+// Deliveries are made with the broker's lock held, so rather than waiting
+// there, which would hold up every other client while one consumer is slow
+// or paused, the message is let in over the limits and the queue noted. The
+// publisher then waits for each noted queue to have room once the lock is
+// released, holding up only its own connection. It doesn't wait on its own
+// paused subscriptions though, as only its reader could resume them. Queue
+// messages instead wait on their queue under any policy, which passes over
+// a subscription without room until its writer has made some, see refill, so
+// that is the same whether or not there's a publisher. Other deliveries not made for a
+// publisher, e.g. of delayed topic messages, have nobody to push back on so
+// are simply let in.
+
+// Outbound queues a message being sent has taken over their limits
+type pushback struct {
+	queues []fullQueue
+}
+
+// Connection and subscription are copied as the subscription may be
+// detached by the time the publisher waits
+type fullQueue struct {
+	conn  *conn
+	subID string
+}
+
+// Note a subscription whose outbound queue went over its limits, if a
+// publisher is being pushed back on
+func (b *broker) pushBack(sub *subscription) {
+	if b.pushback != nil {
+		b.pushback.queues = append(b.pushback.queues, fullQueue{conn: sub.conn, subID: sub.id})
+	}
+}
+
+// Wait for every noted queue to have room, without the broker's lock
+func (p *pushback) wait(publisher *conn) {
+	for _, queue := range p.queues {
+		if queue.conn == publisher && queue.conn.outbox.isPaused(queue.subID) {
+			continue
+		}
+		queue.conn.waitForRoom(queue.subID)
+	}
+}
+
+// Hand a message to its destination's subscribers, or retain it on a queue
+// until there is one. Fails if the queue is already holding
+// Options.MaxQueueBytes, so that the sender isn't told the message was
+// accepted when it wasn't. Returns how many subscriptions a topic message
+// was handed to, see send.
+func (b *broker) route(dest *destination, msg *message) (int, error) {
+	now := b.clock.Now()
+	b.log.Debugf("Routing message %s to %s (trace %s)", msg.id, dest.name, msg.traceID)
+
+	switch dest.kind {
+	case TOPIC:
+		b.counters.of(dest.name).Published++
+		if msg.expired(now) {
+			b.expire(msg)
+			return 0, nil
+		}
+		msg.seq = b.nextSeq()
+		if len(dest.subscriptions) == 0 {
+			b.log.Debugf("No subscribers on %s, dropping message %s (trace %s)", dest.name, msg.id, msg.traceID)
+		}
+		delivered := 0
+		grouped := map[string]bool{}
+		contentType := b.contentTypeOf(msg)
+		for _, sub := range dest.subscriptions {
+			if sub.group != "" {
+				if grouped[sub.group] {
+					continue
+				}
+				grouped[sub.group] = true
+				sub = dest.nextGroupMember(sub.group, msg, contentType)
+			}
+			if sub == nil || !sub.wants(msg, contentType) {
+				continue
+			}
+			if b.deliver(sub, msg) {
+				delivered++
+			}
+		}
+		return delivered, nil
+	case QUEUE:
+		if max := b.opts.MaxQueueBytes; max > 0 && dest.queuedBytes+int64(msg.size()) > int64(max) {
+			b.log.Debugf("Queue %s is full, refusing message %s (trace %s)", dest.name, msg.id, msg.traceID)
+			return -1, limitError(fmt.Sprintf("Queue %s is full", dest.name))
+		}
+		if err := b.saveMessage(msg); err != nil {
+			return -1, err
+		}
+		b.counters.of(dest.name).Published++
+		msg.seq = b.nextSeq()
+		dest.messages = append(dest.messages, msg)
+		b.queued(dest, msg)
+		b.dispatch(dest)
+	}
+	return -1, nil
+}
+
+// Work out when a message expires from its expires header, an absolute time
+// in milliseconds since the epoch, and its ttl header, in milliseconds from
+// now. If both are given whichever comes first wins. Zero (or no header)
+// means never.
+func messageExpiry(headers map[string]string, now time.Time) (time.Time, error) {
+	var expiresAt time.Time
+	if value, ok := headers[HEADER_EXPIRES]; ok {
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || millis < 0 {
+			return time.Time{}, fmt.Errorf("Invalid %s header %q", HEADER_EXPIRES, value)
+		}
+		if millis > 0 {
+			expiresAt = time.Unix(millis/1000, (millis%1000)*int64(time.Millisecond))
+		}
+	}
+
+	if value, ok := headers[HEADER_TTL]; ok {
+		millis, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || millis < 0 || millis > int64(MAX_TTL/time.Millisecond) {
+			return time.Time{}, fmt.Errorf("Invalid %s header %q", HEADER_TTL, value)
+		}
+		if millis > 0 {
+			ttlExpiry := now.Add(time.Duration(millis) * time.Millisecond)
+			if expiresAt.IsZero() || ttlExpiry.Before(expiresAt) {
+				expiresAt = ttlExpiry
+			}
+		}
+	}
+	return expiresAt, nil
+}
+
+// Longest ttl a message can ask for, well short of overflowing a Duration
+const MAX_TTL = 100 * 365 * 24 * time.Hour
+
+// Delayed delivery
+// A deliver-after header, in milliseconds, holds a message back from its
+// destination until the delay has passed. Its expiry still counts from when
+// it was sent, so a message can expire before it's ever routed. Scheduled
+// messages only live in memory: when the server shuts down any still waiting
+// are discarded, and logged, along with everything else the broker holds.
+
+// Longest delay a message can ask for, the same as the longest ttl
+const MAX_DELIVERY_DELAY = MAX_TTL
+
+func deliveryDelay(headers map[string]string) (time.Duration, error) {
+	value, ok := headers[HEADER_DELIVER_AFTER]
+	if !ok {
+		return 0, nil
+	}
+	millis, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || millis < 0 || millis > int64(MAX_DELIVERY_DELAY/time.Millisecond) {
+		return 0, fmt.Errorf("Invalid %s header %q", HEADER_DELIVER_AFTER, value)
+	}
+	return time.Duration(millis) * time.Millisecond, nil
+}
+
+func (b *broker) schedule(msg *message, delay time.Duration) {
+	if b.closed {
+		return
+	}
+	b.log.Debugf("Scheduling message %s for %s in %s (trace %s)", msg.id, msg.destination, delay, msg.traceID)
+	b.scheduled[msg] = b.clock.AfterFunc(delay, func() { b.scheduledMessageDue(msg) })
+}
+
+// Route a scheduled message once its delay has passed. If the broker was
+// closed while this was waiting for the lock the message will already be
+// gone.
+func (b *broker) scheduledMessageDue(msg *message) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if _, ok := b.scheduled[msg]; !ok {
+		return
+	}
+	delete(b.scheduled, msg)
+	msg.enqueuedAt = b.clock.Now()
+	if _, err := b.route(b.destinations[msg.destination], msg); err != nil {
+		b.log.Warnf("Dropping scheduled message %s: %s (trace %s)", msg.id, err, msg.traceID)
+	}
+}
+
+// Stop routing scheduled messages and dispatching queued ones, returning how
+// many scheduled messages were discarded and how many unacked ones were
+// requeued, see requeueUnacked
+func (b *broker) close() (discarded int, requeued int) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	discarded = len(b.scheduled)
+	for msg, timer := range b.scheduled {
+		timer.Stop()
+		delete(b.scheduled, msg)
+	}
+	return discarded, b.requeueUnacked()
+}
+
+// Requeue on shutdown
+// Messages delivered from a queue but not yet acked go back to the front of
+// the queue when the server shuts down, in the order they were delivered,
+// rather than waiting for each connection to be torn down. Once the broker
+// is closed nothing is dispatched, so they stay there and are counted as
+// queued for as long as the server is around. Persistent ones are still in
+// Options.Store, if there is one, for the next start to replay, and the
+// rest don't survive the process.
+func (b *broker) requeueUnacked() int {
+	requeued := 0
+	for _, dest := range b.destinations {
+		if dest.kind != QUEUE {
+			continue
+		}
+		var messages []*message
+		for _, sub := range dest.subscriptions {
+			for _, d := range sub.unacked.removeAll() {
+				d.stopTimer()
+				sub.settle(d.ackID)
+				d.message.redeliveries++
+				messages = append(messages, d.message)
+				b.queued(dest, d.message)
+			}
+		}
+		dest.messages = append(messages, dest.messages...)
+		requeued += len(messages)
+	}
+	return requeued
+}
+
+func (msg *message) expired(now time.Time) bool {
+	return !msg.expiresAt.IsZero() && !now.Before(msg.expiresAt)
+}
+
+// Expired queue messages go to the dead letter queue. Topic messages are
+// shared between subscriptions, so are just dropped.
+func (b *broker) expire(msg *message) {
+	b.log.Debugf("Message %s on %s has expired (trace %s)", msg.id, msg.destination, msg.traceID)
+	b.counters.of(msg.destination).Expired++
+	if b.destinations[msg.destination].kind == QUEUE && msg.destination != b.deadLetterQueue {
+		b.deadLetter(msg)
+	}
+}
+
+// Hand retained queue messages to subscribers in round-robin order, passing
+// over those without credit, and expiring any that have outlived their
+// expiry time on the way. A message the transformer refuses for one
+// subscriber is offered to the next. Messages that no available subscriber
+// wants, or that every one was refused, stay where they are for later ones
+// to go past.
+func (b *broker) dispatch(dest *destination) {
+	if b.closed {
+		return
+	}
+	now := b.clock.Now()
+	refusals := 0 // Of the current message
+	for i := 0; i < len(dest.messages); {
+		msg := dest.messages[i]
+		if msg.expired(now) {
+			dest.removeMessage(i)
+			b.dequeued(dest, msg)
+			b.expire(msg)
+			continue
+		}
+
+		sub, filtered := dest.nextSubscriber(b.opts.DispatchCredit, msg, b.contentTypeOf(msg))
+		if sub == nil {
+			if !filtered {
+				return
+			}
+			refusals = 0
+			i++
+			continue
+		}
+
+		if !b.deliver(sub, msg) {
+			if refusals++; refusals >= len(dest.subscriptions) {
+				refusals = 0
+				i++
+			}
+			continue
+		}
+		refusals = 0
+		dest.removeMessage(i)
+		b.dequeued(dest, msg)
+	}
+}
+
+func (dest *destination) removeMessage(i int) {
+	if i == 0 {
+		dest.messages[0] = nil
+		dest.messages = dest.messages[1:]
+		return
+	}
+	copy(dest.messages[i:], dest.messages[i+1:])
+	dest.messages[len(dest.messages)-1] = nil
+	dest.messages = dest.messages[:len(dest.messages)-1]
+}
+
+// Advance the round-robin cursor to the next subscription that isn't paused
+// or detached, has credit and room and wants the message, returning nil if
+// there isn't one. Detached subscriptions of retained sessions are passed
+// over so that live consumers get the messages in the meantime. Filtered
+// says whether a subscription was only passed over for its selector or
+// content types, so that another message might be taken.
+func (dest *destination) nextSubscriber(credit int, msg *message, contentType string) (sub *subscription, filtered bool) {
+	for i := 0; i < len(dest.subscriptions); i++ {
+		sub := dest.subscriptions[cursor(dest.next, len(dest.subscriptions))]
+		dest.next++
+		if sub.paused || sub.conn == nil || !sub.hasCredit(credit) || !sub.hasRoom() {
+			continue
+		}
+		if !sub.wants(msg, contentType) {
+			filtered = true
+			continue
+		}
+		return sub, false
+	}
+	return nil, filtered
+}
+
+// Whether a subscription's selector and content types let it take a message
+func (sub *subscription) wants(msg *message, contentType string) bool {
+	return sub.accepts.accepts(contentType) && sub.selects(msg)
+}
+
+// Index a round-robin cursor into n items. Cursors only ever count up, so
+// on a long enough run they wrap round to negative, which mustn't give a
+// negative index.
+func cursor(next int, n int) int {
+	return int(uint(next) % uint(n))
+}
+
+// Whether a subscription can take another message under fair dispatch, see
+// Options.DispatchCredit
+func (sub *subscription) hasCredit(credit int) bool {
+	return credit == 0 || sub.ackMode == ACK_AUTO || sub.unacked.len() < credit
+}
+
+// Whether a subscription can take another queue message without going over
+// its outbound limits, see Back pressure. Whatever the overflow policy, a
+// queue message can wait on its queue, so it's never dropped or made to
+// disconnect the subscriber.
+func (sub *subscription) hasRoom() bool {
+	return sub.conn.hasRoom(sub.id)
+}
+
+// Dispatch a queue's messages again once a subscription that was passed
+// over for want of room has some. Called by the subscription's writer.
+func (b *broker) refill(c *conn, subID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sub, ok := c.subscriptions[subID]; ok && sub.destination.kind == QUEUE {
+		b.dispatch(sub.destination)
+	}
+}
+
+// Advance a subscription group's round-robin cursor to its next member that
+// wants the message, passing over members that are paused or detached
+// unless there are no others. Returns nil if no member wants it.
+func (dest *destination) nextGroupMember(group string, msg *message, contentType string) *subscription {
+	var members []*subscription
+	for _, sub := range dest.subscriptions {
+		if sub.group == group && sub.wants(msg, contentType) {
+			members = append(members, sub)
+		}
+	}
+	if len(members) == 0 {
+		return nil
+	}
+
+	if dest.groupNext == nil {
+		dest.groupNext = map[string]int{}
+	}
+	first := dest.groupNext[group]
+	for i := 0; i < len(members); i++ {
+		sub := members[cursor(first+i, len(members))]
+		if !sub.paused && sub.conn != nil {
+			dest.groupNext[group] = first + i + 1
+			return sub
+		}
+	}
+	dest.groupNext[group] = first + 1
+	return members[cursor(first, len(members))]
+}
+
+// Redeliver a message to the next member of a group, dropping it as a topic
+// would if none of them wants it any more
+func (b *broker) deliverToGroup(dest *destination, group string, msg *message) {
+	member := dest.nextGroupMember(group, msg, b.contentTypeOf(msg))
+	if member == nil {
+		b.log.Debugf("No member of group %s on %s wants message %s, dropping it (trace %s)", group, dest.name, msg.id, msg.traceID)
+		return
+	}
+	b.deliver(member, msg)
+}
+
+// Hand a message to a subscription, or retain it for a detached one.
+// Returns false if the transformer refused it, in which case a queue
+// message is left on its queue for the next dispatch.
+func (b *broker) deliver(sub *subscription, msg *message) bool {
+	if sub.conn == nil {
+		sub.backlog = append(sub.backlog, msg)
+		b.queued(sub.destination, msg)
+		return true
+	}
+
+	frame := parsing.MessageFrame(msg.destination, msg.id, sub.id, msg.body, b.contentTypeOf(msg))
+	for key, value := range msg.headers {
+		if _, reserved := frame.Headers[key]; !reserved {
+			frame.Headers[key] = value
+		}
+	}
+	if b.opts.SequenceHeader {
+		frame.Headers[HEADER_BROKER_SEQ] = strconv.FormatUint(msg.seq, 10)
+	}
+	if msg.redeliveries > 0 {
+		frame.Headers[HEADER_REDELIVERED] = "true"
+		frame.Headers[HEADER_REDELIVERY_COUNT] = strconv.Itoa(msg.redeliveries)
+	}
+
+	if transformer := b.opts.Transformer; transformer != nil {
+		transformed, err := transformer.Transform(sub.describe(), frame.Clone())
+		if err != nil {
+			b.log.Warnf("Error transforming message %s for subscription %s, not delivering it: %s (trace %s)", msg.id, sub.id, err, msg.traceID)
+			return false
+		}
+		frame = transformed
+	}
+
+	if sub.ackMode != ACK_AUTO {
+		ackID := b.nextID("ack")
+		frame.Headers[parsing.HEADER_ACK] = ackID
+
+		d := delivery{ackID: ackID, message: msg, deliveredAt: b.clock.Now()}
+		if b.opts.AckTimeout > 0 {
+			d.timer = b.clock.AfterFunc(b.opts.AckTimeout, func() { b.ackTimedOut(sub, ackID) })
+		}
+		if sub.unacked.len() == 0 {
+			sub.active = b.clock.Now()
+		}
+		sub.unacked.add(d)
+	} else {
+		b.forgetMessage(msg)
+	}
+
+	b.counters.of(msg.destination).Delivered++
+	if full := sub.conn.sendMessage(sub, frame); full {
+		b.pushBack(sub)
+	}
+	return true
+}
+
+// Remove queued messages which have expired, or waited longer than maxAge
+// for a subscriber if it isn't zero, moving them to the dead letter queue if
+// there is one
+func (b *broker) evict(maxAge time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	cutoff := now.Add(-maxAge)
+	for _, dest := range b.destinations {
+		if dest.kind != QUEUE || dest.name == b.deadLetterQueue {
+			continue
+		}
+
+		kept := dest.messages[:0]
+		var evicted, expired []*message
+		for _, msg := range dest.messages {
+			switch {
+			case msg.expired(now):
+				expired = append(expired, msg)
+			case maxAge > 0 && msg.enqueuedAt.Before(cutoff):
+				evicted = append(evicted, msg)
+			default:
+				kept = append(kept, msg)
+			}
+		}
+		for i := len(kept); i < len(dest.messages); i++ {
+			dest.messages[i] = nil
+		}
+		dest.messages = kept
+		for _, msg := range append(evicted, expired...) {
+			b.dequeued(dest, msg)
+		}
+
+		for _, msg := range evicted {
+			b.log.Debugf("Evicting message %s from %s after %s (trace %s)", msg.id, dest.name, maxAge, msg.traceID)
+			b.counters.of(dest.name).Expired++
+			b.deadLetter(msg)
+		}
+		for _, msg := range expired {
+			b.expire(msg)
+		}
+	}
+}
+
+// Move a message to the dead letter queue, or drop it if none is configured.
+// The original destination is preserved in a header. A quarantine takes the
+// place of the dead letter queue when there is one.
+func (b *broker) deadLetter(msg *message) {
+	b.forgetMessage(msg)
+	if b.opts.QuarantineSize > 0 {
+		b.quarantineMessage(msg)
+		return
+	}
+	if b.deadLetterQueue == "" {
+		return
+	}
+
+	dlq := b.destination(b.deadLetterQueue)
+	msg.headers[HEADER_ORIGINAL_DESTINATION] = msg.destination
+	msg.destination = dlq.name
+	msg.enqueuedAt = b.clock.Now()
+	msg.expiresAt = time.Time{}
+	if err := b.saveMessage(msg); err != nil {
+		b.log.Warnf("Dead lettering message %s without storing it (trace %s)", msg.id, msg.traceID)
+	}
+
+	dlq.messages = append(dlq.messages, msg)
+	b.queued(dlq, msg)
+	b.dispatch(dlq)
+}
+
+// Subscriptions
+
+// A new subscription to a queue is handed the messages already retained on
+// it straight away, oldest first, as far as fair dispatch credit and its
+// outbound queue allow. The rest follow as the subscriber acks and its
+// writer makes room, in the same order.
+func (b *broker) subscribe(c *conn, id string, destName string, opts subscribeOptions) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sub, ok := c.subscriptions[id]; ok {
+		if b.opts.IdempotentSubscribe && sub.matches(b.router, destName, opts) {
+			return nil
+		}
+		return fmt.Errorf("Subscription id %s is already in use", id)
+	}
+	if max := b.opts.MaxSubscriptions; max > 0 && len(c.subscriptions) >= max {
+		return limitError(fmt.Sprintf("Connections can have at most %d subscriptions", max))
+	}
+
+	dest := b.destination(destName)
+	if opts.group != "" {
+		if dest.kind != TOPIC {
+			return fmt.Errorf("Subscription groups are only supported on topics")
+		}
+		if opts.durable {
+			return fmt.Errorf("Subscriptions in a group cannot be durable")
+		}
+	}
+	if opts.durable {
+		return b.subscribeDurable(c, id, dest, opts)
+	}
+
+	sub := &subscription{id: id, conn: c, destination: dest, ackMode: opts.ackMode, overflow: opts.overflow, batchSize: opts.batchSize, group: opts.group, selector: opts.selector, accepts: opts.accepts}
+	c.subscriptions[id] = sub
+	c.outbox.setBatchSize(id, opts.batchSize)
+	dest.subscriptions = append(dest.subscriptions, sub)
+	b.dispatch(dest)
+	return nil
+}
+
+// Whether a SUBSCRIBE repeating an existing subscription's id asks for the
+// same subscription, e.g. from a client re-subscribing after resuming its
+// session, in which case the subscription carries on as it is
+func (sub *subscription) matches(router Router, destName string, opts subscribeOptions) bool {
+	_, normalized := router.Resolve(destName)
+	return sub.destination.name == normalized &&
+		sub.ackMode == opts.ackMode &&
+		sub.group == opts.group &&
+		sub.selector.String() == opts.selector.String() &&
+		sub.accepts.equal(opts.accepts) &&
+		(sub.durableKey != "") == opts.durable
+}
+
+// Durable subscriptions outlive the connection that created them. While
+// detached they retain every message published to their topic, which is
+// delivered as soon as the same client reattaches.
+func (b *broker) subscribeDurable(c *conn, id string, dest *destination, opts subscribeOptions) error {
+	if dest.kind != TOPIC {
+		return fmt.Errorf("Durable subscriptions are only supported on topics")
+	}
+	if c.clientID == "" {
+		return fmt.Errorf("Durable subscriptions require a client-id")
+	}
+
+	key := c.clientID + "/" + id
+	sub, ok := b.durables[key]
+	if ok && sub.destination != dest {
+		return fmt.Errorf("Durable subscription %s is bound to %s", id, sub.destination.name)
+	}
+	if !ok {
+		sub = &subscription{id: id, destination: dest, durableKey: key}
+		b.durables[key] = sub
+		dest.subscriptions = append(dest.subscriptions, sub)
+	}
+
+	// A session that took over this client-id may get here before the old
+	// session has finished detaching
+	if sub.conn != nil {
+		b.detachSubscription(sub)
+	}
+
+	sub.ackMode = opts.ackMode
+	sub.overflow = opts.overflow
+	sub.batchSize = opts.batchSize
+	sub.selector = opts.selector
+	sub.accepts = opts.accepts
+	sub.paused = false
+	b.attach(c, sub)
+	return nil
+}
+
+// Attach a detached subscription to a connection, delivering the messages
+// retained for it in the meantime. Queues only dispatch to attached
+// subscriptions, so one may have messages waiting for it too.
+func (b *broker) attach(c *conn, sub *subscription) {
+	sub.conn = c
+	c.subscriptions[sub.id] = sub
+	c.outbox.setBatchSize(sub.id, sub.batchSize)
+	c.outbox.setPaused(sub.id, sub.paused)
+
+	backlog := sub.backlog
+	sub.backlog = nil
+	now := b.clock.Now()
+	for _, msg := range backlog {
+		b.dequeued(sub.destination, msg)
+		if msg.expired(now) {
+			b.expire(msg)
+			continue
+		}
+		b.deliver(sub, msg)
+	}
+	if sub.destination.kind == QUEUE {
+		b.dispatch(sub.destination)
+	}
+}
+
+func (b *broker) unsubscribe(c *conn, id string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub, ok := c.subscriptions[id]
+	if !ok {
+		return fmt.Errorf("No subscription with id %s", id)
+	}
+
+	delete(c.subscriptions, id)
+	if sub.durableKey != "" {
+		delete(b.durables, sub.durableKey)
+	}
+	b.removeSubscription(sub)
+	return nil
+}
+
+// Pause or resume delivery to a subscription. Messages from a topic keep
+// being queued for it while paused, whereas queues hand their messages to
+// other subscribers instead.
+func (b *broker) setPaused(c *conn, id string, paused bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub, ok := c.subscriptions[id]
+	if !ok {
+		return fmt.Errorf("No subscription with id %s", id)
+	}
+
+	sub.paused = paused
+	c.outbox.setPaused(id, paused)
+	if !paused && sub.destination.kind == QUEUE {
+		b.dispatch(sub.destination)
+	}
+	return nil
+}
+
+// Detach all of a connection's subscriptions when it goes away. Durable
+// subscriptions, and every subscription of a session that can be resumed,
+// keep their unacked messages for redelivery. The rest are removed with
+// unacked queue messages returned to their queue.
+func (b *broker) detach(c *conn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	retain := c.resumeToken != "" && len(c.subscriptions) > 0
+	var retained []*subscription
+	for _, sub := range c.subscriptions {
+		if retain {
+			b.detachSubscription(sub)
+			retained = append(retained, sub)
+		} else if sub.durableKey != "" {
+			b.detachSubscription(sub)
+		} else {
+			b.removeSubscription(sub)
+		}
+	}
+	if retain {
+		b.retainSession(c, retained)
+	}
+}
+
+func (b *broker) detachSubscription(sub *subscription) {
+	delete(sub.conn.subscriptions, sub.id)
+	sub.conn.outbox.discard(sub.id)
+	sub.conn = nil
+
+	redeliveries := make([]*message, 0, sub.unacked.len()+len(sub.backlog))
+	for _, d := range sub.unacked.removeAll() {
+		d.stopTimer()
+		d.message.redeliveries++
+		redeliveries = append(redeliveries, d.message)
+		b.queued(sub.destination, d.message)
+	}
+	sub.backlog = append(redeliveries, sub.backlog...)
+}
+
+func (b *broker) removeSubscription(sub *subscription) {
+	if sub.conn != nil {
+		delete(sub.conn.subscriptions, sub.id)
+		sub.conn.outbox.discard(sub.id)
+		sub.conn = nil
+	}
+
+	dest := sub.destination
+	for i, candidate := range dest.subscriptions {
+		if candidate == sub {
+			dest.subscriptions = append(dest.subscriptions[:i], dest.subscriptions[i+1:]...)
+			break
+		}
+	}
+
+	unacked := sub.unacked.removeAll()
+	for _, d := range unacked {
+		d.stopTimer()
+	}
+	if sub.group != "" {
+		b.leaveGroup(sub, unacked)
+	}
+	if dest.kind == QUEUE {
+		requeued := make([]*message, 0, len(unacked)+len(dest.messages))
+		for _, d := range unacked {
+			d.message.redeliveries++
+			requeued = append(requeued, d.message)
+			b.queued(dest, d.message)
+		}
+		dest.messages = append(requeued, dest.messages...)
+		b.dispatch(dest)
+	}
+}
+
+// Hand the unacked messages of a subscription leaving its group to the
+// remaining members, forgetting the group's cursor if it was the last
+func (b *broker) leaveGroup(sub *subscription, unacked []delivery) {
+	dest := sub.destination
+	for _, other := range dest.subscriptions {
+		if other.group == sub.group {
+			for _, d := range unacked {
+				d.message.redeliveries++
+				b.deliverToGroup(dest, sub.group, d.message)
+			}
+			return
+		}
+	}
+	delete(dest.groupNext, sub.group)
+}
+
+// Acknowledgement
+
+// In client mode an ACK is cumulative, acknowledging every earlier delivery
+// on the same subscription, so acking the newest delivery clears them all.
+// In client-individual mode it only covers one. Acking a delivery that has
+// already been settled, whether directly or by a cumulative ACK for a later
+// one, does nothing. Only deliveries made to this connection can be acked,
+// and if the client names the subscription the delivery must belong to it.
+func (b *broker) ack(c *conn, ackID string, subID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub, err := c.findDelivery(ackID, subID)
+	if sub == nil {
+		return err
+	}
+
+	sub.active = b.clock.Now()
+	if sub.ackMode == ACK_CLIENT {
+		for _, d := range sub.unacked.removeThrough(ackID) {
+			d.stopTimer()
+			sub.settle(d.ackID)
+			sub.acked++
+			b.counters.of(d.message.destination).Acked++
+			b.forgetMessage(d.message)
+		}
+	} else {
+		d, _ := sub.unacked.remove(ackID)
+		d.stopTimer()
+		sub.settle(ackID)
+		sub.acked++
+		b.counters.of(d.message.destination).Acked++
+		b.forgetMessage(d.message)
+	}
+
+	// The ACK has given the subscription credit for messages held back
+	if b.opts.DispatchCredit > 0 && sub.destination.kind == QUEUE {
+		b.dispatch(sub.destination)
+	}
+	return nil
+}
+
+func (b *broker) nack(c *conn, ackID string, subID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sub, err := c.findDelivery(ackID, subID)
+	if sub == nil {
+		return err
+	}
+
+	sub.active = b.clock.Now()
+	d, _ := sub.unacked.remove(ackID)
+	d.stopTimer()
+	sub.settle(ackID)
+	b.redeliver(sub, d.message)
+	return nil
+}
+
+// Redeliver a delivery that wasn't acked in time. If the ACK arrives while
+// this is waiting for the lock the delivery will already be gone.
+func (b *broker) ackTimedOut(sub *subscription, ackID string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	d, ok := sub.unacked.remove(ackID)
+	if !ok {
+		return
+	}
+
+	b.log.Debugf("Message %s was not acked within %s, redelivering (trace %s)", d.message.id, b.opts.AckTimeout, d.message.traceID)
+	sub.settle(ackID)
+	b.redeliver(sub, d.message)
+}
+
+// Redeliver an unacked message, to another subscriber if it came from a
+// queue or another member of the subscription's group, or to the same
+// subscription if it came from a topic
+func (b *broker) redeliver(sub *subscription, msg *message) {
+	msg.redeliveries++
+
+	dest := sub.destination
+	if dest.kind == QUEUE {
+		dest.messages = append([]*message{msg}, dest.messages...)
+		b.queued(dest, msg)
+		b.dispatch(dest)
+	} else if sub.group != "" {
+		b.deliverToGroup(dest, sub.group, msg)
+	} else {
+		b.deliver(sub, msg)
+	}
+}
+
+// Close subscriptions whose unacked messages have gone the idle timeout
+// without an ACK or NACK, as happens when a connection is half dead. Their
+// messages are redelivered as if the connection had dropped: a durable
+// subscription is detached, keeping them for when its client resubscribes,
+// and any other is removed, returning them to their queue or group. The
+// client is then sent an ERROR naming the subscription and disconnected, so
+// its other subscriptions are closed the same way.
+func (b *broker) reclaimIdle(timeout time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	cutoff := b.clock.Now().Add(-timeout)
+	for _, dest := range b.destinations {
+		var idle []*subscription
+		for _, sub := range dest.subscriptions {
+			if sub.conn != nil && sub.unacked.len() > 0 && sub.active.Before(cutoff) {
+				idle = append(idle, sub)
+			}
+		}
+
+		for _, sub := range idle {
+			c := sub.conn
+			b.log.Warnf("Subscription %s of session %s has not acked for %s, closing it", sub.id, c.sessionID, timeout)
+			if sub.durableKey != "" {
+				b.detachSubscription(sub)
+			} else {
+				b.removeSubscription(sub)
+			}
+
+			frame := parsing.ErrorFrame(fmt.Sprintf("Subscription %s closed after not acking for %s, its messages will be redelivered", sub.id, timeout), nil)
+			frame.Headers[parsing.HEADER_SUBSCRIPTION] = sub.id
+			c.send(frame)
+			c.outbox.close()
+		}
+	}
+}
+
+// Find an outstanding delivery to one of the connection's subscriptions. A
+// nil subscription with no error means the ack id belonged to a delivery
+// which has already been settled, so should be ignored. Messages delivered
+// in auto mode count as acked already, so acking them is an error.
+func (c *conn) findDelivery(ackID string, subID string) (*subscription, error) {
+	if sub, ok := c.subscriptions[subID]; ok && subID != "" && sub.ackMode == ACK_AUTO {
+		return nil, fmt.Errorf("Subscription %s is in auto ack mode, its messages can't be acked or nacked", subID)
+	}
+
+	for _, sub := range c.subscriptions {
+		if !sub.unacked.contains(ackID) {
+			continue
+		}
+		if subID != "" && subID != sub.id {
+			return nil, fmt.Errorf("Ack id %s does not belong to subscription %s", ackID, subID)
+		}
+		return sub, nil
+	}
+
+	auto := len(c.subscriptions) > 0
+	for _, sub := range c.subscriptions {
+		for _, settled := range sub.settled {
+			if settled == ackID {
+				return nil, nil
+			}
+		}
+		auto = auto && sub.ackMode == ACK_AUTO
+	}
+	if auto {
+		return nil, fmt.Errorf("Messages delivered in auto ack mode can't be acked or nacked")
+	}
+	return nil, fmt.Errorf("No outstanding message with ack id %s", ackID)
+}
+
+// Remember that an ack id has been dealt with, forgetting the oldest once
+// there are more than SETTLED_ACK_MEMORY
+func (sub *subscription) settle(ackID string) {
+	sub.settled = append(sub.settled, ackID)
+	if len(sub.settled) > SETTLED_ACK_MEMORY {
+		sub.settled = sub.settled[1:]
+	}
+}
+
+func (d delivery) stopTimer() {
+	if d.timer != nil {
+		d.timer.Stop()
+	}
+}
+
+// Memory accounting
+// Messages waiting on a queue, or in the backlog of a detached subscription,
+// are counted against their destination by the size of their headers and
+// body. A topic message held for several subscriptions counts once for each.
+
+func (b *broker) queued(dest *destination, msg *message) {
+	size := int64(msg.size())
+	dest.queuedBytes += size
+	b.queuedBytes += size
+}
+
+func (b *broker) dequeued(dest *destination, msg *message) {
+	size := int64(msg.size())
+	dest.queuedBytes -= size
+	b.queuedBytes -= size
+}
+
+// Bytes taken up by a frame's header keys and values and its body
+func sizeOf(frame parsing.Frame) int {
+	size := len(frame.Body)
+	for key, value := range frame.Headers {
+		size += len(key) + len(value)
+	}
+	return size
+}
+
+// A message's headers aren't changed while it is retained, so its size is
+// the same when it's dequeued as when it was queued
+func (msg *message) size() int {
+	return sizeOf(parsing.Frame{Headers: msg.headers, Body: msg.body})
+}
+
+// Helpers
+
+// Look up a destination by any name the router resolves to it, creating it
+// on first use
+func (b *broker) destination(name string) *destination {
+	kind, normalized := b.router.Resolve(name)
+	dest, ok := b.destinations[normalized]
+	if !ok {
+		dest = &destination{name: normalized, kind: kind}
+		b.destinations[normalized] = dest
+	}
+	return dest
+}
+
+// Trace ids are random rather than counted, so that they stay unique
+// across servers and restarts
+func (b *broker) newTraceID() string {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return b.nextID("trace")
+	}
+	return hex.EncodeToString(id)
+}
+
+// Sequence numbers count up across every destination in the order messages
+// are routed, so comparing them shows how deliveries to different consumers
+// were ordered. Messages refused by a full queue don't get one.
+func (b *broker) nextSeq() uint64 {
+	return atomic.AddUint64(&b.seqCounter, 1)
+}
+
+func (b *broker) nextID(prefix string) string {
+	return fmt.Sprintf("%s-%d", prefix, atomic.AddUint64(&b.idCounter, 1))
+}
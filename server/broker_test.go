@@ -0,0 +1,1426 @@
+package server_test
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+// Queues
+
+func TestQueueDelivery(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "x-custom": "value"}, "hello")
+
+	frame := consumer.expectMessage("hello")
+	if frame.Headers["destination"] != "/queue/a" || frame.Headers["subscription"] != "0" {
+		t.Errorf("MESSAGE should reference its destination and subscription, got %v", frame.Headers)
+	}
+	if frame.Headers["message-id"] == "" {
+		t.Errorf("MESSAGE should have a message-id")
+	}
+	if frame.Headers["x-custom"] != "value" {
+		t.Errorf("MESSAGE should carry the SEND frame's custom headers")
+	}
+	if _, ok := frame.Headers["receipt"]; ok {
+		t.Errorf("MESSAGE should not carry the SEND frame's receipt header")
+	}
+}
+
+func TestSendToNewQueueRetained(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/new", "hello")
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/new", "0", nil)
+	consumer.expectMessage("hello")
+}
+
+func TestRetainedMessagesDeliveredInOrderOnSubscribe(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	for i := 0; i < 5; i++ {
+		producer.publish("/queue/a", strconv.Itoa(i))
+	}
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+	for i := 0; i < 5; i++ {
+		consumer.expectMessage(strconv.Itoa(i))
+	}
+	consumer.expectNoFrame()
+}
+
+func TestRetainedMessagesRespectCreditOnSubscribe(t *testing.T) {
+	_, addr := startServer(t, server.Options{DispatchCredit: 2})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	for i := 0; i < 5; i++ {
+		producer.publish("/queue/a", strconv.Itoa(i))
+	}
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+	first := consumer.expectMessage("0")
+	consumer.expectMessage("1")
+	consumer.expectNoFrame()
+
+	consumer.request(parsing.ACK, map[string]string{"id": first.Headers["ack"]}, "")
+	consumer.expectMessage("2")
+	consumer.expectNoFrame()
+}
+
+// Auto ack has no credit to stop at, so the outbound queue bounds how much
+// of the backlog is handed over at once, and its overflow policy can't drop
+// any of it
+func TestRetainedMessagesRespectOutboundQueueOnSubscribe(t *testing.T) {
+	_, addr := startServer(t, server.Options{OutboundQueueSize: 2})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	for i := 0; i < 20; i++ {
+		producer.publish("/queue/a", strconv.Itoa(i))
+	}
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"overflow-policy": "drop-newest"})
+	for i := 0; i < 20; i++ {
+		consumer.expectMessage(strconv.Itoa(i))
+	}
+	consumer.expectNoFrame()
+}
+
+func TestMessageHeaderNames(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "sub-0", map[string]string{"ack": "client"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "content-type": "text/plain"}, "hello")
+
+	frame := consumer.expectMessage("hello")
+	expected := map[string]bool{
+		"destination":  true,
+		"message-id":   true,
+		"subscription": true,
+		"ack":          true,
+		"content-type": true,
+		"x-trace-id":   true,
+	}
+	for name := range frame.Headers {
+		if !expected[name] {
+			t.Errorf("MESSAGE has unexpected header %q", name)
+		}
+		delete(expected, name)
+	}
+	for name := range expected {
+		t.Errorf("MESSAGE is missing the %q header", name)
+	}
+}
+
+func TestDefaultContentType(t *testing.T) {
+	_, addr := startServer(t, server.Options{DefaultContentType: "text/plain;charset=utf-8"})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "content-type": "application/json"}, "{}")
+	producer.publish("/queue/a", "")
+
+	if frame := consumer.expectMessage("hello"); frame.Headers["content-type"] != "text/plain;charset=utf-8" {
+		t.Errorf("Untyped body should get the default content type, got %q", frame.Headers["content-type"])
+	}
+	if frame := consumer.expectMessage("{}"); frame.Headers["content-type"] != "application/json" {
+		t.Errorf("Explicit content type should be kept, got %q", frame.Headers["content-type"])
+	}
+	if frame := consumer.expectMessage(""); frame.Headers["content-type"] != "" {
+		t.Errorf("Empty body should not get a content type, got %q", frame.Headers["content-type"])
+	}
+}
+
+func TestNoDefaultContentType(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+
+	if frame := consumer.expectMessage("hello"); frame.Headers["content-type"] != "" {
+		t.Errorf("Content type should not be added by default, got %q", frame.Headers["content-type"])
+	}
+}
+
+func TestBodyWithNullBytesDelivered(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a"}, "a\x00b\x00")
+
+	if frame := consumer.expectMessage("a\x00b\x00"); frame.Headers["content-length"] != "4" {
+		t.Errorf("Message with null bytes should carry its content-length, got %q", frame.Headers["content-length"])
+	}
+}
+
+func TestQueueRoundRobin(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	first := dial(t, addr)
+	first.connect(nil)
+	first.subscribe("/queue/a", "0", nil)
+
+	second := dial(t, addr)
+	second.connect(nil)
+	second.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "1")
+	producer.publish("/queue/a", "2")
+
+	first.expectMessage("1")
+	second.expectMessage("2")
+	first.expectNoFrame()
+}
+
+func TestFairDispatchFavoursFasterConsumer(t *testing.T) {
+	_, addr := startServer(t, server.Options{DispatchCredit: 1})
+
+	slow := dial(t, addr)
+	slow.connect(nil)
+	slow.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+
+	fast := dial(t, addr)
+	fast.connect(nil)
+	fast.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	for i := 0; i < 10; i++ {
+		producer.publish("/queue/a", strconv.Itoa(i))
+	}
+
+	// The slow consumer never acks, so holds on to its one message
+	fastCount := 0
+	for fastCount < 9 {
+		frame := fast.expectFrame(parsing.MESSAGE)
+		fast.request(parsing.ACK, map[string]string{"id": frame.Headers["ack"]}, "")
+		fastCount++
+	}
+	slow.expectFrame(parsing.MESSAGE)
+	slow.expectNoFrame()
+	fast.expectNoFrame()
+}
+
+func TestNackRedelivers(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+
+	frame := consumer.expectMessage("hello")
+	consumer.request(parsing.NACK, map[string]string{"id": frame.Headers["ack"]}, "")
+
+	frame = consumer.expectMessage("hello")
+	if frame.Headers["redelivered"] != "true" {
+		t.Errorf("Redelivered message should be flagged as redelivered")
+	}
+	consumer.request(parsing.ACK, map[string]string{"id": frame.Headers["ack"]}, "")
+	consumer.expectNoFrame()
+}
+
+func TestRedeliveryCount(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+
+	frame := consumer.expectMessage("hello")
+	if _, ok := frame.Headers["redelivery-count"]; ok {
+		t.Errorf("First delivery should not carry a redelivery count")
+	}
+	for count := 1; count <= 2; count++ {
+		consumer.request(parsing.NACK, map[string]string{"id": frame.Headers["ack"]}, "")
+		frame = consumer.expectMessage("hello")
+		if frame.Headers["redelivery-count"] != fmt.Sprint(count) {
+			t.Errorf("Redelivery %d should be counted, got %q", count, frame.Headers["redelivery-count"])
+		}
+	}
+}
+
+func TestUnackedRequeuedOnDisconnect(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	first := dial(t, addr)
+	first.connect(nil)
+	first.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+
+	first.expectMessage("hello")
+	first.disconnect()
+
+	second := dial(t, addr)
+	second.connect(nil)
+	second.subscribe("/queue/a", "0", nil)
+	second.expectMessage("hello")
+}
+
+// Topics
+
+func TestTopicFanOut(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	first := dial(t, addr)
+	first.connect(nil)
+	first.subscribe("/topic/news", "0", nil)
+
+	second := dial(t, addr)
+	second.connect(nil)
+	second.subscribe("/topic/news", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/news", "hello")
+
+	first.expectMessage("hello")
+	second.expectMessage("hello")
+}
+
+func TestTopicWithoutSubscribersDrops(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/new", "hello")
+
+	subscriber := dial(t, addr)
+	subscriber.connect(nil)
+	subscriber.subscribe("/topic/new", "0", nil)
+	subscriber.expectNoFrame()
+}
+
+func TestTopicDeliveriesReported(t *testing.T) {
+	_, addr := startServer(t, server.Options{ReportTopicDeliveries: true})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.send("SEND\ndestination:/topic/a\nreceipt:empty\n\nhello\x00")
+	if frame := producer.expectFrame(parsing.RECEIPT); frame.Headers["x-delivered-to"] != "0" {
+		t.Errorf("Receipt should say nobody got the message, got %v", frame.Headers)
+	}
+
+	for _, id := range []string{"0", "1"} {
+		subscriber := dial(t, addr)
+		subscriber.connect(nil)
+		subscriber.subscribe("/topic/a", id, nil)
+	}
+	producer.send("SEND\ndestination:/topic/a\nreceipt:heard\n\nhello\x00")
+	if frame := producer.expectFrame(parsing.RECEIPT); frame.Headers["x-delivered-to"] != "2" {
+		t.Errorf("Receipt should count the subscribers, got %v", frame.Headers)
+	}
+
+	producer.send("SEND\ndestination:/queue/a\nreceipt:queued\n\nhello\x00")
+	if frame := producer.expectFrame(parsing.RECEIPT); frame.Headers["x-delivered-to"] != "" {
+		t.Errorf("Receipt for a queue should not report deliveries, got %v", frame.Headers)
+	}
+}
+
+// Tracing
+
+func TestTraceIDPropagated(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/topic/news", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/topic/news", "x-trace-id": "trace-123"}, "hello")
+
+	frame := consumer.expectMessage("hello")
+	if frame.Headers["x-trace-id"] != "trace-123" {
+		t.Errorf("MESSAGE should carry the trace id of its SEND, got %q", frame.Headers["x-trace-id"])
+	}
+}
+
+func TestTraceIDGenerated(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "1")
+	producer.publish("/queue/a", "2")
+
+	first := consumer.expectMessage("1").Headers["x-trace-id"]
+	second := consumer.expectMessage("2").Headers["x-trace-id"]
+	if first == "" || first == second {
+		t.Errorf("Messages sent without a trace id should each be given a new one, got %q and %q", first, second)
+	}
+}
+
+func TestSequenceHeader(t *testing.T) {
+	_, addr := startServer(t, server.Options{SequenceHeader: true})
+
+	queueConsumer := dial(t, addr)
+	queueConsumer.connect(nil)
+	queueConsumer.subscribe("/queue/a", "0", nil)
+
+	topicConsumer := dial(t, addr)
+	topicConsumer.connect(nil)
+	topicConsumer.subscribe("/topic/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	var last uint64
+	for i := 0; i < 3; i++ {
+		producer.publish("/queue/a", fmt.Sprint(i))
+		producer.publish("/topic/a", fmt.Sprint(i))
+
+		for _, frame := range []parsing.Frame{queueConsumer.expectMessage(fmt.Sprint(i)), topicConsumer.expectMessage(fmt.Sprint(i))} {
+			seq, err := strconv.ParseUint(frame.Headers["x-broker-seq"], 10, 64)
+			if err != nil || seq <= last {
+				t.Fatalf("Sequence numbers should increase across destinations, got %q after %d", frame.Headers["x-broker-seq"], last)
+			}
+			last = seq
+		}
+	}
+}
+
+// Persistence
+
+func TestPersistencePrefixes(t *testing.T) {
+	_, addr := startServer(t, server.Options{
+		PersistentPrefixes: []string{"/queue/orders/"},
+		TransientPrefixes:  []string{"/queue/metrics/", "/queue/orders/drafts/"},
+	})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	producer := dial(t, addr)
+	producer.connect(nil)
+
+	cases := []struct {
+		destination string
+		header      string
+		persistent  bool
+	}{
+		{"/queue/orders/new", "", true},
+		{"/queue/orders/new", "false", true},
+		{"/queue/metrics/cpu", "true", false},
+		{"/queue/orders/drafts/1", "true", false},
+		{"/queue/other", "true", true},
+		{"/queue/other", "", false},
+	}
+	for i, c := range cases {
+		id := fmt.Sprint(i)
+		consumer.subscribe(c.destination, id, nil)
+		headers := map[string]string{"destination": c.destination}
+		if c.header != "" {
+			headers["persistent"] = c.header
+		}
+		producer.request(parsing.SEND, headers, id)
+
+		frame := consumer.expectMessage(id)
+		if persistent := frame.Headers["persistent"] == "true"; persistent != c.persistent {
+			t.Errorf("Message to %s with persistent header %q should be persistent: %t, got %v", c.destination, c.header, c.persistent, frame.Headers)
+		}
+		consumer.request(parsing.UNSUBSCRIBE, map[string]string{"id": id}, "")
+	}
+}
+
+// Subscription groups
+
+func TestSubscriptionGroupRoundRobin(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+	group := map[string]string{"subscription-group": "workers"}
+
+	first := dial(t, addr)
+	first.connect(nil)
+	first.subscribe("/topic/jobs", "0", group)
+
+	second := dial(t, addr)
+	second.connect(nil)
+	second.subscribe("/topic/jobs", "0", group)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/jobs", "1")
+	producer.publish("/topic/jobs", "2")
+	producer.publish("/topic/jobs", "3")
+
+	first.expectMessage("1")
+	second.expectMessage("2")
+	first.expectMessage("3")
+	first.expectNoFrame()
+	second.expectNoFrame()
+}
+
+func TestSubscriptionGroupsFanOut(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	var workers, auditors []*testClient
+	for i := 0; i < 2; i++ {
+		worker := dial(t, addr)
+		worker.connect(nil)
+		worker.subscribe("/topic/jobs", "0", map[string]string{"subscription-group": "workers"})
+		workers = append(workers, worker)
+
+		auditor := dial(t, addr)
+		auditor.connect(nil)
+		auditor.subscribe("/topic/jobs", "0", map[string]string{"subscription-group": "auditors"})
+		auditors = append(auditors, auditor)
+	}
+	loner := dial(t, addr)
+	loner.connect(nil)
+	loner.subscribe("/topic/jobs", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/jobs", "1")
+	producer.publish("/topic/jobs", "2")
+
+	workers[0].expectMessage("1")
+	workers[1].expectMessage("2")
+	auditors[0].expectMessage("1")
+	auditors[1].expectMessage("2")
+	loner.expectMessage("1")
+	loner.expectMessage("2")
+	for _, client := range append(workers, auditors...) {
+		client.expectNoFrame()
+	}
+}
+
+func TestUnackedGroupMessagesHandedOver(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+	group := map[string]string{"subscription-group": "workers", "ack": "client"}
+
+	first := dial(t, addr)
+	first.connect(nil)
+	first.subscribe("/topic/jobs", "0", group)
+
+	second := dial(t, addr)
+	second.connect(nil)
+	second.subscribe("/topic/jobs", "0", group)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/jobs", "1")
+
+	first.expectMessage("1")
+	first.disconnect()
+
+	frame := second.expectMessage("1")
+	if frame.Headers["redelivered"] != "true" {
+		t.Errorf("Handed over message should be flagged as redelivered")
+	}
+}
+
+func TestSubscriptionGroupOnQueueRejected(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(nil)
+	subscriber.send("SUBSCRIBE\ndestination:/queue/a\nid:0\nsubscription-group:workers\n\n\x00")
+	subscriber.expectFrame(parsing.ERROR)
+	subscriber.expectClosed()
+}
+
+// Flow control
+
+func TestPauseHaltsDelivery(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(nil)
+	subscriber.subscribe("/topic/news", "0", nil)
+	subscriber.request(parsing.SEND, map[string]string{"destination": "/control/pause", "subscription": "0"}, "")
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/news", "first")
+	producer.publish("/topic/news", "second")
+	subscriber.expectNoFrame()
+
+	subscriber.request(parsing.SEND, map[string]string{"destination": "/control/resume", "subscription": "0"}, "")
+	subscriber.expectMessage("first")
+	subscriber.expectMessage("second")
+}
+
+// A paused subscription with a full outbound queue holds up its publisher,
+// under the default block policy, but nobody else
+func TestStalledSubscriberBlocksOnlyItsPublisher(t *testing.T) {
+	_, addr := startServer(t, server.Options{OutboundQueueSize: 1})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(nil)
+	subscriber.subscribe("/topic/news", "0", nil)
+	subscriber.request(parsing.SEND, map[string]string{"destination": "/control/pause", "subscription": "0"}, "")
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/news", "first")
+	producer.send("SEND\ndestination:/topic/news\nreceipt:blocked\n\nsecond\x00")
+	producer.expectNoFrame()
+
+	other := dial(t, addr)
+	other.connect(nil)
+	other.subscribe("/queue/a", "0", nil)
+	other.publish("/queue/a", "unrelated")
+	other.expectMessage("unrelated")
+
+	subscriber.request(parsing.SEND, map[string]string{"destination": "/control/resume", "subscription": "0"}, "")
+	subscriber.expectMessage("first")
+	subscriber.expectMessage("second")
+	if frame := producer.expectFrame(parsing.RECEIPT); frame.Headers["receipt-id"] != "blocked" {
+		t.Errorf("Publisher should be receipted once there is room, got %v", frame.Headers)
+	}
+}
+
+// Only the publisher's own reader could resume its paused subscription, so
+// it isn't made to wait for it
+func TestPublisherNotBlockedByOwnPausedSubscription(t *testing.T) {
+	_, addr := startServer(t, server.Options{OutboundQueueSize: 1})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.subscribe("/topic/news", "0", nil)
+	client.request(parsing.SEND, map[string]string{"destination": "/control/pause", "subscription": "0"}, "")
+	client.request(parsing.SEND, map[string]string{"destination": "/topic/news"}, "first")
+	client.request(parsing.SEND, map[string]string{"destination": "/topic/news"}, "second")
+
+	client.request(parsing.SEND, map[string]string{"destination": "/control/resume", "subscription": "0"}, "")
+	client.expectMessage("first")
+	client.expectMessage("second")
+}
+
+func TestCloseWithBlockedPublisher(t *testing.T) {
+	srv, addr := startServer(t, server.Options{OutboundQueueSize: 1})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(nil)
+	subscriber.subscribe("/topic/news", "0", nil)
+	subscriber.request(parsing.SEND, map[string]string{"destination": "/control/pause", "subscription": "0"}, "")
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/news", "first")
+	producer.send("SEND\ndestination:/topic/news\nreceipt:blocked\n\nsecond\x00")
+	producer.expectNoFrame()
+
+	closed := make(chan struct{})
+	go func() {
+		srv.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(FRAME_TIMEOUT):
+		t.Fatalf("Close should not wait on a blocked publisher")
+	}
+	producer.expectFrame(parsing.ERROR)
+	producer.expectClosed()
+}
+
+func TestPausedQueueSubscriberPassedOver(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	paused := dial(t, addr)
+	paused.connect(nil)
+	paused.subscribe("/queue/a", "0", nil)
+	paused.request(parsing.SEND, map[string]string{"destination": "/control/pause", "subscription": "0"}, "")
+
+	active := dial(t, addr)
+	active.connect(nil)
+	active.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "first")
+	producer.publish("/queue/a", "second")
+
+	active.expectMessage("first")
+	active.expectMessage("second")
+	paused.expectNoFrame()
+}
+
+// Content type filters
+
+func TestQueueContentTypeFilter(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	jsonConsumer := dial(t, addr)
+	jsonConsumer.connect(nil)
+	jsonConsumer.subscribe("/queue/a", "0", map[string]string{"accept-content-type": "application/json"})
+
+	textConsumer := dial(t, addr)
+	textConsumer.connect(nil)
+	textConsumer.subscribe("/queue/a", "0", map[string]string{"accept-content-type": "text/*"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "content-type": "image/png"}, "image")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "content-type": "application/json"}, "{}")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "content-type": "text/plain;charset=utf-8"}, "text")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "content-type": "Application/JSON"}, "[]")
+
+	jsonConsumer.expectMessage("{}")
+	jsonConsumer.expectMessage("[]")
+	textConsumer.expectMessage("text")
+	jsonConsumer.expectNoFrame()
+	textConsumer.expectNoFrame()
+
+	anyConsumer := dial(t, addr)
+	anyConsumer.connect(nil)
+	anyConsumer.subscribe("/queue/a", "0", nil)
+	anyConsumer.expectMessage("image")
+}
+
+func TestTopicContentTypeFilter(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	jsonConsumer := dial(t, addr)
+	jsonConsumer.connect(nil)
+	jsonConsumer.subscribe("/topic/a", "0", map[string]string{"accept-content-type": "application/json"})
+
+	textConsumer := dial(t, addr)
+	textConsumer.connect(nil)
+	textConsumer.subscribe("/topic/a", "0", map[string]string{"accept-content-type": "text/plain, */*"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/topic/a", "content-type": "application/json"}, "{}")
+	producer.publish("/topic/a", "")
+
+	jsonConsumer.expectMessage("{}")
+	textConsumer.expectMessage("{}")
+	textConsumer.expectMessage("")
+	jsonConsumer.expectNoFrame()
+}
+
+func TestInvalidContentTypeFilter(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(nil)
+	subscriber.send("SUBSCRIBE\ndestination:/queue/a\nid:0\naccept-content-type:json\n\n\x00")
+	subscriber.expectFrame(parsing.ERROR)
+	subscriber.expectClosed()
+}
+
+func TestPauseUnknownSubscription(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(nil)
+	subscriber.send("SEND\ndestination:/control/pause\nsubscription:missing\n\n\x00")
+	subscriber.expectFrame(parsing.ERROR)
+	subscriber.expectClosed()
+}
+
+// Durable subscriptions
+
+func TestDurableSubscriptionOfflineDelivery(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(map[string]string{"client-id": "reader"})
+	subscriber.subscribe("/topic/news", "d1", map[string]string{"durable": "true"})
+	subscriber.disconnect()
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/news", "first")
+	producer.publish("/topic/news", "second")
+
+	subscriber = dial(t, addr)
+	subscriber.connect(map[string]string{"client-id": "reader"})
+	subscriber.subscribe("/topic/news", "d1", map[string]string{"durable": "true"})
+
+	subscriber.expectMessage("first")
+	subscriber.expectMessage("second")
+}
+
+func TestDurableSubscriptionUnacked(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(map[string]string{"client-id": "reader"})
+	subscriber.subscribe("/topic/news", "d1", map[string]string{"durable": "true", "ack": "client"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/news", "first")
+
+	subscriber.expectMessage("first")
+	subscriber.disconnect()
+
+	subscriber = dial(t, addr)
+	subscriber.connect(map[string]string{"client-id": "reader"})
+	subscriber.subscribe("/topic/news", "d1", map[string]string{"durable": "true", "ack": "client"})
+
+	frame := subscriber.expectMessage("first")
+	if frame.Headers["redelivered"] != "true" {
+		t.Errorf("Unacked message should be flagged as redelivered")
+	}
+}
+
+func TestDurableSubscriptionDeleted(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(map[string]string{"client-id": "reader"})
+	subscriber.subscribe("/topic/news", "d1", map[string]string{"durable": "true"})
+	subscriber.request(parsing.UNSUBSCRIBE, map[string]string{"id": "d1"}, "")
+	subscriber.disconnect()
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/news", "missed")
+
+	subscriber = dial(t, addr)
+	subscriber.connect(map[string]string{"client-id": "reader"})
+	subscriber.subscribe("/topic/news", "d1", map[string]string{"durable": "true"})
+	subscriber.expectNoFrame()
+}
+
+func TestNonDurableSubscriptionDropsOfflineMessages(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(map[string]string{"client-id": "reader"})
+	subscriber.subscribe("/topic/news", "s1", nil)
+	subscriber.disconnect()
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/news", "missed")
+
+	subscriber = dial(t, addr)
+	subscriber.connect(map[string]string{"client-id": "reader"})
+	subscriber.subscribe("/topic/news", "s1", nil)
+	subscriber.expectNoFrame()
+}
+
+func TestDurableSubscriptionRequiresClientID(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(nil)
+	subscriber.send("SUBSCRIBE\ndestination:/topic/news\nid:d1\ndurable:true\n\n\x00")
+	subscriber.expectFrame(parsing.ERROR)
+	subscriber.expectClosed()
+}
+
+func TestUnknownOverflowPolicy(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	subscriber := dial(t, addr)
+	subscriber.connect(nil)
+	subscriber.send("SUBSCRIBE\ndestination:/queue/a\nid:0\noverflow-policy:explode\n\n\x00")
+	subscriber.expectFrame(parsing.ERROR)
+	subscriber.expectClosed()
+}
+
+// Queue limits
+
+func TestSendToFullQueueRefused(t *testing.T) {
+	_, addr := startServer(t, server.Options{MaxQueueBytes: 200})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a"}, strings.Repeat("x", 80))
+
+	producer.sendFrame(parsing.Frame{
+		Command: parsing.SEND,
+		Headers: map[string]string{"destination": "/queue/a", "receipt": "overloaded"},
+		Body:    []byte(strings.Repeat("x", 80)),
+	})
+	frame := producer.expectFrame(parsing.ERROR)
+	if frame.Headers["receipt-id"] != "overloaded" || !strings.Contains(frame.Headers["message"], "full") {
+		t.Errorf("SEND to a full queue should get an ERROR for its receipt, got %v", frame.Headers)
+	}
+	producer.expectClosed()
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+	consumer.expectMessage(strings.Repeat("x", 80))
+	consumer.expectNoFrame()
+}
+
+func TestSendQuota(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{Clock: clock, SendQuota: 2, SendQuotaWindow: time.Minute})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "1")
+	clock.Advance(30 * time.Second)
+	producer.publish("/queue/a", "2")
+
+	// The first message drops out of the window, making room for one more
+	clock.Advance(30 * time.Second)
+	producer.publish("/queue/a", "3")
+
+	producer.send("SEND\ndestination:/queue/a\nreceipt:over\n\n4\x00")
+	frame := producer.expectFrame(parsing.ERROR)
+	if frame.Headers["receipt-id"] != "over" || !strings.Contains(frame.Headers["message"], "quota") {
+		t.Errorf("SEND over the quota should get an ERROR for its receipt, got %v", frame.Headers)
+	}
+	producer.expectClosed()
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+	for _, body := range []string{"1", "2", "3"} {
+		consumer.expectMessage(body)
+	}
+	consumer.expectNoFrame()
+}
+
+// Eviction
+
+func TestMaxMessageAgeEviction(t *testing.T) {
+	maxAge := 50 * time.Millisecond
+	_, addr := startServer(t, server.Options{MaxMessageAge: maxAge})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "stale")
+
+	time.Sleep(4 * maxAge)
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+	consumer.expectNoFrame()
+}
+
+func TestMaxMessageAgeDeadLetter(t *testing.T) {
+	_, addr := startServer(t, server.Options{MaxMessageAge: 50 * time.Millisecond, DeadLetterQueue: "/queue/dlq"})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/dlq", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "stale")
+
+	frame := consumer.expectMessage("stale")
+	if frame.Headers["original-destination"] != "/queue/a" {
+		t.Errorf("Dead lettered message should record its original destination")
+	}
+}
+
+func TestConsumedMessagesNotEvicted(t *testing.T) {
+	maxAge := 50 * time.Millisecond
+	_, addr := startServer(t, server.Options{MaxMessageAge: maxAge, DeadLetterQueue: "/queue/dlq"})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+	consumer.subscribe("/queue/dlq", "1", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "fresh")
+
+	consumer.expectMessage("fresh")
+	time.Sleep(4 * maxAge)
+	consumer.expectNoFrame()
+}
+
+// Expiry
+
+func TestTTLExpiry(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{DeadLetterQueue: "/queue/dlq", Clock: clock})
+
+	deadLetters := dial(t, addr)
+	deadLetters.connect(nil)
+	deadLetters.subscribe("/queue/dlq", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "ttl": "50"}, "short lived")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "ttl": "60000"}, "long lived")
+	clock.Advance(100 * time.Millisecond)
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+
+	frame := consumer.expectMessage("long lived")
+	if frame.Headers["expires"] == "" {
+		t.Errorf("Message with a ttl should carry its absolute expiry")
+	}
+	consumer.expectNoFrame()
+
+	frame = deadLetters.expectMessage("short lived")
+	if frame.Headers["original-destination"] != "/queue/a" {
+		t.Errorf("Expired message should record its original destination")
+	}
+}
+
+func TestTTLAndExpiresEarliestWins(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{Clock: clock})
+
+	now := clock.Now().UnixNano() / int64(time.Millisecond)
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{
+		"destination": "/queue/a",
+		"ttl":         "50",
+		"expires":     fmt.Sprint(now + 60000),
+	}, "ttl first")
+	producer.request(parsing.SEND, map[string]string{
+		"destination": "/queue/a",
+		"ttl":         "60000",
+		"expires":     fmt.Sprint(now + 50),
+	}, "expires first")
+	producer.request(parsing.SEND, map[string]string{
+		"destination": "/queue/a",
+		"ttl":         "60000",
+		"expires":     fmt.Sprint(now + 60000),
+	}, "neither")
+	clock.Advance(100 * time.Millisecond)
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+	consumer.expectMessage("neither")
+	consumer.expectNoFrame()
+}
+
+func TestInvalidTTL(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.send("SEND\ndestination:/queue/a\nttl:soon\n\n\x00")
+	producer.expectFrame(parsing.ERROR)
+	producer.expectClosed()
+}
+
+// Delayed delivery
+
+func TestDeliverAfter(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{Clock: clock})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "deliver-after": "1000"}, "later")
+	producer.publish("/queue/a", "now")
+
+	consumer.expectMessage("now")
+	clock.Advance(999 * time.Millisecond)
+	consumer.expectNoFrame()
+
+	clock.Advance(time.Millisecond)
+	frame := consumer.expectMessage("later")
+	if _, ok := frame.Headers["deliver-after"]; ok {
+		t.Errorf("Delivered message should not carry the deliver-after header")
+	}
+}
+
+func TestDelayedMessageExpires(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{Clock: clock})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/topic/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/topic/a", "deliver-after": "1000", "ttl": "500"}, "stale")
+
+	clock.Advance(time.Second)
+	consumer.expectNoFrame()
+}
+
+func TestScheduledMessagesDiscardedOnClose(t *testing.T) {
+	logs := &recordingLogger{}
+	srv, addr := startServer(t, server.Options{Clock: server.NewFakeClock(), Logger: logs})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "deliver-after": "1000"}, "later")
+
+	srv.Close()
+	logged := false
+	for _, line := range logs.warns() {
+		logged = logged || strings.Contains(line, "Discarded 1 scheduled messages")
+	}
+	if !logged {
+		t.Errorf("Closing the server should log the scheduled messages it discards, got %v", logs.warns())
+	}
+}
+
+// Requeue on shutdown
+
+func TestUnackedRequeuedOnClose(t *testing.T) {
+	srv, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "unacked")
+	consumer.expectMessage("unacked")
+	if queued := srv.Metrics().DestinationQueuedBytes["/queue/a"]; queued != 0 {
+		t.Fatalf("Delivered message should no longer be queued, got %d bytes", queued)
+	}
+
+	srv.Close()
+	if queued := srv.Metrics().DestinationQueuedBytes["/queue/a"]; queued == 0 {
+		t.Errorf("Unacked message should be back on its queue once the server has closed")
+	}
+	consumer.expectFrame(parsing.ERROR)
+	consumer.expectClosed()
+}
+
+func TestInvalidDeliverAfter(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.send("SEND\ndestination:/queue/a\ndeliver-after:-5\n\n\x00")
+	producer.expectFrame(parsing.ERROR)
+	producer.expectClosed()
+}
+
+// Ack validation
+
+func TestAckWithSubscription(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+
+	frame := consumer.expectMessage("hello")
+	consumer.request(parsing.ACK, map[string]string{"id": frame.Headers["ack"], "subscription": "0"}, "")
+}
+
+func TestCumulativeAck(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	for _, body := range []string{"1", "2", "3"} {
+		producer.publish("/queue/a", body)
+	}
+	consumer.expectMessage("1")
+	second := consumer.expectMessage("2")
+	consumer.expectMessage("3")
+	consumer.request(parsing.ACK, map[string]string{"id": second.Headers["ack"]}, "")
+	consumer.disconnect()
+
+	// Only the message after the acked one is still outstanding
+	other := dial(t, addr)
+	other.connect(nil)
+	other.subscribe("/queue/a", "0", nil)
+	other.expectMessage("3")
+	other.expectNoFrame()
+}
+
+func TestAckNewestClearsAll(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	for _, body := range []string{"1", "2", "3"} {
+		producer.publish("/queue/a", body)
+	}
+	first := consumer.expectMessage("1")
+	consumer.expectMessage("2")
+	third := consumer.expectMessage("3")
+	consumer.request(parsing.ACK, map[string]string{"id": third.Headers["ack"]}, "")
+
+	// Out of order and duplicate acks for settled deliveries are ignored
+	consumer.request(parsing.ACK, map[string]string{"id": first.Headers["ack"]}, "")
+	consumer.request(parsing.ACK, map[string]string{"id": third.Headers["ack"]}, "")
+	consumer.disconnect()
+
+	other := dial(t, addr)
+	other.connect(nil)
+	other.subscribe("/queue/a", "0", nil)
+	other.expectNoFrame()
+}
+
+func TestDuplicateIndividualAckIgnored(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+	consumer.publish("/queue/a", "hello")
+
+	frame := consumer.expectMessage("hello")
+	consumer.request(parsing.ACK, map[string]string{"id": frame.Headers["ack"]}, "")
+	consumer.request(parsing.ACK, map[string]string{"id": frame.Headers["ack"]}, "")
+}
+
+func TestAckUnknownIDRejected(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+	consumer.sendFrame(parsing.Frame{Command: parsing.ACK, Headers: map[string]string{"id": "no-such-ack"}, Body: []byte{}})
+	frame := consumer.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "No outstanding message") {
+		t.Errorf("Error should say there's no such delivery, got %q", frame.Headers["message"])
+	}
+	consumer.expectClosed()
+}
+
+func TestAckInAutoModeRejected(t *testing.T) {
+	for _, command := range []parsing.CommandType{parsing.ACK, parsing.NACK} {
+		_, addr := startServer(t, server.Options{})
+
+		consumer := dial(t, addr)
+		consumer.connect(nil)
+		consumer.subscribe("/queue/a", "0", nil)
+
+		producer := dial(t, addr)
+		producer.connect(nil)
+		producer.publish("/queue/a", "hello")
+
+		frame := consumer.expectMessage("hello")
+		consumer.sendFrame(parsing.Frame{Command: command, Headers: map[string]string{"id": frame.Headers["message-id"], "subscription": "0"}, Body: []byte{}})
+		frame = consumer.expectFrame(parsing.ERROR)
+		if !strings.Contains(frame.Headers["message"], "auto") {
+			t.Errorf("%s in auto mode should be rejected for it, got %q", command, frame.Headers["message"])
+		}
+		consumer.expectClosed()
+	}
+}
+
+func TestForeignAckRejected(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+	frame := consumer.expectMessage("hello")
+
+	spoofer := dial(t, addr)
+	spoofer.connect(nil)
+	spoofer.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+	spoofer.sendFrame(parsing.Frame{Command: parsing.ACK, Headers: map[string]string{"id": frame.Headers["ack"]}, Body: []byte{}})
+	spoofer.expectFrame(parsing.ERROR)
+	spoofer.expectClosed()
+
+	// The delivery is still outstanding for the connection it was made to
+	consumer.request(parsing.ACK, map[string]string{"id": frame.Headers["ack"]}, "")
+}
+
+func TestAckForWrongSubscriptionRejected(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+	consumer.subscribe("/queue/b", "1", map[string]string{"ack": "client"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+
+	frame := consumer.expectMessage("hello")
+	consumer.sendFrame(parsing.Frame{Command: parsing.ACK, Headers: map[string]string{"id": frame.Headers["ack"], "subscription": "1"}, Body: []byte{}})
+	consumer.expectFrame(parsing.ERROR)
+	consumer.expectClosed()
+}
+
+// Ack timeouts
+
+func TestAckBeforeTimeout(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{AckTimeout: time.Minute, Clock: clock})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+
+	frame := consumer.expectMessage("hello")
+	consumer.request(parsing.ACK, map[string]string{"id": frame.Headers["ack"]}, "")
+
+	clock.Advance(2 * time.Minute)
+	consumer.expectNoFrame()
+}
+
+func TestAckAfterTimeout(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{AckTimeout: time.Minute, Clock: clock})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+
+	first := consumer.expectMessage("hello")
+	clock.Advance(time.Minute - time.Millisecond)
+	consumer.expectNoFrame()
+
+	clock.Advance(time.Millisecond)
+	second := consumer.expectMessage("hello")
+	if second.Headers["redelivered"] != "true" {
+		t.Errorf("Timed out message should be flagged as redelivered")
+	}
+	if first.Headers["ack"] == second.Headers["ack"] {
+		t.Errorf("Redelivery should have a new ack id")
+	}
+
+	// The late ack for the first delivery is ignored rather than an error
+	consumer.request(parsing.ACK, map[string]string{"id": first.Headers["ack"]}, "")
+	consumer.request(parsing.ACK, map[string]string{"id": second.Headers["ack"]}, "")
+}
+
+func TestAckTimeoutRedeliversToAnotherConsumer(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{AckTimeout: time.Minute, Clock: clock})
+
+	stalled := dial(t, addr)
+	stalled.connect(nil)
+	stalled.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+	stalled.expectMessage("hello")
+
+	healthy := dial(t, addr)
+	healthy.connect(nil)
+	healthy.subscribe("/queue/a", "0", nil)
+
+	clock.Advance(time.Minute)
+	frame := healthy.expectMessage("hello")
+	if frame.Headers["redelivered"] != "true" {
+		t.Errorf("Timed out message should be flagged as redelivered")
+	}
+}
+
+// Idle subscriptions
+
+func TestIdleSubscriptionReclaimed(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{SubscriptionIdleTimeout: time.Minute, Clock: clock})
+
+	stalled := dial(t, addr)
+	stalled.connect(nil)
+	stalled.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+	stalled.expectMessage("hello")
+
+	healthy := dial(t, addr)
+	healthy.connect(nil)
+	healthy.subscribe("/queue/a", "0", nil)
+
+	clock.Advance(2 * time.Minute)
+	frame := healthy.expectMessage("hello")
+	if frame.Headers["redelivered"] != "true" {
+		t.Errorf("Reclaimed message should be flagged as redelivered")
+	}
+	if frame := stalled.expectFrame(parsing.ERROR); frame.Headers["subscription"] != "0" {
+		t.Errorf("Client should be told which subscription was closed, got %v", frame.Headers)
+	}
+
+	stalled.expectClosed()
+
+	// The idle subscription is gone, so everything goes to the other
+	producer.publish("/queue/a", "next")
+	healthy.expectMessage("next")
+}
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+)
+
+// Client certificates
+// With Options.TLSClientCAFile set, clients connecting over TLS can
+// authenticate with a certificate signed by one of its CAs instead of a login
+// and passcode. The common name of the certificate's subject becomes the
+// session's principal, as a login would, so it is what Options.AdminLogins
+// and the audit log go by. A verified certificate takes precedence over any
+// login in the CONNECT frame, and the Authenticator isn't consulted. Unless
+// Options.TLSRequireClientCert is set, clients without a certificate can
+// still connect and authenticate as usual.
+
+// Have the TLS handshake ask for, and verify, client certificates
+func configureClientAuth(config *tls.Config, opts Options) error {
+	pem, err := ioutil.ReadFile(opts.TLSClientCAFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS client CAs: %s", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return fmt.Errorf("loading TLS client CAs: no certificates found in %s", opts.TLSClientCAFile)
+	}
+
+	config.ClientCAs = pool
+	config.ClientAuth = tls.VerifyClientCertIfGiven
+	if opts.TLSRequireClientCert {
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return nil
+}
+
+// The principal named by the client's verified certificate, if it has one.
+// The handshake is over by the time a CONNECT frame has been read.
+func (c *conn) certificatePrincipal() (string, bool) {
+	netConn := c.netConn
+	if compressed, ok := netConn.(*compressionConn); ok {
+		netConn = compressed.Conn
+	}
+	tlsConn, ok := netConn.(*tls.Conn)
+	if !ok {
+		return "", false
+	}
+
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 || len(chains[0]) == 0 {
+		return "", false
+	}
+	name := chains[0][0].Subject.CommonName
+	return name, name != ""
+}
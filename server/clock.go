@@ -0,0 +1,28 @@
+package server
+
+import "time"
+
+// Clock
+// Ack timeouts, message expiry, eviction, session retention, sending
+// heart-beats and the accept backoff all read the time through a Clock, so
+// that tests can move it forward deterministically instead of sleeping.
+// Socket deadlines are enforced by the OS and always use the real time.
+
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is a pending call scheduled with Clock.AfterFunc
+type Timer interface {
+	// Stop cancels the call, returning false if it has already happened
+	Stop() bool
+}
+
+// The clock used unless Options.Clock says otherwise
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                            { return time.Now() }
+func (systemClock) After(d time.Duration) <-chan time.Time    { return time.After(d) }
+func (systemClock) AfterFunc(d time.Duration, f func()) Timer { return time.AfterFunc(d, f) }
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// FakeClock only moves when told to, firing any timers that come due. It is
+// exported so that the external tests can pass it in Options.
+type FakeClock struct {
+	mu      sync.Mutex
+	changed *sync.Cond // Signalled when a timer is added
+	now     time.Time
+	timers  []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *FakeClock
+	at    time.Time
+	f     func()
+}
+
+func NewFakeClock() *FakeClock {
+	clock := &FakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	clock.changed = sync.NewCond(&clock.mu)
+	return clock
+}
+
+func (clock *FakeClock) Now() time.Time {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return clock.now
+}
+
+func (clock *FakeClock) After(d time.Duration) <-chan time.Time {
+	ch := make(chan time.Time, 1)
+	clock.AfterFunc(d, func() { ch <- clock.Now() })
+	return ch
+}
+
+func (clock *FakeClock) AfterFunc(d time.Duration, f func()) Timer {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	timer := &fakeTimer{clock: clock, at: clock.now.Add(d), f: f}
+	clock.timers = append(clock.timers, timer)
+	clock.changed.Broadcast()
+	return timer
+}
+
+// BlockUntil waits for there to be at least n pending timers, so that a test
+// can be sure whatever it is waiting on has started its timer before
+// advancing the clock
+func (clock *FakeClock) BlockUntil(n int) {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	for len(clock.timers) < n {
+		clock.changed.Wait()
+	}
+}
+
+// Pending is the number of timers waiting to fire
+func (clock *FakeClock) Pending() int {
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+	return len(clock.timers)
+}
+
+// Advance moves the clock forward, calling the functions of timers that come
+// due in the order they were due
+func (clock *FakeClock) Advance(d time.Duration) {
+	clock.mu.Lock()
+	clock.now = clock.now.Add(d)
+	var due, pending []*fakeTimer
+	for _, timer := range clock.timers {
+		if timer.at.After(clock.now) {
+			pending = append(pending, timer)
+		} else {
+			due = append(due, timer)
+		}
+	}
+	clock.timers = pending
+	clock.mu.Unlock()
+
+	sort.SliceStable(due, func(i, j int) bool { return due[i].at.Before(due[j].at) })
+	for _, timer := range due {
+		timer.f()
+	}
+}
+
+func (timer *fakeTimer) Stop() bool {
+	clock := timer.clock
+	clock.mu.Lock()
+	defer clock.mu.Unlock()
+
+	for i, candidate := range clock.timers {
+		if candidate == timer {
+			clock.timers = append(clock.timers[:i], clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"bufio"
+	"compress/gzip"
+	"io"
+	"net"
+	"sync"
+)
+
+// Compression
+// When Options.Compression is set a client can opt into gzip by compressing
+// everything it sends, starting with its CONNECT frame. The server tells from
+// the gzip magic number at the start of the stream, which no STOMP frame can
+// begin with, and then compresses everything it sends back too. Connections
+// that start uncompressed stay that way.
+
+var GZIP_MAGIC = []byte{0x1f, 0x8b}
+
+type compressionConn struct {
+	net.Conn
+	buffered *bufio.Reader
+
+	mu     sync.Mutex
+	reader io.Reader    // Nil until the start of the stream has been seen
+	writer *gzip.Writer // Nil unless the client compresses
+}
+
+func newCompressionConn(netConn net.Conn) *compressionConn {
+	return &compressionConn{Conn: netConn, buffered: bufio.NewReader(netConn)}
+}
+
+func (c *compressionConn) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	reader := c.reader
+	c.mu.Unlock()
+
+	if reader == nil {
+		var err error
+		if reader, err = c.sniff(); err != nil {
+			return 0, err
+		}
+	}
+	return reader.Read(p)
+}
+
+// Decide from the first bytes the client sends whether it is compressing.
+// Anything sent before then, e.g. an ERROR because the server is shutting
+// down, goes out uncompressed.
+func (c *compressionConn) sniff() (io.Reader, error) {
+	var reader io.Reader = c.buffered
+	var writer *gzip.Writer
+	if magic, err := c.buffered.Peek(len(GZIP_MAGIC)); err == nil && magic[0] == GZIP_MAGIC[0] && magic[1] == GZIP_MAGIC[1] {
+		gzipReader, err := gzip.NewReader(c.buffered)
+		if err != nil {
+			return nil, err
+		}
+		reader = gzipReader
+		writer = gzip.NewWriter(c.Conn)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.reader = reader
+	c.writer = writer
+	return reader, nil
+}
+
+// Each write is a batch of whole frames, so it is flushed straight away
+// rather than held back waiting for more to compress
+func (c *compressionConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	writer := c.writer
+	c.mu.Unlock()
+
+	if writer == nil {
+		return c.Conn.Write(p)
+	}
+	if _, err := writer.Write(p); err != nil {
+		return 0, err
+	}
+	if err := writer.Flush(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (c *compressionConn) Close() error {
+	c.mu.Lock()
+	writer := c.writer
+	c.mu.Unlock()
+
+	if writer != nil {
+		writer.Close()
+	}
+	return c.Conn.Close()
+}
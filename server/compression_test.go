@@ -0,0 +1,45 @@
+package server_test
+
+import (
+	"compress/gzip"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestCompressedHandshake(t *testing.T) {
+	_, addr := startServer(t, server.Options{Compression: true})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	writer := gzip.NewWriter(conn)
+	writer.Write([]byte("CONNECT\naccept-version:1.2\nhost:localhost\n\n\x00"))
+	if err := writer.Flush(); err != nil {
+		t.Fatalf("Error writing: %s", err)
+	}
+
+	reader, err := gzip.NewReader(conn)
+	if err != nil {
+		t.Fatalf("Server should reply to a compressed CONNECT compressed, got %s", err)
+	}
+	parser := parsing.NewStompParserFromReader(reader)
+	frame, err := parser.NextFrame()
+	if err != nil || frame.Command != parsing.CONNECTED {
+		t.Errorf("Should complete a handshake over gzip, got %v %v", frame.Command, err)
+	}
+}
+
+func TestUncompressedHandshakeWithCompressionEnabled(t *testing.T) {
+	_, addr := startServer(t, server.Options{Compression: true})
+
+	client := dial(t, addr)
+	client.connect(map[string]string{"accept-version": "1.2", "host": "localhost"})
+}
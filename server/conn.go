@@ -0,0 +1,797 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+const PROTOCOL_VERSION = "1.2"
+
+// How long a slow consumer being disconnected has to read its ERROR frame
+const SLOW_CONSUMER_GRACE = time.Second
+
+// How long to keep reading, and ignoring, whatever a client sends after its
+// DISCONNECT, see linger
+const DISCONNECT_LINGER = time.Second
+
+// Most messages a subscription can ask to have written per flush
+const MAX_BATCH_SIZE = 1000
+
+// Client connections
+// Each connection is served by two goroutines: a reader which parses and
+// dispatches incoming frames, and a writer which owns every write to the
+// socket so that outgoing frames can never interleave.
+
+type conn struct {
+	server  *Server
+	netConn net.Conn // Only written to by writeLoop, everything else queues frames on the outbox
+	reader  *idleReader
+	parser  parsing.StompParser
+	outbox  *outbox
+	wrote   int32 // Set by the writer after writing frames, for the heart-beat sender
+
+	disconnected int32         // Set after a DISCONNECT, so that the writer only shuts its side of the socket
+	writerDone   chan struct{} // Closed when the writer has finished
+
+	sessionID     string // Only changed with the server's lock held
+	clientID      string
+	resumeToken   string         // Lets the client resume the session if it drops, when retention is enabled
+	principal     string         // Login the client authenticated as, if any
+	will          *parsing.Frame // Published if the connection drops without a DISCONNECT
+	state         connState
+	receipt       string                   // Receipt requested by the frame being handled, if any
+	subscriptions map[string]*subscription // Guarded by the broker's lock
+	quotaSent     []time.Time              // Guarded by the broker's lock, see chargeQuota
+
+	history     frameHistory // Recent frames read from the client, for debugging
+	ingest      rateMeter    // Frames read from the client
+	ingestAlarm bool         // Whether the ingest rate is over the alarm threshold
+	sampleSkip  int          // Frames to read before the next is counted, see sample
+
+	transactions     map[string]*transaction // Open transactions keyed by id
+	transactionBytes int                     // Size of the frames held by open transactions
+}
+
+func newConn(server *Server, netConn net.Conn) *conn {
+	reader := &idleReader{conn: netConn}
+	outbox := newOutbox()
+	outbox.maxBytes = server.opts.MaxOutboundBytes
+	return &conn{
+		server:     server,
+		netConn:    netConn,
+		reader:     reader,
+		parser:     parsing.NewStompParserFromReader(reader, server.parserOptions()...),
+		outbox:     outbox,
+		writerDone: make(chan struct{}),
+
+		subscriptions: map[string]*subscription{},
+		sampleSkip:    server.sampler.firstSkip(),
+	}
+}
+
+func (c *conn) serve() {
+	go c.writeLoop()
+	defer c.cleanup()
+
+	for {
+		frame, err := c.parser.NextFrame()
+		// The client closing between frames, even before sending anything,
+		// is a normal close rather than a protocol error
+		if err == io.EOF {
+			if c.reader.timedOut {
+				c.server.log.Infof("Session %s sent nothing for %s, closing the connection", c.sessionID, c.reader.timeout)
+			}
+			return
+		}
+		parsed := err == nil
+		c.countFrame(frame, parsed)
+		c.receipt = frame.Headers[parsing.HEADER_RECEIPT]
+		if parsed {
+			c.history.record(frame)
+			c.logBody(frame)
+			err = frame.Validate()
+		}
+		if err != nil {
+			if reason, ok := badFrameReason(parsed, err); ok {
+				c.reject(reason, err.Error())
+			} else {
+				c.sendError(err.Error())
+			}
+			if !c.resync(parsed, err) {
+				return
+			}
+			continue
+		}
+
+		if keepGoing := c.dispatch(frame); !keepGoing {
+			if c.state == STATE_DISCONNECTING {
+				c.linger()
+			}
+			return
+		}
+	}
+}
+
+func (c *conn) logBody(frame parsing.Frame) {
+	if c.server.bodyLog == nil {
+		return
+	}
+	limit := c.server.opts.LogBodyLimit
+	if limit == 0 {
+		limit = DEFAULT_LOG_BODY_LIMIT
+	}
+	c.server.bodyLog.Tracef("Connection from %s sent %s", c.netConn.RemoteAddr(), describeWithBody(frame, limit))
+}
+
+// Whether to carry on after sending an ERROR for a bad frame, which only
+// happens if Options.ResyncAfterBadFrames is set. A frame that parsed but
+// was invalid has already been read in full, one that didn't parse is
+// skipped. Anything else, e.g. the connection failing, still closes it.
+func (c *conn) resync(parsed bool, err error) bool {
+	if !c.server.opts.ResyncAfterBadFrames {
+		return false
+	}
+	if parsed {
+		return true
+	}
+	if _, ok := err.(parsing.ParseError); ok {
+		return c.parser.Resync() == nil
+	}
+	return false
+}
+
+// Connection states
+// A connection only accepts CONNECT or STOMP until the handshake is done,
+// and only other frames after it. Nothing is read once the client has sent
+// DISCONNECT.
+
+type connState int
+
+const (
+	STATE_AWAITING_CONNECT connState = iota
+	STATE_CONNECTED
+	STATE_DISCONNECTING
+)
+
+// Dispatch a single frame, returning false if the connection should close
+func (c *conn) dispatch(frame parsing.Frame) bool {
+	handshake := frame.Command == parsing.CONNECT || frame.Command == parsing.STOMP
+	switch c.state {
+	case STATE_AWAITING_CONNECT:
+		if !handshake {
+			c.reject(REJECT_INVALID, fmt.Sprintf("Expected a CONNECT frame, got %s", frame.Command))
+			return false
+		}
+	case STATE_CONNECTED:
+		if handshake {
+			c.reject(REJECT_INVALID, "Already connected")
+			return false
+		}
+	case STATE_DISCONNECTING:
+		return false
+	}
+	if c.server.opts.ReceiptPolicy == RECEIPT_ON_ACCEPT && !handshake && frame.Command != parsing.DISCONNECT {
+		c.receiptEarly(frame)
+	}
+	if _, ok := frame.Headers[parsing.HEADER_TRANSACTION]; ok && transactable[frame.Command] {
+		return c.handleTransacted(frame)
+	}
+
+	switch frame.Command {
+	case parsing.CONNECT, parsing.STOMP:
+		return c.handleConnect(frame)
+	case parsing.SEND:
+		return c.handleSend(frame)
+	case parsing.SUBSCRIBE:
+		return c.handleSubscribe(frame)
+	case parsing.UNSUBSCRIBE:
+		return c.handleUnsubscribe(frame)
+	case parsing.ACK:
+		return c.handleAck(frame)
+	case parsing.NACK:
+		return c.handleNack(frame)
+	case parsing.BEGIN:
+		return c.handleBegin(frame)
+	case parsing.COMMIT:
+		return c.handleCommit(frame)
+	case parsing.ABORT:
+		return c.handleAbort(frame)
+	case parsing.DISCONNECT:
+		return c.handleDisconnect(frame)
+	default:
+		c.reject(REJECT_INVALID, fmt.Sprintf("Unsupported command %s", frame.Command))
+		return false
+	}
+}
+
+// A CONNECT with neither a login nor a passcode is anonymous. Unless
+// Options.AllowAnonymous is set it is authenticated like any other, so
+// fails as an empty login would.
+func anonymous(frame parsing.Frame) bool {
+	_, hasLogin := frame.Headers[parsing.HEADER_LOGIN]
+	_, hasPasscode := frame.Headers[parsing.HEADER_PASSCODE]
+	return !hasLogin && !hasPasscode
+}
+
+func (c *conn) handleConnect(frame parsing.Frame) bool {
+	result := c.connect(frame)
+	c.auditConnect(frame, result)
+	return result == CONNECT_ACCEPTED
+}
+
+func (c *conn) connect(frame parsing.Frame) ConnectResult {
+	// The CONNECTED frame is the acknowledgement of a CONNECT, so a receipt
+	// could never be honoured
+	if _, ok := frame.Headers[parsing.HEADER_RECEIPT]; ok {
+		c.reject(REJECT_INVALID, fmt.Sprintf("%s frame must not request a receipt", frame.Command))
+		return CONNECT_REFUSED
+	}
+	if !c.server.policy.OptionalConnectHeaders && !c.requireHeaders(frame, parsing.HEADER_ACCEPT_VERSION, parsing.HEADER_HOST) {
+		return CONNECT_REFUSED
+	}
+
+	if versions, ok := frame.Headers[parsing.HEADER_ACCEPT_VERSION]; ok && !acceptsVersion(versions, PROTOCOL_VERSION) {
+		unsupported := parsing.ErrorFrame(fmt.Sprintf("Supported protocol versions are %s", PROTOCOL_VERSION), nil)
+		unsupported.Headers[parsing.HEADER_VERSION] = PROTOCOL_VERSION
+		c.send(unsupported)
+		return CONNECT_REFUSED
+	}
+
+	principal, certified := c.certificatePrincipal()
+	if certified {
+		c.server.log.Debugf("Connection from %s authenticated by certificate as %q", c.netConn.RemoteAddr(), principal)
+	} else {
+		principal = frame.Headers[parsing.HEADER_LOGIN]
+	}
+	if auth := c.server.opts.Authenticator; auth != nil && !certified {
+		if c.server.opts.AllowAnonymous && anonymous(frame) {
+			c.server.log.Debugf("Anonymous connection from %s", c.netConn.RemoteAddr())
+		} else if !auth.Authenticate(frame.Headers[parsing.HEADER_LOGIN], frame.Headers[parsing.HEADER_PASSCODE]) {
+			c.server.log.Warnf("Authentication failed for login %q from %s", frame.Headers[parsing.HEADER_LOGIN], c.netConn.RemoteAddr())
+			c.reject(REJECT_UNAUTHORIZED, "Authentication failed")
+			return CONNECT_AUTH_FAILED
+		}
+	}
+	c.principal = principal
+
+	// A CONNECT without a heart-beat header doesn't want heart-beats
+	clientHeartBeat, _, err := frame.HeartBeat()
+	if err != nil {
+		c.reject(REJECT_INVALID, err.Error())
+		return CONNECT_REFUSED
+	}
+	heartBeat, sendInterval, receiveInterval, err := c.server.negotiateHeartBeat(clientHeartBeat)
+	if err != nil {
+		c.reject(REJECT_INVALID, err.Error())
+		return CONNECT_REFUSED
+	}
+
+	c.server.assignSession(c, c.server.nextSessionID())
+	c.clientID = frame.Headers[HEADER_CLIENT_ID]
+	if c.clientID != "" {
+		if err := c.server.registerClient(c); err != nil {
+			c.sendError(err.Error())
+			return CONNECT_REFUSED
+		}
+	}
+	if c.server.opts.SessionRetention > 0 {
+		token, err := newResumeToken()
+		if err != nil {
+			c.sendError(fmt.Sprintf("Error issuing resume token: %s", err))
+			return CONNECT_REFUSED
+		}
+		c.resumeToken = token
+	}
+	var resumed *retainedSession
+	if token, ok := frame.Headers[HEADER_RESUME_TOKEN]; ok {
+		session, err := c.server.broker.claimSession(c, token)
+		if err != nil {
+			c.sendError(err.Error())
+			return CONNECT_REFUSED
+		}
+		resumed = session
+		c.server.assignSession(c, session.sessionID)
+	}
+
+	connected := parsing.ConnectedFrame(PROTOCOL_VERSION, c.sessionID, SERVER_NAME)
+	connected.Headers[parsing.HEADER_HEART_BEAT] = heartBeat.String()
+	if c.resumeToken != "" {
+		connected.Headers[HEADER_RESUME_TOKEN] = c.resumeToken
+	}
+	c.state = STATE_CONNECTED
+	c.will = willFromConnect(frame)
+
+	c.server.log.Infof("Session %s connected from %s", c.sessionID, c.netConn.RemoteAddr())
+	c.send(connected)
+	if sendInterval > 0 {
+		go c.sendHeartBeats(sendInterval)
+	}
+	c.reader.timeout = receiveInterval * HEART_BEAT_TOLERANCE
+
+	// Redeliveries have to follow the CONNECTED frame
+	if resumed != nil {
+		c.server.log.Infof("Session %s resumed", c.sessionID)
+		c.server.broker.resume(c, resumed)
+	} else {
+		c.subscribeDefaults(frame.Headers[parsing.HEADER_HOST])
+	}
+	return CONNECT_ACCEPTED
+}
+
+func (c *conn) handleSend(frame parsing.Frame) bool {
+	if !c.requireHeaders(frame, parsing.HEADER_DESTINATION) {
+		return false
+	}
+	if !c.server.policy.ReservedHeaders {
+		for _, name := range serverAssignedHeaders {
+			if _, ok := frame.Headers[name]; ok {
+				c.reject(REJECT_INVALID, fmt.Sprintf("SEND frame must not set the %s header", name))
+				return false
+			}
+		}
+	}
+	if strings.HasPrefix(frame.Headers[parsing.HEADER_DESTINATION], CONTROL_PREFIX) {
+		return c.handleControl(frame)
+	}
+	if strings.HasPrefix(frame.Headers[parsing.HEADER_DESTINATION], MANAGEMENT_PREFIX) {
+		return c.handleManagement(frame)
+	}
+
+	if err := c.server.broker.checkQuota(c); err != nil {
+		c.rejectRefused(err)
+		return false
+	}
+	delivered, err := c.server.broker.send(c, frame)
+	if err != nil {
+		c.rejectRefused(err)
+		return false
+	}
+	c.server.broker.chargeQuota(c)
+	if c.server.opts.ReportTopicDeliveries && delivered >= 0 {
+		c.sendReceiptWith(frame, map[string]string{HEADER_DELIVERED_TO: strconv.Itoa(delivered)})
+	} else {
+		c.sendReceipt(frame)
+	}
+	return true
+}
+
+func (c *conn) handleSubscribe(frame parsing.Frame) bool {
+	if !c.requireHeaders(frame, parsing.HEADER_DESTINATION, parsing.HEADER_ID) {
+		return false
+	}
+
+	mode := ACK_AUTO
+	if name, ok := frame.Headers[parsing.HEADER_ACK]; ok {
+		if mode, ok = ackModes[name]; !ok {
+			c.reject(REJECT_INVALID, fmt.Sprintf("Unknown ack mode %s", name))
+			return false
+		}
+	}
+	opts := subscribeOptions{
+		ackMode:   mode,
+		durable:   frame.Headers[HEADER_DURABLE] == "true",
+		overflow:  c.server.opts.OverflowPolicy,
+		batchSize: 1,
+		group:     frame.Headers[HEADER_SUBSCRIPTION_GROUP],
+	}
+	if value, ok := frame.Headers[HEADER_BATCH_SIZE]; ok {
+		size, err := strconv.Atoi(value)
+		if err != nil || size < 1 || size > MAX_BATCH_SIZE {
+			c.reject(REJECT_INVALID, fmt.Sprintf("Batch size must be between 1 and %d", MAX_BATCH_SIZE))
+			return false
+		}
+		opts.batchSize = size
+	}
+	if name, ok := frame.Headers[HEADER_OVERFLOW_POLICY]; ok {
+		if err := opts.overflow.Set(name); err != nil {
+			c.reject(REJECT_INVALID, fmt.Sprintf("Unknown overflow policy %s", name))
+			return false
+		}
+	}
+	if source, ok := frame.Headers[HEADER_SELECTOR]; ok {
+		sel, err := parseSelector(source, c.server.opts.MaxSelectorLength, c.server.opts.MaxSelectorDepth)
+		if err != nil {
+			c.rejectRefused(err)
+			return false
+		}
+		opts.selector = sel
+	}
+	if header, ok := frame.Headers[HEADER_ACCEPT_CONTENT_TYPE]; ok {
+		filter, err := parseContentTypeFilter(header)
+		if err != nil {
+			c.reject(REJECT_INVALID, err.Error())
+			return false
+		}
+		opts.accepts = filter
+	}
+
+	err := c.server.broker.subscribe(c, frame.Headers[parsing.HEADER_ID], frame.Headers[parsing.HEADER_DESTINATION], opts)
+	if err != nil {
+		c.rejectRefused(err)
+		return false
+	}
+	c.sendReceipt(frame)
+	return true
+}
+
+// Unsubscribing from a durable subscription deletes it, as opposed to
+// disconnecting which leaves it to collect messages until the client returns
+func (c *conn) handleUnsubscribe(frame parsing.Frame) bool {
+	if !c.requireHeaders(frame, parsing.HEADER_ID) {
+		return false
+	}
+
+	if err := c.server.broker.unsubscribe(c, frame.Headers[parsing.HEADER_ID]); err != nil {
+		c.rejectRefused(err)
+		return false
+	}
+	c.sendReceipt(frame)
+	return true
+}
+
+func (c *conn) handleAck(frame parsing.Frame) bool {
+	if !c.requireHeaders(frame, parsing.HEADER_ID) {
+		return false
+	}
+
+	if err := c.server.broker.ack(c, frame.Headers[parsing.HEADER_ID], frame.Headers[parsing.HEADER_SUBSCRIPTION]); err != nil {
+		c.rejectRefused(err)
+		return false
+	}
+	c.sendReceipt(frame)
+	return true
+}
+
+func (c *conn) handleNack(frame parsing.Frame) bool {
+	if !c.requireHeaders(frame, parsing.HEADER_ID) {
+		return false
+	}
+
+	if err := c.server.broker.nack(c, frame.Headers[parsing.HEADER_ID], frame.Headers[parsing.HEADER_SUBSCRIPTION]); err != nil {
+		c.rejectRefused(err)
+		return false
+	}
+	c.sendReceipt(frame)
+	return true
+}
+
+// Subscriptions are released before the receipt is sent so that a client
+// which has seen the receipt can rely on its durable subscriptions being
+// detached and its client-id being free
+func (c *conn) handleDisconnect(frame parsing.Frame) bool {
+	c.state = STATE_DISCONNECTING
+	c.will = nil
+	c.resumeToken = ""
+	c.release()
+	c.sendReceipt(frame)
+	return false
+}
+
+// Flow control
+// Sending to one of these destinations pauses or resumes delivery to the
+// subscription named by the subscription header, without unsubscribing. The
+// rest of the prefix is reserved for future control operations.
+const (
+	CONTROL_PREFIX = "/control/"
+	CONTROL_PAUSE  = CONTROL_PREFIX + "pause"
+	CONTROL_RESUME = CONTROL_PREFIX + "resume"
+)
+
+func (c *conn) handleControl(frame parsing.Frame) bool {
+	var paused bool
+	switch destination := frame.Headers[parsing.HEADER_DESTINATION]; destination {
+	case CONTROL_PAUSE:
+		paused = true
+	case CONTROL_RESUME:
+		paused = false
+	default:
+		c.reject(REJECT_INVALID, fmt.Sprintf("Unknown control destination %s", destination))
+		return false
+	}
+
+	if !c.requireHeaders(frame, parsing.HEADER_SUBSCRIPTION) {
+		return false
+	}
+	if err := c.server.broker.setPaused(c, frame.Headers[parsing.HEADER_SUBSCRIPTION], paused); err != nil {
+		c.rejectRefused(err)
+		return false
+	}
+	c.sendReceipt(frame)
+	return true
+}
+
+func (c *conn) requireHeaders(frame parsing.Frame, names ...string) bool {
+	for _, name := range names {
+		if _, ok := frame.Headers[name]; !ok {
+			c.reject(REJECT_MISSING_HEADER, fmt.Sprintf("%s frame is missing the %s header", frame.Command, name))
+			return false
+		}
+	}
+	return true
+}
+
+// Build the SEND frame for a client's last will, if it registered one
+func willFromConnect(frame parsing.Frame) *parsing.Frame {
+	destination, ok := frame.Headers[HEADER_WILL_DESTINATION]
+	if !ok {
+		return nil
+	}
+
+	will := parsing.Frame{
+		Command: parsing.SEND,
+		Headers: map[string]string{parsing.HEADER_DESTINATION: destination},
+		Body:    []byte(frame.Headers[HEADER_WILL_BODY]),
+	}
+	if contentType, ok := frame.Headers[HEADER_WILL_CONTENT_TYPE]; ok {
+		will.Headers[parsing.HEADER_CONTENT_TYPE] = contentType
+	}
+	return &will
+}
+
+func acceptsVersion(versions string, version string) bool {
+	for _, candidate := range strings.Split(versions, ",") {
+		if strings.TrimSpace(candidate) == version {
+			return true
+		}
+	}
+	return false
+}
+
+// Responses
+
+func (c *conn) send(frame parsing.Frame) {
+	c.outbox.push(frame)
+}
+
+// Queue a message for one of the connection's subscriptions, applying the
+// subscription's overflow policy if it already has a full queue. Called with
+// the broker's lock held, so never waits, instead returning whether the
+// message went over the limits and the publisher should wait for room.
+func (c *conn) sendMessage(sub *subscription, frame parsing.Frame) bool {
+	dropped, full := c.outbox.pushMessage(sub.id, frame, c.server.opts.OutboundQueueSize, sub.overflow)
+	if !dropped {
+		return full
+	}
+
+	if sub.overflow == OVERFLOW_DISCONNECT {
+		c.server.log.Warnf("Outbound queue for subscription %s of session %s is full, disconnecting", sub.id, c.sessionID)
+		c.disconnectSlowConsumer()
+		return false
+	}
+	c.server.log.Debugf("Outbound queue for subscription %s of session %s is full, dropped a message", sub.id, c.sessionID)
+	return false
+}
+
+// Whether a subscription's outbound queue has room for another message,
+// noting it for the writer to refill if not
+func (c *conn) hasRoom(subID string) bool {
+	return c.outbox.hasRoom(subID, c.server.opts.OutboundQueueSize)
+}
+
+// Block until a subscription's outbound queue has room again, or the
+// connection closes. Must be called without the broker's lock.
+func (c *conn) waitForRoom(subID string) {
+	c.outbox.waitForRoom(subID, c.server.opts.OutboundQueueSize)
+}
+
+func (c *conn) sendReceipt(frame parsing.Frame) {
+	c.sendReceiptWith(frame, nil)
+}
+
+// Receipt a frame, adding headers of the server's own to the RECEIPT
+func (c *conn) sendReceiptWith(frame parsing.Frame, headers map[string]string) {
+	receipt, ok := frame.Headers[parsing.HEADER_RECEIPT]
+	if !ok {
+		return
+	}
+	receiptFrame := parsing.ReceiptFrame(receipt)
+	for key, value := range headers {
+		receiptFrame.Headers[key] = value
+	}
+	c.send(receiptFrame)
+}
+
+// Receipt a frame before handling it. The receipt header is removed so that
+// the handler's own sendReceipt has nothing left to do.
+func (c *conn) receiptEarly(frame parsing.Frame) {
+	c.sendReceipt(frame)
+	delete(frame.Headers, parsing.HEADER_RECEIPT)
+}
+
+// Report an error with the frame being handled, correlating the ERROR with
+// the frame's receipt if it asked for one. Only the reader may call this,
+// other goroutines use terminate.
+func (c *conn) sendError(message string) {
+	c.sendErrorFor(c.receipt, message)
+}
+
+func (c *conn) sendErrorFor(receipt string, message string) {
+	c.server.log.Warnf("Sending error to %s: %s", c.netConn.RemoteAddr(), message)
+	c.queueError(receipt, message)
+}
+
+func (c *conn) queueError(receipt string, message string) {
+	frame := parsing.ErrorFrame(message, nil)
+	if receipt != "" {
+		frame.Headers[parsing.HEADER_RECEIPT_ID] = receipt
+	}
+	c.send(frame)
+}
+
+// Teardown
+
+// Terminate the connection from outside of its reader goroutine. The error
+// is flushed to the client before the socket is closed, which in turn
+// unblocks the reader and triggers cleanup.
+func (c *conn) terminate(message string) {
+	c.sendErrorFor("", message)
+	c.outbox.close()
+}
+
+// A consumer that has stopped reading would never drain its queued messages,
+// so they are thrown away and the writer is given a short grace period to
+// get the error out before the socket is closed regardless
+func (c *conn) disconnectSlowConsumer() {
+	c.outbox.discardMessages()
+	c.terminate("Slow consumer, outbound queue overflowed")
+	c.netConn.SetWriteDeadline(time.Now().Add(SLOW_CONSUMER_GRACE))
+}
+
+// Release the session before the writer is allowed to close the socket, so
+// that a client which has seen the close can immediately reuse its client-id
+func (c *conn) cleanup() {
+	c.release()
+	c.outbox.close()
+
+	if c.will != nil {
+		c.server.log.Infof("Session %s dropped, publishing its last will to %s", c.sessionID, c.will.Headers[parsing.HEADER_DESTINATION])
+		c.server.broker.send(c, *c.will)
+	}
+	c.server.log.Infof("Connection from %s closed", c.netConn.RemoteAddr())
+	for _, summary := range c.history.recent() {
+		c.server.log.Debugf("Connection from %s recently sent %s", c.netConn.RemoteAddr(), summary)
+	}
+}
+
+// Nothing the client sends after DISCONNECT is parsed, but closing a socket
+// with unread data resets the connection, which can lose the RECEIPT on its
+// way to the client. So once the writer has flushed it and shut its side of
+// the socket, anything more is read and thrown away until the client closes
+// too or DISCONNECT_LINGER has passed.
+func (c *conn) linger() {
+	atomic.StoreInt32(&c.disconnected, 1)
+	c.outbox.close()
+	<-c.writerDone
+
+	c.netConn.SetReadDeadline(time.Now().Add(DISCONNECT_LINGER))
+	io.Copy(ioutil.Discard, c.netConn)
+	c.netConn.Close()
+}
+
+// Detach subscriptions, abort transactions and free the client-id. Safe to
+// call more than once.
+func (c *conn) release() {
+	c.abortTransactions()
+	if subs := c.server.broker.subscriptionsOf(c); len(subs) > 0 {
+		c.server.log.Infof("Session %s closing with subscriptions %s", c.sessionID, formatSubscriptions(subs))
+	}
+	c.server.broker.detach(c)
+	c.server.removeConn(c)
+}
+
+func (c *conn) writeLoop() {
+	defer close(c.writerDone)
+	defer c.closeSocket()
+
+	encoder := parsing.NewStompEncoder(c.netConn)
+	flushes := flushTimer{clock: c.server.clock, interval: c.server.opts.FlushInterval, outbox: c.outbox}
+	for {
+		frames, ok := c.outbox.pop()
+		for _, subID := range c.outbox.roomMade(c.server.opts.OutboundQueueSize) {
+			c.server.broker.refill(c, subID)
+		}
+		if !ok {
+			if flushes.stop() {
+				encoder.Flush()
+			}
+			return
+		}
+
+		var err error
+		// Flushing held back frames does for a heart-beat
+		if len(frames) == 0 && !flushes.running() {
+			err = encoder.WriteHeartBeat()
+		}
+		for _, frame := range frames {
+			if err = encoder.Write(frame); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			if flushes.holdBack(frames) {
+				flushes.start()
+			} else {
+				flushes.stop()
+				err = encoder.Flush()
+			}
+		}
+		if err == nil && len(frames) > 0 {
+			atomic.StoreInt32(&c.wrote, 1)
+		}
+		// A peer that stopped reading may still be sending, so the reader
+		// can't be relied on to notice. Closing the socket unblocks it, and
+		// it then tears the session down as for any dropped connection.
+		if err != nil {
+			c.server.log.Infof("Error writing to %s, closing the connection: %s", c.netConn.RemoteAddr(), err)
+			c.outbox.close()
+			c.netConn.Close()
+			return
+		}
+	}
+}
+
+// Flush timer
+// With Options.FlushInterval set the writer leaves MESSAGE frames in its
+// buffer, and starts a timer that wakes it to flush them unless another
+// frame does so first. Only the writer goroutine uses it.
+
+type flushTimer struct {
+	clock    Clock
+	interval time.Duration
+	outbox   *outbox
+	timer    Timer // Set while frames are held back
+}
+
+// Whether the frames just written can wait for more to be flushed with them
+func (flushes *flushTimer) holdBack(frames []parsing.Frame) bool {
+	if flushes.interval <= 0 || len(frames) == 0 {
+		return false
+	}
+	for _, frame := range frames {
+		if frame.Command != parsing.MESSAGE {
+			return false
+		}
+	}
+	return true
+}
+
+// Start the timer, unless it's already running for frames held back earlier,
+// so that a steady trickle of messages can't hold them back indefinitely
+func (flushes *flushTimer) start() {
+	if flushes.timer == nil {
+		flushes.timer = flushes.clock.AfterFunc(flushes.interval, flushes.outbox.requestFlush)
+	}
+}
+
+func (flushes *flushTimer) running() bool {
+	return flushes.timer != nil
+}
+
+// Stop the timer, returning whether any frames were being held back
+func (flushes *flushTimer) stop() bool {
+	if flushes.timer == nil {
+		return false
+	}
+	flushes.timer.Stop()
+	flushes.timer = nil
+	return true
+}
+
+// Close the socket once there's nothing more to write, or after a DISCONNECT
+// only shut the sending side if possible, leaving the reader to linger
+func (c *conn) closeSocket() {
+	if atomic.LoadInt32(&c.disconnected) == 1 {
+		if halfCloser, ok := c.netConn.(interface{ CloseWrite() error }); ok && halfCloser.CloseWrite() == nil {
+			return
+		}
+	}
+	c.netConn.Close()
+}
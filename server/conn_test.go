@@ -0,0 +1,229 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+func TestWriteFailureTearsDownConnection(t *testing.T) {
+	srv, err := New(Options{})
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	halfOpen := &halfOpenConn{Conn: serverSide}
+
+	c := newConn(srv, halfOpen)
+	srv.addConn(c)
+	served := make(chan struct{})
+	go func() {
+		c.serve()
+		close(served)
+	}()
+
+	client := parsing.NewStompParserFromReader(clientSide)
+	clientSide.Write([]byte("CONNECT\n\n\x00SUBSCRIBE\ndestination:/queue/a\nid:0\nreceipt:r\n\n\x00"))
+	for _, command := range []parsing.CommandType{parsing.CONNECTED, parsing.RECEIPT} {
+		if frame, err := client.NextFrame(); err != nil || frame.Command != command {
+			t.Fatalf("Expected a %s frame, got %v %v", command, frame.Command, err)
+		}
+	}
+
+	// The peer stops reading but its side of the connection stays open
+	halfOpen.failWrites()
+	srv.broker.send(nil, parsing.Frame{
+		Command: parsing.SEND,
+		Headers: map[string]string{parsing.HEADER_DESTINATION: "/queue/a"},
+		Body:    []byte("hello"),
+	})
+
+	select {
+	case <-served:
+	case <-time.After(time.Second):
+		t.Fatalf("Reader should exit once a write fails")
+	}
+	if subs := srv.broker.subscriptionsOf(c); len(subs) != 0 {
+		t.Errorf("Subscriptions should be removed, got %v", subs)
+	}
+	srv.broker.mu.Lock()
+	if dest := srv.broker.destination("/queue/a"); len(dest.subscriptions) != 0 {
+		t.Errorf("Destination should forget the subscription")
+	}
+	srv.broker.mu.Unlock()
+	if srv.connForSession(c.sessionID) != nil {
+		t.Errorf("Connection should be forgotten")
+	}
+}
+
+func TestConcurrentWritesDoNotInterleave(t *testing.T) {
+	srv, err := New(Options{})
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	clientSide.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c := newConn(srv, serverSide)
+	srv.addConn(c)
+	go c.serve()
+
+	client := parsing.NewStompParserFromReader(clientSide)
+	clientSide.Write([]byte("CONNECT\n\n\x00SUBSCRIBE\ndestination:/topic/t\nid:0\nreceipt:sub\n\n\x00"))
+	for _, command := range []parsing.CommandType{parsing.CONNECTED, parsing.RECEIPT} {
+		if frame, err := client.NextFrame(); err != nil || frame.Command != command {
+			t.Fatalf("Expected a %s frame, got %v %v", command, frame.Command, err)
+		}
+	}
+
+	// Messages are queued by the publishers' goroutines while receipts are
+	// queued by the connection's reader
+	const publishers, perPublisher = 8, 100
+	for i := 0; i < publishers; i++ {
+		go func(i int) {
+			for j := 0; j < perPublisher; j++ {
+				srv.broker.send(nil, parsing.Frame{
+					Command: parsing.SEND,
+					Headers: map[string]string{parsing.HEADER_DESTINATION: "/topic/t"},
+					Body:    []byte(fmt.Sprintf("%d-%d", i, j)),
+				})
+			}
+		}(i)
+	}
+	go func() {
+		for j := 0; j < perPublisher; j++ {
+			fmt.Fprintf(clientSide, "SEND\ndestination:/queue/other\nreceipt:r%d\n\n\x00", j)
+		}
+	}()
+
+	bodies := map[string]bool{}
+	receipts := 0
+	for len(bodies) < publishers*perPublisher || receipts < perPublisher {
+		frame, err := client.NextFrame()
+		if err != nil {
+			t.Fatalf("Every frame should be well formed, got %s after %d messages and %d receipts", err, len(bodies), receipts)
+		}
+		switch frame.Command {
+		case parsing.MESSAGE:
+			body := string(frame.Body)
+			var i, j int
+			if n, _ := fmt.Sscanf(body, "%d-%d", &i, &j); n != 2 || bodies[body] || frame.Headers[parsing.HEADER_SUBSCRIPTION] != "0" {
+				t.Fatalf("Unexpected MESSAGE %v %q", frame.Headers, body)
+			}
+			bodies[body] = true
+		case parsing.RECEIPT:
+			if expected := fmt.Sprintf("r%d", receipts); frame.Headers[parsing.HEADER_RECEIPT_ID] != expected {
+				t.Fatalf("Expected receipt %s, got %v", expected, frame.Headers)
+			}
+			receipts++
+		default:
+			t.Fatalf("Unexpected %s frame %v", frame.Command, frame.Headers)
+		}
+	}
+}
+
+// Connection whose writes fail once told to, while reads carry on
+type halfOpenConn struct {
+	net.Conn
+	mu     sync.Mutex
+	broken bool
+}
+
+func (c *halfOpenConn) failWrites() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.broken = true
+}
+
+func (c *halfOpenConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	broken := c.broken
+	c.mu.Unlock()
+	if broken {
+		return 0, errors.New("broken pipe")
+	}
+	return c.Conn.Write(p)
+}
+
+func TestQueueWaitsForOutboundRoom(t *testing.T) {
+	srv, err := New(Options{OutboundQueueSize: 2})
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	clientSide.SetDeadline(time.Now().Add(10 * time.Second))
+
+	c := newConn(srv, serverSide)
+	srv.addConn(c)
+	go c.serve()
+
+	client := parsing.NewStompParserFromReader(clientSide)
+	clientSide.Write([]byte("CONNECT\n\n\x00SUBSCRIBE\ndestination:/queue/a\nid:0\nreceipt:sub\n\n\x00"))
+	for _, command := range []parsing.CommandType{parsing.CONNECTED, parsing.RECEIPT} {
+		if frame, err := client.NextFrame(); err != nil || frame.Command != command {
+			t.Fatalf("Expected a %s frame, got %v %v", command, frame.Command, err)
+		}
+	}
+
+	// Nothing is read from the pipe, so the writer is stuck on the first
+	// message and the rest wait on the queue once the outbound queue is full
+	const sent = 10
+	for i := 0; i < sent; i++ {
+		srv.broker.send(nil, parsing.Frame{
+			Command: parsing.SEND,
+			Headers: map[string]string{parsing.HEADER_DESTINATION: "/queue/a"},
+			Body:    []byte(fmt.Sprint(i)),
+		})
+	}
+	srv.broker.mu.Lock()
+	retained := len(srv.broker.destination("/queue/a").messages)
+	srv.broker.mu.Unlock()
+	if retained < sent-3 {
+		t.Errorf("Messages beyond the outbound queue should stay on the queue, %d of %d did", retained, sent)
+	}
+
+	// As the writer makes room the queue refills it, in order
+	for i := 0; i < sent; i++ {
+		frame, err := client.NextFrame()
+		if err != nil || frame.Command != parsing.MESSAGE || string(frame.Body) != fmt.Sprint(i) {
+			t.Fatalf("Expected message %d, got %v %q %v", i, frame.Command, frame.Body, err)
+		}
+	}
+}
+
+func TestRefusedSendKeepsQuota(t *testing.T) {
+	srv, err := New(Options{SendQuota: 1, SendQuotaWindow: time.Minute, MaxQueueBytes: 64})
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	c := newConn(srv, serverSide)
+
+	send := func(body string) {
+		c.handleSend(parsing.Frame{
+			Command: parsing.SEND,
+			Headers: map[string]string{parsing.HEADER_DESTINATION: "/queue/a"},
+			Body:    []byte(body),
+		})
+	}
+
+	// Too large for the queue, so refused by the broker
+	send(string(make([]byte, 100)))
+	if err := srv.broker.checkQuota(c); err != nil {
+		t.Fatalf("A refused send should leave the quota alone, got %s", err)
+	}
+
+	send("hello")
+	if err := srv.broker.checkQuota(c); err == nil {
+		t.Errorf("An accepted send should count against the quota")
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"net"
+	"sync"
+	"time"
+)
+
+// Connection rate limits
+// After a restart every client may reconnect at once. Options.ConnectRate
+// limits how quickly each remote IP can open connections, with a token bucket
+// per IP holding up to Options.ConnectBurst connections and refilling at the
+// rate per second. A connection accepted with the bucket empty is closed
+// straight away, before anything is read from it, so that a reconnect storm
+// costs the server as little as possible. Clients are expected to retry with
+// their own backoff.
+
+// Buckets that have refilled are forgotten once this many IPs are tracked,
+// so that the limiter's memory is bounded by the IPs connecting recently
+const CONNECT_LIMITER_PRUNE_SIZE = 1024
+
+type connectLimiter struct {
+	clock Clock
+	rate  float64
+	burst int
+
+	mu      sync.Mutex
+	buckets map[string]*connectBucket
+}
+
+type connectBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+func newConnectLimiter(clock Clock, opts Options) *connectLimiter {
+	return &connectLimiter{
+		clock:   clock,
+		rate:    opts.ConnectRate,
+		burst:   opts.ConnectBurst,
+		buckets: map[string]*connectBucket{},
+	}
+}
+
+// Take a token for a connection from the address, returning whether there
+// was one. Always allows connections when no rate is configured.
+func (limiter *connectLimiter) allow(addr net.Addr) bool {
+	if limiter.rate == 0 {
+		return true
+	}
+
+	limiter.mu.Lock()
+	defer limiter.mu.Unlock()
+
+	now := limiter.clock.Now()
+	if len(limiter.buckets) >= CONNECT_LIMITER_PRUNE_SIZE {
+		limiter.prune(now)
+	}
+
+	ip := remoteIP(addr)
+	bucket, ok := limiter.buckets[ip]
+	if !ok {
+		bucket = &connectBucket{tokens: float64(limiter.burst), updated: now}
+		limiter.buckets[ip] = bucket
+	}
+	limiter.refill(bucket, now)
+
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens--
+	return true
+}
+
+func (limiter *connectLimiter) refill(bucket *connectBucket, now time.Time) {
+	bucket.tokens += now.Sub(bucket.updated).Seconds() * limiter.rate
+	if bucket.tokens > float64(limiter.burst) {
+		bucket.tokens = float64(limiter.burst)
+	}
+	bucket.updated = now
+}
+
+// Forget buckets that are full again, which a new bucket would be anyway
+func (limiter *connectLimiter) prune(now time.Time) {
+	for ip, bucket := range limiter.buckets {
+		if limiter.refill(bucket, now); bucket.tokens >= float64(limiter.burst) {
+			delete(limiter.buckets, ip)
+		}
+	}
+}
+
+// The IP part of a remote address, or the whole address if it has no port,
+// e.g. for unix sockets
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
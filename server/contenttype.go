@@ -0,0 +1,76 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Content type filters
+// A SUBSCRIBE frame can list the content types its subscription accepts in
+// the HEADER_ACCEPT_CONTENT_TYPE header, comma separated, e.g.
+// "application/json, text/*". Messages of other types are passed over for
+// the subscription: a queue hands them to another subscriber, or keeps them
+// until one turns up, and a topic or group delivers them to the others.
+// Types are compared without their parameters and ignoring case. A message
+// without a content-type, even after Options.DefaultContentType is applied,
+// is only accepted by */*. Subscriptions without the header accept anything.
+
+// Accepted media types, nil accepting everything
+type contentTypeFilter []string
+
+func parseContentTypeFilter(header string) (contentTypeFilter, error) {
+	var filter contentTypeFilter
+	for _, accepted := range strings.Split(header, ",") {
+		mediaType := mediaTypeOf(accepted)
+		if parts := strings.Split(mediaType, "/"); len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("Invalid content type %q in %s header", strings.TrimSpace(accepted), HEADER_ACCEPT_CONTENT_TYPE)
+		}
+		filter = append(filter, mediaType)
+	}
+	return filter, nil
+}
+
+// A content type without its parameters, in lower case
+func mediaTypeOf(contentType string) string {
+	if i := strings.IndexByte(contentType, ';'); i >= 0 {
+		contentType = contentType[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(contentType))
+}
+
+// Whether the filter accepts a message of the content type, empty for an
+// untyped message
+func (filter contentTypeFilter) accepts(contentType string) bool {
+	if filter == nil {
+		return true
+	}
+
+	mediaType := mediaTypeOf(contentType)
+	for _, accepted := range filter {
+		if accepted == "*/*" {
+			return true
+		}
+		if mediaType == "" {
+			continue
+		}
+		if accepted == mediaType || strings.HasSuffix(accepted, "/*") && strings.HasPrefix(mediaType, accepted[:len(accepted)-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+func (filter contentTypeFilter) equal(other contentTypeFilter) bool {
+	return strings.Join(filter, ",") == strings.Join(other, ",") && (filter == nil) == (other == nil)
+}
+
+// The content type a message is delivered with
+func (b *broker) contentTypeOf(msg *message) string {
+	contentType, ok := msg.headers[parsing.HEADER_CONTENT_TYPE]
+	if !ok && len(msg.body) > 0 {
+		contentType = b.opts.DefaultContentType
+	}
+	return contentType
+}
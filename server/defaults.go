@@ -0,0 +1,44 @@
+package server
+
+import "fmt"
+
+// Default subscriptions
+// A DefaultSubscriber names destinations, e.g. a broadcast topic, that each
+// client is subscribed to as soon as it has connected, chosen by its login
+// and the virtual host from its CONNECT. The subscriptions are in auto ack
+// mode with ids DEFAULT_SUBSCRIPTION_PREFIX followed by a counter, which the
+// client sees on the messages it gets and can unsubscribe with. A
+// destination that can't be subscribed to is logged and skipped rather than
+// refusing the connection. Resumed sessions get their own subscriptions back
+// instead.
+
+type DefaultSubscriber interface {
+	DefaultDestinations(principal string, host string) []string
+}
+
+// The same destinations for every client
+type StaticDefaultDestinations []string
+
+func (destinations StaticDefaultDestinations) DefaultDestinations(principal string, host string) []string {
+	return destinations
+}
+
+const DEFAULT_SUBSCRIPTION_PREFIX = "default-"
+
+// Called once the CONNECTED frame has been sent
+func (c *conn) subscribeDefaults(host string) {
+	subscriber := c.server.opts.DefaultSubscriber
+	if subscriber == nil {
+		return
+	}
+
+	opts := subscribeOptions{ackMode: ACK_AUTO, overflow: c.server.opts.OverflowPolicy, batchSize: 1}
+	for i, destination := range subscriber.DefaultDestinations(c.principal, host) {
+		id := fmt.Sprintf("%s%d", DEFAULT_SUBSCRIPTION_PREFIX, i)
+		if err := c.server.broker.subscribe(c, id, destination, opts); err != nil {
+			c.server.log.Warnf("Error subscribing session %s to default destination %s: %s", c.sessionID, destination, err)
+			continue
+		}
+		c.server.log.Debugf("Subscribed session %s to default destination %s as %s", c.sessionID, destination, id)
+	}
+}
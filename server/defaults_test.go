@@ -0,0 +1,51 @@
+package server_test
+
+import (
+	"testing"
+
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestDefaultSubscriptions(t *testing.T) {
+	srv, addr := startServer(t, server.Options{
+		Authenticator:     acceptAny{},
+		DefaultSubscriber: loginDefaults{},
+	})
+
+	consumer := dial(t, addr)
+	session := consumer.connect(map[string]string{"login": "ops"}).Headers["session"]
+	eventually(t, func() bool { return len(srv.SubscriptionsForConn(session)) == 2 })
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/broadcast", "to everyone")
+	frame := consumer.expectMessage("to everyone")
+	if frame.Headers["subscription"] != "default-0" {
+		t.Errorf("Message should carry the default subscription's id, got %v", frame.Headers)
+	}
+	producer.publish("/topic/ops", "to ops")
+	frame = consumer.expectMessage("to ops")
+	if frame.Headers["subscription"] != "default-1" {
+		t.Errorf("Message should carry the default subscription's id, got %v", frame.Headers)
+	}
+}
+
+func TestStaticDefaultDestinations(t *testing.T) {
+	srv, addr := startServer(t, server.Options{DefaultSubscriber: server.StaticDefaultDestinations{"/topic/broadcast"}})
+
+	consumer := dial(t, addr)
+	session := consumer.connect(nil).Headers["session"]
+	eventually(t, func() bool { return len(srv.SubscriptionsForConn(session)) == 1 })
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/broadcast", "hello")
+	consumer.expectMessage("hello")
+}
+
+// Subscribes everyone to a broadcast topic, and each login to its own topic
+type loginDefaults struct{}
+
+func (loginDefaults) DefaultDestinations(principal string, host string) []string {
+	return []string{"/topic/broadcast", "/topic/" + principal}
+}
@@ -0,0 +1,32 @@
+package server
+
+// Headers understood by this server which are not part of the STOMP spec
+const (
+	HEADER_ACCEPT_CONTENT_TYPE  = "accept-content-type"
+	HEADER_BATCH_SIZE           = "batch-size"
+	HEADER_BROKER_SEQ           = "x-broker-seq"
+	HEADER_CLIENT_ID            = "client-id"
+	HEADER_DEAD_LETTER          = "dead-letter"
+	HEADER_DELIVER_AFTER        = "deliver-after"
+	HEADER_DELIVERED_TO         = "x-delivered-to"
+	HEADER_DURABLE              = "durable"
+	HEADER_EXPIRES              = "expires"
+	HEADER_ORIGINAL_DESTINATION = "original-destination"
+	HEADER_OVERFLOW_POLICY      = "overflow-policy"
+	HEADER_PERSISTENT           = "persistent"
+	HEADER_REDELIVERED          = "redelivered"
+	HEADER_REDELIVERY_COUNT     = "redelivery-count"
+	HEADER_REPLY_TO             = "reply-to"
+	HEADER_RESUME_TOKEN         = "resume-token"
+	HEADER_SELECTOR             = "selector"
+	HEADER_SUBSCRIPTION_GROUP   = "subscription-group"
+	HEADER_TARGET               = "target"
+	HEADER_TRACE_ID             = "x-trace-id"
+	HEADER_TTL                  = "ttl"
+
+	// Last will, published on the client's behalf if its connection drops
+	// without a DISCONNECT
+	HEADER_WILL_DESTINATION  = "will-destination"
+	HEADER_WILL_BODY         = "will-body"
+	HEADER_WILL_CONTENT_TYPE = "will-content-type"
+)
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+)
+
+// Health checks
+// /healthz reports whether the server is up and listening, /readyz whether
+// it is accepting new connections, which stops as soon as it starts
+// draining. Both respond 200 when healthy and 503 otherwise.
+
+// HealthHandler returns an HTTP handler serving /healthz and /readyz
+func (server *Server) HealthHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, server.isLive())
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		writeHealth(w, server.isReady())
+	})
+	return mux
+}
+
+func (server *Server) listenHealth() error {
+	listener, err := net.Listen("tcp", server.opts.HealthAddr)
+	if err != nil {
+		return fmt.Errorf("listening for health checks: %s", err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/healthz", server.HealthHandler())
+	mux.Handle("/readyz", server.HealthHandler())
+	mux.Handle("/metrics", server.MetricsHandler())
+	health := &http.Server{Handler: mux}
+	server.mu.Lock()
+	server.health = health
+	server.mu.Unlock()
+
+	server.log.Infof("Serving health checks and metrics on %s", listener.Addr())
+	go health.Serve(listener)
+	return nil
+}
+
+func (server *Server) isLive() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.listener != nil && !server.closed
+}
+
+func (server *Server) isReady() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.listener != nil && !server.closed && !server.draining
+}
+
+func writeHealth(w http.ResponseWriter, ok bool) {
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintln(w, "unavailable")
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
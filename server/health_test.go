@@ -0,0 +1,85 @@
+package server_test
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestHealthBeforeListening(t *testing.T) {
+	srv, _ := server.New(server.Options{})
+
+	if status := healthStatus(srv, "/healthz"); status != http.StatusServiceUnavailable {
+		t.Errorf("/healthz should fail before the server is listening, got %d", status)
+	}
+	if status := healthStatus(srv, "/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("/readyz should fail before the server is listening, got %d", status)
+	}
+}
+
+func TestReadyUntilDrained(t *testing.T) {
+	srv, addr := startServer(t, server.Options{})
+	eventually(t, func() bool { return srv.Addr() != nil })
+
+	if status := healthStatus(srv, "/readyz"); status != http.StatusOK {
+		t.Errorf("/readyz should pass while listening, got %d", status)
+	}
+
+	client := dial(t, addr)
+	client.connect(nil)
+	srv.Drain()
+
+	if status := healthStatus(srv, "/readyz"); status != http.StatusServiceUnavailable {
+		t.Errorf("/readyz should fail once draining, got %d", status)
+	}
+	if status := healthStatus(srv, "/healthz"); status != http.StatusOK {
+		t.Errorf("/healthz should pass while draining, got %d", status)
+	}
+
+	// Existing sessions carry on but new connections are refused
+	client.request(parsing.SEND, map[string]string{"destination": "/queue/a"}, "hello")
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Errorf("New connections should be refused once draining")
+	}
+
+	srv.Close()
+	if status := healthStatus(srv, "/healthz"); status != http.StatusServiceUnavailable {
+		t.Errorf("/healthz should fail once closed, got %d", status)
+	}
+}
+
+func TestHealthAddr(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error reserving a port: %s", err)
+	}
+	healthAddr := listener.Addr().String()
+	listener.Close()
+
+	srv, err := server.New(server.Options{Addr: "127.0.0.1:0", HealthAddr: healthAddr})
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+	go srv.ListenAndServe()
+	t.Cleanup(func() { srv.Close() })
+
+	eventually(t, func() bool {
+		resp, err := http.Get("http://" + healthAddr + "/readyz")
+		if err != nil {
+			return false
+		}
+		resp.Body.Close()
+		return resp.StatusCode == http.StatusOK
+	})
+}
+
+func healthStatus(srv *server.Server, path string) int {
+	recorder := httptest.NewRecorder()
+	srv.HealthHandler().ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+	return recorder.Code
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Heart-beating
+// Each direction's interval is negotiated as the spec says: the larger of
+// what the sender can do and what the receiver wants, or none if either is
+// zero. The server's advertised intervals are never below MinHeartBeat, so
+// a client asking for faster heart-beats is clamped to the minimum unless
+// the policy is to reject it. Heart-beats are only sent when nothing else
+// has been written for half the interval. A client that sends nothing for
+// HEART_BEAT_TOLERANCE times its interval is presumed dead.
+
+const HEART_BEAT_TOLERANCE = 2
+
+// Negotiate the intervals at which the server sends heart-beats to a client
+// and expects to receive them, from the client's heart-beat header
+func (server *Server) negotiateHeartBeat(client parsing.HeartBeat) (advertised parsing.HeartBeat, send time.Duration, receive time.Duration, err error) {
+	opts := server.opts
+	advertised = parsing.HeartBeat{
+		Outgoing: atLeast(opts.HeartBeatSend, opts.MinHeartBeat),
+		Incoming: atLeast(opts.HeartBeatReceive, opts.MinHeartBeat),
+	}
+
+	if advertised.Outgoing > 0 && client.Incoming > 0 {
+		if client.Incoming < opts.MinHeartBeat && opts.HeartBeatPolicy == HEART_BEAT_REJECT {
+			return advertised, 0, 0, fmt.Errorf("Heart-beats every %s are more often than the minimum of %s", client.Incoming, opts.MinHeartBeat)
+		}
+		send = atLeast(advertised.Outgoing, client.Incoming)
+	}
+	if advertised.Incoming > 0 && client.Outgoing > 0 {
+		receive = atLeast(advertised.Incoming, client.Outgoing)
+	}
+	return advertised, send, receive, nil
+}
+
+// The larger of two intervals, or zero if the first is
+func atLeast(interval time.Duration, min time.Duration) time.Duration {
+	if interval > 0 && interval < min {
+		return min
+	}
+	return interval
+}
+
+// Ask the writer for a heart-beat whenever nothing has been written for half
+// the interval, until the connection closes
+func (c *conn) sendHeartBeats(interval time.Duration) {
+	for {
+		<-c.server.clock.After(interval / 2)
+		if atomic.SwapInt32(&c.wrote, 0) == 1 {
+			continue
+		}
+		if !c.outbox.pushHeartBeat() {
+			return
+		}
+	}
+}
+
+// Reads from a connection, failing if nothing arrives within the timeout.
+// The deadline is pushed back on every read, so heart-beats keep the
+// connection alive even though the parser only sees them between frames.
+// Socket deadlines always use the real time.
+type idleReader struct {
+	conn     net.Conn
+	timeout  time.Duration // Zero never times out
+	timedOut bool
+}
+
+func (reader *idleReader) Read(p []byte) (int, error) {
+	if reader.timeout > 0 {
+		reader.conn.SetReadDeadline(time.Now().Add(reader.timeout))
+	}
+	n, err := reader.conn.Read(p)
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+		reader.timedOut = true
+	}
+	return n, err
+}
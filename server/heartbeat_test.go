@@ -0,0 +1,122 @@
+package server_test
+
+import (
+	"bufio"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestHeartBeatNegotiation(t *testing.T) {
+	_, addr := startServer(t, server.Options{HeartBeatSend: time.Second, HeartBeatReceive: 2 * time.Second})
+
+	client := dial(t, addr)
+	connected := client.connect(map[string]string{"heart-beat": "500,5000"})
+	if connected.Headers["heart-beat"] != "1000,2000" {
+		t.Errorf("CONNECTED should advertise the server's intervals, got %q", connected.Headers["heart-beat"])
+	}
+}
+
+func TestHeartBeatAbsentFromConnect(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{HeartBeatSend: time.Second, HeartBeatReceive: 2 * time.Second, Clock: clock})
+	clock.BlockUntil(1) // The server's eviction sweep
+	timers := clock.Pending()
+
+	client := dial(t, addr)
+	connected := client.connect(nil)
+	if connected.Headers["heart-beat"] != "1000,2000" {
+		t.Errorf("CONNECTED should advertise the server's intervals, got %q", connected.Headers["heart-beat"])
+	}
+	if clock.Pending() != timers {
+		t.Errorf("A CONNECT without a heart-beat header should not start heart-beating")
+	}
+
+	beating := dial(t, addr)
+	beating.connect(map[string]string{"heart-beat": "0,1000"})
+	clock.BlockUntil(timers + 1)
+}
+
+func TestAggressiveHeartBeatClamped(t *testing.T) {
+	_, addr := startServer(t, server.Options{HeartBeatSend: 10 * time.Millisecond, MinHeartBeat: 50 * time.Millisecond})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("CONNECT\naccept-version:1.2\nhost:localhost\nheart-beat:0,1\n\n\x00"))
+
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(FRAME_TIMEOUT))
+	connected, err := reader.ReadString('\x00')
+	if err != nil || !strings.Contains(connected, "heart-beat:50,0\n") {
+		t.Fatalf("CONNECTED should advertise the minimum interval, got %q %v", connected, err)
+	}
+
+	// Heart-beats still come, but no more often than the minimum allows
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	heartBeats := 0
+	for {
+		b, err := reader.ReadByte()
+		if err != nil {
+			break
+		}
+		if b != '\n' {
+			t.Fatalf("Expected only heart-beats, got %q", b)
+		}
+		heartBeats++
+	}
+	if heartBeats < 1 || heartBeats > 10 {
+		t.Errorf("Heart-beats should be sent at the minimum interval, got %d in 200ms", heartBeats)
+	}
+}
+
+func TestAggressiveHeartBeatRejected(t *testing.T) {
+	_, addr := startServer(t, server.Options{
+		HeartBeatSend:   time.Second,
+		MinHeartBeat:    time.Second,
+		HeartBeatPolicy: server.HEART_BEAT_REJECT,
+	})
+
+	client := dial(t, addr)
+	client.sendFrame(parsing.Frame{Command: parsing.CONNECT, Headers: map[string]string{"heart-beat": "0,10"}, Body: []byte{}})
+	frame := client.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "minimum") {
+		t.Errorf("Error should explain the heart-beat minimum, got %q", frame.Headers["message"])
+	}
+	client.expectClosed()
+}
+
+func TestInvalidHeartBeatRejected(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	client.sendFrame(parsing.Frame{Command: parsing.CONNECT, Headers: map[string]string{"heart-beat": "soon"}, Body: []byte{}})
+	client.expectFrame(parsing.ERROR)
+	client.expectClosed()
+}
+
+func TestSilentClientDisconnected(t *testing.T) {
+	_, addr := startServer(t, server.Options{HeartBeatReceive: 20 * time.Millisecond})
+
+	client := dial(t, addr)
+	client.connect(map[string]string{"heart-beat": "20,0"})
+	client.expectClosed()
+}
+
+func TestHeartBeatsKeepClientConnected(t *testing.T) {
+	_, addr := startServer(t, server.Options{HeartBeatReceive: 20 * time.Millisecond})
+
+	client := dial(t, addr)
+	client.connect(map[string]string{"heart-beat": "20,0"})
+	for i := 0; i < 10; i++ {
+		time.Sleep(10 * time.Millisecond)
+		client.send("\n")
+	}
+	client.subscribe("/queue/a", "0", nil)
+}
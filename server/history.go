@@ -0,0 +1,48 @@
+package server
+
+import "github.com/jonathanlloyd/skewserver/parsing"
+
+// Frame history
+// Each connection remembers a summary of the last few frames it read, with
+// their headers but not their bodies, so that when it closes the debug log
+// shows what the client was doing. Passcodes are redacted. Only touched by
+// the connection's reader goroutine. The zero value is an empty history.
+
+const FRAME_HISTORY_SIZE = 16
+
+type frameHistory struct {
+	frames   [FRAME_HISTORY_SIZE]string
+	next     int // Slot for the next frame
+	recorded int // How many slots are filled, up to FRAME_HISTORY_SIZE
+}
+
+func (history *frameHistory) record(frame parsing.Frame) {
+	history.frames[history.next] = redact(frame).String()
+	history.next = (history.next + 1) % FRAME_HISTORY_SIZE
+	if history.recorded < FRAME_HISTORY_SIZE {
+		history.recorded++
+	}
+}
+
+// The recorded frames, oldest first
+func (history *frameHistory) recent() []string {
+	recent := make([]string, 0, history.recorded)
+	for i := FRAME_HISTORY_SIZE - history.recorded; i < FRAME_HISTORY_SIZE; i++ {
+		recent = append(recent, history.frames[(history.next+i)%FRAME_HISTORY_SIZE])
+	}
+	return recent
+}
+
+func redact(frame parsing.Frame) parsing.Frame {
+	if _, ok := frame.Headers[parsing.HEADER_PASSCODE]; !ok {
+		return frame
+	}
+	frame = frame.Clone()
+	frame.Headers[parsing.HEADER_PASSCODE] = "***"
+	for i, header := range frame.RawHeaders {
+		if header[0] == parsing.HEADER_PASSCODE {
+			frame.RawHeaders[i][1] = "***"
+		}
+	}
+	return frame
+}
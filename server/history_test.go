@@ -0,0 +1,44 @@
+package server
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+func TestFrameHistoryKeepsMostRecent(t *testing.T) {
+	var history frameHistory
+	if len(history.recent()) != 0 {
+		t.Errorf("A new history should be empty")
+	}
+
+	for i := 0; i < FRAME_HISTORY_SIZE+3; i++ {
+		history.record(parsing.Frame{Command: parsing.SEND, Headers: map[string]string{"destination": fmt.Sprint(i)}})
+	}
+
+	recent := history.recent()
+	if len(recent) != FRAME_HISTORY_SIZE {
+		t.Fatalf("History should keep the last %d frames, got %d", FRAME_HISTORY_SIZE, len(recent))
+	}
+	for i, summary := range recent {
+		expected := fmt.Sprintf("SEND destination:%d (0 byte body)", i+3)
+		if summary != expected {
+			t.Errorf("Frame %d of the history should be %q, got %q", i, expected, summary)
+		}
+	}
+}
+
+func TestFrameHistoryRedactsPasscode(t *testing.T) {
+	var history frameHistory
+	frame := parsing.Frame{Command: parsing.CONNECT, Headers: map[string]string{"login": "alice", "passcode": "secret"}}
+	history.record(frame)
+
+	if strings.Contains(history.recent()[0], "secret") {
+		t.Errorf("History should not record passcodes, got %q", history.recent()[0])
+	}
+	if frame.Headers["passcode"] != "secret" {
+		t.Errorf("Redacting the history should not change the frame")
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Logger is the subset of the logrus API used by the server. Embedders can
+// plug in their own implementation and tests can capture output.
+type Logger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// TraceLogger is a Logger with a trace level below debug, as logrus has.
+// Frame bodies are only ever logged at trace level, see Options.LogBodies.
+type TraceLogger interface {
+	Logger
+	Tracef(format string, args ...interface{})
+}
+
+// Rate limits a repetitive log line to limit occurrences per interval
+type logLimiter struct {
+	clock    Clock
+	limit    int
+	interval time.Duration
+
+	windowStart time.Time
+	logged      int
+	suppressed  int
+}
+
+// Record an occurrence, returning whether to log it and, when an interval
+// has just ended, how many occurrences were suppressed during it
+func (limiter *logLimiter) allow() (allowed bool, suppressed int) {
+	now := limiter.clock.Now()
+	if now.Sub(limiter.windowStart) >= limiter.interval {
+		suppressed = limiter.suppressed
+		limiter.windowStart = now
+		limiter.logged = 0
+		limiter.suppressed = 0
+	}
+
+	if limiter.logged < limiter.limit {
+		limiter.logged++
+		return true, suppressed
+	}
+	limiter.suppressed++
+	return false, suppressed
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debugf(format string, args ...interface{}) {}
+func (nopLogger) Infof(format string, args ...interface{})  {}
+func (nopLogger) Warnf(format string, args ...interface{})  {}
+func (nopLogger) Errorf(format string, args ...interface{}) {}
+
+// Body logging
+// With Options.LogBodies set, and a logger that has a trace level, each frame
+// read from a client is logged in full. Its body is quoted so that binary
+// content can't garble the log and cut short at the configured limit, and
+// passcodes are redacted as for the frame history.
+
+// How much of a body is logged unless Options.LogBodyLimit says otherwise
+const DEFAULT_LOG_BODY_LIMIT = 256
+
+func describeWithBody(frame parsing.Frame, limit int) string {
+	if len(frame.Body) == 0 {
+		return redact(frame).String()
+	}
+	body := frame.Body
+	truncated := ""
+	if len(body) > limit {
+		truncated = fmt.Sprintf(" (%d more bytes)", len(body)-limit)
+		body = body[:limit]
+	}
+	return fmt.Sprintf("%s: %q%s", redact(frame), body, truncated)
+}
@@ -0,0 +1,249 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Management
+// Operators query the server by sending to a destination under
+// MANAGEMENT_PREFIX, naming what the operation applies to in headers. The
+// answer is published as a JSON message to the destination in the reply-to
+// header. Only logins listed in Options.AdminLogins may do this.
+
+const (
+	MANAGEMENT_PREFIX        = "/admin/"
+	MANAGEMENT_SUBSCRIPTIONS = MANAGEMENT_PREFIX + "subscriptions" // Subscriptions of the session in the session header
+	MANAGEMENT_DISCONNECT    = MANAGEMENT_PREFIX + "disconnect"    // Forcibly disconnect the session in the session header
+	MANAGEMENT_QUARANTINE    = MANAGEMENT_PREFIX + "quarantine"    // Messages held in quarantine, oldest first
+	MANAGEMENT_UNACKED       = MANAGEMENT_PREFIX + "unacked"       // Unacked deliveries of the session in the session header
+	MANAGEMENT_PURGE         = MANAGEMENT_PREFIX + "purge"         // Remove the messages retained on the queue in the target header
+)
+
+// Subscription describes one of a session's active subscriptions
+type Subscription struct {
+	ID          string `json:"id"`
+	Destination string `json:"destination"`
+	AckMode     string `json:"ack"`
+	Durable     bool   `json:"durable"`
+	Group       string `json:"group,omitempty"`
+	Paused      bool   `json:"paused"`
+	Acked       uint64 `json:"acked"` // Deliveries acked so far
+
+	Accepts []string `json:"accepts,omitempty"` // Content types taken, if filtered
+}
+
+func (sub Subscription) String() string {
+	return fmt.Sprintf("%s:%s", sub.ID, sub.Destination)
+}
+
+// SubscriptionsForConn lists the active subscriptions of the connection with
+// the given session id, ordered by subscription id. It returns nil if there
+// is no such connection.
+func (server *Server) SubscriptionsForConn(sessionID string) []Subscription {
+	c := server.connForSession(sessionID)
+	if c == nil {
+		return nil
+	}
+	return server.broker.subscriptionsOf(c)
+}
+
+// UnackedMessage describes a delivery waiting for an ACK or NACK, for finding
+// consumers that have stopped acking
+type UnackedMessage struct {
+	ID           string    `json:"id"`
+	AckID        string    `json:"ack"`
+	Redeliveries int       `json:"redeliveries"`
+	DeliveredAt  time.Time `json:"delivered_at"`
+	AgeMillis    int64     `json:"age_ms"` // How long the delivery has been waiting
+}
+
+// UnackedForConn lists the unacked deliveries of the connection with the
+// given session id, oldest first, keyed by subscription id. Subscriptions
+// with nothing unacked are left out. It returns nil if there is no such
+// connection.
+func (server *Server) UnackedForConn(sessionID string) map[string][]UnackedMessage {
+	c := server.connForSession(sessionID)
+	if c == nil {
+		return nil
+	}
+	return server.broker.unackedOf(c)
+}
+
+// Disconnection says whether a session was forcibly disconnected
+type Disconnection struct {
+	Session      string `json:"session"`
+	Disconnected bool   `json:"disconnected"` // False if there was no such session
+}
+
+// DisconnectSession forcibly disconnects the connection with the given
+// session id, sending it an ERROR with the reason. The session is torn down
+// as for any dropped connection, so its last will is published. It returns
+// false if there is no such connection.
+func (server *Server) DisconnectSession(sessionID string, reason string) bool {
+	c := server.connForSession(sessionID)
+	if c == nil {
+		return false
+	}
+	c.terminate(reason)
+	return true
+}
+
+func (server *Server) connForSession(sessionID string) *conn {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	for c := range server.conns {
+		if c.sessionID == sessionID {
+			return c
+		}
+	}
+	return nil
+}
+
+func (b *broker) subscriptionsOf(c *conn) []Subscription {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	subs := make([]Subscription, 0, len(c.subscriptions))
+	for _, sub := range c.subscriptions {
+		subs = append(subs, sub.describe())
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+	return subs
+}
+
+func (b *broker) unackedOf(c *conn) map[string][]UnackedMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.clock.Now()
+	unacked := map[string][]UnackedMessage{}
+	for _, sub := range c.subscriptions {
+		for _, d := range sub.unacked.list() {
+			unacked[sub.id] = append(unacked[sub.id], UnackedMessage{
+				ID:           d.message.id,
+				AckID:        d.ackID,
+				Redeliveries: d.message.redeliveries,
+				DeliveredAt:  d.deliveredAt,
+				AgeMillis:    int64(now.Sub(d.deliveredAt) / time.Millisecond),
+			})
+		}
+	}
+	return unacked
+}
+
+func (sub *subscription) describe() Subscription {
+	return Subscription{
+		ID:          sub.id,
+		Destination: sub.destination.name,
+		AckMode:     ackModeNames[sub.ackMode],
+		Durable:     sub.durableKey != "",
+		Group:       sub.group,
+		Paused:      sub.paused,
+		Acked:       sub.acked,
+		Accepts:     sub.accepts,
+	}
+}
+
+func (c *conn) handleManagement(frame parsing.Frame) bool {
+	if !c.isAdmin() {
+		c.server.log.Warnf("Session %s (login %q) attempted a management operation", c.sessionID, c.principal)
+		c.reject(REJECT_UNAUTHORIZED, "Not authorized for management operations")
+		return false
+	}
+	if !c.requireHeaders(frame, HEADER_REPLY_TO) {
+		return false
+	}
+
+	var reply interface{}
+	switch operation := frame.Headers[parsing.HEADER_DESTINATION]; operation {
+	case MANAGEMENT_SUBSCRIPTIONS:
+		if !c.requireHeaders(frame, parsing.HEADER_SESSION) {
+			return false
+		}
+		subs := c.server.SubscriptionsForConn(frame.Headers[parsing.HEADER_SESSION])
+		if subs == nil {
+			subs = []Subscription{}
+		}
+		reply = subs
+	case MANAGEMENT_DISCONNECT:
+		if !c.requireHeaders(frame, parsing.HEADER_SESSION) {
+			return false
+		}
+		session := frame.Headers[parsing.HEADER_SESSION]
+		c.server.log.Infof("Session %s (login %q) is disconnecting session %s", c.sessionID, c.principal, session)
+		reply = Disconnection{
+			Session:      session,
+			Disconnected: c.server.DisconnectSession(session, "Disconnected by an administrator"),
+		}
+	case MANAGEMENT_QUARANTINE:
+		reply = c.server.QuarantinedMessages()
+	case MANAGEMENT_UNACKED:
+		if !c.requireHeaders(frame, parsing.HEADER_SESSION) {
+			return false
+		}
+		unacked := c.server.UnackedForConn(frame.Headers[parsing.HEADER_SESSION])
+		if unacked == nil {
+			unacked = map[string][]UnackedMessage{}
+		}
+		reply = unacked
+	case MANAGEMENT_PURGE:
+		if !c.requireHeaders(frame, HEADER_TARGET) {
+			return false
+		}
+		target := frame.Headers[HEADER_TARGET]
+		c.server.log.Infof("Session %s (login %q) is purging %s", c.sessionID, c.principal, target)
+		purge, err := c.server.PurgeQueue(target, frame.Headers[HEADER_DEAD_LETTER] == "true")
+		if err != nil {
+			c.rejectRefused(err)
+			return false
+		}
+		reply = purge
+	default:
+		c.reject(REJECT_INVALID, fmt.Sprintf("Unknown management operation %s", operation))
+		return false
+	}
+
+	body, err := json.Marshal(reply)
+	if err != nil {
+		c.sendError(fmt.Sprintf("Error encoding management reply: %s", err))
+		return false
+	}
+	_, err = c.server.broker.send(c, parsing.Frame{
+		Command: parsing.SEND,
+		Headers: map[string]string{
+			parsing.HEADER_DESTINATION:  frame.Headers[HEADER_REPLY_TO],
+			parsing.HEADER_CONTENT_TYPE: "application/json",
+		},
+		Body: body,
+	})
+	if err != nil {
+		c.sendError(err.Error())
+		return false
+	}
+	c.sendReceipt(frame)
+	return true
+}
+
+func (c *conn) isAdmin() bool {
+	for _, login := range c.server.opts.AdminLogins {
+		if c.principal != "" && c.principal == login {
+			return true
+		}
+	}
+	return false
+}
+
+func formatSubscriptions(subs []Subscription) string {
+	names := make([]string, len(subs))
+	for i, sub := range subs {
+		names[i] = sub.String()
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,280 @@
+package server_test
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestSubscriptionsForConn(t *testing.T) {
+	srv, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	session := client.connect(nil).Headers["session"]
+	if subs := srv.SubscriptionsForConn(session); len(subs) != 0 {
+		t.Errorf("New session should have no subscriptions, got %v", subs)
+	}
+
+	client.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+	client.subscribe("/topic/b", "1", nil)
+	expected := []server.Subscription{
+		{ID: "0", Destination: "/queue/a", AckMode: "client"},
+		{ID: "1", Destination: "/topic/b", AckMode: "auto"},
+	}
+	if subs := srv.SubscriptionsForConn(session); !reflect.DeepEqual(expected, subs) {
+		t.Errorf("Should list subscriptions, got %v", subs)
+	}
+
+	client.request(parsing.UNSUBSCRIBE, map[string]string{"id": "0"}, "")
+	if subs := srv.SubscriptionsForConn(session); !reflect.DeepEqual(expected[1:], subs) {
+		t.Errorf("Should not list removed subscriptions, got %v", subs)
+	}
+
+	if subs := srv.SubscriptionsForConn("no-such-session"); subs != nil {
+		t.Errorf("Unknown session should have no subscriptions, got %v", subs)
+	}
+}
+
+func TestManagementSubscriptions(t *testing.T) {
+	_, addr := startServer(t, server.Options{Authenticator: acceptAny{}, AdminLogins: []string{"admin"}})
+
+	client := dial(t, addr)
+	session := client.connect(nil).Headers["session"]
+	client.subscribe("/queue/a", "0", nil)
+
+	admin := dial(t, addr)
+	admin.connect(map[string]string{"login": "admin"})
+	admin.subscribe("/queue/replies", "replies", nil)
+	admin.request(parsing.SEND, map[string]string{
+		"destination": "/admin/subscriptions",
+		"session":     session,
+		"reply-to":    "/queue/replies",
+	}, "")
+
+	frame, ok := admin.nextFrame(FRAME_TIMEOUT)
+	if !ok || frame.Command != parsing.MESSAGE {
+		t.Fatalf("Admin should get a reply")
+	}
+	var subs []server.Subscription
+	if err := json.Unmarshal(frame.Body, &subs); err != nil {
+		t.Fatalf("Reply should be JSON: %s", err)
+	}
+	if len(subs) != 1 || subs[0].Destination != "/queue/a" {
+		t.Errorf("Reply should list the session's subscriptions, got %v", subs)
+	}
+}
+
+func TestManagementDisconnect(t *testing.T) {
+	_, addr := startServer(t, server.Options{Authenticator: acceptAny{}, AdminLogins: []string{"admin"}})
+
+	misbehaving := dial(t, addr)
+	session := misbehaving.connect(nil).Headers["session"]
+	bystander := dial(t, addr)
+	bystander.connect(nil)
+
+	admin := dial(t, addr)
+	admin.connect(map[string]string{"login": "admin"})
+	admin.subscribe("/queue/replies", "replies", nil)
+	admin.request(parsing.SEND, map[string]string{
+		"destination": "/admin/disconnect",
+		"session":     session,
+		"reply-to":    "/queue/replies",
+	}, "")
+
+	frame := misbehaving.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "administrator") {
+		t.Errorf("Disconnected session should be told why, got %v", frame.Headers)
+	}
+	misbehaving.expectClosed()
+
+	frame, ok := admin.nextFrame(FRAME_TIMEOUT)
+	if !ok || frame.Command != parsing.MESSAGE {
+		t.Fatalf("Admin should get a reply")
+	}
+	var result server.Disconnection
+	if err := json.Unmarshal(frame.Body, &result); err != nil || !result.Disconnected || result.Session != session {
+		t.Errorf("Reply should confirm the disconnect, got %s (%v)", frame.Body, err)
+	}
+
+	bystander.request(parsing.SEND, map[string]string{"destination": "/queue/a"}, "still here")
+}
+
+func TestManagementQuarantine(t *testing.T) {
+	clock := server.NewFakeClock()
+	srv, addr := startServer(t, server.Options{
+		Authenticator:   acceptAny{},
+		AdminLogins:     []string{"admin"},
+		DeadLetterQueue: "/queue/dlq",
+		QuarantineSize:  10,
+		Clock:           clock,
+	})
+
+	deadLetters := dial(t, addr)
+	deadLetters.connect(nil)
+	deadLetters.subscribe("/queue/dlq", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "ttl": "50", "x-poison": "yes"}, "poison\x01")
+	clock.Advance(100 * time.Millisecond)
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+	consumer.expectNoFrame()
+	deadLetters.expectNoFrame()
+
+	admin := dial(t, addr)
+	admin.connect(map[string]string{"login": "admin"})
+	admin.subscribe("/queue/replies", "replies", nil)
+	admin.request(parsing.SEND, map[string]string{"destination": "/admin/quarantine", "reply-to": "/queue/replies"}, "")
+
+	frame, ok := admin.nextFrame(FRAME_TIMEOUT)
+	if !ok || frame.Command != parsing.MESSAGE {
+		t.Fatalf("Admin should get a reply")
+	}
+	var quarantined []server.QuarantinedMessage
+	if err := json.Unmarshal(frame.Body, &quarantined); err != nil || len(quarantined) != 1 {
+		t.Fatalf("Reply should list the quarantined message, got %s (%v)", frame.Body, err)
+	}
+	msg := quarantined[0]
+	if msg.Destination != "/queue/a" || msg.Headers["x-poison"] != "yes" || string(msg.Body) != "poison\x01" {
+		t.Errorf("Quarantined message should keep its destination, headers and body, got %+v", msg)
+	}
+	if !reflect.DeepEqual(quarantined, srv.QuarantinedMessages()) {
+		t.Errorf("Reply should match the server's quarantine, got %+v", quarantined)
+	}
+}
+
+func TestManagementUnacked(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{Authenticator: acceptAny{}, AdminLogins: []string{"admin"}, Clock: clock})
+
+	consumer := dial(t, addr)
+	session := consumer.connect(nil).Headers["session"]
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+	consumer.subscribe("/queue/b", "1", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a"}, "first")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a"}, "second")
+	first := consumer.expectFrame(parsing.MESSAGE)
+	second := consumer.expectFrame(parsing.MESSAGE)
+	clock.Advance(2 * time.Second)
+
+	admin := dial(t, addr)
+	admin.connect(map[string]string{"login": "admin"})
+	admin.subscribe("/queue/replies", "replies", nil)
+	admin.request(parsing.SEND, map[string]string{
+		"destination": "/admin/unacked",
+		"session":     session,
+		"reply-to":    "/queue/replies",
+	}, "")
+
+	frame, ok := admin.nextFrame(FRAME_TIMEOUT)
+	if !ok || frame.Command != parsing.MESSAGE {
+		t.Fatalf("Admin should get a reply")
+	}
+	var unacked map[string][]server.UnackedMessage
+	if err := json.Unmarshal(frame.Body, &unacked); err != nil {
+		t.Fatalf("Reply should be JSON: %s", err)
+	}
+	if len(unacked) != 1 || len(unacked["0"]) != 2 {
+		t.Fatalf("Reply should only list subscriptions with unacked deliveries, got %s", frame.Body)
+	}
+	for i, delivered := range []parsing.Frame{first, second} {
+		msg := unacked["0"][i]
+		if msg.ID != delivered.Headers["message-id"] || msg.AckID != delivered.Headers["ack"] {
+			t.Errorf("Reply should list deliveries oldest first, got %+v for %v", msg, delivered.Headers)
+		}
+		if msg.AgeMillis != 2000 {
+			t.Errorf("Reply should give how long deliveries have waited, got %dms", msg.AgeMillis)
+		}
+	}
+}
+
+func TestManagementPurge(t *testing.T) {
+	_, addr := startServer(t, server.Options{Authenticator: acceptAny{}, AdminLogins: []string{"admin"}})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	for i := 0; i < 3; i++ {
+		producer.publish("/queue/stuck", "stale")
+	}
+
+	admin := dial(t, addr)
+	admin.connect(map[string]string{"login": "admin"})
+	admin.subscribe("/queue/replies", "replies", nil)
+	admin.request(parsing.SEND, map[string]string{
+		"destination": "/admin/purge",
+		"target":      "/queue/stuck",
+		"reply-to":    "/queue/replies",
+	}, "")
+
+	frame, ok := admin.nextFrame(FRAME_TIMEOUT)
+	if !ok || frame.Command != parsing.MESSAGE {
+		t.Fatalf("Admin should get a reply")
+	}
+	var purge server.Purge
+	if err := json.Unmarshal(frame.Body, &purge); err != nil || purge.Purged != 3 || purge.Destination != "/queue/stuck" {
+		t.Errorf("Reply should count the purged messages, got %s (%v)", frame.Body, err)
+	}
+
+	producer.publish("/queue/stuck", "fresh")
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/stuck", "0", nil)
+	consumer.expectMessage("fresh")
+	consumer.expectNoFrame()
+}
+
+func TestManagementPurgeToDeadLetterQueue(t *testing.T) {
+	_, addr := startServer(t, server.Options{Authenticator: acceptAny{}, AdminLogins: []string{"admin"}, DeadLetterQueue: "/queue/dlq"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/stuck", "stale")
+
+	admin := dial(t, addr)
+	admin.connect(map[string]string{"login": "admin"})
+	admin.request(parsing.SEND, map[string]string{
+		"destination": "/admin/purge",
+		"target":      "/queue/stuck",
+		"dead-letter": "true",
+		"reply-to":    "/queue/replies",
+	}, "")
+
+	deadLetters := dial(t, addr)
+	deadLetters.connect(nil)
+	deadLetters.subscribe("/queue/dlq", "0", nil)
+	frame := deadLetters.expectMessage("stale")
+	if frame.Headers["original-destination"] != "/queue/stuck" {
+		t.Errorf("Dead letter should say where it was purged from, got %v", frame.Headers)
+	}
+
+	admin.send("SEND\ndestination:/admin/purge\ntarget:/topic/a\nreply-to:/queue/replies\n\n\x00")
+	admin.expectFrame(parsing.ERROR)
+}
+
+func TestManagementRequiresAdmin(t *testing.T) {
+	_, addr := startServer(t, server.Options{Authenticator: acceptAny{}, AdminLogins: []string{"admin"}})
+
+	client := dial(t, addr)
+	client.connect(map[string]string{"login": "someone"})
+	client.send("SEND\ndestination:/admin/subscriptions\nsession:session-1\nreply-to:/queue/replies\nreceipt:r1\n\n\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if frame.Headers["receipt-id"] != "r1" {
+		t.Errorf("Error should be correlated with the failed frame's receipt, got %v", frame.Headers)
+	}
+	client.expectClosed()
+}
+
+type acceptAny struct{}
+
+func (acceptAny) Authenticate(login string, passcode string) bool { return true }
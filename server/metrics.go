@@ -0,0 +1,373 @@
+package server
+
+import (
+	"fmt"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Metrics
+// Load figures are served at /metrics in the Prometheus text format, next to
+// the health checks, and are also available to embedders through Metrics.
+
+// Metrics is a snapshot of the server's load
+type Metrics struct {
+	Connections int64 // Connections being handled, including those yet to send CONNECT
+
+	FramesPerSecond        float64            // Frames received across all connections
+	SessionFramesPerSecond map[string]float64 // Frames received per session, keyed by session id
+
+	QueuedBytes            int64            // Size of every message retained by the broker
+	DestinationQueuedBytes map[string]int64 // Size of the messages retained per destination, for those retaining any
+
+	// Running totals per destination, with those beyond the tracking limit
+	// added up under OTHER_DESTINATIONS
+	DestinationCounts map[string]DestinationCounts
+
+	// Running totals of frames refused because of the client, by reason
+	Rejections map[RejectReason]uint64
+
+	// Running totals of well formed frames received, by command. Estimates
+	// scaled up from a sample if Options.MetricsSampleRate is set.
+	FramesReceived map[string]uint64
+}
+
+// DestinationCounts are running totals of what has happened to the messages
+// of a destination
+type DestinationCounts struct {
+	Published uint64 // Messages routed to the destination
+	Delivered uint64 // MESSAGE frames sent to its subscribers, including redeliveries
+	Acked     uint64 // Deliveries acked
+	Expired   uint64 // Messages that expired or were evicted before delivery
+}
+
+// Metrics takes a snapshot of the server's load
+func (server *Server) Metrics() Metrics {
+	now := server.clock.Now()
+	metrics := Metrics{
+		Connections:            atomic.LoadInt64(&server.activeConns),
+		FramesPerSecond:        server.ingest.rate(now),
+		SessionFramesPerSecond: map[string]float64{},
+	}
+	metrics.QueuedBytes, metrics.DestinationQueuedBytes = server.broker.queuedBytesByDestination()
+	metrics.DestinationCounts = server.broker.destinationCounts()
+	metrics.Rejections = server.rejections.snapshot()
+	metrics.FramesReceived = server.frames.snapshot()
+
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	for c := range server.conns {
+		if c.sessionID != "" {
+			metrics.SessionFramesPerSecond[c.sessionID] = c.ingest.rate(now)
+		}
+	}
+	return metrics
+}
+
+// MetricsHandler returns an HTTP handler serving /metrics
+func (server *Server) MetricsHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		metrics := server.Metrics()
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+		writeMetricHeader(w, "skewserver_connections", "Connections being handled")
+		fmt.Fprintf(w, "skewserver_connections %d\n", metrics.Connections)
+
+		writeMetricHeader(w, "skewserver_frames_per_second", "Frames received per second across all connections")
+		fmt.Fprintf(w, "skewserver_frames_per_second %g\n", metrics.FramesPerSecond)
+
+		writeMetricHeader(w, "skewserver_session_frames_per_second", "Frames received per second on each session")
+		sessions := make([]string, 0, len(metrics.SessionFramesPerSecond))
+		for sessionID := range metrics.SessionFramesPerSecond {
+			sessions = append(sessions, sessionID)
+		}
+		sort.Strings(sessions)
+		for _, sessionID := range sessions {
+			fmt.Fprintf(w, "skewserver_session_frames_per_second{session=%q} %g\n", sessionID, metrics.SessionFramesPerSecond[sessionID])
+		}
+
+		writeMetricHeader(w, "skewserver_queued_bytes", "Size of the messages retained by the broker")
+		fmt.Fprintf(w, "skewserver_queued_bytes %d\n", metrics.QueuedBytes)
+
+		writeMetricHeader(w, "skewserver_destination_queued_bytes", "Size of the messages retained for each destination")
+		destinations := make([]string, 0, len(metrics.DestinationQueuedBytes))
+		for name := range metrics.DestinationQueuedBytes {
+			destinations = append(destinations, name)
+		}
+		sort.Strings(destinations)
+		for _, name := range destinations {
+			fmt.Fprintf(w, "skewserver_destination_queued_bytes{destination=%q} %d\n", name, metrics.DestinationQueuedBytes[name])
+		}
+
+		labels := make([]string, 0, len(metrics.DestinationCounts))
+		for label := range metrics.DestinationCounts {
+			labels = append(labels, label)
+		}
+		sort.Strings(labels)
+		counters := []struct {
+			name  string
+			help  string
+			value func(DestinationCounts) uint64
+		}{
+			{"skewserver_destination_published_total", "Messages routed to each destination", func(counts DestinationCounts) uint64 { return counts.Published }},
+			{"skewserver_destination_delivered_total", "Messages delivered from each destination", func(counts DestinationCounts) uint64 { return counts.Delivered }},
+			{"skewserver_destination_acked_total", "Deliveries acked from each destination", func(counts DestinationCounts) uint64 { return counts.Acked }},
+			{"skewserver_destination_expired_total", "Messages that expired on each destination", func(counts DestinationCounts) uint64 { return counts.Expired }},
+		}
+		for _, counter := range counters {
+			writeMetricHeaderOfType(w, counter.name, counter.help, "counter")
+			for _, label := range labels {
+				fmt.Fprintf(w, "%s{destination=%q} %d\n", counter.name, label, counter.value(metrics.DestinationCounts[label]))
+			}
+		}
+
+		writeMetricHeaderOfType(w, "skewserver_rejected_frames_total", "Frames refused because of the client, by reason", "counter")
+		for _, reason := range rejectReasons {
+			fmt.Fprintf(w, "skewserver_rejected_frames_total{reason=%q} %d\n", reason, metrics.Rejections[reason])
+		}
+
+		writeMetricHeaderOfType(w, "skewserver_received_frames_total", "Well formed frames received, by command", "counter")
+		commands := make([]string, 0, len(metrics.FramesReceived))
+		for command := range metrics.FramesReceived {
+			commands = append(commands, command)
+		}
+		sort.Strings(commands)
+		for _, command := range commands {
+			fmt.Fprintf(w, "skewserver_received_frames_total{command=%q} %d\n", command, metrics.FramesReceived[command])
+		}
+	})
+	return mux
+}
+
+func (b *broker) queuedBytesByDestination() (int64, map[string]int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	byDestination := map[string]int64{}
+	for name, dest := range b.destinations {
+		if dest.queuedBytes > 0 {
+			byDestination[name] = dest.queuedBytes
+		}
+	}
+	return b.queuedBytes, byDestination
+}
+
+func writeMetricHeader(w http.ResponseWriter, name string, help string) {
+	writeMetricHeaderOfType(w, name, help, "gauge")
+}
+
+func writeMetricHeaderOfType(w http.ResponseWriter, name string, help string, kind string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// Destination counters
+// Destinations are created on demand, so labelling metrics with every one
+// would let clients grow the metrics without bound. Only the first
+// Options.MaxMetricDestinations destinations to be counted get their own
+// label, after which the rest are added up under OTHER_DESTINATIONS.
+// Guarded by the broker's lock.
+
+// Label for the destinations beyond the tracking limit, which can't clash
+// with a destination name as those always begin with a slash
+const OTHER_DESTINATIONS = "other"
+
+// How many destinations are labelled unless Options.MaxMetricDestinations
+// says otherwise
+const DEFAULT_MAX_METRIC_DESTINATIONS = 100
+
+type destinationCounters struct {
+	limit  int
+	counts map[string]*DestinationCounts
+}
+
+func newDestinationCounters(limit int) destinationCounters {
+	if limit == 0 {
+		limit = DEFAULT_MAX_METRIC_DESTINATIONS
+	}
+	return destinationCounters{limit: limit, counts: map[string]*DestinationCounts{}}
+}
+
+// The counts to add to for a destination, starting to track it if there is
+// room and otherwise using the shared overflow counts
+func (counters *destinationCounters) of(name string) *DestinationCounts {
+	if counts, ok := counters.counts[name]; ok {
+		return counts
+	}
+	label := name
+	if len(counters.counts) >= counters.limit {
+		label = OTHER_DESTINATIONS
+		if counts, ok := counters.counts[label]; ok {
+			return counts
+		}
+	}
+	counts := &DestinationCounts{}
+	counters.counts[label] = counts
+	return counts
+}
+
+func (b *broker) destinationCounts() map[string]DestinationCounts {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	snapshot := make(map[string]DestinationCounts, len(b.counters.counts))
+	for label, counts := range b.counters.counts {
+		snapshot[label] = *counts
+	}
+	return snapshot
+}
+
+// Ingest rates
+// Frames are counted into one second buckets, and the rate is the average
+// over the last RATE_WINDOW_SECONDS of them. When a connection's rate goes
+// over Options.IngestAlarmRate a warning is logged, once until it drops back
+// under. This only raises the alarm, nothing is throttled.
+
+const RATE_WINDOW_SECONDS = 10
+
+type rateMeter struct {
+	mu      sync.Mutex
+	buckets [RATE_WINDOW_SECONDS]struct {
+		second int64 // Unix time of the second the bucket is counting
+		count  int
+	}
+}
+
+// Count events, returning the rate including them
+func (meter *rateMeter) mark(now time.Time, count int) float64 {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+
+	second := now.Unix()
+	bucket := &meter.buckets[second%RATE_WINDOW_SECONDS]
+	if bucket.second != second {
+		bucket.second = second
+		bucket.count = 0
+	}
+	bucket.count += count
+	return meter.rateLocked(second)
+}
+
+func (meter *rateMeter) rate(now time.Time) float64 {
+	meter.mu.Lock()
+	defer meter.mu.Unlock()
+	return meter.rateLocked(now.Unix())
+}
+
+func (meter *rateMeter) rateLocked(second int64) float64 {
+	total := 0
+	for _, bucket := range meter.buckets {
+		if second-bucket.second < RATE_WINDOW_SECONDS {
+			total += bucket.count
+		}
+	}
+	return float64(total) / RATE_WINDOW_SECONDS
+}
+
+// Count a frame read from the connection, by its command if it was parsed,
+// raising the alarm if it has pushed the connection's rate over the threshold
+func (c *conn) countFrame(frame parsing.Frame, parsed bool) {
+	weight, sampled := c.sample()
+	if !sampled {
+		return
+	}
+	if parsed {
+		c.server.frames.add(frame.Command, weight)
+	}
+
+	now := c.server.clock.Now()
+	c.server.ingest.mark(now, weight)
+	rate := c.ingest.mark(now, weight)
+
+	threshold := c.server.opts.IngestAlarmRate
+	if threshold <= 0 {
+		return
+	}
+	if rate > threshold && !c.ingestAlarm {
+		c.server.log.Warnf("Session %s from %s is sending %.1f frames per second, over the alarm threshold of %.1f", c.sessionID, c.netConn.RemoteAddr(), rate, threshold)
+	}
+	c.ingestAlarm = rate > threshold
+}
+
+// Frame sampling
+// Counting every frame takes locks shared by all connections, which shows up
+// at very high frame rates. With Options.MetricsSampleRate set to N, each
+// connection only counts one in every N frames it reads, as N frames. The
+// first frame counted is picked at random, so that connections sending
+// fewer than N frames are still counted N times over in the right
+// proportion, making the totals and rates unbiased estimates. The ingest
+// alarm only looks at the sampled frames.
+
+// Whether to count the frame just read, and how many frames it stands for
+func (c *conn) sample() (weight int, sampled bool) {
+	n := c.server.opts.MetricsSampleRate
+	if n <= 1 {
+		return 1, true
+	}
+	if c.sampleSkip > 0 {
+		c.sampleSkip--
+		return 0, false
+	}
+	c.sampleSkip = n - 1
+	return n, true
+}
+
+// Picks where each connection's sampling starts, from a source of its own
+// as the global one is only seeded on request
+type frameSampler struct {
+	rate int
+
+	mu     sync.Mutex
+	source *rand.Rand
+}
+
+func newFrameSampler(opts Options) *frameSampler {
+	return &frameSampler{
+		rate:   opts.MetricsSampleRate,
+		source: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Frames a new connection should read before the first is counted
+func (sampler *frameSampler) firstSkip() int {
+	if sampler.rate <= 1 {
+		return 0
+	}
+
+	sampler.mu.Lock()
+	defer sampler.mu.Unlock()
+	return sampler.source.Intn(sampler.rate)
+}
+
+type frameCounters struct {
+	mu     sync.Mutex
+	counts map[parsing.CommandType]uint64
+}
+
+func (counters *frameCounters) add(command parsing.CommandType, count int) {
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+
+	if counters.counts == nil {
+		counters.counts = map[parsing.CommandType]uint64{}
+	}
+	counters.counts[command] += uint64(count)
+}
+
+// Keyed by command name, only including commands that have been received
+func (counters *frameCounters) snapshot() map[string]uint64 {
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+
+	snapshot := make(map[string]uint64, len(counters.counts))
+	for command, count := range counters.counts {
+		snapshot[command.String()] = count
+	}
+	return snapshot
+}
@@ -0,0 +1,307 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestConnectionCount(t *testing.T) {
+	srv, addr := startServer(t, server.Options{})
+
+	const clients = 20
+	conns := make(chan net.Conn, clients)
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if conn, err := net.Dial("tcp", addr); err == nil {
+				conns <- conn
+			}
+		}()
+	}
+	wg.Wait()
+	close(conns)
+	if len(conns) != clients {
+		t.Fatalf("Error dialing, only %d of %d connected", len(conns), clients)
+	}
+	eventually(t, func() bool { return srv.Metrics().Connections == clients })
+
+	for conn := range conns {
+		wg.Add(1)
+		go func(conn net.Conn) {
+			defer wg.Done()
+			conn.Close()
+		}(conn)
+	}
+	wg.Wait()
+	eventually(t, func() bool { return srv.Metrics().Connections == 0 })
+}
+
+func TestIngestRates(t *testing.T) {
+	srv, addr := startServer(t, server.Options{Clock: server.NewFakeClock()})
+
+	client := dial(t, addr)
+	session := client.connect(nil).Headers["session"]
+	for i := 0; i < 9; i++ {
+		client.publish("/topic/a", "hello")
+	}
+
+	// Ten frames in the same second, averaged over the window
+	metrics := srv.Metrics()
+	if rate := metrics.SessionFramesPerSecond[session]; rate != 10.0/server.RATE_WINDOW_SECONDS {
+		t.Errorf("Session rate should count its frames over the window, got %g", rate)
+	}
+	if metrics.FramesPerSecond != metrics.SessionFramesPerSecond[session] {
+		t.Errorf("Global rate should count every connection, got %g", metrics.FramesPerSecond)
+	}
+
+	recorder := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	if !strings.Contains(string(body), `skewserver_session_frames_per_second{session="`+session+`"} 1`) {
+		t.Errorf("Metrics should include the session's rate, got %s", body)
+	}
+}
+
+func TestIngestRateWindowSlides(t *testing.T) {
+	clock := server.NewFakeClock()
+	srv, addr := startServer(t, server.Options{Clock: clock})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.publish("/topic/a", "hello")
+
+	clock.Advance(server.RATE_WINDOW_SECONDS * time.Second)
+	if rate := srv.Metrics().FramesPerSecond; rate != 0 {
+		t.Errorf("Frames older than the window should not count, got %g", rate)
+	}
+}
+
+func TestIngestAlarm(t *testing.T) {
+	logs := &recordingLogger{}
+	_, addr := startServer(t, server.Options{Clock: server.NewFakeClock(), Logger: logs, IngestAlarmRate: 5})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	var burst strings.Builder
+	for i := 0; i < 100; i++ {
+		burst.WriteString("SEND\ndestination:/topic/a\n\nhello\x00")
+	}
+	client.send(burst.String())
+	client.request(parsing.SEND, map[string]string{"destination": "/topic/a"}, "last")
+
+	alarms := 0
+	for _, line := range logs.warns() {
+		if strings.Contains(line, "alarm threshold") {
+			alarms++
+		}
+	}
+	if alarms != 1 {
+		t.Errorf("Crossing the alarm threshold should log one warning, got %d", alarms)
+	}
+}
+
+func TestQueuedBytes(t *testing.T) {
+	srv, addr := startServer(t, server.Options{})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+	first := srv.Metrics()
+	if first.QueuedBytes <= int64(len("hello")) || first.DestinationQueuedBytes["/queue/a"] != first.QueuedBytes {
+		t.Errorf("Queued message should be counted with its headers, got %d (%v)", first.QueuedBytes, first.DestinationQueuedBytes)
+	}
+
+	producer.publish("/queue/a", "hello")
+	if queued := srv.Metrics().QueuedBytes; queued != 2*first.QueuedBytes {
+		t.Errorf("Total should rise with each queued message, got %d after %d", queued, first.QueuedBytes)
+	}
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+	consumer.expectMessage("hello")
+	consumer.expectMessage("hello")
+	drained := srv.Metrics()
+	if drained.QueuedBytes != 0 || len(drained.DestinationQueuedBytes) != 0 {
+		t.Errorf("Totals should fall back to zero once the messages are delivered, got %d (%v)", drained.QueuedBytes, drained.DestinationQueuedBytes)
+	}
+}
+
+func TestDestinationCounts(t *testing.T) {
+	clock := server.NewFakeClock()
+	srv, addr := startServer(t, server.Options{Clock: clock, MaxMetricDestinations: 2})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "1")
+	producer.publish("/queue/a", "2")
+	frame := consumer.expectMessage("1")
+	consumer.expectMessage("2")
+	consumer.request(parsing.ACK, map[string]string{"id": frame.Headers["ack"]}, "")
+
+	producer.request(parsing.SEND, map[string]string{"destination": "/topic/b", "ttl": "1"}, "stale")
+	producer.publish("/topic/c", "overflow")
+	producer.publish("/topic/d", "overflow")
+
+	counts := srv.Metrics().DestinationCounts
+	expected := map[string]server.DestinationCounts{
+		"/queue/a": {Published: 2, Delivered: 2, Acked: 1},
+		"/topic/b": {Published: 1},
+		"other":    {Published: 2},
+	}
+	if !reflect.DeepEqual(expected, counts) {
+		t.Errorf("Destinations should be counted up to the limit, got %v", counts)
+	}
+
+	clock.Advance(time.Second)
+	producer.request(parsing.SEND, map[string]string{"destination": "/topic/b", "expires": "1"}, "stale")
+	if expired := srv.Metrics().DestinationCounts["/topic/b"].Expired; expired != 1 {
+		t.Errorf("Expired messages should be counted, got %d", expired)
+	}
+}
+
+func TestDestinationCountsServed(t *testing.T) {
+	srv, addr := startServer(t, server.Options{})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+
+	recorder := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body := recorder.Body.String()
+	if !strings.Contains(body, "# TYPE skewserver_destination_published_total counter") ||
+		!strings.Contains(body, `skewserver_destination_published_total{destination="/queue/a"} 1`) {
+		t.Errorf("Destination counters should be served, got %s", body)
+	}
+}
+
+func TestRejectionCounts(t *testing.T) {
+	creds, _ := server.LoadStaticCredentials(writeCredentials(t, "alice:secret\n"))
+	srv, addr := startServer(t, server.Options{
+		Authenticator:   creds,
+		MaxBodySize:     8,
+		SendQuota:       1,
+		SendQuotaWindow: time.Minute,
+	})
+	login := map[string]string{"login": "alice", "passcode": "secret"}
+
+	intruder := dial(t, addr)
+	intruder.send("CONNECT\naccept-version:1.2\nlogin:alice\npasscode:guess\n\n\x00")
+	intruder.expectFrame(parsing.ERROR)
+
+	garbled := dial(t, addr)
+	garbled.connect(login)
+	garbled.send("SEND\nbad header\n\n\x00")
+	garbled.expectFrame(parsing.ERROR)
+
+	oversized := dial(t, addr)
+	oversized.connect(login)
+	oversized.send("SEND\ndestination:/queue/a\n\nmuch too long\x00")
+	oversized.expectFrame(parsing.ERROR)
+
+	headless := dial(t, addr)
+	headless.connect(login)
+	headless.send("SEND\n\nhello\x00")
+	headless.expectFrame(parsing.ERROR)
+
+	invalid := dial(t, addr)
+	invalid.connect(login)
+	invalid.send("SUBSCRIBE\ndestination:/queue/a\nid:0\nack:sometimes\n\n\x00")
+	invalid.expectFrame(parsing.ERROR)
+
+	producer := dial(t, addr)
+	producer.connect(login)
+	producer.publish("/queue/a", "first")
+	producer.send("SEND\ndestination:/queue/a\n\nsecond\x00")
+	producer.expectFrame(parsing.ERROR)
+
+	expected := map[server.RejectReason]uint64{
+		server.REJECT_PARSE_ERROR:    1,
+		server.REJECT_MISSING_HEADER: 1,
+		server.REJECT_UNAUTHORIZED:   1,
+		server.REJECT_OVER_LIMIT:     2,
+		server.REJECT_INVALID:        1,
+	}
+	if rejections := srv.Metrics().Rejections; !reflect.DeepEqual(expected, rejections) {
+		t.Errorf("Rejections should be counted by reason, got %v", rejections)
+	}
+
+	recorder := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	if body := recorder.Body.String(); !strings.Contains(body, `skewserver_rejected_frames_total{reason="over-limit"} 2`) {
+		t.Errorf("Rejection counters should be served, got %s", body)
+	}
+}
+
+func TestFrameCounts(t *testing.T) {
+	srv, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	for i := 0; i < 3; i++ {
+		client.publish("/queue/a", "hello")
+	}
+
+	expected := map[string]uint64{"CONNECT": 1, "SEND": 3}
+	if counts := srv.Metrics().FramesReceived; !reflect.DeepEqual(counts, expected) {
+		t.Errorf("Frames should be counted by command, expected %v got %v", expected, counts)
+	}
+
+	recorder := httptest.NewRecorder()
+	srv.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, _ := ioutil.ReadAll(recorder.Body)
+	if !strings.Contains(string(body), `skewserver_received_frames_total{command="SEND"} 3`) {
+		t.Errorf("Metrics should include the frame counts, got %s", body)
+	}
+}
+
+func TestSampledFrameCounts(t *testing.T) {
+	const sampleRate = 10
+	srv, addr := startServer(t, server.Options{MetricsSampleRate: sampleRate})
+
+	// Each connection's estimate is out by less than the sample rate, so
+	// across them the total is well within tolerance
+	const clients = 20
+	const sends = 100
+	const tolerance = 0.15
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		client := dial(t, addr)
+		client.connect(nil)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < sends; j++ {
+				client.publish("/queue/a", "hello")
+			}
+		}()
+	}
+	wg.Wait()
+
+	counts := srv.Metrics().FramesReceived
+	for command, count := range counts {
+		if count%sampleRate != 0 {
+			t.Errorf("Sampled %s count should be scaled by the sample rate, got %d", command, count)
+		}
+	}
+	const actual = clients * sends
+	if estimate := float64(counts["SEND"]); estimate < actual*(1-tolerance) || estimate > actual*(1+tolerance) {
+		t.Errorf("Sampled SEND count should be within %g%% of %d, got %g", tolerance*100, actual, estimate)
+	}
+}
@@ -0,0 +1,530 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+const DEFAULT_PORT = 61613
+
+// The smallest frame size limit allowed, leaving room for a client to send
+// "CONNECT\naccept-version:1.2\n\n\x00" and so connect at all
+const MIN_FRAME_SIZE = 32
+
+// Options configures a Server. The zero value is usable and matches the
+// behaviour of a server started without any flags, except for the TCP socket
+// options which default to off. Every tunable lives here so that it can be
+// validated in one place before the server starts.
+type Options struct {
+	// Address for ListenAndServe, defaults to all interfaces on DEFAULT_PORT
+	Addr string
+
+	// Address for ListenAndServe to serve HTTP health checks and metrics on,
+	// see HealthHandler and MetricsHandler. Empty disables them.
+	HealthAddr string
+
+	// Serve over TLS when both are set
+	TLSCertFile string
+	TLSKeyFile  string
+
+	// Authenticate clients by TLS certificates signed by the CAs in this PEM
+	// file, optionally refusing clients without one, see configureClientAuth.
+	// Requires TLS.
+	TLSClientCAFile      string
+	TLSRequireClientCert bool
+
+	// Let clients opt into gzip compression by compressing what they send,
+	// see compressionConn
+	Compression bool
+
+	// Socket options applied to every accepted TCP connection
+	TCPNoDelay   bool
+	TCPKeepAlive time.Duration // Zero disables keep-alive probes
+
+	// Limits on individual header keys and values in incoming frames, in
+	// bytes. Zero means unlimited.
+	MaxHeaderKeyLength   int
+	MaxHeaderValueLength int
+
+	// Limit on the number of lines before the body of an incoming frame,
+	// counting the command. Zero means unlimited.
+	MaxHeaderLines int
+
+	// Connections per second each remote IP can open, in bursts of up to
+	// ConnectBurst, see connectLimiter. Zero is unlimited.
+	ConnectRate  float64
+	ConnectBurst int
+
+	// Frames per second over which a connection's ingest rate is logged as a
+	// warning. Zero disables the alarm.
+	IngestAlarmRate float64
+
+	// Count only one in this many frames received towards the ingest rates
+	// and frame totals, scaling the figures back up, to save work at very
+	// high frame rates. Zero or one counts every frame.
+	MetricsSampleRate int
+
+	// Limits on the size of incoming frames in bytes, for the body alone and
+	// for the frame as a whole, so that e.g. large bodies can be allowed while
+	// keeping the headers small. Zero means unlimited. The frame limit must be
+	// at least MIN_FRAME_SIZE, and the body limit can't be more than it.
+	MaxBodySize  int
+	MaxFrameSize int
+
+	// Reject anything that doesn't follow the STOMP 1.2 spec exactly, rather
+	// than tolerating the mistakes real clients are known to make
+	Strict bool
+
+	// Accept a blank line in place of the null byte ending a frame without a
+	// body, for typing frames by hand. Can't be combined with Strict.
+	BlankLineTerminators bool
+
+	// Keep the connection open after a frame that can't be parsed or is
+	// invalid, sending an ERROR for it and carrying on with the next frame.
+	// The spec has the connection closed after any ERROR, so this is only
+	// for clients known to cope. Can't be combined with Strict.
+	ResyncAfterBadFrames bool
+
+	// Checks the login and passcode of connecting clients. When nil every
+	// client is let in.
+	Authenticator Authenticator
+
+	// Let clients connect without a login or passcode, even when there is an
+	// Authenticator. They have no principal, so can't be admins.
+	AllowAnonymous bool
+
+	// Logins allowed to use the management destinations. Requires an
+	// Authenticator or client certificates, as otherwise anyone could claim
+	// to be an admin.
+	AdminLogins []string
+
+	// Told of every CONNECT and whether it was accepted, for security
+	// auditing. Defaults to none.
+	Auditor Auditor
+
+	// Heart-beating, as advertised in CONNECTED frames: the smallest interval
+	// at which the server can send heart-beats, and the interval at which it
+	// would like to receive them. Zero disables each direction.
+	HeartBeatSend    time.Duration
+	HeartBeatReceive time.Duration
+
+	// Shortest heart-beat interval a client can negotiate in either
+	// direction, see HeartBeatPolicy. Zero allows any.
+	MinHeartBeat    time.Duration
+	HeartBeatPolicy HeartBeatPolicy
+
+	// What to do when a client connects with a client-id that is already in
+	// use by a live session
+	DuplicateSessionPolicy DuplicateSessionPolicy
+
+	// How long the subscriptions of a session that drops without a DISCONNECT
+	// are kept for the client to resume it, using the resume token from its
+	// CONNECTED frame. Zero disables resumption.
+	SessionRetention time.Duration
+
+	// Limits on the transactions each connection can have open at once, and
+	// on the size in bytes of the frames they hold back until they're
+	// committed. Zero means unlimited.
+	MaxTransactions     int
+	MaxTransactionBytes int
+
+	// Most messages open transactions can hold across every connection,
+	// zero is unbounded. A transacted SEND beyond it gets an ERROR, see
+	// holdTransacted.
+	MaxTransactedMessages int
+
+	// Accept a SUBSCRIBE reusing the id of one of the connection's
+	// subscriptions when it asks for the same destination and ack mode,
+	// receipting it and leaving the subscription as it is. Otherwise reusing
+	// an id is an error.
+	IdempotentSubscribe bool
+
+	// Most bytes of messages each queue can retain, counting their headers
+	// and bodies, zero is unbounded. A SEND to a full queue gets an ERROR
+	// instead of a RECEIPT, unless the receipt policy has already sent one.
+	MaxQueueBytes int
+
+	// Fair dispatch: how many unacked messages from a queue each of its
+	// subscribers in a client ack mode can hold, zero is unbounded. Once a
+	// subscriber is out of credit further messages wait on the queue for
+	// whichever acks first, so faster consumers get proportionally more.
+	// Subscribers in auto mode are never held back.
+	DispatchCredit int
+
+	// Most messages a connection can publish within any SendQuotaWindow,
+	// zero is unlimited. A SEND over the quota gets an ERROR.
+	SendQuota       int
+	SendQuotaWindow time.Duration
+
+	// Most subscriptions a connection can have at once, zero is unbounded.
+	// A SUBSCRIBE beyond the limit gets an ERROR.
+	MaxSubscriptions int
+
+	// Limits on the selector a SUBSCRIBE can filter its messages with, on its
+	// length in bytes and on how deeply its parentheses and NOTs nest. A
+	// SUBSCRIBE over either gets an ERROR. Zero means unlimited.
+	MaxSelectorLength int
+	MaxSelectorDepth  int
+
+	// Destination prefixes whose messages are always, or never, persistent
+	// whatever their persistent header says, see broker.persistent
+	PersistentPrefixes []string
+	TransientPrefixes  []string
+
+	// Where persistent queue messages are kept until they're acked, so that
+	// they survive a restart, see Store. New replays whatever the store
+	// holds. With ValidateReplay a stored frame that isn't a valid SEND is
+	// skipped rather than stopping the server from starting.
+	Store          Store
+	ValidateReplay bool
+
+	// Messages retained on a queue for longer than this are evicted, and moved
+	// to the dead letter queue if one is configured. Zero disables eviction.
+	MaxMessageAge   time.Duration
+	DeadLetterQueue string
+
+	// Hold up to this many dead letters in a quarantine for inspection
+	// instead of moving them to the dead letter queue, see QuarantinedMessage.
+	// Zero disables the quarantine.
+	QuarantineSize int
+
+	// Messages delivered to client or client-individual subscriptions which
+	// aren't acked within this long are redelivered. Zero waits forever.
+	AckTimeout time.Duration
+
+	// Subscriptions holding unacked messages which go this long without an
+	// ACK or NACK are closed, and the messages redelivered, on the grounds
+	// that their client is no longer processing them. The client is sent an
+	// ERROR with the subscription header naming it and disconnected. Zero
+	// never closes them.
+	SubscriptionIdleTimeout time.Duration
+
+	// Stamp delivered messages with the broker's sequence number for them, in
+	// the x-broker-seq header, for debugging the order of deliveries
+	SequenceHeader bool
+
+	// Content type stamped on delivered messages whose SEND frame had a body
+	// but no content-type header. Empty leaves them untyped, as the spec does.
+	DefaultContentType string
+
+	// Maximum number of messages waiting to be written to each subscription,
+	// zero is unbounded. When a subscription's queue is full the overflow
+	// policy decides what happens, which a SUBSCRIBE frame can override with
+	// the overflow-policy header. Queue messages wait on their queue instead.
+	OutboundQueueSize int
+	OverflowPolicy    OverflowPolicy
+
+	// Most bytes of messages waiting to be written to each connection, across
+	// all of its subscriptions, zero is unbounded. Going over it is handled
+	// by the same overflow policy as a full outbound queue, so that a few
+	// huge messages can't take up unbounded memory. A message larger than
+	// the limit is still let through once nothing else is waiting.
+	MaxOutboundBytes int
+
+	// How long a written MESSAGE can wait in the write buffer for more to be
+	// sent with it, so that bursts of small frames go out in fewer writes.
+	// The buffer is still flushed early if it fills up, and any other frame
+	// flushes it straight away. Zero flushes after every frame.
+	FlushInterval time.Duration
+
+	// When a RECEIPT is sent for a frame that asks for one, see ReceiptPolicy
+	ReceiptPolicy ReceiptPolicy
+
+	// Add a HEADER_DELIVERED_TO header to the RECEIPT for a SEND to a topic,
+	// saying how many subscriptions the message was handed to, so that a
+	// producer can tell when nobody was listening. Requires receipts to be
+	// sent after routing.
+	ReportTopicDeliveries bool
+
+	// Decides which destinations are queues and which are topics. Defaults to
+	// the /queue/ and /topic/ prefixes.
+	Router Router
+
+	// Changes each MESSAGE before it is delivered. Defaults to none.
+	Transformer Transformer
+
+	// Picks destinations to subscribe clients to when they connect. Defaults
+	// to none.
+	DefaultSubscriber DefaultSubscriber
+
+	// Names new sessions. Defaults to random ids.
+	SessionIDGenerator SessionIDGenerator
+
+	// How many destinations get their own label on the per destination
+	// metrics, after which the rest are added up under OTHER_DESTINATIONS.
+	// Zero means DEFAULT_MAX_METRIC_DESTINATIONS.
+	MaxMetricDestinations int
+
+	// How often to log the number of active connections. Zero never does.
+	ConnectionLogInterval time.Duration
+
+	// Where to send operational logs. Defaults to discarding them.
+	Logger Logger
+
+	// Log every frame read from a client along with its body, at trace
+	// level. Bodies can hold sensitive data, so this only happens if the
+	// Logger is a TraceLogger too, and it's up to the logger to be set to
+	// trace level. LogBodyLimit is the most bytes of each body to log, zero
+	// meaning DEFAULT_LOG_BODY_LIMIT.
+	LogBodies    bool
+	LogBodyLimit int
+
+	// Source of the time for timeouts, expiry and eviction. Defaults to the
+	// system clock.
+	Clock Clock
+}
+
+// Validate checks that the options are consistent with each other
+func (opts Options) Validate() error {
+	if opts.Addr != "" {
+		if _, _, err := net.SplitHostPort(opts.Addr); err != nil {
+			return fmt.Errorf("invalid listen address %q: %s", opts.Addr, err)
+		}
+	}
+	if opts.HealthAddr != "" {
+		if _, _, err := net.SplitHostPort(opts.HealthAddr); err != nil {
+			return fmt.Errorf("invalid health check address %q: %s", opts.HealthAddr, err)
+		}
+	}
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return errors.New("TLS requires both a certificate and a key file")
+	}
+	if opts.TLSClientCAFile != "" && opts.TLSCertFile == "" {
+		return errors.New("client certificates require TLS")
+	}
+	if opts.TLSRequireClientCert && opts.TLSClientCAFile == "" {
+		return errors.New("requiring client certificates requires a client CA file")
+	}
+	if opts.Strict && opts.BlankLineTerminators {
+		return errors.New("blank line terminators can't be accepted in strict mode")
+	}
+	if opts.Strict && opts.ResyncAfterBadFrames {
+		return errors.New("bad frames can't be skipped in strict mode")
+	}
+	for _, limit := range []struct {
+		name     string
+		negative bool
+	}{
+		{"TCP keep-alive period", opts.TCPKeepAlive < 0},
+		{"heart-beat intervals", opts.HeartBeatSend < 0 || opts.HeartBeatReceive < 0 || opts.MinHeartBeat < 0},
+		{"header length limits", opts.MaxHeaderKeyLength < 0 || opts.MaxHeaderValueLength < 0},
+		{"connection log interval", opts.ConnectionLogInterval < 0},
+		{"subscription idle timeout", opts.SubscriptionIdleTimeout < 0},
+		{"subscription limit", opts.MaxSubscriptions < 0},
+		{"selector limits", opts.MaxSelectorLength < 0 || opts.MaxSelectorDepth < 0},
+		{"queue size limit", opts.MaxQueueBytes < 0},
+		{"dispatch credit", opts.DispatchCredit < 0},
+		{"header line limit", opts.MaxHeaderLines < 0},
+		{"connection rate limit", opts.ConnectRate < 0 || opts.ConnectBurst < 0},
+		{"ingest alarm rate", opts.IngestAlarmRate < 0},
+		{"metrics sample rate", opts.MetricsSampleRate < 0},
+		{"frame size limits", opts.MaxBodySize < 0 || opts.MaxFrameSize < 0},
+		{"outbound queue size", opts.OutboundQueueSize < 0},
+		{"outbound byte limit", opts.MaxOutboundBytes < 0},
+		{"send quota", opts.SendQuota < 0 || opts.SendQuotaWindow < 0},
+		{"metric destination limit", opts.MaxMetricDestinations < 0},
+		{"log body limit", opts.LogBodyLimit < 0},
+		{"flush interval", opts.FlushInterval < 0},
+		{"session retention", opts.SessionRetention < 0},
+		{"transaction limits", opts.MaxTransactions < 0 || opts.MaxTransactionBytes < 0 || opts.MaxTransactedMessages < 0},
+		{"quarantine size", opts.QuarantineSize < 0},
+		{"max message age", opts.MaxMessageAge < 0},
+		{"ack timeout", opts.AckTimeout < 0},
+	} {
+		if limit.negative {
+			return fmt.Errorf("%s must not be negative", limit.name)
+		}
+	}
+	if opts.MaxFrameSize > 0 && opts.MaxFrameSize < MIN_FRAME_SIZE {
+		return fmt.Errorf("frame size limit must be at least %d bytes", MIN_FRAME_SIZE)
+	}
+	if opts.MaxBodySize > 0 && opts.MaxFrameSize > 0 && opts.MaxBodySize > opts.MaxFrameSize {
+		return errors.New("body size limit must not be more than the frame size limit")
+	}
+	if _, ok := heartBeatPolicyNames[opts.HeartBeatPolicy]; !ok {
+		return fmt.Errorf("unknown heart-beat policy %d", opts.HeartBeatPolicy)
+	}
+	if len(opts.AdminLogins) > 0 && opts.Authenticator == nil && !opts.TLSRequireClientCert {
+		return errors.New("admin logins require an authenticator or client certificates")
+	}
+	if _, ok := duplicateSessionPolicyNames[opts.DuplicateSessionPolicy]; !ok {
+		return fmt.Errorf("unknown duplicate session policy %d", opts.DuplicateSessionPolicy)
+	}
+	for _, persistent := range opts.PersistentPrefixes {
+		for _, transient := range opts.TransientPrefixes {
+			if persistent == transient {
+				return fmt.Errorf("destination prefix %q can't be both persistent and transient", persistent)
+			}
+		}
+	}
+	if opts.ValidateReplay && opts.Store == nil {
+		return errors.New("replay validation requires a store")
+	}
+	if opts.ConnectRate > 0 && opts.ConnectBurst == 0 {
+		return errors.New("connection rate limit requires a burst")
+	}
+	if opts.SendQuota > 0 && opts.SendQuotaWindow == 0 {
+		return errors.New("send quota requires a window")
+	}
+	if _, ok := overflowPolicyNames[opts.OverflowPolicy]; !ok {
+		return fmt.Errorf("unknown overflow policy %d", opts.OverflowPolicy)
+	}
+	if _, ok := receiptPolicyNames[opts.ReceiptPolicy]; !ok {
+		return fmt.Errorf("unknown receipt policy %d", opts.ReceiptPolicy)
+	}
+	if opts.ReportTopicDeliveries && opts.ReceiptPolicy != RECEIPT_AFTER_ROUTING {
+		return errors.New("topic delivery reports require receipts to be sent after routing")
+	}
+	if opts.DeadLetterQueue != "" {
+		if kind, _ := opts.router().Resolve(opts.DeadLetterQueue); kind != QUEUE {
+			return fmt.Errorf("dead letter queue %s must be a queue", opts.DeadLetterQueue)
+		}
+	}
+	return nil
+}
+
+func (opts Options) router() Router {
+	if opts.Router == nil {
+		return prefixRouter{}
+	}
+	return opts.Router
+}
+
+func (opts Options) sessionIDGenerator() SessionIDGenerator {
+	if opts.SessionIDGenerator == nil {
+		return &randomSessionIDs{}
+	}
+	return opts.SessionIDGenerator
+}
+
+// Duplicate session policies
+
+type DuplicateSessionPolicy int
+
+const (
+	DUPLICATE_SESSION_REJECT DuplicateSessionPolicy = iota
+	DUPLICATE_SESSION_TAKEOVER
+)
+
+var duplicateSessionPolicyNames = map[DuplicateSessionPolicy]string{
+	DUPLICATE_SESSION_REJECT:   "reject",
+	DUPLICATE_SESSION_TAKEOVER: "takeover",
+}
+
+func (policy DuplicateSessionPolicy) String() string {
+	return duplicateSessionPolicyNames[policy]
+}
+
+// Set allows the policy to be used as a flag.Value
+func (policy *DuplicateSessionPolicy) Set(name string) error {
+	for candidate, candidateName := range duplicateSessionPolicyNames {
+		if candidateName == name {
+			*policy = candidate
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown duplicate session policy %q", name)
+}
+
+// Heart-beat policies
+// A client asking for heart-beats more often than Options.MinHeartBeat is
+// either clamped to the minimum, which it learns from the CONNECTED frame as
+// the spec's negotiation never goes below what the server advertises, or
+// rejected with an ERROR.
+
+type HeartBeatPolicy int
+
+const (
+	HEART_BEAT_CLAMP HeartBeatPolicy = iota
+	HEART_BEAT_REJECT
+)
+
+var heartBeatPolicyNames = map[HeartBeatPolicy]string{
+	HEART_BEAT_CLAMP:  "clamp",
+	HEART_BEAT_REJECT: "reject",
+}
+
+func (policy HeartBeatPolicy) String() string {
+	return heartBeatPolicyNames[policy]
+}
+
+// Set allows the policy to be used as a flag.Value
+func (policy *HeartBeatPolicy) Set(name string) error {
+	for candidate, candidateName := range heartBeatPolicyNames {
+		if candidateName == name {
+			*policy = candidate
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown heart-beat policy %q", name)
+}
+
+// Overflow policies
+
+type OverflowPolicy int
+
+const (
+	OVERFLOW_BLOCK       OverflowPolicy = iota // Make the publisher wait for room
+	OVERFLOW_DROP_OLDEST                       // Drop the longest waiting message
+	OVERFLOW_DROP_NEWEST                       // Drop the message being published
+	OVERFLOW_DISCONNECT                        // Disconnect the slow consumer
+)
+
+var overflowPolicyNames = map[OverflowPolicy]string{
+	OVERFLOW_BLOCK:       "block",
+	OVERFLOW_DROP_OLDEST: "drop-oldest",
+	OVERFLOW_DROP_NEWEST: "drop-newest",
+	OVERFLOW_DISCONNECT:  "disconnect",
+}
+
+func (policy OverflowPolicy) String() string {
+	return overflowPolicyNames[policy]
+}
+
+// Set allows the policy to be used as a flag.Value
+func (policy *OverflowPolicy) Set(name string) error {
+	for candidate, candidateName := range overflowPolicyNames {
+		if candidateName == name {
+			*policy = candidate
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown overflow policy %q", name)
+}
+
+// Receipt policies
+// By default a RECEIPT is only sent once the frame has taken effect, so a
+// receipted SEND has been routed to its subscribers or retained on its queue.
+// Receipting on accept answers as soon as the frame has been parsed, which
+// saves clients a round trip through the broker but means a RECEIPT can be
+// followed by an ERROR for the same frame. DISCONNECT is always receipted
+// last, as the spec requires.
+
+type ReceiptPolicy int
+
+const (
+	RECEIPT_AFTER_ROUTING ReceiptPolicy = iota // Once the frame has taken effect
+	RECEIPT_ON_ACCEPT                          // As soon as the frame is parsed
+)
+
+var receiptPolicyNames = map[ReceiptPolicy]string{
+	RECEIPT_AFTER_ROUTING: "routed",
+	RECEIPT_ON_ACCEPT:     "accepted",
+}
+
+func (policy ReceiptPolicy) String() string {
+	return receiptPolicyNames[policy]
+}
+
+// Set allows the policy to be used as a flag.Value
+func (policy *ReceiptPolicy) Set(name string) error {
+	for candidate, candidateName := range receiptPolicyNames {
+		if candidateName == name {
+			*policy = candidate
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown receipt policy %q", name)
+}
@@ -0,0 +1,223 @@
+package server_test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestValidOptions(t *testing.T) {
+	valid := []server.Options{
+		{},
+		{Addr: "127.0.0.1:61613", TCPNoDelay: true, TCPKeepAlive: time.Minute},
+		{MaxMessageAge: time.Minute, DeadLetterQueue: "/queue/dlq"},
+		{DuplicateSessionPolicy: server.DUPLICATE_SESSION_TAKEOVER},
+		{OutboundQueueSize: 100, OverflowPolicy: server.OVERFLOW_DROP_OLDEST},
+		{MaxFrameSize: server.MIN_FRAME_SIZE},
+		{MaxBodySize: 64, MaxFrameSize: 64},
+		{MaxBodySize: 1024},
+	}
+
+	for _, opts := range valid {
+		if err := opts.Validate(); err != nil {
+			t.Errorf("Options %+v should be valid, got %s", opts, err)
+		}
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	invalid := map[string]server.Options{
+		"bad address":             {Addr: "no-port"},
+		"bad health address":      {HealthAddr: "no-port"},
+		"TLS cert without key":    {TLSCertFile: "cert.pem"},
+		"TLS key without cert":    {TLSKeyFile: "key.pem"},
+		"client CAs without TLS":  {TLSClientCAFile: "ca.pem"},
+		"client certs without CA": {TLSCertFile: "cert.pem", TLSKeyFile: "key.pem", TLSRequireClientCert: true},
+		"negative keep-alive":     {TCPKeepAlive: -time.Second},
+		"negative max age":        {MaxMessageAge: -time.Second},
+		"negative retention":      {SessionRetention: -time.Second},
+		"negative transactions":   {MaxTransactions: -1},
+		"negative tx bytes":       {MaxTransactionBytes: -1},
+		"negative tx messages":    {MaxTransactedMessages: -1},
+		"negative idle timeout":   {SubscriptionIdleTimeout: -time.Second},
+		"negative log interval":   {ConnectionLogInterval: -time.Second},
+		"negative heart-beat":     {HeartBeatSend: -time.Second},
+		"unknown heart-beat rule": {HeartBeatPolicy: 42},
+		"unknown session policy":  {DuplicateSessionPolicy: 42},
+		"topic dead letter queue": {DeadLetterQueue: "/topic/dlq"},
+		"negative queue size":     {OutboundQueueSize: -1},
+		"negative queue bytes":    {MaxQueueBytes: -1},
+		"negative flush interval": {FlushInterval: -time.Second},
+		"negative outbound bytes": {MaxOutboundBytes: -1},
+		"negative log body limit": {LogBodyLimit: -1},
+		"negative metric labels":  {MaxMetricDestinations: -1},
+		"negative send quota":     {SendQuota: -1, SendQuotaWindow: time.Second},
+		"negative quarantine":     {QuarantineSize: -1},
+		"early delivery reports":  {ReportTopicDeliveries: true, ReceiptPolicy: server.RECEIPT_ON_ACCEPT},
+		"quota without window":    {SendQuota: 10},
+		"negative credit":         {DispatchCredit: -1},
+		"negative subscriptions":  {MaxSubscriptions: -1},
+		"negative selector depth": {MaxSelectorDepth: -1},
+		"conflicting persistence": {PersistentPrefixes: []string{"/queue/"}, TransientPrefixes: []string{"/queue/"}},
+		"replay without store":    {ValidateReplay: true},
+		"negative body size":      {MaxBodySize: -1},
+		"negative frame size":     {MaxFrameSize: -1},
+		"tiny frame size":         {MaxFrameSize: server.MIN_FRAME_SIZE - 1},
+		"body bigger than frame":  {MaxBodySize: 128, MaxFrameSize: 64},
+		"negative line limit":     {MaxHeaderLines: -1},
+		"negative alarm rate":     {IngestAlarmRate: -1},
+		"negative sample rate":    {MetricsSampleRate: -1},
+		"negative connect rate":   {ConnectRate: -1, ConnectBurst: 1},
+		"connect rate no burst":   {ConnectRate: 1},
+		"admins without auth":     {AdminLogins: []string{"admin"}},
+		"strict blank lines":      {Strict: true, BlankLineTerminators: true},
+		"strict resync":           {Strict: true, ResyncAfterBadFrames: true},
+		"unknown overflow policy": {OverflowPolicy: 42},
+		"unknown receipt policy":  {ReceiptPolicy: 42},
+	}
+
+	for name, opts := range invalid {
+		if err := opts.Validate(); err == nil {
+			t.Errorf("Options with %s should be invalid", name)
+		}
+		if _, err := server.New(opts); err == nil {
+			t.Errorf("New should reject options with %s", name)
+		}
+	}
+}
+
+func TestUnloadableTLSCertificate(t *testing.T) {
+	dir := tempDir(t)
+	opts := server.Options{
+		TLSCertFile: filepath.Join(dir, "missing.pem"),
+		TLSKeyFile:  filepath.Join(dir, "missing.key"),
+	}
+
+	if _, err := server.New(opts); err == nil {
+		t.Errorf("New should fail when the TLS certificate cannot be loaded")
+	}
+}
+
+func TestListenAndServeTLS(t *testing.T) {
+	certFile, keyFile := writeTestCertificate(t)
+
+	srv, err := server.New(server.Options{Addr: "127.0.0.1:0", TLSCertFile: certFile, TLSKeyFile: keyFile})
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+	go srv.ListenAndServe()
+	t.Cleanup(func() { srv.Close() })
+	eventually(t, func() bool { return srv.Addr() != nil })
+
+	conn, err := tls.Dial("tcp", srv.Addr().String(), &tls.Config{InsecureSkipVerify: true})
+	if err != nil {
+		t.Fatalf("Error dialing over TLS: %s", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("CONNECT\naccept-version:1.2\n\n\x00"))
+	parser := parsing.NewStompParserFromReader(conn)
+	frame, err := parser.NextFrame()
+	if err != nil || frame.Command != parsing.CONNECTED {
+		t.Errorf("Should complete a handshake over TLS, got %v %v", frame.Command, err)
+	}
+}
+
+// Write a self-signed certificate for 127.0.0.1 and return the file paths
+func writeTestCertificate(t *testing.T) (certFile string, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "skewserver"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Error creating certificate: %s", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("Error marshalling key: %s", err)
+	}
+
+	dir := tempDir(t)
+	certFile = filepath.Join(dir, "cert.pem")
+	keyFile = filepath.Join(dir, "key.pem")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)
+	return
+}
+
+// Write a CA certificate and return its file along with a client certificate
+// it has signed for the common name
+func writeClientCertificate(t *testing.T, commonName string) (caFile string, cert tls.Certificate) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	caTemplate := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "skewserver test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	caDER, err := x509.CreateCertificate(rand.Reader, &caTemplate, &caTemplate, &caKey.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Error creating CA certificate: %s", err)
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Error generating key: %s", err)
+	}
+	template := x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &caTemplate, &key.PublicKey, caKey)
+	if err != nil {
+		t.Fatalf("Error creating client certificate: %s", err)
+	}
+
+	caFile = filepath.Join(tempDir(t), "ca.pem")
+	ioutil.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: caDER}), 0600)
+	return caFile, tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "skewserver")
+	if err != nil {
+		t.Fatalf("Error creating temp dir: %s", err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
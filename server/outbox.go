@@ -0,0 +1,381 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Outbox
+// Queue of frames waiting to be written by a connection's writer goroutine.
+// Control frames (CONNECTED, RECEIPT, ERROR) are never dropped, while each
+// subscription's messages are queued separately so that their length can be
+// bounded. The bytes of messages queued across all subscriptions can also be
+// bounded, with the same overflow policies applying, although a message is
+// always let in when nothing else is queued however large it is. The writer
+// takes turns between subscriptions so that a busy one can't starve the
+// rest, but a control frame is only written once every message queued before
+// it has been, so that e.g. a receipt still follows the messages it covers.
+// A subscription with a batch size has up to that many of its messages
+// handed to the writer at once, to be written with a single flush. Once
+// closed no new frames are accepted but queued ones are still drained, apart
+// from those of paused subscriptions. The broker can ask whether a
+// subscription has room for another message, and the writer then reports
+// when one it had none for has some again. A heart-beat can be asked for
+// when the connection has been idle, which is dropped if a frame is queued
+// in the meantime as that will do instead. Likewise the writer can be woken
+// to flush frames it is holding back.
+
+type outbox struct {
+	mu        sync.Mutex
+	cond      *sync.Cond // Signalled whenever a frame is queued or removed
+	control   []queuedFrame
+	queues    map[string][]queuedFrame // Messages keyed by subscription id
+	order     []string                 // Subscription ids in the order they take turns
+	next      int                      // Round-robin cursor into order
+	paused    map[string]bool          // Subscriptions whose messages are held back
+	batches   map[string]int           // Batch sizes of subscriptions that batch
+	starved   map[string]bool          // Subscriptions found without room, see hasRoom
+	seq       uint64
+	bytes     int  // Size of the queued messages, see sizeOf
+	maxBytes  int  // Limit on bytes, zero is unbounded
+	heartBeat bool // Whether a heart-beat is waiting to be written
+	flushDue  bool // Whether the writer should flush the frames it has buffered
+	closed    bool
+}
+
+type queuedFrame struct {
+	seq   uint64
+	size  int
+	frame parsing.Frame
+}
+
+func newOutbox() *outbox {
+	box := &outbox{
+		queues:  map[string][]queuedFrame{},
+		paused:  map[string]bool{},
+		batches: map[string]int{},
+		starved: map[string]bool{},
+	}
+	box.cond = sync.NewCond(&box.mu)
+	return box
+}
+
+func (box *outbox) push(frame parsing.Frame) bool {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	if box.closed {
+		return false
+	}
+	box.control = append(box.control, box.queued(frame))
+	box.cond.Broadcast()
+	return true
+}
+
+// Queue a message for a subscription. If limit messages are already waiting,
+// or the message would take the outbox over its byte limit, the overflow
+// policy decides whether to let it in regardless, make room by dropping the
+// oldest, or give up on this one. Dropping the oldest only drops the
+// subscription's own messages, so if it has none left this one is given up
+// on. Returns dropped if a message was dropped, in which case a disconnect
+// policy should close the connection, and full if the block policy let the
+// message in over the limits, in which case the publisher should be made to
+// wait for room, see waitForRoom. The wait is left to the caller as it
+// mustn't hold the broker's lock.
+func (box *outbox) pushMessage(subID string, frame parsing.Frame, limit int, policy OverflowPolicy) (dropped bool, full bool) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	message := box.queued(frame)
+	message.size = sizeOf(frame)
+overflow:
+	for !box.closed && box.full(subID, limit, message.size) {
+		switch policy {
+		case OVERFLOW_BLOCK:
+			full = true
+			break overflow
+		case OVERFLOW_DROP_OLDEST:
+			queue := box.queues[subID]
+			if len(queue) == 0 {
+				return true, false
+			}
+			box.bytes -= queue[0].size
+			queue[0] = queuedFrame{}
+			box.queues[subID] = queue[1:]
+			dropped = true
+		default:
+			return true, false
+		}
+	}
+	if box.closed {
+		return dropped, false
+	}
+
+	queue, ok := box.queues[subID]
+	if !ok {
+		box.order = append(box.order, subID)
+	}
+	box.queues[subID] = append(queue, message)
+	box.bytes += message.size
+	box.cond.Broadcast()
+	return dropped, full
+}
+
+// Block until a subscription is back within its message limit and the
+// outbox within its byte limit, or the outbox is closed
+func (box *outbox) waitForRoom(subID string, limit int) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	for !box.closed && box.over(subID, limit) {
+		box.cond.Wait()
+	}
+}
+
+// Whether a subscription can take another message without going over limit
+// messages or the outbox going over its byte limit. A subscription found
+// without room is noted until roomMade reports it has some again.
+func (box *outbox) hasRoom(subID string, limit int) bool {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	if box.atLimit(subID, limit) {
+		box.starved[subID] = true
+		return false
+	}
+	return true
+}
+
+// Subscriptions found without room by hasRoom which have room again
+func (box *outbox) roomMade(limit int) []string {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	var subIDs []string
+	for subID := range box.starved {
+		if box.atLimit(subID, limit) {
+			continue
+		}
+		delete(box.starved, subID)
+		subIDs = append(subIDs, subID)
+	}
+	return subIDs
+}
+
+// Whether a subscription has limit messages waiting, or the outbox has
+// reached its byte limit
+func (box *outbox) atLimit(subID string, limit int) bool {
+	if limit > 0 && len(box.queues[subID]) >= limit {
+		return true
+	}
+	return box.maxBytes > 0 && box.bytes >= box.maxBytes
+}
+
+// Whether a subscription has more than limit messages waiting, or the outbox
+// more than its byte limit, as the block policy allows for
+func (box *outbox) over(subID string, limit int) bool {
+	if limit > 0 && len(box.queues[subID]) > limit {
+		return true
+	}
+	return box.maxBytes > 0 && box.bytes > box.maxBytes
+}
+
+// Whether a message of the given size would take a subscription over the
+// message limit, or the outbox over its byte limit
+func (box *outbox) full(subID string, limit int, size int) bool {
+	if limit > 0 && len(box.queues[subID]) >= limit {
+		return true
+	}
+	return box.maxBytes > 0 && box.bytes > 0 && box.bytes+size > box.maxBytes
+}
+
+// Block until frames are available, returning false once the outbox is
+// closed and drained. More than one frame is only returned for a batching
+// subscription, and none means a heart-beat should be written or that a
+// flush is due.
+func (box *outbox) pop() ([]parsing.Frame, bool) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	for !box.ready() && !box.heartBeat && !box.flushDue && !box.closed {
+		box.cond.Wait()
+	}
+	if !box.ready() {
+		if (box.heartBeat || box.flushDue) && !box.closed {
+			box.heartBeat = false
+			box.flushDue = false
+			return nil, true
+		}
+		return nil, false
+	}
+	box.heartBeat = false
+
+	var frames []parsing.Frame
+	if subID, ok := box.nextTurn(); ok {
+		queue := box.queues[subID]
+		n := box.batches[subID]
+		if n < 1 {
+			n = 1
+		}
+		for len(frames) < n && len(queue) > 0 {
+			if len(frames) > 0 && len(box.control) > 0 && box.control[0].seq < queue[0].seq {
+				break
+			}
+			frames = append(frames, queue[0].frame)
+			box.bytes -= queue[0].size
+			queue[0] = queuedFrame{}
+			queue = queue[1:]
+		}
+		box.queues[subID] = queue
+	} else {
+		frames = append(frames, box.control[0].frame)
+		box.control[0] = queuedFrame{}
+		box.control = box.control[1:]
+	}
+	box.cond.Broadcast()
+	return frames, true
+}
+
+// Pick the next subscription with a message that can be written before the
+// oldest control frame, returning false if the control frame goes first.
+// Paused subscriptions don't hold back control frames.
+func (box *outbox) nextTurn() (string, bool) {
+	for i := 0; i < len(box.order); i++ {
+		subID := box.order[(box.next+i)%len(box.order)]
+		queue := box.queues[subID]
+		if len(queue) == 0 || box.paused[subID] {
+			continue
+		}
+		if len(box.control) > 0 && box.control[0].seq < queue[0].seq {
+			continue
+		}
+		box.next = (box.next + i + 1) % len(box.order)
+		return subID, true
+	}
+	return "", false
+}
+
+// Throw away messages queued for a subscription that has gone away
+func (box *outbox) discard(subID string) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	delete(box.paused, subID)
+	delete(box.batches, subID)
+	delete(box.starved, subID)
+	queue, ok := box.queues[subID]
+	if !ok {
+		return
+	}
+	for _, message := range queue {
+		box.bytes -= message.size
+	}
+	delete(box.queues, subID)
+	for i, candidate := range box.order {
+		if candidate == subID {
+			box.order = append(box.order[:i], box.order[i+1:]...)
+			break
+		}
+	}
+	box.next = 0
+	box.cond.Broadcast()
+}
+
+// Throw away every queued message, leaving only control frames
+func (box *outbox) discardMessages() {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	box.queues = map[string][]queuedFrame{}
+	box.bytes = 0
+	box.paused = map[string]bool{}
+	box.batches = map[string]int{}
+	box.starved = map[string]bool{}
+	box.order = nil
+	box.next = 0
+	box.cond.Broadcast()
+}
+
+// Stop or restart writing a subscription's messages. Messages keep being
+// queued while paused, subject to the overflow policy.
+func (box *outbox) setPaused(subID string, paused bool) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	if paused {
+		box.paused[subID] = true
+	} else {
+		delete(box.paused, subID)
+	}
+	box.cond.Broadcast()
+}
+
+func (box *outbox) isPaused(subID string) bool {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+	return box.paused[subID]
+}
+
+// Hand up to size of a subscription's messages to the writer at a time
+func (box *outbox) setBatchSize(subID string, size int) {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	if size > 1 {
+		box.batches[subID] = size
+	} else {
+		delete(box.batches, subID)
+	}
+}
+
+// Ask for a heart-beat unless there are frames waiting anyway, returning
+// false once the outbox is closed
+func (box *outbox) pushHeartBeat() bool {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	if box.closed {
+		return false
+	}
+	if !box.ready() {
+		box.heartBeat = true
+		box.cond.Broadcast()
+	}
+	return true
+}
+
+// Wake the writer to flush what it has buffered, if it has nothing else to do
+func (box *outbox) requestFlush() {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	box.flushDue = true
+	box.cond.Broadcast()
+}
+
+func (box *outbox) close() {
+	box.mu.Lock()
+	defer box.mu.Unlock()
+
+	box.closed = true
+	box.cond.Broadcast()
+}
+
+func (box *outbox) queued(frame parsing.Frame) queuedFrame {
+	box.seq++
+	return queuedFrame{seq: box.seq, frame: frame}
+}
+
+// Whether there is a frame that can be written now
+func (box *outbox) ready() bool {
+	if len(box.control) > 0 {
+		return true
+	}
+	for subID, queue := range box.queues {
+		if len(queue) > 0 && !box.paused[subID] {
+			return true
+		}
+	}
+	return false
+}
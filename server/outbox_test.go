@@ -0,0 +1,345 @@
+package server
+
+import (
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Nothing pops from these outboxes, which stands in for a consumer that has
+// stopped reading
+
+func TestOverflowBlockWaitsForRoom(t *testing.T) {
+	box := newOutbox()
+	box.pushMessage("0", testMessage("1"), 2, OVERFLOW_BLOCK)
+	box.pushMessage("0", testMessage("2"), 2, OVERFLOW_BLOCK)
+
+	// The message is let in over the limit, leaving the caller to wait
+	if dropped, full := box.pushMessage("0", testMessage("3"), 2, OVERFLOW_BLOCK); dropped || !full {
+		t.Fatalf("Blocking should let the message in over the limit, got dropped %t full %t", dropped, full)
+	}
+	waited := make(chan struct{})
+	go func() {
+		box.waitForRoom("0", 2)
+		close(waited)
+	}()
+
+	select {
+	case <-waited:
+		t.Fatalf("Publisher should wait while the queue is over its limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	box.pop()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatalf("Publisher should be unblocked once there is room")
+	}
+	expectBodies(t, box, "2", "3")
+}
+
+func TestOverflowBlockReleasedOnClose(t *testing.T) {
+	box := newOutbox()
+	box.pushMessage("0", testMessage("1"), 1, OVERFLOW_BLOCK)
+	box.pushMessage("0", testMessage("2"), 1, OVERFLOW_BLOCK)
+
+	waited := make(chan struct{})
+	go func() {
+		box.waitForRoom("0", 1)
+		close(waited)
+	}()
+	box.close()
+
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatalf("Publisher should be unblocked when the connection closes")
+	}
+}
+
+func TestOverflowDropOldest(t *testing.T) {
+	box := newOutbox()
+	box.pushMessage("0", testMessage("1"), 2, OVERFLOW_DROP_OLDEST)
+	box.pushMessage("0", testMessage("2"), 2, OVERFLOW_DROP_OLDEST)
+
+	if dropped, _ := box.pushMessage("0", testMessage("3"), 2, OVERFLOW_DROP_OLDEST); !dropped {
+		t.Errorf("Publishing to a full queue should report a dropped message")
+	}
+	expectBodies(t, box, "2", "3")
+}
+
+func TestOverflowDropNewest(t *testing.T) {
+	box := newOutbox()
+	box.pushMessage("0", testMessage("1"), 2, OVERFLOW_DROP_NEWEST)
+	box.pushMessage("0", testMessage("2"), 2, OVERFLOW_DROP_NEWEST)
+
+	if dropped, _ := box.pushMessage("0", testMessage("3"), 2, OVERFLOW_DROP_NEWEST); !dropped {
+		t.Errorf("Publishing to a full queue should report a dropped message")
+	}
+	expectBodies(t, box, "1", "2")
+}
+
+func TestOverflowLimitIsPerSubscription(t *testing.T) {
+	box := newOutbox()
+	box.pushMessage("0", testMessage("1"), 1, OVERFLOW_DROP_NEWEST)
+
+	if dropped, _ := box.pushMessage("1", testMessage("2"), 1, OVERFLOW_DROP_NEWEST); dropped {
+		t.Errorf("A full queue should not affect other subscriptions")
+	}
+	expectBodies(t, box, "1", "2")
+}
+
+func TestControlFramesNotLimited(t *testing.T) {
+	box := newOutbox()
+	box.pushMessage("0", testMessage("1"), 1, OVERFLOW_DROP_NEWEST)
+	box.push(parsing.Frame{Command: parsing.RECEIPT, Headers: map[string]string{}, Body: []byte("receipt")})
+
+	expectBodies(t, box, "1", "receipt")
+}
+
+func TestRoundRobinAcrossSubscriptions(t *testing.T) {
+	box := newOutbox()
+	topics := []string{"a", "b", "c"}
+	for _, topic := range topics {
+		for i := 0; i < 100; i++ {
+			box.pushMessage(topic, testMessage(topic), 0, OVERFLOW_BLOCK)
+		}
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 30; i++ {
+		frame, _ := popOne(box)
+		counts[string(frame.Body)]++
+	}
+	for _, topic := range topics {
+		if counts[topic] < 9 || counts[topic] > 11 {
+			t.Errorf("Subscriptions should take turns, got %v", counts)
+			break
+		}
+	}
+}
+
+func TestControlFrameFollowsEarlierMessages(t *testing.T) {
+	box := newOutbox()
+	box.pushMessage("0", testMessage("1"), 0, OVERFLOW_BLOCK)
+	box.pushMessage("1", testMessage("2"), 0, OVERFLOW_BLOCK)
+	box.push(parsing.Frame{Command: parsing.RECEIPT, Headers: map[string]string{}, Body: []byte("receipt")})
+	box.pushMessage("0", testMessage("3"), 0, OVERFLOW_BLOCK)
+
+	expectBodies(t, box, "1", "2", "receipt", "3")
+}
+
+func TestPausedSubscriptionHeldBack(t *testing.T) {
+	box := newOutbox()
+	box.setPaused("0", true)
+	box.pushMessage("0", testMessage("1"), 0, OVERFLOW_BLOCK)
+	box.push(parsing.Frame{Command: parsing.RECEIPT, Headers: map[string]string{}, Body: []byte("receipt")})
+	box.pushMessage("1", testMessage("2"), 0, OVERFLOW_BLOCK)
+
+	if frame, _ := popOne(box); string(frame.Body) != "receipt" {
+		t.Errorf("Paused messages should not hold back control frames, got %q", frame.Body)
+	}
+	if frame, _ := popOne(box); string(frame.Body) != "2" {
+		t.Errorf("Other subscriptions should keep flowing, got %q", frame.Body)
+	}
+
+	box.setPaused("0", false)
+	expectBodies(t, box, "1")
+}
+
+func TestOverflowDisconnect(t *testing.T) {
+	srv, err := New(Options{OutboundQueueSize: 1, OverflowPolicy: OVERFLOW_DISCONNECT})
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+
+	c := newConn(srv, serverSide)
+	go c.writeLoop()
+
+	sub := &subscription{id: "0", overflow: OVERFLOW_DISCONNECT}
+	for _, body := range []string{"1", "2", "3"} {
+		c.sendMessage(sub, testMessage(body))
+	}
+
+	clientSide.SetReadDeadline(time.Now().Add(SLOW_CONSUMER_GRACE + time.Second))
+	received, err := ioutil.ReadAll(clientSide)
+	if err != nil {
+		t.Fatalf("Slow consumer should be disconnected, got %s", err)
+	}
+	if !strings.Contains(string(received), "Slow consumer") {
+		t.Errorf("Slow consumer should be sent an ERROR, got %q", received)
+	}
+	if strings.Contains(string(received), "\n\n3\x00") {
+		t.Errorf("Overflowing message should not be delivered")
+	}
+}
+
+func TestBatchedMessagesPoppedTogether(t *testing.T) {
+	box := newOutbox()
+	box.setBatchSize("0", 3)
+	for _, body := range []string{"1", "2", "3", "4"} {
+		box.pushMessage("0", testMessage(body), 0, OVERFLOW_BLOCK)
+	}
+	box.pushMessage("1", testMessage("5"), 0, OVERFLOW_BLOCK)
+
+	if frames, _ := box.pop(); len(frames) != 3 || string(frames[2].Body) != "3" {
+		t.Errorf("Batching subscription should have up to its batch size popped at once, got %d frames", len(frames))
+	}
+	expectBodies(t, box, "5", "4")
+}
+
+func TestBatchStopsAtControlFrame(t *testing.T) {
+	box := newOutbox()
+	box.setBatchSize("0", 10)
+	box.pushMessage("0", testMessage("1"), 0, OVERFLOW_BLOCK)
+	box.push(parsing.Frame{Command: parsing.RECEIPT, Headers: map[string]string{}, Body: []byte("receipt")})
+	box.pushMessage("0", testMessage("2"), 0, OVERFLOW_BLOCK)
+
+	if frames, _ := box.pop(); len(frames) != 1 {
+		t.Errorf("Batch should not overtake a control frame, got %d frames", len(frames))
+	}
+	expectBodies(t, box, "receipt", "2")
+}
+
+func TestBatchFlushedTogether(t *testing.T) {
+	for _, batchSize := range []int{1, 5} {
+		srv, err := New(Options{})
+		if err != nil {
+			t.Fatalf("Error creating server: %s", err)
+		}
+		serverSide, clientSide := net.Pipe()
+		writes := &countingConn{Conn: serverSide}
+
+		c := newConn(srv, writes)
+		c.outbox.setBatchSize("0", batchSize)
+		for i := 0; i < 5; i++ {
+			c.outbox.pushMessage("0", testMessage(strconv.Itoa(i)), 0, OVERFLOW_BLOCK)
+		}
+		c.outbox.close()
+		go func() {
+			c.writeLoop()
+			serverSide.Close()
+		}()
+
+		received, err := ioutil.ReadAll(clientSide)
+		if err != nil {
+			t.Fatalf("Error reading messages: %s", err)
+		}
+		if count := strings.Count(string(received), "MESSAGE"); count != 5 {
+			t.Errorf("All messages should be delivered, got %d", count)
+		}
+		if expected := 5 / batchSize; writes.count() != expected {
+			t.Errorf("Batch size %d should take %d writes, took %d", batchSize, expected, writes.count())
+		}
+	}
+}
+
+func TestOutboundByteLimit(t *testing.T) {
+	large := testMessage(strings.Repeat("x", 1000))
+
+	box := newOutbox()
+	box.maxBytes = 1500
+	box.pushMessage("0", large, 0, OVERFLOW_DROP_NEWEST)
+	if dropped, _ := box.pushMessage("1", large, 0, OVERFLOW_DROP_NEWEST); !dropped {
+		t.Errorf("Message taking the outbox over its byte limit should be dropped")
+	}
+	if dropped, _ := box.pushMessage("1", testMessage("small"), 0, OVERFLOW_DROP_NEWEST); dropped {
+		t.Errorf("Message fitting within the byte limit should be queued")
+	}
+
+	box.pop()
+	if dropped, _ := box.pushMessage("1", large, 0, OVERFLOW_DROP_NEWEST); dropped {
+		t.Errorf("Message should be queued once the writer has made room")
+	}
+}
+
+func TestOutboundByteLimitBlocks(t *testing.T) {
+	large := testMessage(strings.Repeat("x", 1000))
+
+	box := newOutbox()
+	box.maxBytes = 1500
+	box.pushMessage("0", large, 0, OVERFLOW_BLOCK)
+	if _, full := box.pushMessage("1", large, 0, OVERFLOW_BLOCK); !full {
+		t.Fatalf("Publishing over the byte limit should make the publisher wait")
+	}
+
+	waited := make(chan struct{})
+	go func() {
+		box.waitForRoom("1", 0)
+		close(waited)
+	}()
+	select {
+	case <-waited:
+		t.Fatalf("Publisher should wait while the outbox is over the byte limit")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	box.pop()
+	select {
+	case <-waited:
+	case <-time.After(time.Second):
+		t.Fatalf("Publisher should be unblocked once there is room")
+	}
+}
+
+func TestOversizedMessageLetThroughAlone(t *testing.T) {
+	box := newOutbox()
+	box.maxBytes = 100
+	if dropped, _ := box.pushMessage("0", testMessage(strings.Repeat("x", 1000)), 0, OVERFLOW_DROP_NEWEST); dropped {
+		t.Errorf("Message larger than the byte limit should still be queued when nothing else is")
+	}
+}
+
+func testMessage(body string) parsing.Frame {
+	return parsing.Frame{Command: parsing.MESSAGE, Headers: map[string]string{}, Body: []byte(body)}
+}
+
+func expectBodies(t *testing.T, box *outbox, bodies ...string) {
+	t.Helper()
+	box.close()
+	for _, body := range bodies {
+		frame, ok := popOne(box)
+		if !ok || string(frame.Body) != body {
+			t.Fatalf("Expected frame %q next, got %q", body, frame.Body)
+		}
+	}
+	if frame, ok := popOne(box); ok {
+		t.Errorf("Expected no more frames, got %q", frame.Body)
+	}
+}
+
+func popOne(box *outbox) (parsing.Frame, bool) {
+	frames, ok := box.pop()
+	if !ok {
+		return parsing.Frame{}, false
+	}
+	return frames[0], true
+}
+
+type countingConn struct {
+	net.Conn
+	mu     sync.Mutex
+	writes int
+}
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	c.writes++
+	c.mu.Unlock()
+	return c.Conn.Write(p)
+}
+
+func (c *countingConn) count() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writes
+}
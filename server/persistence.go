@@ -0,0 +1,28 @@
+package server
+
+import "strings"
+
+// Persistence
+// Whether a message is persistent is up to its sender, through the
+// persistent header, unless the destination falls under one of the
+// configured persistent or transient prefixes, which override it. Where
+// prefixes of both kinds match the longest wins. Persistent messages on
+// queues are kept in Options.Store if there is one, see FileStore, and the
+// decision is carried on the delivered MESSAGE either way.
+
+// Decide whether a message sent to the normalized destination is persistent
+func (b *broker) persistent(destination string, headers map[string]string) bool {
+	persistent := headers[HEADER_PERSISTENT] == "true"
+	longest := -1
+	for _, prefix := range b.opts.PersistentPrefixes {
+		if strings.HasPrefix(destination, prefix) && len(prefix) > longest {
+			persistent, longest = true, len(prefix)
+		}
+	}
+	for _, prefix := range b.opts.TransientPrefixes {
+		if strings.HasPrefix(destination, prefix) && len(prefix) > longest {
+			persistent, longest = false, len(prefix)
+		}
+	}
+	return persistent
+}
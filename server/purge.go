@@ -0,0 +1,64 @@
+package server
+
+import "fmt"
+
+// Purging
+// Operators can clear out a stuck queue through MANAGEMENT_PURGE, which
+// removes every message retained on it. Messages already delivered and
+// waiting to be acked are left with their subscribers. The purged messages
+// are dropped, or with HEADER_DEAD_LETTER set to true moved on to the dead
+// letter queue, or the quarantine, as if they had been evicted.
+
+// Purge says how many messages were purged from a queue
+type Purge struct {
+	Destination  string `json:"destination"`
+	Purged       int    `json:"purged"`
+	DeadLettered bool   `json:"dead_lettered"` // Whether they went to the dead letter queue rather than being dropped
+}
+
+// PurgeQueue removes every message retained on the queue, moving them to the
+// dead letter queue if deadLetter is set. It fails if the destination is a
+// topic, or if dead lettering is asked for without a dead letter queue or
+// quarantine to move them to.
+func (server *Server) PurgeQueue(destination string, deadLetter bool) (Purge, error) {
+	return server.broker.purge(destination, deadLetter)
+}
+
+func (b *broker) purge(destName string, deadLetter bool) (Purge, error) {
+	kind, normalized := b.router.Resolve(destName)
+	if kind != QUEUE {
+		return Purge{}, fmt.Errorf("Only queues can be purged, %s is a topic", normalized)
+	}
+	if deadLetter {
+		if b.deadLetterQueue == "" && b.opts.QuarantineSize == 0 {
+			return Purge{}, fmt.Errorf("No dead letter queue is configured")
+		}
+		if normalized == b.deadLetterQueue && b.opts.QuarantineSize == 0 {
+			return Purge{}, fmt.Errorf("Messages on the dead letter queue can't be dead lettered")
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	purge := Purge{Destination: normalized, DeadLettered: deadLetter}
+	dest, ok := b.destinations[normalized]
+	if !ok {
+		return purge, nil
+	}
+
+	messages := dest.messages
+	dest.messages = nil
+	purge.Purged = len(messages)
+	b.log.Infof("Purging %d messages from %s", len(messages), dest.name)
+	for _, msg := range messages {
+		b.dequeued(dest, msg)
+		if deadLetter {
+			b.deadLetter(msg)
+		} else {
+			b.forgetMessage(msg)
+			b.log.Debugf("Purged message %s from %s (trace %s)", msg.id, dest.name, msg.traceID)
+		}
+	}
+	return purge, nil
+}
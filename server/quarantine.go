@@ -0,0 +1,60 @@
+package server
+
+import "time"
+
+// Quarantine
+// Messages that would go to the dead letter queue can be held in a
+// quarantine instead, where nothing consumes them but operators can inspect
+// them whole through MANAGEMENT_QUARANTINE. It holds at most
+// Options.QuarantineSize messages, making room for newer ones by dropping
+// the oldest.
+
+// QuarantinedMessage is a dead letter held for inspection, with the headers
+// and body it was sent with
+type QuarantinedMessage struct {
+	ID            string            `json:"id"`
+	Destination   string            `json:"destination"`
+	Headers       map[string]string `json:"headers"`
+	Body          []byte            `json:"body"` // Base64 encoded in JSON, as it needn't be text
+	TraceID       string            `json:"trace"`
+	Redeliveries  int               `json:"redeliveries"`
+	QuarantinedAt time.Time         `json:"quarantined_at"`
+}
+
+// QuarantinedMessages lists the messages held in quarantine, oldest first
+func (server *Server) QuarantinedMessages() []QuarantinedMessage {
+	return server.broker.quarantined()
+}
+
+// Called with the broker locked in place of moving a message to the dead
+// letter queue
+func (b *broker) quarantineMessage(msg *message) {
+	if len(b.quarantine) >= b.opts.QuarantineSize {
+		dropped := b.quarantine[0]
+		b.log.Debugf("Quarantine is full, dropping message %s (trace %s)", dropped.ID, dropped.TraceID)
+		b.quarantine[0] = QuarantinedMessage{}
+		b.quarantine = b.quarantine[1:]
+	}
+
+	headers := make(map[string]string, len(msg.headers))
+	for key, value := range msg.headers {
+		headers[key] = value
+	}
+	b.log.Infof("Quarantining message %s from %s (trace %s)", msg.id, msg.destination, msg.traceID)
+	b.quarantine = append(b.quarantine, QuarantinedMessage{
+		ID:            msg.id,
+		Destination:   msg.destination,
+		Headers:       headers,
+		Body:          msg.body,
+		TraceID:       msg.traceID,
+		Redeliveries:  msg.redeliveries,
+		QuarantinedAt: b.clock.Now(),
+	})
+}
+
+func (b *broker) quarantined() []QuarantinedMessage {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return append([]QuarantinedMessage{}, b.quarantine...)
+}
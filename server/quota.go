@@ -0,0 +1,45 @@
+package server
+
+import "fmt"
+
+// Send quotas
+// Options.SendQuota limits how many messages a connection can publish within
+// any Options.SendQuotaWindow, counted over a sliding window. A SEND over the
+// quota is refused like any other frame, see Rejections. Refused messages
+// don't count against the quota, and nor do frames to control or management
+// destinations.
+
+// Return an error if the connection's quota is used up. Only the
+// connection's reader sends, so the quota can't be used up between this and
+// chargeQuota.
+func (b *broker) checkQuota(c *conn) error {
+	limit, window := b.opts.SendQuota, b.opts.SendQuotaWindow
+	if limit == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if sent := c.quotaSent; len(sent) >= limit && b.clock.Now().Sub(sent[0]) < window {
+		return limitError(fmt.Sprintf("Send quota of %d messages per %s exceeded", limit, window))
+	}
+	return nil
+}
+
+// Count a message the broker has accepted against the connection's quota
+func (b *broker) chargeQuota(c *conn) {
+	limit := b.opts.SendQuota
+	if limit == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	sent := c.quotaSent
+	if len(sent) >= limit {
+		sent = sent[1:]
+	}
+	c.quotaSent = append(sent, b.clock.Now())
+}
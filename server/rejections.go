@@ -0,0 +1,103 @@
+package server
+
+import (
+	"sync"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Rejections
+// Frames refused because the client got something wrong are counted by
+// reason, so that operators can spot misbehaving clients in the metrics.
+// Errors that aren't down to the client, such as the server failing to
+// issue a resume token, aren't counted. As STOMP 1.2 requires, the
+// connection is closed after every ERROR, including those for a send quota
+// or a limit the client would be under again later, and those the server
+// sends of its own accord, such as for a reclaimed subscription. A client
+// that wants to carry on has to reconnect. The one exception is a malformed
+// or invalid frame when Options.ResyncAfterBadFrames is set.
+
+type RejectReason string
+
+const (
+	REJECT_PARSE_ERROR    RejectReason = "parse-error"    // Not a well formed frame
+	REJECT_MISSING_HEADER RejectReason = "missing-header" // Lacks a header its command requires
+	REJECT_UNAUTHORIZED   RejectReason = "unauthorized"   // Failed to authenticate, or isn't allowed to do what it asked
+	REJECT_OVER_LIMIT     RejectReason = "over-limit"     // Over a size limit, the subscription limit or the send quota
+	REJECT_INVALID        RejectReason = "invalid"        // Well formed but not allowed, e.g. an unknown ack mode
+)
+
+var rejectReasons = []RejectReason{
+	REJECT_PARSE_ERROR,
+	REJECT_MISSING_HEADER,
+	REJECT_UNAUTHORIZED,
+	REJECT_OVER_LIMIT,
+	REJECT_INVALID,
+}
+
+// An error the broker returns when a frame would take the client or a
+// destination over a limit, as opposed to the frame being invalid
+type limitError string
+
+func (e limitError) Error() string {
+	return string(e)
+}
+
+type rejectionCounters struct {
+	mu     sync.Mutex
+	counts map[RejectReason]uint64
+}
+
+func (counters *rejectionCounters) add(reason RejectReason) {
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+
+	if counters.counts == nil {
+		counters.counts = map[RejectReason]uint64{}
+	}
+	counters.counts[reason]++
+}
+
+// Every reason is included, so that a count is reported from zero
+func (counters *rejectionCounters) snapshot() map[RejectReason]uint64 {
+	counters.mu.Lock()
+	defer counters.mu.Unlock()
+
+	snapshot := make(map[RejectReason]uint64, len(rejectReasons))
+	for _, reason := range rejectReasons {
+		snapshot[reason] = counters.counts[reason]
+	}
+	return snapshot
+}
+
+// Refuse a frame the client got wrong with an ERROR, counting why
+func (c *conn) reject(reason RejectReason, message string) {
+	c.server.rejections.add(reason)
+	c.server.log.Warnf("Rejecting a frame from %s (%s): %s", c.netConn.RemoteAddr(), reason, message)
+	c.queueError(c.receipt, message)
+}
+
+// Refuse a frame the broker wouldn't accept
+func (c *conn) rejectRefused(err error) {
+	reason := REJECT_INVALID
+	if _, ok := err.(limitError); ok {
+		reason = REJECT_OVER_LIMIT
+	}
+	c.reject(reason, err.Error())
+}
+
+// Why a frame read from the client was bad, if it was the client's fault
+// rather than e.g. the connection failing
+func badFrameReason(parsed bool, err error) (RejectReason, bool) {
+	if parsed {
+		return REJECT_INVALID, true
+	}
+	parseErr, ok := err.(parsing.ParseError)
+	if !ok {
+		return "", false
+	}
+	if parseErr.ExceedsLimit() {
+		return REJECT_OVER_LIMIT, true
+	}
+	return REJECT_PARSE_ERROR, true
+}
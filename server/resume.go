@@ -0,0 +1,100 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+)
+
+// Session resumption
+// When Options.SessionRetention is set every CONNECTED frame carries a
+// resume token. A session that drops without a DISCONNECT has its
+// subscriptions detached rather than removed, keeping unacked messages for
+// redelivery as durable subscriptions do. A client presenting the token in
+// its next CONNECT within the retention window takes the session back,
+// otherwise the subscriptions are removed as if the session had closed.
+
+type retainedSession struct {
+	sessionID     string
+	principal     string
+	subscriptions []*subscription
+	timer         Timer // Removes the subscriptions once the window is over
+}
+
+// Hold on to a dropped session's detached subscriptions. Called with the
+// broker's lock held.
+func (b *broker) retainSession(c *conn, subs []*subscription) {
+	token := c.resumeToken
+	b.sessions[token] = &retainedSession{
+		sessionID:     c.sessionID,
+		principal:     c.principal,
+		subscriptions: subs,
+		timer:         b.clock.AfterFunc(b.opts.SessionRetention, func() { b.expireSession(token) }),
+	}
+}
+
+// Take back a retained session so that it can be reattached to the
+// connection presenting its token
+func (b *broker) claimSession(c *conn, token string) (*retainedSession, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	session, ok := b.sessions[token]
+	if !ok || session.principal != c.principal {
+		return nil, errors.New("Unknown or expired resume token")
+	}
+	delete(b.sessions, token)
+	session.timer.Stop()
+	return session, nil
+}
+
+// Reattach a claimed session's subscriptions, redelivering what they missed
+func (b *broker) resume(c *conn, session *retainedSession) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for _, sub := range session.subscriptions {
+		// A durable subscription may have been reclaimed through its
+		// client-id in the meantime
+		if sub.durableKey != "" && (b.durables[sub.durableKey] != sub || sub.conn != nil) {
+			continue
+		}
+		b.attach(c, sub)
+	}
+}
+
+func (b *broker) expireSession(token string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	session, ok := b.sessions[token]
+	if !ok {
+		return
+	}
+	delete(b.sessions, token)
+
+	b.log.Debugf("Retention window for session %s is over", session.sessionID)
+	for _, sub := range session.subscriptions {
+		if sub.durableKey != "" {
+			continue
+		}
+		// Messages held for the session go back to the queue they came from
+		if sub.destination.kind == QUEUE {
+			sub.destination.messages = append(sub.backlog, sub.destination.messages...)
+		} else {
+			for _, msg := range sub.backlog {
+				b.dequeued(sub.destination, msg)
+			}
+		}
+		sub.backlog = nil
+		b.removeSubscription(sub)
+	}
+}
+
+func newResumeToken() (string, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(token), nil
+}
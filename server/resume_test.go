@@ -0,0 +1,185 @@
+package server_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestResumeSession(t *testing.T) {
+	srv, addr := startServer(t, server.Options{SessionRetention: time.Minute})
+
+	client := dial(t, addr)
+	connected := client.connect(nil)
+	session, token := connected.Headers["session"], connected.Headers["resume-token"]
+	if token == "" {
+		t.Fatalf("CONNECTED should carry a resume token")
+	}
+	client.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+
+	publisher := dial(t, addr)
+	publisher.connect(nil)
+	publisher.publish("/queue/a", "hello")
+	client.expectMessage("hello")
+
+	dropConnection(t, srv, client, session)
+
+	resumed := dial(t, addr)
+	connected = resumed.connect(map[string]string{"resume-token": token})
+	if connected.Headers["session"] != session {
+		t.Errorf("Resumed session should keep its id, got %s", connected.Headers["session"])
+	}
+	if connected.Headers["resume-token"] == "" || connected.Headers["resume-token"] == token {
+		t.Errorf("Resumed session should be issued a new resume token")
+	}
+
+	frame := resumed.expectMessage("hello")
+	if frame.Headers["redelivered"] != "true" || frame.Headers["subscription"] != "0" {
+		t.Errorf("Unacked message should be redelivered to the resumed subscription, got %v", frame.Headers)
+	}
+
+	publisher.publish("/queue/a", "again")
+	resumed.expectMessage("again")
+}
+
+func TestQueueSkipsRetainedSession(t *testing.T) {
+	srv, addr := startServer(t, server.Options{SessionRetention: time.Minute})
+
+	retained := dial(t, addr)
+	connected := retained.connect(nil)
+	retained.subscribe("/queue/a", "0", nil)
+	dropConnection(t, srv, retained, connected.Headers["session"])
+
+	live := dial(t, addr)
+	live.connect(nil)
+	live.subscribe("/queue/a", "0", nil)
+	for _, body := range []string{"1", "2", "3", "4"} {
+		live.publish("/queue/a", body)
+		live.expectMessage(body)
+	}
+	live.disconnect()
+
+	// With no live consumer left the queue holds on to messages until the
+	// session is resumed
+	publisher := dial(t, addr)
+	publisher.connect(nil)
+	publisher.publish("/queue/a", "5")
+
+	resumed := dial(t, addr)
+	resumed.connect(map[string]string{"resume-token": connected.Headers["resume-token"]})
+	resumed.expectMessage("5")
+	resumed.expectNoFrame()
+}
+
+func TestResumeWindowExpired(t *testing.T) {
+	clock := server.NewFakeClock()
+	srv, addr := startServer(t, server.Options{SessionRetention: time.Minute, Clock: clock})
+
+	client := dial(t, addr)
+	connected := client.connect(nil)
+	client.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+	client.publish("/queue/a", "hello")
+	client.expectMessage("hello")
+	dropConnection(t, srv, client, connected.Headers["session"])
+
+	// The unacked message goes back to the queue once the window is over
+	other := dial(t, addr)
+	other.connect(nil)
+	other.subscribe("/queue/a", "0", nil)
+	other.expectNoFrame()
+	clock.Advance(time.Minute)
+	other.expectMessage("hello")
+
+	resumed := dial(t, addr)
+	resumed.sendFrame(parsing.Frame{
+		Command: parsing.CONNECT,
+		Headers: map[string]string{"resume-token": connected.Headers["resume-token"]},
+		Body:    []byte{},
+	})
+	resumed.expectFrame(parsing.ERROR)
+	resumed.expectClosed()
+}
+
+func TestDisconnectEndsSession(t *testing.T) {
+	_, addr := startServer(t, server.Options{SessionRetention: time.Minute})
+
+	client := dial(t, addr)
+	token := client.connect(nil).Headers["resume-token"]
+	client.subscribe("/queue/a", "0", nil)
+	client.disconnect()
+
+	resumed := dial(t, addr)
+	resumed.sendFrame(parsing.Frame{
+		Command: parsing.CONNECT,
+		Headers: map[string]string{"resume-token": token},
+		Body:    []byte{},
+	})
+	resumed.expectFrame(parsing.ERROR)
+}
+
+func TestNoResumeTokenByDefault(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	if token, ok := client.connect(nil).Headers["resume-token"]; ok {
+		t.Errorf("Resume tokens should only be issued when sessions are retained, got %s", token)
+	}
+}
+
+// Close the client's socket without a DISCONNECT and wait for the server to
+// notice
+// Re-subscribing
+
+func TestResubscribeAfterResume(t *testing.T) {
+	srv, addr := startServer(t, server.Options{SessionRetention: time.Minute, IdempotentSubscribe: true})
+
+	client := dial(t, addr)
+	connected := client.connect(nil)
+	client.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+	dropConnection(t, srv, client, connected.Headers["session"])
+
+	// A client which doesn't know its subscriptions survived subscribes again
+	resumed := dial(t, addr)
+	resumed.connect(map[string]string{"resume-token": connected.Headers["resume-token"]})
+	resumed.subscribe("/queue/a", "0", map[string]string{"ack": "client"})
+
+	resumed.publish("/queue/a", "hello")
+	resumed.expectMessage("hello")
+	resumed.expectNoFrame()
+	if subs := srv.SubscriptionsForConn(connected.Headers["session"]); len(subs) != 1 {
+		t.Errorf("Re-subscribing should keep the one subscription, got %v", subs)
+	}
+}
+
+func TestResubscribeToOtherDestinationRejected(t *testing.T) {
+	_, addr := startServer(t, server.Options{IdempotentSubscribe: true})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.subscribe("/queue/a", "0", nil)
+	client.send("SUBSCRIBE\ndestination:/queue/b\nid:0\n\n\x00")
+	client.expectFrame(parsing.ERROR)
+	client.expectClosed()
+}
+
+func TestDuplicateSubscriptionIDRejected(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.subscribe("/queue/a", "0", nil)
+	client.send("SUBSCRIBE\ndestination:/queue/a\nid:0\nreceipt:again\n\n\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if frame.Headers["receipt-id"] != "again" {
+		t.Errorf("Error should answer the repeated SUBSCRIBE's receipt, got %v", frame.Headers)
+	}
+	client.expectClosed()
+}
+
+func dropConnection(t *testing.T, srv *server.Server, client *testClient, session string) {
+	t.Helper()
+	client.conn.Close()
+	eventually(t, func() bool { return srv.SubscriptionsForConn(session) == nil })
+}
@@ -0,0 +1,25 @@
+package server
+
+import "strings"
+
+// Routing
+// A Router decides whether a destination is a queue or a topic, and the
+// normalized name it goes by, so that e.g. a JMS-style naming scheme can be
+// supported. Destinations are keyed by their normalized name, which is also
+// the destination delivered messages carry. Control and management
+// destinations are recognised before the router is consulted.
+
+type Router interface {
+	Resolve(destination string) (kind DestinationKind, normalized string)
+}
+
+// The router used unless Options.Router says otherwise, which makes
+// destinations starting with /topic/ topics and everything else queues
+type prefixRouter struct{}
+
+func (prefixRouter) Resolve(destination string) (DestinationKind, string) {
+	if strings.HasPrefix(destination, "/topic/") {
+		return TOPIC, destination
+	}
+	return QUEUE, destination
+}
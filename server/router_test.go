@@ -0,0 +1,50 @@
+package server_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestCustomRouter(t *testing.T) {
+	_, addr := startServer(t, server.Options{Router: bareNameRouter{}})
+
+	first := dial(t, addr)
+	first.connect(nil)
+	first.subscribe("news", "0", nil)
+
+	second := dial(t, addr)
+	second.connect(nil)
+	second.subscribe("/topic/news", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("news", "hello")
+
+	frame := first.expectMessage("hello")
+	if frame.Headers["destination"] != "/topic/news" {
+		t.Errorf("Message should carry the normalized destination, got %q", frame.Headers["destination"])
+	}
+	second.expectMessage("hello")
+}
+
+func TestDeadLetterQueueMustBeQueueForRouter(t *testing.T) {
+	opts := server.Options{Router: bareNameRouter{}, DeadLetterQueue: "dlq"}
+	if err := opts.Validate(); err == nil {
+		t.Errorf("Options with a dead letter queue the router makes a topic should be invalid")
+	}
+}
+
+// Routes bare names, e.g. "news", to the topic of the same name
+type bareNameRouter struct{}
+
+func (bareNameRouter) Resolve(destination string) (server.DestinationKind, string) {
+	if !strings.HasPrefix(destination, "/") {
+		return server.TOPIC, "/topic/" + destination
+	}
+	if strings.HasPrefix(destination, "/topic/") {
+		return server.TOPIC, destination
+	}
+	return server.QUEUE, destination
+}
@@ -0,0 +1,310 @@
+package server
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Selectors
+// A SUBSCRIBE frame can carry a selector header, a condition on the headers
+// of a message that it has to meet to be delivered to the subscription.
+// Conditions compare a header with a quoted string or a number, as in
+// region = 'eu' or priority <> 9, and combine with AND, OR, NOT and
+// parentheses. A header the message doesn't have never compares equal or
+// unequal, and a number only equals a header that parses as the same number.
+// Queue messages a selector passes over are left for other subscribers,
+// topic messages just aren't delivered to that subscription. So that a
+// client can't make routing expensive, or the parser recurse without bound,
+// Options.MaxSelectorLength limits the size of a selector and
+// Options.MaxSelectorDepth how deeply its parentheses and NOTs can nest.
+// Either being exceeded fails the SUBSCRIBE.
+
+type selector struct {
+	source    string
+	condition condition
+}
+
+type condition interface {
+	matches(headers map[string]string) bool
+}
+
+type comparison struct {
+	header string
+	value  string
+	number bool // Compare as numbers rather than strings
+	equal  bool // = rather than <>
+}
+
+type conjunction struct{ left, right condition }
+
+type disjunction struct{ left, right condition }
+
+type negation struct{ operand condition }
+
+func (cond comparison) matches(headers map[string]string) bool {
+	value, ok := headers[cond.header]
+	if !ok {
+		return false
+	}
+	if !cond.number {
+		return (value == cond.value) == cond.equal
+	}
+	actual, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+	if err != nil {
+		return false
+	}
+	expected, _ := strconv.ParseFloat(cond.value, 64)
+	return (actual == expected) == cond.equal
+}
+
+func (cond conjunction) matches(headers map[string]string) bool {
+	return cond.left.matches(headers) && cond.right.matches(headers)
+}
+
+func (cond disjunction) matches(headers map[string]string) bool {
+	return cond.left.matches(headers) || cond.right.matches(headers)
+}
+
+func (cond negation) matches(headers map[string]string) bool {
+	return !cond.operand.matches(headers)
+}
+
+// Whether a message meets the subscription's selector, if it has one
+func (sub *subscription) selects(msg *message) bool {
+	return sub.selector == nil || sub.selector.condition.matches(msg.headers)
+}
+
+// The selector as the client sent it, empty for none
+func (sel *selector) String() string {
+	if sel == nil {
+		return ""
+	}
+	return sel.source
+}
+
+// Parsing
+
+func parseSelector(source string, maxLength int, maxDepth int) (*selector, error) {
+	if maxLength > 0 && len(source) > maxLength {
+		return nil, limitError(fmt.Sprintf("Selectors can be at most %d bytes", maxLength))
+	}
+
+	tokens, err := tokenizeSelector(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &selectorParser{tokens: tokens, maxDepth: maxDepth}
+	cond, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if next := p.peek(); next.kind != TOKEN_END {
+		return nil, fmt.Errorf("Unexpected %q at position %d of selector", next.text, next.pos)
+	}
+	return &selector{source: source, condition: cond}, nil
+}
+
+type selectorTokenKind int
+
+const (
+	TOKEN_END selectorTokenKind = iota
+	TOKEN_IDENTIFIER
+	TOKEN_STRING
+	TOKEN_NUMBER
+	TOKEN_EQUAL
+	TOKEN_NOT_EQUAL
+	TOKEN_OPEN
+	TOKEN_CLOSE
+	TOKEN_AND
+	TOKEN_OR
+	TOKEN_NOT
+)
+
+var selectorKeywords = map[string]selectorTokenKind{
+	"AND": TOKEN_AND,
+	"OR":  TOKEN_OR,
+	"NOT": TOKEN_NOT,
+}
+
+type selectorToken struct {
+	kind selectorTokenKind
+	text string // Unquoted for strings
+	pos  int
+}
+
+func tokenizeSelector(source string) ([]selectorToken, error) {
+	var tokens []selectorToken
+	for i := 0; i < len(source); {
+		start := i
+		switch char := source[i]; {
+		case char == ' ' || char == '\t':
+			i++
+			continue
+		case char == '(':
+			tokens = append(tokens, selectorToken{TOKEN_OPEN, "(", start})
+			i++
+		case char == ')':
+			tokens = append(tokens, selectorToken{TOKEN_CLOSE, ")", start})
+			i++
+		case char == '=':
+			tokens = append(tokens, selectorToken{TOKEN_EQUAL, "=", start})
+			i++
+		case strings.HasPrefix(source[i:], "<>"):
+			tokens = append(tokens, selectorToken{TOKEN_NOT_EQUAL, "<>", start})
+			i += 2
+		case char == '\'':
+			// Quotes inside a string are doubled, as in SQL
+			var value strings.Builder
+			for i++; ; i++ {
+				if i >= len(source) {
+					return nil, fmt.Errorf("Unterminated string at position %d of selector", start)
+				}
+				if source[i] == '\'' {
+					if i+1 < len(source) && source[i+1] == '\'' {
+						i++
+					} else {
+						break
+					}
+				}
+				value.WriteByte(source[i])
+			}
+			i++
+			tokens = append(tokens, selectorToken{TOKEN_STRING, value.String(), start})
+		case char == '-' || char == '.' || isDigit(char):
+			for i++; i < len(source) && (isDigit(source[i]) || source[i] == '.'); i++ {
+			}
+			text := source[start:i]
+			if _, err := strconv.ParseFloat(text, 64); err != nil {
+				return nil, fmt.Errorf("Invalid number %q at position %d of selector", text, start)
+			}
+			tokens = append(tokens, selectorToken{TOKEN_NUMBER, text, start})
+		case isIdentifierStart(char):
+			// Header names commonly contain dashes, e.g. content-type
+			for i++; i < len(source) && (isIdentifierStart(source[i]) || isDigit(source[i]) || source[i] == '-' || source[i] == '.'); i++ {
+			}
+			text := source[start:i]
+			kind, ok := selectorKeywords[strings.ToUpper(text)]
+			if !ok {
+				kind = TOKEN_IDENTIFIER
+			}
+			tokens = append(tokens, selectorToken{kind, text, start})
+		default:
+			return nil, fmt.Errorf("Unexpected %q at position %d of selector", char, start)
+		}
+	}
+	return append(tokens, selectorToken{TOKEN_END, "end", len(source)}), nil
+}
+
+func isDigit(char byte) bool {
+	return char >= '0' && char <= '9'
+}
+
+func isIdentifierStart(char byte) bool {
+	return char == '_' || (char >= 'a' && char <= 'z') || (char >= 'A' && char <= 'Z')
+}
+
+// Recursive descent, with OR binding more loosely than AND and AND than NOT
+type selectorParser struct {
+	tokens   []selectorToken
+	next     int
+	depth    int
+	maxDepth int
+}
+
+func (p *selectorParser) peek() selectorToken {
+	return p.tokens[p.next]
+}
+
+func (p *selectorParser) take() selectorToken {
+	token := p.tokens[p.next]
+	if token.kind != TOKEN_END {
+		p.next++
+	}
+	return token
+}
+
+func (p *selectorParser) parseOr() (condition, error) {
+	left, err := p.parseAnd()
+	for err == nil && p.peek().kind == TOKEN_OR {
+		p.take()
+		var right condition
+		if right, err = p.parseAnd(); err == nil {
+			left = disjunction{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *selectorParser) parseAnd() (condition, error) {
+	left, err := p.parseUnary()
+	for err == nil && p.peek().kind == TOKEN_AND {
+		p.take()
+		var right condition
+		if right, err = p.parseUnary(); err == nil {
+			left = conjunction{left, right}
+		}
+	}
+	return left, err
+}
+
+func (p *selectorParser) parseUnary() (condition, error) {
+	switch p.peek().kind {
+	case TOKEN_NOT:
+		p.take()
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		operand, err := p.parseUnary()
+		p.depth--
+		if err != nil {
+			return nil, err
+		}
+		return negation{operand}, nil
+	case TOKEN_OPEN:
+		p.take()
+		if err := p.nest(); err != nil {
+			return nil, err
+		}
+		cond, err := p.parseOr()
+		p.depth--
+		if err != nil {
+			return nil, err
+		}
+		if closing := p.take(); closing.kind != TOKEN_CLOSE {
+			return nil, fmt.Errorf("Expected ) at position %d of selector", closing.pos)
+		}
+		return cond, nil
+	default:
+		return p.parseComparison()
+	}
+}
+
+func (p *selectorParser) nest() error {
+	p.depth++
+	if p.maxDepth > 0 && p.depth > p.maxDepth {
+		return limitError(fmt.Sprintf("Selectors can nest at most %d levels deep", p.maxDepth))
+	}
+	return nil
+}
+
+func (p *selectorParser) parseComparison() (condition, error) {
+	header := p.take()
+	if header.kind != TOKEN_IDENTIFIER {
+		return nil, fmt.Errorf("Expected a header name at position %d of selector", header.pos)
+	}
+	operator := p.take()
+	if operator.kind != TOKEN_EQUAL && operator.kind != TOKEN_NOT_EQUAL {
+		return nil, fmt.Errorf("Expected = or <> at position %d of selector", operator.pos)
+	}
+	value := p.take()
+	if value.kind != TOKEN_STRING && value.kind != TOKEN_NUMBER {
+		return nil, fmt.Errorf("Expected a string or number at position %d of selector", value.pos)
+	}
+	return comparison{
+		header: header.text,
+		value:  value.text,
+		number: value.kind == TOKEN_NUMBER,
+		equal:  operator.kind == TOKEN_EQUAL,
+	}, nil
+}
@@ -0,0 +1,100 @@
+package server_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestSelectorFiltersTopic(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	everything := dial(t, addr)
+	everything.connect(nil)
+	everything.subscribe("/topic/a", "0", nil)
+
+	selective := dial(t, addr)
+	selective.connect(nil)
+	selective.subscribe("/topic/a", "0", map[string]string{"selector": "(region = 'eu' OR region = 'uk') AND NOT priority = 1"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/topic/a", "region": "us"}, "us")
+	producer.request(parsing.SEND, map[string]string{"destination": "/topic/a", "region": "eu", "priority": "1"}, "low")
+	producer.request(parsing.SEND, map[string]string{"destination": "/topic/a", "region": "uk", "priority": "5"}, "uk")
+	producer.request(parsing.SEND, map[string]string{"destination": "/topic/a", "region": "eu"}, "eu")
+
+	for _, body := range []string{"us", "low", "uk", "eu"} {
+		everything.expectMessage(body)
+	}
+	selective.expectMessage("uk")
+	selective.expectMessage("eu")
+	selective.expectNoFrame()
+}
+
+func TestSelectorLeavesQueueMessages(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	selective := dial(t, addr)
+	selective.connect(nil)
+	selective.subscribe("/queue/a", "0", map[string]string{"selector": "region <> 'eu'"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "region": "eu"}, "eu")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "region": "us"}, "us")
+
+	// The message the selector passes over doesn't hold up the one behind it
+	selective.expectMessage("us")
+	selective.expectNoFrame()
+
+	other := dial(t, addr)
+	other.connect(nil)
+	other.subscribe("/queue/a", "0", nil)
+	other.expectMessage("eu")
+}
+
+func TestInvalidSelector(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.send("SUBSCRIBE\ndestination:/topic/a\nid:0\nselector:region = \n\n\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "selector") {
+		t.Errorf("Error should explain the selector is invalid, got %q", frame.Headers["message"])
+	}
+	client.expectClosed()
+}
+
+func TestSelectorTooLong(t *testing.T) {
+	_, addr := startServer(t, server.Options{MaxSelectorLength: 20})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.subscribe("/topic/a", "0", map[string]string{"selector": "region = 'eu'"})
+
+	client.send("SUBSCRIBE\ndestination:/topic/a\nid:1\nselector:region = 'eu' OR region = 'uk'\n\n\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "at most 20 bytes") {
+		t.Errorf("Error should explain the selector length limit, got %q", frame.Headers["message"])
+	}
+	client.expectClosed()
+}
+
+func TestSelectorTooDeep(t *testing.T) {
+	_, addr := startServer(t, server.Options{MaxSelectorDepth: 3})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.subscribe("/topic/a", "0", map[string]string{"selector": "NOT ((a = 1))"})
+
+	client.send("SUBSCRIBE\ndestination:/topic/a\nid:1\nselector:NOT (NOT (a = 1 OR (b = 2)))\n\n\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "at most 3 levels") {
+		t.Errorf("Error should explain the selector depth limit, got %q", frame.Headers["message"])
+	}
+	client.expectClosed()
+}
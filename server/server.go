@@ -0,0 +1,457 @@
+package server
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+const SERVER_NAME = "skewserver"
+
+var ErrServerClosed = errors.New("server closed")
+
+// Server accepts STOMP client connections and tracks their sessions
+type Server struct {
+	opts      Options
+	log       Logger
+	clock     Clock
+	broker    *broker
+	tlsConfig *tls.Config // Nil unless serving over TLS
+	policy    parsing.Policy
+	bodyLog   TraceLogger // Nil unless logging frame bodies, see Options.LogBodies
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[*conn]struct{}
+	clients  map[string]*conn // Live sessions keyed by client-id
+	closed   bool
+	draining bool
+	health   *http.Server  // Nil unless serving health checks
+	done     chan struct{} // Closed when the server is, stopping background tasks
+
+	ingest     rateMeter         // Frames read across all connections
+	rejections rejectionCounters // Frames refused because of the client, by reason
+	frames     frameCounters     // Well formed frames received, by command
+	sampler    *frameSampler
+	sessionIDs SessionIDGenerator
+	connects   *connectLimiter
+
+	activeConns int64 // Connections being handled, whether or not they have sent CONNECT
+}
+
+// New validates the options and creates a server. Nothing is started until
+// Serve or ListenAndServe is called, apart from background maintenance.
+func New(opts Options) (*Server, error) {
+	if err := opts.Validate(); err != nil {
+		return nil, err
+	}
+
+	var tlsConfig *tls.Config
+	if opts.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCertFile, opts.TLSKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading TLS certificate: %s", err)
+		}
+		tlsConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		if opts.TLSClientCAFile != "" {
+			if err := configureClientAuth(tlsConfig, opts); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	logger := opts.Logger
+	if logger == nil {
+		logger = nopLogger{}
+	}
+
+	clock := opts.Clock
+	if clock == nil {
+		clock = systemClock{}
+	}
+
+	policy := parsing.LENIENT
+	if opts.Strict {
+		policy = parsing.STRICT
+	}
+	policy.BlankLineTerminators = opts.BlankLineTerminators
+
+	var bodyLog TraceLogger
+	if tracer, ok := logger.(TraceLogger); ok && opts.LogBodies {
+		bodyLog = tracer
+	}
+
+	server := &Server{
+		opts:      opts,
+		log:       logger,
+		clock:     clock,
+		broker:    newBroker(logger, clock, opts),
+		tlsConfig: tlsConfig,
+		policy:    policy,
+		bodyLog:   bodyLog,
+		conns:     map[*conn]struct{}{},
+		clients:   map[string]*conn{},
+		done:      make(chan struct{}),
+
+		sessionIDs: opts.sessionIDGenerator(),
+		connects:   newConnectLimiter(clock, opts),
+		sampler:    newFrameSampler(opts),
+	}
+
+	if opts.Store != nil {
+		if err := server.replayStore(); err != nil {
+			return nil, err
+		}
+	}
+
+	go server.evictionLoop()
+	if opts.ConnectionLogInterval > 0 {
+		go server.connectionLogLoop()
+	}
+	return server, nil
+}
+
+// ListenAndServe listens on the configured address, over TLS if configured,
+// and serves connections until the server is closed
+func (server *Server) ListenAndServe() error {
+	addr := server.opts.Addr
+	if addr == "" {
+		addr = fmt.Sprintf(":%d", DEFAULT_PORT)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	if server.opts.HealthAddr != "" {
+		if err := server.listenHealth(); err != nil {
+			listener.Close()
+			return err
+		}
+	}
+
+	// Socket options have to be applied before the TLS wrapper hides the
+	// underlying TCP connection
+	if server.tlsConfig != nil {
+		listener = tls.NewListener(socketOptionsListener{listener, server}, server.tlsConfig)
+	}
+
+	server.log.Infof("Listening on %s...", listener.Addr())
+	return server.Serve(listener)
+}
+
+// Addr returns the address being listened on, or nil before Serve is called
+func (server *Server) Addr() net.Addr {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.listener == nil {
+		return nil
+	}
+	return server.listener.Addr()
+}
+
+// Serve accepts connections on the listener until it fails permanently or the
+// server is closed, in which case ErrServerClosed is returned.
+func (server *Server) Serve(listener net.Listener) error {
+	server.mu.Lock()
+	if server.closed || server.draining {
+		server.mu.Unlock()
+		listener.Close()
+		return ErrServerClosed
+	}
+	server.listener = listener
+	server.mu.Unlock()
+
+	var backoff time.Duration
+	errorLog := &logLimiter{clock: server.clock, limit: ACCEPT_ERROR_LOG_LIMIT, interval: ACCEPT_ERROR_LOG_INTERVAL}
+	refusalLog := &logLimiter{clock: server.clock, limit: ACCEPT_ERROR_LOG_LIMIT, interval: ACCEPT_ERROR_LOG_INTERVAL}
+	for {
+		netConn, err := listener.Accept()
+		if err != nil {
+			if server.isStopping() {
+				return ErrServerClosed
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Temporary() {
+				backoff = nextAcceptBackoff(backoff)
+				allowed, suppressed := errorLog.allow()
+				if suppressed > 0 {
+					server.log.Errorf("Suppressed %d more errors accepting connections", suppressed)
+				}
+				if allowed {
+					server.log.Errorf("Error accepting connection, retrying in %s: %s", backoff, err)
+				}
+				<-server.clock.After(backoff)
+				continue
+			}
+			return err
+		}
+
+		backoff = 0
+		if !server.connects.allow(netConn.RemoteAddr()) {
+			allowed, suppressed := refusalLog.allow()
+			if suppressed > 0 {
+				server.log.Warnf("Refused %d more connections over the connection rate limit", suppressed)
+			}
+			if allowed {
+				server.log.Warnf("Refusing connection from %s over the connection rate limit", netConn.RemoteAddr())
+			}
+			netConn.Close()
+			continue
+		}
+		go server.handleIncomingConnection(netConn)
+	}
+}
+
+// Temporary accept errors (e.g. running out of file descriptors) are retried
+// with exponential backoff rather than taking the whole server down
+const (
+	MIN_ACCEPT_BACKOFF = 5 * time.Millisecond
+	MAX_ACCEPT_BACKOFF = time.Second
+)
+
+// Under a flood of accept errors only the first ACCEPT_ERROR_LOG_LIMIT in
+// each ACCEPT_ERROR_LOG_INTERVAL are logged, followed by a count of the rest,
+// so that the log can't fill the disk. Fatal errors are returned by Serve
+// and never suppressed.
+const (
+	ACCEPT_ERROR_LOG_LIMIT    = 10
+	ACCEPT_ERROR_LOG_INTERVAL = time.Minute
+)
+
+func nextAcceptBackoff(backoff time.Duration) time.Duration {
+	if backoff == 0 {
+		return MIN_ACCEPT_BACKOFF
+	}
+	if backoff *= 2; backoff > MAX_ACCEPT_BACKOFF {
+		return MAX_ACCEPT_BACKOFF
+	}
+	return backoff
+}
+
+// Drain stops accepting new connections but leaves existing sessions to
+// carry on, so that readiness checks fail and clients move elsewhere before
+// the server is closed
+func (server *Server) Drain() error {
+	server.mu.Lock()
+	server.draining = true
+	listener := server.listener
+	server.mu.Unlock()
+
+	server.log.Infof("Draining, no longer accepting connections")
+	if listener != nil {
+		return listener.Close()
+	}
+	return nil
+}
+
+// Close stops accepting connections and terminates every open one, first
+// returning messages delivered from queues but not yet acked to their queues
+func (server *Server) Close() error {
+	server.mu.Lock()
+	if !server.closed {
+		close(server.done)
+	}
+	server.closed = true
+	listener := server.listener
+	health := server.health
+	conns := make([]*conn, 0, len(server.conns))
+	for c := range server.conns {
+		conns = append(conns, c)
+	}
+	server.mu.Unlock()
+
+	// Unacked messages are requeued before the connections are torn down,
+	// so that none are handed out again on the way
+	discarded, requeued := server.broker.close()
+	if discarded > 0 {
+		server.log.Warnf("Discarded %d scheduled messages that were not yet due", discarded)
+	}
+	if requeued > 0 {
+		server.log.Infof("Requeued %d unacked messages for shutdown", requeued)
+	}
+	for _, c := range conns {
+		c.terminate("Server is shutting down")
+	}
+
+	if health != nil {
+		health.Close()
+	}
+	if listener != nil {
+		return listener.Close()
+	}
+	return nil
+}
+
+// Periodically evict expired messages and those older than MaxMessageAge,
+// and reclaim subscriptions idle for longer than SubscriptionIdleTimeout.
+// Sweeping at half of each limit (but at least once a second) bounds how
+// long past it anything can survive.
+func (server *Server) evictionLoop() {
+	interval := time.Second
+	if maxAge := server.opts.MaxMessageAge; maxAge > 0 && maxAge/2 < interval {
+		interval = maxAge / 2
+	}
+	if idle := server.opts.SubscriptionIdleTimeout; idle > 0 && idle/2 < interval {
+		interval = idle / 2
+	}
+
+	for {
+		select {
+		case <-server.clock.After(interval):
+			server.broker.evict(server.opts.MaxMessageAge)
+			if idle := server.opts.SubscriptionIdleTimeout; idle > 0 {
+				server.broker.reclaimIdle(idle)
+			}
+		case <-server.done:
+			return
+		}
+	}
+}
+
+// Log how many connections there are every ConnectionLogInterval, so that
+// the load shows up in the log without scraping the metrics
+func (server *Server) connectionLogLoop() {
+	for {
+		select {
+		case <-server.clock.After(server.opts.ConnectionLogInterval):
+			server.log.Infof("%d active connections", atomic.LoadInt64(&server.activeConns))
+		case <-server.done:
+			return
+		}
+	}
+}
+
+// Whether the listener is being closed deliberately, by Drain or Close
+func (server *Server) isStopping() bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	return server.closed || server.draining
+}
+
+func (server *Server) handleIncomingConnection(netConn net.Conn) {
+	atomic.AddInt64(&server.activeConns, 1)
+	defer atomic.AddInt64(&server.activeConns, -1)
+	server.log.Infof("Handling incoming connection from %s", netConn.RemoteAddr())
+
+	if err := configureTCPConn(netConn, server.opts); err != nil {
+		server.log.Warnf("Error setting socket options for %s: %s", netConn.RemoteAddr(), err)
+	}
+	if server.opts.Compression {
+		netConn = newCompressionConn(netConn)
+	}
+
+	c := newConn(server, netConn)
+	if !server.addConn(c) {
+		c.terminate("Server is shutting down")
+	}
+	c.serve()
+}
+
+type socketOptionsListener struct {
+	net.Listener
+	server *Server
+}
+
+func (listener socketOptionsListener) Accept() (net.Conn, error) {
+	netConn, err := listener.Listener.Accept()
+	if err == nil {
+		if err := configureTCPConn(netConn, listener.server.opts); err != nil {
+			listener.server.log.Warnf("Error setting socket options for %s: %s", netConn.RemoteAddr(), err)
+		}
+	}
+	return netConn, err
+}
+
+// Apply the configured socket options if the connection is TCP. Other
+// connection types (e.g. unix sockets) are left untouched.
+func configureTCPConn(netConn net.Conn, opts Options) error {
+	tcpConn, ok := netConn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+
+	if err := tcpConn.SetNoDelay(opts.TCPNoDelay); err != nil {
+		return err
+	}
+
+	if opts.TCPKeepAlive <= 0 {
+		return tcpConn.SetKeepAlive(false)
+	}
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		return err
+	}
+	return tcpConn.SetKeepAlivePeriod(opts.TCPKeepAlive)
+}
+
+func (server *Server) parserOptions() []parsing.ParserOption {
+	return []parsing.ParserOption{
+		parsing.WithMaxHeaderKeyLength(server.opts.MaxHeaderKeyLength),
+		parsing.WithMaxHeaderValueLength(server.opts.MaxHeaderValueLength),
+		parsing.WithMaxHeaderLines(server.opts.MaxHeaderLines),
+		parsing.WithMaxBodySize(server.opts.MaxBodySize),
+		parsing.WithMaxFrameSize(server.opts.MaxFrameSize),
+		parsing.WithPolicy(server.policy),
+	}
+}
+
+// Connection and session bookkeeping
+
+func (server *Server) addConn(c *conn) bool {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	if server.closed {
+		return false
+	}
+	server.conns[c] = struct{}{}
+	return true
+}
+
+func (server *Server) removeConn(c *conn) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+
+	delete(server.conns, c)
+	if c.clientID != "" && server.clients[c.clientID] == c {
+		delete(server.clients, c.clientID)
+	}
+}
+
+// Set the connection's session id, under the lock so that other goroutines
+// looking up connections by session see it
+func (server *Server) assignSession(c *conn, sessionID string) {
+	server.mu.Lock()
+	defer server.mu.Unlock()
+	c.sessionID = sessionID
+}
+
+func (server *Server) nextSessionID() string {
+	return server.sessionIDs.NewSessionID()
+}
+
+// Claim the connection's client-id, applying the duplicate session policy if
+// another live session already holds it.
+func (server *Server) registerClient(c *conn) error {
+	server.mu.Lock()
+	existing, ok := server.clients[c.clientID]
+	if ok && server.opts.DuplicateSessionPolicy != DUPLICATE_SESSION_TAKEOVER {
+		server.mu.Unlock()
+		return fmt.Errorf("Client id %s is already connected", c.clientID)
+	}
+	server.clients[c.clientID] = c
+	server.mu.Unlock()
+
+	if ok {
+		server.log.Infof("Session %s taking over client id %s from session %s", c.sessionID, c.clientID, existing.sessionID)
+		existing.terminate("Session taken over by a new connection with the same client id")
+	}
+	return nil
+}
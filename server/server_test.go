@@ -0,0 +1,922 @@
+package server_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+// How long to wait for a frame that should arrive, and for one that shouldn't
+const (
+	FRAME_TIMEOUT    = 2 * time.Second
+	NO_FRAME_TIMEOUT = 100 * time.Millisecond
+)
+
+// Handshake
+
+func TestConnect(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	connected := client.connect(map[string]string{"accept-version": "1.0,1.2", "host": "localhost"})
+
+	if connected.Headers["version"] != "1.2" {
+		t.Errorf("CONNECTED should negotiate version 1.2")
+	}
+	if connected.Headers["session"] == "" {
+		t.Errorf("CONNECTED should include a session id")
+	}
+}
+
+func TestSessionIDGenerator(t *testing.T) {
+	_, addr := startServer(t, server.Options{SessionIDGenerator: &countingSessionIDs{prefix: "eu-west-"}})
+
+	for _, expected := range []string{"eu-west-1", "eu-west-2"} {
+		client := dial(t, addr)
+		if session := client.connect(nil).Headers["session"]; session != expected {
+			t.Errorf("CONNECTED should carry the generated session id %s, got %s", expected, session)
+		}
+	}
+}
+
+type countingSessionIDs struct {
+	prefix string
+	count  int32
+}
+
+func (ids *countingSessionIDs) NewSessionID() string {
+	return fmt.Sprintf("%s%d", ids.prefix, atomic.AddInt32(&ids.count, 1))
+}
+
+func TestConnectUnsupportedVersion(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	client.send("CONNECT\naccept-version:1.0\n\n\x00")
+
+	frame := client.expectFrame(parsing.ERROR)
+	if frame.Headers["version"] != "1.2" {
+		t.Errorf("ERROR should advertise the supported versions")
+	}
+	client.expectClosed()
+}
+
+func TestConnectWithReceipt(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	for _, command := range []string{"CONNECT", "STOMP"} {
+		client := dial(t, addr)
+		client.send(command + "\naccept-version:1.2\nreceipt:x\n\n\x00")
+
+		frame := client.expectFrame(parsing.ERROR)
+		if !strings.Contains(frame.Headers["message"], "receipt") {
+			t.Errorf("ERROR should explain that %s cannot request a receipt, got %q", command, frame.Headers["message"])
+		}
+		client.expectClosed()
+	}
+}
+
+func TestDisconnectReceipt(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.send("DISCONNECT\nreceipt:77\n\n\x00")
+
+	frame := client.expectFrame(parsing.RECEIPT)
+	if frame.Headers["receipt-id"] != "77" {
+		t.Errorf("RECEIPT should reference the DISCONNECT receipt")
+	}
+	client.expectClosed()
+}
+
+func TestDataAfterDisconnectIgnored(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.send("DISCONNECT\nreceipt:77\n\n\x00not a frame\n\n\x00SEND\ndestination:/queue/a\n\nhello\x00")
+
+	frame := client.expectFrame(parsing.RECEIPT)
+	if frame.Headers["receipt-id"] != "77" {
+		t.Errorf("RECEIPT should reference the DISCONNECT receipt")
+	}
+	client.expectClosed()
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+	consumer.expectNoFrame()
+}
+
+func TestHeaderLengthLimits(t *testing.T) {
+	_, addr := startServer(t, server.Options{MaxHeaderKeyLength: 16, MaxHeaderValueLength: 16})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.publish("/queue/a", "fits")
+
+	client.send("SEND\ndestination:/queue/much-too-long-for-the-limit\n\n\x00")
+	client.expectFrame(parsing.ERROR)
+	client.expectClosed()
+}
+
+func TestFrameSizeLimits(t *testing.T) {
+	_, addr := startServer(t, server.Options{MaxBodySize: 8, MaxFrameSize: 64})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.publish("/queue/a", "fits")
+
+	client.send("SEND\ndestination:/queue/a\n\nmuch too long\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "Body exceeds") {
+		t.Errorf("Error should say the body is too large, got %q", frame.Headers["message"])
+	}
+	client.expectClosed()
+}
+
+func TestSubscriptionLimit(t *testing.T) {
+	_, addr := startServer(t, server.Options{MaxSubscriptions: 3})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	for i := 0; i < 3; i++ {
+		client.subscribe(fmt.Sprintf("/queue/%d", i), fmt.Sprint(i), nil)
+	}
+
+	client.send("SUBSCRIBE\ndestination:/queue/3\nid:3\n\n\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "at most 3 subscriptions") {
+		t.Errorf("Error should give the subscription limit, got %q", frame.Headers["message"])
+	}
+	client.expectClosed()
+}
+
+func TestResyncAfterBadFrame(t *testing.T) {
+	_, addr := startServer(t, server.Options{ResyncAfterBadFrames: true})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.send("SEND\ndestination:/queue/a\n\nfirst\x00" +
+		"SEND\nbad header\n\nskipped\x00" +
+		"SUBSCRIBE\n\nno body allowed\x00" +
+		"SEND\ndestination:/queue/a\n\nsecond\x00")
+
+	producer.expectFrame(parsing.ERROR)
+	producer.expectFrame(parsing.ERROR)
+	consumer.expectMessage("first")
+	consumer.expectMessage("second")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a"}, "third")
+	consumer.expectMessage("third")
+}
+
+func TestCloseWithoutSending(t *testing.T) {
+	logs := &recordingLogger{}
+	_, addr := startServer(t, server.Options{Logger: logs})
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	conn.(*net.TCPConn).CloseWrite()
+
+	reply, err := ioutil.ReadAll(conn)
+	if err != nil || len(reply) > 0 {
+		t.Errorf("Server should close the connection without replying, got %q %v", reply, err)
+	}
+	if len(logs.warns()) > 0 || len(logs.errors()) > 0 {
+		t.Errorf("An empty connection should not be logged as a problem, got %v %v", logs.warns(), logs.errors())
+	}
+}
+
+func TestSendBeforeConnect(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	client.send("SEND\ndestination:/queue/a\n\nhello\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "Expected a CONNECT frame") {
+		t.Errorf("Error should explain a CONNECT was expected, got %q", frame.Headers["message"])
+	}
+	client.expectClosed()
+}
+
+func TestConnectTwice(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.sendFrame(parsing.Frame{Command: parsing.CONNECT, Headers: map[string]string{}, Body: []byte{}})
+	frame := client.expectFrame(parsing.ERROR)
+	if frame.Headers["message"] != "Already connected" {
+		t.Errorf("Error should explain the client is already connected, got %q", frame.Headers["message"])
+	}
+	client.expectClosed()
+}
+
+func TestBodyForbidden(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.send("SUBSCRIBE\ndestination:/queue/a\nid:0\n\nhello\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "must not have a body") {
+		t.Errorf("Error should explain the body isn't allowed, got %q", frame.Headers["message"])
+	}
+	if _, ok := frame.Headers["receipt-id"]; ok {
+		t.Errorf("Error for a frame without a receipt should not carry a receipt-id")
+	}
+	client.expectClosed()
+}
+
+// Last will
+
+func TestLastWillOnAbruptDisconnect(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	watcher := dial(t, addr)
+	watcher.connect(nil)
+	watcher.subscribe("/topic/status", "0", nil)
+
+	client := dial(t, addr)
+	client.connect(map[string]string{
+		"will-destination":  "/topic/status",
+		"will-body":         "client gone",
+		"will-content-type": "text/plain",
+	})
+	client.conn.Close()
+
+	frame := watcher.expectMessage("client gone")
+	if frame.Headers["content-type"] != "text/plain" {
+		t.Errorf("Last will should carry its content type")
+	}
+}
+
+func TestNoLastWillOnCleanDisconnect(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	watcher := dial(t, addr)
+	watcher.connect(nil)
+	watcher.subscribe("/topic/status", "0", nil)
+
+	client := dial(t, addr)
+	client.connect(map[string]string{
+		"will-destination": "/topic/status",
+		"will-body":        "client gone",
+	})
+	client.disconnect()
+
+	watcher.expectNoFrame()
+}
+
+// Duplicate sessions
+
+func TestDuplicateSessionRejected(t *testing.T) {
+	_, addr := startServer(t, server.Options{DuplicateSessionPolicy: server.DUPLICATE_SESSION_REJECT})
+
+	first := dial(t, addr)
+	first.connect(map[string]string{"client-id": "app"})
+
+	second := dial(t, addr)
+	second.send("CONNECT\nclient-id:app\n\n\x00")
+	second.expectFrame(parsing.ERROR)
+	second.expectClosed()
+
+	// The original session should be unaffected
+	first.send("DISCONNECT\nreceipt:1\n\n\x00")
+	first.expectFrame(parsing.RECEIPT)
+}
+
+func TestDuplicateSessionTakeover(t *testing.T) {
+	_, addr := startServer(t, server.Options{DuplicateSessionPolicy: server.DUPLICATE_SESSION_TAKEOVER})
+
+	first := dial(t, addr)
+	first.connect(map[string]string{"client-id": "app"})
+
+	second := dial(t, addr)
+	second.connect(map[string]string{"client-id": "app"})
+
+	first.expectFrame(parsing.ERROR)
+	first.expectClosed()
+
+	// A third session should now take over from the second
+	third := dial(t, addr)
+	third.connect(map[string]string{"client-id": "app"})
+	second.expectFrame(parsing.ERROR)
+	second.expectClosed()
+}
+
+func TestClientIDReleasedOnDisconnect(t *testing.T) {
+	_, addr := startServer(t, server.Options{DuplicateSessionPolicy: server.DUPLICATE_SESSION_REJECT})
+
+	first := dial(t, addr)
+	first.connect(map[string]string{"client-id": "app"})
+	first.send("DISCONNECT\nreceipt:1\n\n\x00")
+	first.expectFrame(parsing.RECEIPT)
+	first.expectClosed()
+
+	second := dial(t, addr)
+	second.connect(map[string]string{"client-id": "app"})
+}
+
+func TestDuplicateSessionPolicyFlag(t *testing.T) {
+	var policy server.DuplicateSessionPolicy
+	if err := policy.Set("takeover"); err != nil || policy != server.DUPLICATE_SESSION_TAKEOVER {
+		t.Errorf("takeover should parse to DUPLICATE_SESSION_TAKEOVER")
+	}
+	if err := policy.Set("bogus"); err == nil {
+		t.Errorf("Unknown policies should be rejected")
+	}
+}
+
+// Strict mode
+
+func TestStrictConnectRequiresHeaders(t *testing.T) {
+	_, lenientAddr := startServer(t, server.Options{})
+	lenient := dial(t, lenientAddr)
+	lenient.send("CONNECT\n\n\x00")
+	lenient.expectFrame(parsing.CONNECTED)
+
+	_, strictAddr := startServer(t, server.Options{Strict: true})
+	strict := dial(t, strictAddr)
+	strict.send("CONNECT\n\n\x00")
+	if frame := strict.expectFrame(parsing.ERROR); !strings.Contains(frame.Headers["message"], "accept-version") {
+		t.Errorf("Error should name the missing header, got %q", frame.Headers["message"])
+	}
+	strict.expectClosed()
+}
+
+func TestStrictLowercaseCommand(t *testing.T) {
+	_, lenientAddr := startServer(t, server.Options{})
+	lenient := dial(t, lenientAddr)
+	lenient.send("connect\naccept-version:1.2\nhost:localhost\n\n\x00")
+	lenient.expectFrame(parsing.CONNECTED)
+
+	_, strictAddr := startServer(t, server.Options{Strict: true})
+	strict := dial(t, strictAddr)
+	strict.send("connect\naccept-version:1.2\nhost:localhost\n\n\x00")
+	if frame := strict.expectFrame(parsing.ERROR); !strings.Contains(frame.Headers["message"], "case sensitive") {
+		t.Errorf("Error should explain commands are case sensitive, got %q", frame.Headers["message"])
+	}
+	strict.expectClosed()
+}
+
+func TestStrictReservedHeaders(t *testing.T) {
+	_, lenientAddr := startServer(t, server.Options{})
+	consumer := dial(t, lenientAddr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, lenientAddr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "message-id": "spoofed", "ack": "spoofed"}, "hello")
+
+	frame := consumer.expectMessage("hello")
+	if frame.Headers["message-id"] == "spoofed" || frame.Headers["ack"] == "spoofed" {
+		t.Errorf("Lenient server should ignore server-assigned headers on SEND, got %v", frame.Headers)
+	}
+
+	_, strictAddr := startServer(t, server.Options{Strict: true})
+	strict := dial(t, strictAddr)
+	strict.connect(map[string]string{"accept-version": "1.2", "host": "localhost"})
+	strict.send("SEND\ndestination:/queue/a\nmessage-id:spoofed\n\n\x00")
+	if frame := strict.expectFrame(parsing.ERROR); !strings.Contains(frame.Headers["message"], "message-id") {
+		t.Errorf("Error should name the reserved header, got %q", frame.Headers["message"])
+	}
+	strict.expectClosed()
+}
+
+func TestBlankLineTerminators(t *testing.T) {
+	_, addr := startServer(t, server.Options{BlankLineTerminators: true})
+	client := dial(t, addr)
+	client.send("CONNECT\naccept-version:1.2\nhost:localhost\n\n\n")
+	client.expectFrame(parsing.CONNECTED)
+	client.send("SUBSCRIBE\nid:0\ndestination:/queue/a\nreceipt:subscribed\n\n\n")
+	client.expectFrame(parsing.RECEIPT)
+
+	_, defaultAddr := startServer(t, server.Options{})
+	defaultClient := dial(t, defaultAddr)
+	defaultClient.send("CONNECT\naccept-version:1.2\nhost:localhost\n\n\n")
+	defaultClient.expectNoFrame()
+}
+
+// Receipt policies
+
+func TestReceiptAfterRouting(t *testing.T) {
+	commands := receiptedSend(t, server.RECEIPT_AFTER_ROUTING)
+	if commands[0] != parsing.MESSAGE || commands[1] != parsing.RECEIPT {
+		t.Errorf("Receipt should follow the delivery it covers, got %v", commands)
+	}
+}
+
+func TestReceiptOnAccept(t *testing.T) {
+	commands := receiptedSend(t, server.RECEIPT_ON_ACCEPT)
+	if commands[0] != parsing.RECEIPT || commands[1] != parsing.MESSAGE {
+		t.Errorf("Receipt should precede the delivery, got %v", commands)
+	}
+}
+
+func TestDisconnectReceiptedLast(t *testing.T) {
+	_, addr := startServer(t, server.Options{ReceiptPolicy: server.RECEIPT_ON_ACCEPT})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.subscribe("/queue/a", "0", nil)
+	client.disconnect()
+}
+
+// Write flushing
+
+func TestFlushInterval(t *testing.T) {
+	clock := server.NewFakeClock()
+	_, addr := startServer(t, server.Options{Clock: clock, FlushInterval: 50 * time.Millisecond})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "small")
+
+	// Far below the buffer size, so only the timer flushes it
+	clock.BlockUntil(1)
+	consumer.expectNoFrame()
+	clock.Advance(50 * time.Millisecond)
+	consumer.expectMessage("small")
+}
+
+// Lone subscriber sending to its own queue, returning the commands of the
+// first two frames it gets back
+func receiptedSend(t *testing.T, policy server.ReceiptPolicy) []parsing.CommandType {
+	_, addr := startServer(t, server.Options{ReceiptPolicy: policy})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.subscribe("/queue/a", "0", nil)
+	client.send("SEND\ndestination:/queue/a\nreceipt:sent\n\nhello\x00")
+
+	var commands []parsing.CommandType
+	for len(commands) < 2 {
+		frame, ok := client.nextFrame(FRAME_TIMEOUT)
+		if !ok {
+			t.Fatalf("Expected a MESSAGE and a RECEIPT, got %v", commands)
+		}
+		commands = append(commands, frame.Command)
+	}
+	return commands
+}
+
+// Body logging
+
+func TestBodiesLoggedOnlyWhenEnabled(t *testing.T) {
+	cases := []struct {
+		name      string
+		logBodies bool
+		logger    server.Logger
+		logged    bool
+	}{
+		{"enabled with a trace logger", true, &tracingLogger{}, true},
+		{"disabled with a trace logger", false, &tracingLogger{}, false},
+		{"enabled without a trace level", true, &recordingLogger{}, false},
+	}
+	for _, c := range cases {
+		_, addr := startServer(t, server.Options{LogBodies: c.logBodies, LogBodyLimit: 10, Logger: c.logger})
+
+		client := dial(t, addr)
+		client.connect(map[string]string{"login": "guest", "passcode": "secret"})
+		client.publish("/queue/a", "sensitive\ndata that goes on")
+
+		var traces []string
+		if tracer, ok := c.logger.(*tracingLogger); ok {
+			traces = tracer.traces()
+		}
+		logged := false
+		for _, line := range traces {
+			logged = logged || strings.Contains(line, `(27 byte body): "sensitive\n" (17 more bytes)`)
+			if strings.Contains(line, "secret") {
+				t.Errorf("%s: passcodes should be redacted, got %s", c.name, line)
+			}
+		}
+		if logged != c.logged {
+			t.Errorf("%s: body should be logged %t, got %v", c.name, c.logged, traces)
+		}
+	}
+}
+
+// Accept errors
+
+func TestTemporaryAcceptErrorsRetried(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	listener := &flakyListener{Listener: inner, failures: 3, err: temporaryError{}}
+
+	srv, _ := server.New(server.Options{})
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(listener) }()
+	defer srv.Close()
+
+	client := dial(t, inner.Addr().String())
+	client.connect(nil)
+
+	select {
+	case err := <-served:
+		t.Fatalf("Serve should survive temporary errors, returned %v", err)
+	default:
+	}
+}
+
+func TestFatalAcceptErrorReturned(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	fatal := errors.New("listener broken")
+	listener := &flakyListener{Listener: inner, failures: 1, err: fatal}
+
+	srv, _ := server.New(server.Options{})
+	defer srv.Close()
+
+	if err := srv.Serve(listener); err != fatal {
+		t.Errorf("Serve should return fatal accept errors, got %v", err)
+	}
+}
+
+func TestAcceptErrorLoggingBounded(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	failures := 200
+	listener := &flakyListener{Listener: inner, failures: failures, err: temporaryError{}}
+
+	clock := server.NewFakeClock()
+	logs := &recordingLogger{}
+	srv, _ := server.New(server.Options{Clock: clock, Logger: logs})
+	go srv.Serve(listener)
+	defer srv.Close()
+
+	start := clock.Now()
+	for i := 0; i < failures; i++ {
+		clock.BlockUntil(2) // The eviction loop's timer and the accept backoff
+		clock.Advance(server.MAX_ACCEPT_BACKOFF)
+	}
+	client := dial(t, inner.Addr().String())
+	client.connect(nil)
+
+	intervals := int(clock.Now().Sub(start)/server.ACCEPT_ERROR_LOG_INTERVAL) + 1
+	lines := logs.errors()
+	if len(lines) > intervals*(server.ACCEPT_ERROR_LOG_LIMIT+1) {
+		t.Errorf("Accept errors should be rate limited, got %d log lines over %d intervals", len(lines), intervals)
+	}
+	summarised := false
+	for _, line := range lines {
+		summarised = summarised || strings.Contains(line, "Suppressed")
+	}
+	if !summarised {
+		t.Errorf("Suppressed accept errors should be counted in the log")
+	}
+}
+
+func TestConnectRateLimited(t *testing.T) {
+	clock := server.NewFakeClock()
+	logs := &recordingLogger{}
+	_, addr := startServer(t, server.Options{ConnectRate: 1, ConnectBurst: 3, Clock: clock, Logger: logs})
+
+	for i := 0; i < 3; i++ {
+		dial(t, addr).connect(nil)
+	}
+	for i := 0; i < 20; i++ {
+		dial(t, addr).expectClosed()
+	}
+	if len(logs.warns()) == 0 {
+		t.Errorf("Refused connections should be logged")
+	}
+
+	clock.Advance(time.Second)
+	dial(t, addr).connect(nil)
+	dial(t, addr).expectClosed()
+}
+
+func TestServeReturnsAfterClose(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+
+	srv, _ := server.New(server.Options{})
+	served := make(chan error, 1)
+	go func() { served <- srv.Serve(listener) }()
+	eventually(t, func() bool { return srv.Addr() != nil })
+	srv.Close()
+
+	select {
+	case err := <-served:
+		if err != server.ErrServerClosed {
+			t.Errorf("Serve should return ErrServerClosed, got %v", err)
+		}
+	case <-time.After(FRAME_TIMEOUT):
+		t.Errorf("Serve should return once the server is closed")
+	}
+}
+
+// Listener which fails a number of times before delegating to a real one
+type flakyListener struct {
+	net.Listener
+	failures int
+	err      error
+}
+
+func (listener *flakyListener) Accept() (net.Conn, error) {
+	if listener.failures > 0 {
+		listener.failures--
+		return nil, listener.err
+	}
+	return listener.Listener.Accept()
+}
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "too many open files" }
+func (temporaryError) Timeout() bool   { return false }
+func (temporaryError) Temporary() bool { return true }
+
+// Test helpers
+
+func startServer(t *testing.T, opts server.Options) (*server.Server, string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+
+	srv, err := server.New(opts)
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+	go srv.Serve(listener)
+	t.Cleanup(func() { srv.Close() })
+
+	return srv, listener.Addr().String()
+}
+
+// Minimal STOMP client which parses incoming frames in the background so
+// tests can wait on them with a timeout
+type testClient struct {
+	t        *testing.T
+	conn     net.Conn
+	frames   chan parsing.Frame
+	pending  []parsing.Frame // Frames that arrived while waiting for a receipt
+	receipts int
+}
+
+func dial(t *testing.T, addr string) *testClient {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	return newTestClient(t, conn)
+}
+
+func dialTLS(t *testing.T, addr string, config *tls.Config) *testClient {
+	conn, err := tls.Dial("tcp", addr, config)
+	if err != nil {
+		t.Fatalf("Error dialing over TLS: %s", err)
+	}
+	return newTestClient(t, conn)
+}
+
+func newTestClient(t *testing.T, conn net.Conn) *testClient {
+	t.Cleanup(func() { conn.Close() })
+
+	client := &testClient{t: t, conn: conn, frames: make(chan parsing.Frame, 1024)}
+	go client.readLoop()
+	return client
+}
+
+func (client *testClient) readLoop() {
+	defer close(client.frames)
+
+	parser := parsing.NewStompParserFromReader(client.conn)
+	for {
+		frame, err := parser.NextFrame()
+		if err != nil {
+			return
+		}
+		client.frames <- frame
+	}
+}
+
+func (client *testClient) send(data string) {
+	if _, err := client.conn.Write([]byte(data)); err != nil {
+		client.t.Fatalf("Error writing: %s", err)
+	}
+}
+
+func (client *testClient) sendFrame(frame parsing.Frame) {
+	client.send(string(frame.Marshal()))
+}
+
+func (client *testClient) connect(headers map[string]string) parsing.Frame {
+	client.sendFrame(parsing.Frame{Command: parsing.CONNECT, Headers: headers, Body: []byte{}})
+	return client.expectFrame(parsing.CONNECTED)
+}
+
+// Send a frame with a receipt and wait for the server to process it
+func (client *testClient) request(command parsing.CommandType, headers map[string]string, body string) {
+	client.t.Helper()
+
+	client.receipts++
+	receipt := fmt.Sprintf("receipt-%d", client.receipts)
+
+	frame := parsing.Frame{Command: command, Headers: map[string]string{"receipt": receipt}, Body: []byte(body)}
+	for key, value := range headers {
+		frame.Headers[key] = value
+	}
+	client.sendFrame(frame)
+
+	// Deliveries triggered by the request may overtake its receipt
+	var deliveries []parsing.Frame
+	for {
+		reply, ok := client.nextFrame(FRAME_TIMEOUT)
+		if !ok {
+			client.t.Fatalf("Expected receipt %s but none arrived", receipt)
+		}
+		if reply.Command == parsing.MESSAGE {
+			deliveries = append(deliveries, reply)
+			continue
+		}
+		if reply.Command != parsing.RECEIPT || reply.Headers["receipt-id"] != receipt {
+			client.t.Fatalf("Expected receipt %s, got %s (%v)", receipt, reply.Command, reply.Headers)
+		}
+		break
+	}
+	client.pending = append(client.pending, deliveries...)
+}
+
+func (client *testClient) subscribe(destination string, id string, headers map[string]string) {
+	client.t.Helper()
+
+	subscribeHeaders := map[string]string{"destination": destination, "id": id}
+	for key, value := range headers {
+		subscribeHeaders[key] = value
+	}
+	client.request(parsing.SUBSCRIBE, subscribeHeaders, "")
+}
+
+func (client *testClient) publish(destination string, body string) {
+	client.t.Helper()
+	client.request(parsing.SEND, map[string]string{"destination": destination}, body)
+}
+
+func (client *testClient) disconnect() {
+	client.t.Helper()
+	client.request(parsing.DISCONNECT, nil, "")
+	client.expectClosed()
+}
+
+func (client *testClient) expectMessage(body string) parsing.Frame {
+	client.t.Helper()
+
+	frame := client.expectFrame(parsing.MESSAGE)
+	if string(frame.Body) != body {
+		client.t.Fatalf("Expected message %q, got %q", body, frame.Body)
+	}
+	return frame
+}
+
+func (client *testClient) nextFrame(timeout time.Duration) (parsing.Frame, bool) {
+	if len(client.pending) > 0 {
+		frame := client.pending[0]
+		client.pending = client.pending[1:]
+		return frame, true
+	}
+
+	select {
+	case frame, ok := <-client.frames:
+		return frame, ok
+	case <-time.After(timeout):
+		return parsing.Frame{}, false
+	}
+}
+
+func (client *testClient) expectFrame(command parsing.CommandType) parsing.Frame {
+	client.t.Helper()
+
+	frame, ok := client.nextFrame(FRAME_TIMEOUT)
+	if !ok {
+		client.t.Fatalf("Expected a %s frame but none arrived", command)
+	}
+	if frame.Command != command {
+		client.t.Fatalf("Expected a %s frame, got %s (%v)", command, frame.Command, frame.Headers)
+	}
+	return frame
+}
+
+func (client *testClient) expectNoFrame() {
+	client.t.Helper()
+
+	if frame, ok := client.nextFrame(NO_FRAME_TIMEOUT); ok {
+		client.t.Fatalf("Expected no frame, got %s (%v)", frame.Command, frame.Headers)
+	}
+}
+
+// Wait for the server to close the connection, ignoring any further frames
+func (client *testClient) expectClosed() {
+	client.t.Helper()
+
+	deadline := time.After(FRAME_TIMEOUT)
+	for {
+		select {
+		case _, ok := <-client.frames:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			client.t.Fatalf("Expected the connection to be closed")
+		}
+	}
+}
+
+// Logger which keeps its warning and error lines for tests to inspect
+type recordingLogger struct {
+	mu       sync.Mutex
+	warnings []string
+	lines    []string
+}
+
+func (logger *recordingLogger) Debugf(format string, args ...interface{}) {}
+func (logger *recordingLogger) Infof(format string, args ...interface{})  {}
+
+func (logger *recordingLogger) Warnf(format string, args ...interface{}) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.warnings = append(logger.warnings, fmt.Sprintf(format, args...))
+}
+
+func (logger *recordingLogger) Errorf(format string, args ...interface{}) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.lines = append(logger.lines, fmt.Sprintf(format, args...))
+}
+
+func (logger *recordingLogger) warns() []string {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return append([]string(nil), logger.warnings...)
+}
+
+func (logger *recordingLogger) errors() []string {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return append([]string(nil), logger.lines...)
+}
+
+// Logger which also has a trace level, keeping its trace lines
+type tracingLogger struct {
+	recordingLogger
+	traceLines []string
+}
+
+func (logger *tracingLogger) Tracef(format string, args ...interface{}) {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	logger.traceLines = append(logger.traceLines, fmt.Sprintf(format, args...))
+}
+
+func (logger *tracingLogger) traces() []string {
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	return append([]string(nil), logger.traceLines...)
+}
+
+func eventually(t *testing.T, condition func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(FRAME_TIMEOUT)
+	for !condition() {
+		if time.Now().After(deadline) {
+			t.Fatalf("Condition not met before timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync/atomic"
+)
+
+// Session ids
+// A SessionIDGenerator names each new session, which is the id a client is
+// told in CONNECTED and that management requests refer to, so that e.g. ids
+// can be UUIDs or carry the region the server runs in. Ids must be unique
+// among the sessions a server knows of, including those retained for
+// resumption. It is called concurrently from each connection's goroutine.
+
+type SessionIDGenerator interface {
+	NewSessionID() string
+}
+
+// The generator used unless Options.SessionIDGenerator says otherwise, which
+// picks 128 random bits so that ids don't collide across servers or
+// restarts. Should randomness run out it falls back to counting.
+type randomSessionIDs struct {
+	counter uint64
+}
+
+func (ids *randomSessionIDs) NewSessionID() string {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return fmt.Sprintf("session-%d", atomic.AddUint64(&ids.counter, 1))
+	}
+	return "session-" + hex.EncodeToString(id)
+}
@@ -0,0 +1,295 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Message store
+// Persistent messages routed to a queue are saved to Options.Store, and
+// removed once they have been acked, delivered to an auto ack subscription
+// or dropped. When the server starts it replays whatever the store still
+// holds back into the broker, so messages outlive a crash or restart. A
+// message is removed only after it has been replayed and stored again, so a
+// crash part way through a replay can deliver a message twice but never
+// loses one. Messages on topics, in detached durable subscriptions or
+// waiting out a deliver-after delay aren't stored. The store is written
+// with the broker locked, so a slow store slows routing down.
+
+// Store keeps persistent messages until the broker no longer needs them
+type Store interface {
+	// Save a message sent to a destination, returning the key to remove it by
+	Save(destination string, frame parsing.Frame) (string, error)
+	Remove(key string) error
+
+	// Call replay with every message saved and not removed since the store
+	// was last replayed, in the order they were saved, stopping at the
+	// first error. Each message replay succeeds for is removed.
+	ReplayAll(replay func(destination string, frame parsing.Frame) error) error
+}
+
+// FileStore is a Store which appends to a log file, one JSON record per
+// line. Opening it compacts the log down to the messages it still holds.
+type FileStore struct {
+	path string
+
+	mu      sync.Mutex
+	file    *os.File
+	next    uint64        // Key of the next message saved
+	pending []storeRecord // Read back when the store was opened, until it's replayed
+}
+
+type storeRecord struct {
+	Key         uint64            `json:"key"`
+	Removed     bool              `json:"removed,omitempty"`
+	Destination string            `json:"destination,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Body        []byte            `json:"body,omitempty"`
+}
+
+// OpenFileStore opens the store logged to path, creating it if need be
+func OpenFileStore(path string) (*FileStore, error) {
+	records, err := readStoreLog(path)
+	if err != nil {
+		return nil, err
+	}
+
+	store := &FileStore{path: path, pending: records, next: 1}
+	for _, record := range records {
+		if record.Key >= store.next {
+			store.next = record.Key + 1
+		}
+	}
+	if err := store.compact(); err != nil {
+		return nil, err
+	}
+
+	store.file, err = os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Read the messages a log still holds, in the order they were saved. A last
+// record without its newline was cut short by a crash while it was being
+// written, so is ignored.
+func readStoreLog(path string) ([]storeRecord, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var order []uint64
+	saved := map[uint64]storeRecord{}
+	reader := bufio.NewReader(file)
+	for line := 1; ; line++ {
+		data, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var record storeRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			return nil, fmt.Errorf("corrupt record on line %d of %s: %s", line, path, err)
+		}
+		if record.Removed {
+			delete(saved, record.Key)
+			continue
+		}
+		saved[record.Key] = record
+		order = append(order, record.Key)
+	}
+
+	var records []storeRecord
+	for _, key := range order {
+		if record, ok := saved[key]; ok {
+			records = append(records, record)
+		}
+	}
+	return records, nil
+}
+
+// Rewrite the log with just the pending messages, replacing it in one go so
+// that a crash leaves either the old log or the new one
+func (store *FileStore) compact() error {
+	temp := store.path + ".tmp"
+	file, err := os.OpenFile(temp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(file)
+	for _, record := range store.pending {
+		if err = writeStoreRecord(writer, record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = writer.Flush()
+	}
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		os.Remove(temp)
+		return err
+	}
+	return os.Rename(temp, store.path)
+}
+
+func writeStoreRecord(w io.Writer, record storeRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// Save a message, syncing it to disk before returning
+func (store *FileStore) Save(destination string, frame parsing.Frame) (string, error) {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+
+	record := storeRecord{Key: store.next, Destination: destination, Headers: frame.Headers, Body: frame.Body}
+	if err := writeStoreRecord(store.file, record); err != nil {
+		return "", err
+	}
+	if err := store.file.Sync(); err != nil {
+		return "", err
+	}
+	store.next++
+	return strconv.FormatUint(record.Key, 10), nil
+}
+
+// Remove a message. This isn't synced, as losing it in a crash only means
+// the message is replayed again.
+func (store *FileStore) Remove(key string) error {
+	parsed, err := strconv.ParseUint(key, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid store key %q", key)
+	}
+
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return writeStoreRecord(store.file, storeRecord{Key: parsed, Removed: true})
+}
+
+// ReplayAll replays the messages the log held when it was opened. Replay
+// can save messages to the store as it goes.
+func (store *FileStore) ReplayAll(replay func(destination string, frame parsing.Frame) error) error {
+	store.mu.Lock()
+	pending := store.pending
+	store.pending = nil
+	store.mu.Unlock()
+
+	for _, record := range pending {
+		frame := parsing.Frame{Command: parsing.SEND, Headers: record.Headers, Body: record.Body}
+		if frame.Headers == nil {
+			frame.Headers = map[string]string{}
+		}
+		if frame.Body == nil {
+			frame.Body = []byte{}
+		}
+		if err := replay(record.Destination, frame); err != nil {
+			return err
+		}
+		if err := store.Remove(strconv.FormatUint(record.Key, 10)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close the log file
+func (store *FileStore) Close() error {
+	store.mu.Lock()
+	defer store.mu.Unlock()
+	return store.file.Close()
+}
+
+// Saving and replaying
+
+// Save a persistent queue message to the store, if there is one
+func (b *broker) saveMessage(msg *message) error {
+	if b.opts.Store == nil || msg.headers[HEADER_PERSISTENT] != "true" {
+		return nil
+	}
+
+	headers := make(map[string]string, len(msg.headers)+1)
+	for key, value := range msg.headers {
+		headers[key] = value
+	}
+	headers[parsing.HEADER_DESTINATION] = msg.destination
+	key, err := b.opts.Store.Save(msg.destination, parsing.Frame{Command: parsing.SEND, Headers: headers, Body: msg.body})
+	if err != nil {
+		b.log.Errorf("Error storing message %s: %s (trace %s)", msg.id, err, msg.traceID)
+		return fmt.Errorf("Error storing message: %s", err)
+	}
+	msg.storeKey = key
+	return nil
+}
+
+// Remove a message from the store once the broker is done with it
+func (b *broker) forgetMessage(msg *message) {
+	if msg.storeKey == "" {
+		return
+	}
+	if err := b.opts.Store.Remove(msg.storeKey); err != nil {
+		b.log.Warnf("Error removing message %s from the store, it will be replayed: %s (trace %s)", msg.id, err, msg.traceID)
+	}
+	msg.storeKey = ""
+}
+
+// Route the messages left in the store by the last run, as if they had only
+// just been sent. With Options.ValidateReplay a stored frame that isn't a
+// valid SEND is skipped, otherwise it fails the replay.
+func (server *Server) replayStore() error {
+	replayed, skipped := 0, 0
+	err := server.opts.Store.ReplayAll(func(destination string, frame parsing.Frame) error {
+		frame.Headers[parsing.HEADER_DESTINATION] = destination
+		if server.opts.ValidateReplay {
+			if err := validateStored(frame, server.clock.Now()); err != nil {
+				server.log.Warnf("Skipping stored message for %s: %s", destination, err)
+				skipped++
+				return nil
+			}
+		}
+		if _, err := server.broker.send(nil, frame); err != nil {
+			return fmt.Errorf("replaying message for %s: %s", destination, err)
+		}
+		replayed++
+		return nil
+	})
+	if replayed > 0 || skipped > 0 {
+		server.log.Infof("Replayed %d stored messages, skipped %d", replayed, skipped)
+	}
+	return err
+}
+
+func validateStored(frame parsing.Frame, now time.Time) error {
+	if frame.Command != parsing.SEND || frame.Headers[parsing.HEADER_DESTINATION] == "" {
+		return fmt.Errorf("not a SEND frame with a destination")
+	}
+	if err := frame.Validate(); err != nil {
+		return err
+	}
+	_, err := messageExpiry(frame.Headers, now)
+	return err
+}
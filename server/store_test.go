@@ -0,0 +1,82 @@
+package server_test
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestStoreReplayedOnRestart(t *testing.T) {
+	path := filepath.Join(tempDir(t), "messages.log")
+
+	store := openStore(t, path)
+	srv, addr := startServer(t, server.Options{Store: store})
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "persistent": "true"}, "acked")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "persistent": "true"}, "unacked")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a"}, "transient")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/b", "persistent": "true"}, "waiting")
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+	ackID := consumer.expectMessage("acked").Headers["ack"]
+	consumer.expectMessage("unacked")
+	consumer.expectMessage("transient")
+	consumer.request(parsing.ACK, map[string]string{"id": ackID}, "")
+	srv.Close()
+	store.Close()
+
+	// Only the persistent messages that weren't acked come back
+	store = openStore(t, path)
+	defer store.Close()
+	_, addr = startServer(t, server.Options{Store: store})
+	consumer = dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+	consumer.subscribe("/queue/b", "1", nil)
+	consumer.expectMessage("unacked")
+	consumer.expectMessage("waiting")
+	consumer.expectNoFrame()
+}
+
+func TestStoreReplayValidation(t *testing.T) {
+	path := filepath.Join(tempDir(t), "messages.log")
+	log := `{"key":1,"destination":"/queue/a","headers":{"destination":"/queue/a","ttl":"soon"},"body":"YmFk"}
+{"key":2,"destination":"/queue/a","headers":{"destination":"/queue/a","persistent":"true"},"body":"Z29vZA=="}
+{"key":3,"destination":"/queue/a","hea`
+	if err := ioutil.WriteFile(path, []byte(log), 0600); err != nil {
+		t.Fatalf("Error writing store: %s", err)
+	}
+
+	store := openStore(t, path)
+	_, err := server.New(server.Options{Store: store})
+	if err == nil || !strings.Contains(err.Error(), "ttl") {
+		t.Errorf("Replaying an invalid message should fail, got %v", err)
+	}
+	store.Close()
+
+	// The record cut short by a crash is ignored, and validation skips the
+	// invalid one
+	store = openStore(t, path)
+	defer store.Close()
+	_, addr := startServer(t, server.Options{Store: store, ValidateReplay: true})
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+	consumer.expectMessage("good")
+	consumer.expectNoFrame()
+}
+
+func openStore(t *testing.T, path string) *server.FileStore {
+	store, err := server.OpenFileStore(path)
+	if err != nil {
+		t.Fatalf("Error opening store: %s", err)
+	}
+	return store
+}
@@ -0,0 +1,84 @@
+//go:build linux
+// +build linux
+
+package server
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTCPOptionsApplied(t *testing.T) {
+	conn := acceptTestConn(t)
+	defer conn.Close()
+
+	opts := Options{TCPNoDelay: true, TCPKeepAlive: 42 * time.Second}
+	if err := configureTCPConn(conn, opts); err != nil {
+		t.Fatalf("No error should be raised: %s", err)
+	}
+
+	if getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) == 0 {
+		t.Errorf("TCP_NODELAY should be set")
+	}
+	if getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) == 0 {
+		t.Errorf("SO_KEEPALIVE should be set")
+	}
+	if idle := getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_KEEPIDLE); idle != 42 {
+		t.Errorf("Keep-alive idle time should be 42s, got %ds", idle)
+	}
+}
+
+func TestTCPOptionsDisabled(t *testing.T) {
+	conn := acceptTestConn(t)
+	defer conn.Close()
+
+	opts := Options{TCPNoDelay: false, TCPKeepAlive: 0}
+	if err := configureTCPConn(conn, opts); err != nil {
+		t.Fatalf("No error should be raised: %s", err)
+	}
+
+	if getsockopt(t, conn, syscall.IPPROTO_TCP, syscall.TCP_NODELAY) != 0 {
+		t.Errorf("TCP_NODELAY should not be set")
+	}
+	if getsockopt(t, conn, syscall.SOL_SOCKET, syscall.SO_KEEPALIVE) != 0 {
+		t.Errorf("SO_KEEPALIVE should not be set")
+	}
+}
+
+func acceptTestConn(t *testing.T) net.Conn {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error listening: %s", err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error dialing: %s", err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	conn, err := listener.Accept()
+	if err != nil {
+		t.Fatalf("Error accepting: %s", err)
+	}
+	return conn
+}
+
+func getsockopt(t *testing.T, conn net.Conn, level, opt int) (value int) {
+	rawConn, err := conn.(*net.TCPConn).SyscallConn()
+	if err != nil {
+		t.Fatalf("Error getting raw connection: %s", err)
+	}
+
+	var sockErr error
+	err = rawConn.Control(func(fd uintptr) {
+		value, sockErr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil || sockErr != nil {
+		t.Fatalf("Error reading socket option: %v %v", err, sockErr)
+	}
+	return
+}
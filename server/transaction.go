@@ -0,0 +1,177 @@
+package server
+
+import (
+	"fmt"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Transactions
+// SEND, ACK and NACK frames with a transaction header are held back until
+// the client COMMITs the transaction, and thrown away if it ABORTs or the
+// connection closes first. They are receipted when they are held back.
+// COMMIT handles them in the order they were sent, as if they had only just
+// arrived, so it isn't atomic: a frame refused part way through fails the
+// COMMIT, which gets the ERROR in place of its RECEIPT, with the frames
+// before it already handled. So that a client can't
+// hold back frames without bound by never committing, Options.MaxTransactions
+// limits how many transactions a connection can have open at once and
+// Options.MaxTransactionBytes the size of the frames they hold between them.
+// Options.MaxTransactedMessages bounds the messages held back across every
+// connection, so that many clients at once can't exhaust memory either. A
+// frame over any of them fails, closing the connection and so aborting its
+// transactions rather than leaving a hole in one that would still commit.
+// Transactions are only touched by the connection's reader.
+
+// Frames which can be part of a transaction
+var transactable = map[parsing.CommandType]bool{
+	parsing.SEND: true,
+	parsing.ACK:  true,
+	parsing.NACK: true,
+}
+
+type transaction struct {
+	frames   []parsing.Frame
+	bytes    int // Size of the frames, see sizeOf
+	messages int // SEND frames, counted against the broker-wide limit
+}
+
+func (c *conn) handleBegin(frame parsing.Frame) bool {
+	if !c.requireHeaders(frame, parsing.HEADER_TRANSACTION) {
+		return false
+	}
+
+	id := frame.Headers[parsing.HEADER_TRANSACTION]
+	if _, ok := c.transactions[id]; ok {
+		c.reject(REJECT_INVALID, fmt.Sprintf("Transaction %s is already open", id))
+		return false
+	}
+	if max := c.server.opts.MaxTransactions; max > 0 && len(c.transactions) >= max {
+		c.reject(REJECT_OVER_LIMIT, fmt.Sprintf("Connections can have at most %d open transactions", max))
+		return false
+	}
+
+	if c.transactions == nil {
+		c.transactions = map[string]*transaction{}
+	}
+	c.transactions[id] = &transaction{}
+	c.sendReceipt(frame)
+	return true
+}
+
+// Hold back a frame until its transaction is committed
+func (c *conn) handleTransacted(frame parsing.Frame) bool {
+	id := frame.Headers[parsing.HEADER_TRANSACTION]
+	tx, ok := c.transactions[id]
+	if !ok {
+		c.reject(REJECT_INVALID, fmt.Sprintf("No open transaction %s", id))
+		return false
+	}
+
+	held := parsing.Frame{Command: frame.Command, Headers: map[string]string{}, Body: frame.Body}
+	for key, value := range frame.Headers {
+		if key != parsing.HEADER_RECEIPT && key != parsing.HEADER_TRANSACTION {
+			held.Headers[key] = value
+		}
+	}
+	size := sizeOf(held)
+	if max := c.server.opts.MaxTransactionBytes; max > 0 && c.transactionBytes+size > max {
+		c.reject(REJECT_OVER_LIMIT, fmt.Sprintf("Transactions can hold at most %d bytes per connection", max))
+		return false
+	}
+	if held.Command == parsing.SEND {
+		if err := c.server.broker.holdTransacted(); err != nil {
+			c.rejectRefused(err)
+			return false
+		}
+		tx.messages++
+	}
+
+	tx.frames = append(tx.frames, held)
+	tx.bytes += size
+	c.transactionBytes += size
+	c.sendReceipt(frame)
+	return true
+}
+
+func (c *conn) handleCommit(frame parsing.Frame) bool {
+	tx, ok := c.endTransaction(frame)
+	if !ok {
+		return false
+	}
+
+	for _, held := range tx.frames {
+		if keepGoing := c.dispatch(held); !keepGoing {
+			return false
+		}
+	}
+	c.sendReceipt(frame)
+	return true
+}
+
+func (c *conn) handleAbort(frame parsing.Frame) bool {
+	if _, ok := c.endTransaction(frame); !ok {
+		return false
+	}
+	c.sendReceipt(frame)
+	return true
+}
+
+// Close the transaction a COMMIT or ABORT names, returning it
+func (c *conn) endTransaction(frame parsing.Frame) (*transaction, bool) {
+	if !c.requireHeaders(frame, parsing.HEADER_TRANSACTION) {
+		return nil, false
+	}
+
+	id := frame.Headers[parsing.HEADER_TRANSACTION]
+	tx, ok := c.transactions[id]
+	if !ok {
+		c.reject(REJECT_INVALID, fmt.Sprintf("No open transaction %s", id))
+		return nil, false
+	}
+	delete(c.transactions, id)
+	c.transactionBytes -= tx.bytes
+	c.server.broker.releaseTransacted(tx.messages)
+	return tx, true
+}
+
+// Throw away transactions left open when the connection closes
+func (c *conn) abortTransactions() {
+	if len(c.transactions) > 0 {
+		c.server.log.Debugf("Session %s closed with %d open transactions, aborting them", c.sessionID, len(c.transactions))
+	}
+	for _, tx := range c.transactions {
+		c.server.broker.releaseTransacted(tx.messages)
+	}
+	c.transactions = nil
+	c.transactionBytes = 0
+}
+
+// Count a message held back by a transaction against the broker-wide limit,
+// returning an error if the limit has been reached
+func (b *broker) holdTransacted() error {
+	max := b.opts.MaxTransactedMessages
+	if max == 0 {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.transacted >= max {
+		return limitError(fmt.Sprintf("Open transactions across the server can hold at most %d messages", max))
+	}
+	b.transacted++
+	return nil
+}
+
+// Stop counting the messages held back by a transaction that has ended
+func (b *broker) releaseTransacted(messages int) {
+	if b.opts.MaxTransactedMessages == 0 || messages == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.transacted -= messages
+}
@@ -0,0 +1,169 @@
+package server_test
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestTransactionCommit(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.BEGIN, map[string]string{"transaction": "tx1"}, "")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx1"}, "first")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx1"}, "second")
+	consumer.expectNoFrame()
+
+	producer.request(parsing.COMMIT, map[string]string{"transaction": "tx1"}, "")
+	if frame := consumer.expectMessage("first"); frame.Headers["transaction"] != "" {
+		t.Errorf("Delivered message should not carry the transaction header, got %v", frame.Headers)
+	}
+	consumer.expectMessage("second")
+}
+
+func TestCommitRefused(t *testing.T) {
+	_, addr := startServer(t, server.Options{SendQuota: 1, SendQuotaWindow: time.Minute})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.request(parsing.BEGIN, map[string]string{"transaction": "tx1"}, "")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx1"}, "1")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx1"}, "2")
+
+	// The quota only allows the first, so the COMMIT gets an ERROR for its
+	// receipt rather than a RECEIPT
+	producer.send("COMMIT\ntransaction:tx1\nreceipt:commit\n\n\x00")
+	frame := producer.expectFrame(parsing.ERROR)
+	if frame.Headers["receipt-id"] != "commit" || !strings.Contains(frame.Headers["message"], "quota") {
+		t.Errorf("COMMIT with a refused SEND should get an ERROR for its receipt, got %v", frame.Headers)
+	}
+	producer.expectClosed()
+}
+
+func TestTransactionAbort(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", map[string]string{"ack": "client-individual"})
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "hello")
+	ackID := consumer.expectMessage("hello").Headers["ack"]
+
+	// Neither the send nor the ack takes effect
+	producer.request(parsing.BEGIN, map[string]string{"transaction": "tx1"}, "")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx1"}, "aborted")
+	producer.request(parsing.ABORT, map[string]string{"transaction": "tx1"}, "")
+	consumer.request(parsing.BEGIN, map[string]string{"transaction": "tx2"}, "")
+	consumer.request(parsing.NACK, map[string]string{"id": ackID, "transaction": "tx2"}, "")
+	consumer.request(parsing.ABORT, map[string]string{"transaction": "tx2"}, "")
+	consumer.expectNoFrame()
+
+	// Left open, a transaction is aborted when its connection closes
+	producer.request(parsing.BEGIN, map[string]string{"transaction": "tx3"}, "")
+	producer.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx3"}, "dropped")
+	producer.disconnect()
+	consumer.expectNoFrame()
+}
+
+func TestUnknownTransaction(t *testing.T) {
+	_, addr := startServer(t, server.Options{})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.send("SEND\ndestination:/queue/a\ntransaction:missing\n\nhello\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "missing") {
+		t.Errorf("Error should name the transaction, got %q", frame.Headers["message"])
+	}
+	client.expectClosed()
+}
+
+func TestTransactionLimit(t *testing.T) {
+	_, addr := startServer(t, server.Options{MaxTransactions: 2})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.request(parsing.BEGIN, map[string]string{"transaction": "tx1"}, "")
+	client.request(parsing.BEGIN, map[string]string{"transaction": "tx2"}, "")
+
+	// Ending a transaction makes room for another
+	client.request(parsing.COMMIT, map[string]string{"transaction": "tx1"}, "")
+	client.request(parsing.BEGIN, map[string]string{"transaction": "tx3"}, "")
+
+	client.send("BEGIN\ntransaction:tx4\n\n\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "at most 2 open transactions") {
+		t.Errorf("Error should explain the transaction limit, got %q", frame.Headers["message"])
+	}
+	client.expectClosed()
+}
+
+func TestTransactionBytesLimit(t *testing.T) {
+	_, addr := startServer(t, server.Options{MaxTransactionBytes: 100})
+
+	client := dial(t, addr)
+	client.connect(nil)
+	client.request(parsing.BEGIN, map[string]string{"transaction": "tx1"}, "")
+	client.request(parsing.BEGIN, map[string]string{"transaction": "tx2"}, "")
+	client.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx1"}, strings.Repeat("x", 50))
+
+	// The limit is shared between the connection's transactions
+	client.send("SEND\ndestination:/queue/a\ntransaction:tx2\n\n" + strings.Repeat("x", 50) + "\x00")
+	frame := client.expectFrame(parsing.ERROR)
+	if !strings.Contains(frame.Headers["message"], "at most 100 bytes") {
+		t.Errorf("Error should explain the byte limit, got %q", frame.Headers["message"])
+	}
+	client.expectClosed()
+}
+
+func TestTransactedMessageLimit(t *testing.T) {
+	_, addr := startServer(t, server.Options{MaxTransactedMessages: 3})
+
+	first := dial(t, addr)
+	first.connect(nil)
+	first.request(parsing.BEGIN, map[string]string{"transaction": "tx1"}, "")
+	first.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx1"}, "1")
+	first.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx1"}, "2")
+
+	// The limit is across connections, and going over it aborts the
+	// connection's transactions rather than committing them without the SEND
+	second := dial(t, addr)
+	second.connect(nil)
+	second.request(parsing.BEGIN, map[string]string{"transaction": "tx1"}, "")
+	second.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx1"}, "lost")
+	second.send("SEND\ndestination:/queue/a\ntransaction:tx1\nreceipt:over\n\n4\x00")
+	frame := second.expectFrame(parsing.ERROR)
+	if frame.Headers["receipt-id"] != "over" || !strings.Contains(frame.Headers["message"], "at most 3 messages") {
+		t.Errorf("Transacted SEND over the limit should get an ERROR for its receipt, got %v", frame.Headers)
+	}
+	second.expectClosed()
+
+	// Ending a transaction frees up its messages
+	third := dial(t, addr)
+	third.connect(nil)
+	third.request(parsing.BEGIN, map[string]string{"transaction": "tx1"}, "")
+	third.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx1"}, "3")
+	first.request(parsing.COMMIT, map[string]string{"transaction": "tx1"}, "")
+	third.request(parsing.SEND, map[string]string{"destination": "/queue/a", "transaction": "tx1"}, "4")
+	third.request(parsing.COMMIT, map[string]string{"transaction": "tx1"}, "")
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/queue/a", "0", nil)
+	for _, body := range []string{"1", "2", "3", "4"} {
+		consumer.expectMessage(body)
+	}
+	consumer.expectNoFrame()
+}
@@ -0,0 +1,15 @@
+package server
+
+import "github.com/jonathanlloyd/skewserver/parsing"
+
+// Transformation
+// A Transformer lets an embedder change each MESSAGE just before it goes to
+// a subscriber, e.g. to add or rename headers or rewrite the body. It gets
+// its own copy of the frame, so changes don't leak to other subscribers. If
+// it returns an error the message isn't delivered to that subscriber, and a
+// queue message stays on its queue to be dispatched again later. It is
+// called with the broker locked, so must not call back into the server.
+
+type Transformer interface {
+	Transform(sub Subscription, frame parsing.Frame) (parsing.Frame, error)
+}
@@ -0,0 +1,82 @@
+package server_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+	"github.com/jonathanlloyd/skewserver/server"
+)
+
+func TestTransformAddsHeader(t *testing.T) {
+	_, addr := startServer(t, server.Options{Transformer: subscriptionHeaderTransformer{}})
+
+	consumer := dial(t, addr)
+	consumer.connect(nil)
+	consumer.subscribe("/topic/a", "sub-0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/topic/a", "hello")
+
+	frame := consumer.expectMessage("hello")
+	if frame.Headers["x-delivered-to"] != "sub-0:/topic/a" {
+		t.Errorf("Message should carry the header added by the transform, got %v", frame.Headers)
+	}
+}
+
+func TestTransformErrorDropsDelivery(t *testing.T) {
+	_, addr := startServer(t, server.Options{Transformer: subscriptionHeaderTransformer{}, ReportTopicDeliveries: true})
+
+	rejected := dial(t, addr)
+	rejected.connect(nil)
+	rejected.subscribe("/topic/a", "reject", nil)
+
+	accepted := dial(t, addr)
+	accepted.connect(nil)
+	accepted.subscribe("/topic/a", "sub-0", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.send("SEND\ndestination:/topic/a\nreceipt:sent\n\nhello\x00")
+	if frame := producer.expectFrame(parsing.RECEIPT); frame.Headers["x-delivered-to"] != "1" {
+		t.Errorf("Receipt should only count the subscription the message was delivered to, got %v", frame.Headers)
+	}
+
+	accepted.expectMessage("hello")
+	rejected.expectNoFrame()
+}
+
+func TestTransformErrorLeavesQueueMessage(t *testing.T) {
+	_, addr := startServer(t, server.Options{Transformer: subscriptionHeaderTransformer{}})
+
+	rejected := dial(t, addr)
+	rejected.connect(nil)
+	rejected.subscribe("/queue/a", "reject", nil)
+
+	producer := dial(t, addr)
+	producer.connect(nil)
+	producer.publish("/queue/a", "first")
+	producer.publish("/queue/a", "second")
+	rejected.expectNoFrame()
+
+	// The messages waited on the queue for a subscriber they could go to
+	accepted := dial(t, addr)
+	accepted.connect(nil)
+	accepted.subscribe("/queue/a", "sub-0", nil)
+	accepted.expectMessage("first")
+	accepted.expectMessage("second")
+	rejected.expectNoFrame()
+}
+
+// Records which subscription each message went to, refusing to deliver to
+// any subscription with the id "reject"
+type subscriptionHeaderTransformer struct{}
+
+func (subscriptionHeaderTransformer) Transform(sub server.Subscription, frame parsing.Frame) (parsing.Frame, error) {
+	if sub.ID == "reject" {
+		return frame, errors.New("rejected")
+	}
+	frame.Headers["x-delivered-to"] = sub.String()
+	return frame, nil
+}
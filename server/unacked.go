@@ -0,0 +1,79 @@
+package server
+
+import "container/list"
+
+// Unacked deliveries
+// A subscription's outstanding deliveries are kept in the order they were
+// made, which a cumulative ACK in client mode relies on, and indexed by ack
+// id so that resolving an ACK or NACK doesn't mean scanning them all. The
+// zero value is an empty set.
+
+type unackedDeliveries struct {
+	order   list.List // Of delivery, oldest first
+	byAckID map[string]*list.Element
+}
+
+func (set *unackedDeliveries) add(d delivery) {
+	if set.byAckID == nil {
+		set.byAckID = map[string]*list.Element{}
+	}
+	set.byAckID[d.ackID] = set.order.PushBack(d)
+}
+
+func (set *unackedDeliveries) contains(ackID string) bool {
+	_, ok := set.byAckID[ackID]
+	return ok
+}
+
+// Remove a single delivery, returning false if there isn't one with the ack
+// id
+func (set *unackedDeliveries) remove(ackID string) (delivery, bool) {
+	element, ok := set.byAckID[ackID]
+	if !ok {
+		return delivery{}, false
+	}
+	delete(set.byAckID, ackID)
+	if len(set.byAckID) == 0 {
+		// Maps never shrink, so drop the index once it's empty rather than
+		// holding on to the space a burst of deliveries took up
+		set.byAckID = nil
+	}
+	return set.order.Remove(element).(delivery), true
+}
+
+// Remove a delivery and every delivery made before it, oldest first
+func (set *unackedDeliveries) removeThrough(ackID string) []delivery {
+	if !set.contains(ackID) {
+		return nil
+	}
+
+	var removed []delivery
+	for {
+		d, _ := set.remove(set.order.Front().Value.(delivery).ackID)
+		removed = append(removed, d)
+		if d.ackID == ackID {
+			return removed
+		}
+	}
+}
+
+// Remove every delivery, oldest first
+func (set *unackedDeliveries) removeAll() []delivery {
+	removed := set.list()
+	set.order.Init()
+	set.byAckID = nil
+	return removed
+}
+
+// Every delivery, oldest first, leaving them in the set
+func (set *unackedDeliveries) list() []delivery {
+	listed := make([]delivery, 0, set.order.Len())
+	for element := set.order.Front(); element != nil; element = element.Next() {
+		listed = append(listed, element.Value.(delivery))
+	}
+	return listed
+}
+
+func (set *unackedDeliveries) len() int {
+	return set.order.Len()
+}
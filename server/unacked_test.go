@@ -0,0 +1,140 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"testing"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+func TestCumulativeRemoval(t *testing.T) {
+	var set unackedDeliveries
+	for i := 0; i < 5; i++ {
+		set.add(delivery{ackID: fmt.Sprint(i)})
+	}
+
+	removed := set.removeThrough("2")
+	if len(removed) != 3 || removed[0].ackID != "0" || removed[2].ackID != "2" {
+		t.Errorf("Cumulative removal should take the delivery and every earlier one in order, got %v", removed)
+	}
+	if set.len() != 2 || set.contains("1") || !set.contains("3") {
+		t.Errorf("Later deliveries should still be outstanding")
+	}
+	if removed := set.removeThrough("2"); removed != nil {
+		t.Errorf("Removing an unknown ack id should remove nothing, got %v", removed)
+	}
+
+	if _, ok := set.remove("4"); !ok {
+		t.Errorf("Should remove a single delivery out of order")
+	}
+	if removed := set.removeAll(); len(removed) != 1 || removed[0].ackID != "3" {
+		t.Errorf("Should remove the remaining delivery, got %v", removed)
+	}
+	if set.len() != 0 || set.contains("3") {
+		t.Errorf("Set should be empty")
+	}
+}
+
+// A connection open for days acks millions of messages, none of which
+// should leave anything behind in its state or the broker's
+func TestLongLivedConnectionStaysBounded(t *testing.T) {
+	messages := 1000000
+	if testing.Short() || raceEnabled {
+		messages = 20000
+	}
+
+	srv, err := New(Options{})
+	if err != nil {
+		t.Fatalf("Error creating server: %s", err)
+	}
+	defer srv.Close()
+	serverSide, clientSide := net.Pipe()
+	defer clientSide.Close()
+	c := newConn(srv, serverSide)
+	go func() {
+		for _, ok := c.outbox.pop(); ok; _, ok = c.outbox.pop() {
+		}
+	}()
+	defer c.outbox.close()
+
+	b := srv.broker
+	opts := subscribeOptions{ackMode: ACK_CLIENT_INDIVIDUAL, overflow: OVERFLOW_BLOCK, batchSize: 1}
+	for _, id := range []string{"0", "1"} {
+		if err := b.subscribe(c, id, "/queue/a", opts); err != nil {
+			t.Fatalf("Error subscribing: %s", err)
+		}
+	}
+	send := parsing.Frame{Command: parsing.SEND, Headers: map[string]string{"destination": "/queue/a"}, Body: []byte("body")}
+
+	var heap uint64
+	for i := 0; i < messages; i++ {
+		if i == messages/10 {
+			heap = liveHeap()
+		}
+		c.history.record(send)
+		if _, err := b.send(nil, send.Clone()); err != nil {
+			t.Fatalf("Error sending message %d: %s", i, err)
+		}
+		b.mu.Lock()
+		var sub *subscription
+		for _, candidate := range c.subscriptions {
+			if candidate.unacked.len() > 0 {
+				sub = candidate
+			}
+		}
+		ackID := sub.unacked.order.Front().Value.(delivery).ackID
+		b.mu.Unlock()
+		if err := b.ack(c, ackID, sub.id); err != nil {
+			t.Fatalf("Error acking message %d: %s", i, err)
+		}
+	}
+
+	for _, sub := range c.subscriptions {
+		if sub.unacked.len() != 0 || sub.unacked.byAckID != nil {
+			t.Errorf("Subscription %s should have nothing left unacked", sub.id)
+		}
+		if len(sub.settled) > SETTLED_ACK_MEMORY || cap(sub.settled) > 4*SETTLED_ACK_MEMORY {
+			t.Errorf("Subscription %s should only remember recent acks, holds %d of %d", sub.id, len(sub.settled), cap(sub.settled))
+		}
+	}
+	dest := b.destinations["/queue/a"]
+	if len(dest.messages) != 0 || dest.queuedBytes != 0 {
+		t.Errorf("Queue should be empty, got %d messages, %d bytes", len(dest.messages), dest.queuedBytes)
+	}
+	if len(c.history.recent()) != FRAME_HISTORY_SIZE {
+		t.Errorf("History should keep only the last %d frames", FRAME_HISTORY_SIZE)
+	}
+	if grown := int64(liveHeap()) - int64(heap); grown > 1<<20 {
+		t.Errorf("Live heap should stay flat over the connection's life, grew by %d bytes", grown)
+	}
+}
+
+func TestCursorWraps(t *testing.T) {
+	if index := cursor(-1, 3); index < 0 || index >= 3 {
+		t.Errorf("Cursor that has wrapped round should still index in range, got %d", index)
+	}
+}
+
+func liveHeap() uint64 {
+	runtime.GC()
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+func BenchmarkAckMiddleOfLargeUnackedSet(b *testing.B) {
+	const size = 100000
+	var set unackedDeliveries
+	for i := 0; i < size; i++ {
+		set.add(delivery{ackID: fmt.Sprint(i)})
+	}
+	middle := fmt.Sprint(size / 2)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		d, _ := set.remove(middle)
+		set.add(d)
+	}
+}
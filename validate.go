@@ -0,0 +1,29 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/jonathanlloyd/skewserver/parsing"
+)
+
+// Run with -validate to check a file of STOMP frames offline, see
+// parsing.ValidateFrames
+func validateFile(path string, strict bool) int {
+	file, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error opening %s: %s\n", path, err)
+		return 1
+	}
+	defer file.Close()
+
+	policy := parsing.LENIENT
+	if strict {
+		policy = parsing.STRICT
+	}
+	if err := parsing.ValidateFrames(file, os.Stdout, policy); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return 1
+	}
+	return 0
+}